@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/niclabs/dns-tools/tools"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	hsmCmd.PersistentFlags().StringSliceP("p11lib", "p", []string{}, "Full path to PKCS11 lib file. It can be repeated (or separated by commas) to check several targets.")
+	hsmCmd.PersistentFlags().StringSlice("p11-slot", []string{}, "Position of the slot with the keys in the list of slots with tokens of each --p11lib, in the same order. Default is 0 for each lib.")
+	hsmCmd.PersistentFlags().StringP("user-key", "k", "1234", "HSM User Login PKCS11Key.")
+	hsmCmd.PersistentFlags().StringP("key-label", "l", "HSM-tools", "Label of HSM Signer PKCS11Key.")
+	hsmCmd.PersistentFlags().StringP("sign-algorithm", "a", "rsa", "Algorithm used in signing.")
+	hsmCmd.PersistentFlags().StringP("zone", "z", "", "Zone name used in test signatures.")
+
+	hsmCheckCmd.Flags().Int("bench", 0, "If it is more than zero, measures the time needed to create this number of signatures with the ZSK.")
+	hsmCmd.AddCommand(hsmCheckCmd)
+}
+
+var hsmCmd = &cobra.Command{
+	Use:   "hsm",
+	Short: "PKCS#11 device utilities",
+}
+
+var hsmCheckCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Checks that the PKCS#11 targets are usable to sign the zone",
+	RunE:  hsmCheck,
+}
+
+func hsmCheck(cmd *cobra.Command, _ []string) error {
+	if err := viper.BindPFlags(cmd.Flags()); err != nil {
+		return err
+	}
+	targets, err := tools.PKCS11TargetsFromConfig(viper.GetStringSlice("p11lib"), viper.GetStringSlice("p11-slot"))
+	if err != nil {
+		return err
+	}
+	key := viper.GetString("user-key")
+	label := viper.GetString("key-label")
+	bench := viper.GetInt("bench")
+	signAlgorithm := viper.GetString("sign-algorithm")
+	if _, ok := tools.StringToSignAlgorithm[signAlgorithm]; !ok {
+		return fmt.Errorf("unknown sign algorithm %s", signAlgorithm)
+	}
+	ctx, err := tools.NewContext(&tools.ContextConfig{
+		Zone:          tools.NormalizeFQDN(viper.GetString("zone")),
+		SignAlgorithm: signAlgorithm,
+	}, commandLog)
+	if err != nil {
+		return err
+	}
+	defer ctx.Close()
+
+	failed := 0
+	for _, report := range ctx.CheckPKCS11Targets(key, label, targets) {
+		commandLog.Printf("Target %s:", report.Target)
+		commandLog.Printf("  Token label: %s", report.TokenLabel)
+		commandLog.Printf("  Token flags: %s", strings.Join(report.TokenFlags, ", "))
+		commandLog.Printf("  Mechanisms: %s", strings.Join(report.Mechanisms, ", "))
+		for _, role := range []string{"zsk", "ksk"} {
+			if tag, ok := report.Keys[role]; ok {
+				commandLog.Printf("  %s: key tag %d, test signature verified", strings.ToUpper(role), tag)
+			}
+		}
+		if report.OK() {
+			commandLog.Printf("  Status: OK")
+			continue
+		}
+		failed++
+		for _, problem := range report.Problems {
+			commandLog.Printf("  Problem: %s", problem)
+		}
+		commandLog.Printf("  Status: FAILED")
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d targets failed the check", failed, len(targets))
+	}
+
+	if bench > 0 {
+		session, err := ctx.NewPKCS11FailoverSession(key, label, targets)
+		if err != nil {
+			return err
+		}
+		defer session.End()
+		commandLog.Printf("Creating %d signatures with the ZSK", bench)
+		result, err := tools.BenchSign(session, bench)
+		if err != nil {
+			return err
+		}
+		commandLog.Printf("%d signatures in %s (%.2f signatures per second)", result.Signatures, result.Duration, result.PerSecond())
+		commandLog.Printf("Estimated time for 100000 signatures: %s", result.Estimate(100000))
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/niclabs/dns-tools/tools"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	keySplitCmd.Flags().StringP("key", "k", "ksk.pem", "Full path to the PEM key file to split.")
+	keySplitCmd.Flags().IntP("threshold", "m", 2, "Number of shares needed to rebuild the key.")
+	keySplitCmd.Flags().IntP("shares", "n", 3, "Number of shares.")
+	keySplitCmd.Flags().StringSlice("passphrase-file", []string{}, "Full path to a file with the passphrase of each share, in order, or a single one for all of them. It can be repeated.")
+	keySplitCmd.Flags().String("out-dir", ".", "Directory where the share files (<key name>-share-<index>.json) are written.")
+	keyCombineCmd.Flags().StringSlice("share", []string{}, "Full path to a share file. It can be repeated.")
+	keyCombineCmd.Flags().StringSlice("passphrase-file", []string{}, "Full path to a file with the passphrase of each share, in the same order, or a single one for all of them. It can be repeated.")
+	keyCombineCmd.Flags().StringP("output", "o", "", "Full path to the PEM key file to write.")
+	keyCmd.AddCommand(keySplitCmd)
+	keyCmd.AddCommand(keyCombineCmd)
+}
+
+var keyCmd = &cobra.Command{
+	Use:   "key",
+	Short: "Splits PEM key files in passphrase encrypted shares and combines them",
+}
+
+var keySplitCmd = &cobra.Command{
+	Use:   "split",
+	Short: "Splits a PEM key file in M-of-N Shamir shares, each encrypted with a passphrase",
+	RunE:  keySplit,
+}
+
+var keyCombineCmd = &cobra.Command{
+	Use:   "combine",
+	Short: "Rebuilds a PEM key file from its shares",
+	RunE:  keyCombine,
+}
+
+func keySplit(cmd *cobra.Command, _ []string) error {
+	if err := viper.BindPFlags(cmd.Flags()); err != nil {
+		return err
+	}
+	keyPath, outDir := viper.GetString("key"), viper.GetString("out-dir")
+	if err := filesExist(keyPath); err != nil {
+		return err
+	}
+	if stat, err := os.Stat(outDir); err != nil || !stat.IsDir() {
+		return fmt.Errorf("directory %s doesn't exist", outDir)
+	}
+	passphrases, err := tools.ReadPassphraseFiles(viper.GetStringSlice("passphrase-file"))
+	if err != nil {
+		return err
+	}
+	keyPEM, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return err
+	}
+	shares, err := tools.SplitKey(keyPEM, viper.GetInt("threshold"), viper.GetInt("shares"), passphrases)
+	for i := range keyPEM {
+		keyPEM[i] = 0
+	}
+	if err != nil {
+		return err
+	}
+	name := strings.TrimSuffix(filepath.Base(keyPath), filepath.Ext(keyPath))
+	for _, share := range shares {
+		encoded, err := json.MarshalIndent(share, "", "  ")
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(outDir, fmt.Sprintf("%s-share-%d.json", name, share.Index))
+		if err := ioutil.WriteFile(path, encoded, 0600); err != nil {
+			return fmt.Errorf("cannot write share file: %s", err)
+		}
+		commandLog.Printf("Share %d written to %s", share.Index, path)
+	}
+	commandLog.Printf("Key split in %d shares. Any %d of them rebuild it", len(shares), shares[0].Threshold)
+	return nil
+}
+
+func keyCombine(cmd *cobra.Command, _ []string) error {
+	if err := viper.BindPFlags(cmd.Flags()); err != nil {
+		return err
+	}
+	output := viper.GetString("output")
+	if len(output) == 0 {
+		return fmt.Errorf("output file not specified")
+	}
+	shares, err := tools.ReadKeyShareFiles(viper.GetStringSlice("share"))
+	if err != nil {
+		return err
+	}
+	passphrases, err := tools.ReadPassphraseFiles(viper.GetStringSlice("passphrase-file"))
+	if err != nil {
+		return err
+	}
+	keyPEM, err := tools.CombineKeyShares(shares, passphrases)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for i := range keyPEM {
+			keyPEM[i] = 0
+		}
+	}()
+	file, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot create output file: %s", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(keyPEM); err != nil {
+		return err
+	}
+	commandLog.Printf("Key rebuilt from %d shares and written to %s", len(shares), output)
+	return nil
+}
@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/niclabs/dns-tools/tools"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	ksrCreateCmd.PersistentFlags().StringP("zone", "z", "", "Zone name.")
+	ksrCreateCmd.PersistentFlags().StringP("sign-algorithm", "a", "rsa", "Algorithm of the keys.")
+	ksrCreateCmd.PersistentFlags().StringP("output", "o", "ksr.json", "Full path to the KSR file to write.")
+	ksrCreateCmd.PersistentFlags().StringSlice("dnskey-file", []string{}, "Full path to a file with other ZSK DNSKEY RRs to include in the bundles, like the next ZSK of a rollover. It can be repeated.")
+	ksrCreateCmd.PersistentFlags().Uint32("dnskey-ttl", 3600, "TTL of the DNSKEY RRset.")
+	ksrCreateCmd.PersistentFlags().String("start", "", "Inception date of the first bundle, in YYYYMMDD format. Default is now.")
+	ksrCreateCmd.PersistentFlags().Int("bundles", 9, "Number of bundles.")
+	ksrCreateCmd.PersistentFlags().String("interval", "10 days", "Time between the inceptions of two consecutive bundles, in human readable format.")
+	ksrCreateCmd.PersistentFlags().String("validity", "21 days", "Validity of the DNSKEY RRset signatures of each bundle, in human readable format. It must be longer than --interval.")
+
+	skrSignCmd.PersistentFlags().String("ksr", "ksr.json", "Full path to the KSR file to sign.")
+	skrSignCmd.PersistentFlags().StringP("output", "o", "skr.json", "Full path to the SKR file to write.")
+	ksrCmd.AddCommand(ksrCreateCmd)
+	skrCmd.AddCommand(skrSignCmd)
+}
+
+var ksrCmd = &cobra.Command{
+	Use:   "ksr",
+	Short: "Key Signing Requests, with the ZSKs that an offline KSK has to sign",
+}
+
+var ksrCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Creates a Key Signing Request with the ZSK of one of the registered backends, to be signed with skr sign",
+}
+
+var skrCmd = &cobra.Command{
+	Use:   "skr",
+	Short: "Signed Key Responses, with the DNSKEY RRsets signed by an offline KSK",
+}
+
+var skrSignCmd = &cobra.Command{
+	Use:   "sign",
+	Short: "Signs a Key Signing Request with the KSK of one of the registered backends, to be used with sign --skr",
+}
+
+// addOfflineKSKCommands adds a ksr create and a skr sign subcommand for each registered backend.
+func addOfflineKSKCommands() error {
+	for _, backend := range tools.Backends() {
+		createCmd := &cobra.Command{
+			Use:   backend.Name,
+			Short: fmt.Sprintf("Creates a KSR with the ZSK of the %s backend", backend.Name),
+			RunE:  createKSR(backend.Name),
+		}
+		signCmd := &cobra.Command{
+			Use:   backend.Name,
+			Short: fmt.Sprintf("Signs a KSR with the KSK of the %s backend", backend.Name),
+			RunE:  signKSR(backend.Name),
+		}
+		for _, cmd := range []*cobra.Command{createCmd, signCmd} {
+			if err := addBackendOptions(cmd.PersistentFlags(), backend); err != nil {
+				return err
+			}
+		}
+		ksrCreateCmd.AddCommand(createCmd)
+		skrSignCmd.AddCommand(signCmd)
+	}
+	return nil
+}
+
+// createKSR returns a command function that creates a KSR with the ZSK of a session of the backend provided.
+func createKSR(name string) func(cmd *cobra.Command, _ []string) error {
+	return func(cmd *cobra.Command, _ []string) error {
+		if err := viper.BindPFlags(cmd.Flags()); err != nil {
+			return err
+		}
+		zone := tools.NormalizeFQDN(viper.GetString("zone"))
+		if len(zone) == 0 {
+			return fmt.Errorf("zone not specified")
+		}
+		start := time.Now()
+		if startDate := viper.GetString("start"); len(startDate) > 0 {
+			var err error
+			if start, err = time.Parse("20060102", startDate); err != nil {
+				return fmt.Errorf("invalid start date: %s", err)
+			}
+		}
+		extra, err := tools.ReadDNSKEYFiles(viper.GetStringSlice("dnskey-file"))
+		if err != nil {
+			return err
+		}
+		signAlgorithm := viper.GetString("sign-algorithm")
+		if _, ok := tools.StringToSignAlgorithm[signAlgorithm]; !ok {
+			return fmt.Errorf("unknown sign algorithm %s", signAlgorithm)
+		}
+		ctx, err := tools.NewContext(&tools.ContextConfig{
+			Zone:          zone,
+			SignAlgorithm: signAlgorithm,
+		}, commandLog)
+		if err != nil {
+			return err
+		}
+		session, err := ctx.NewSession(name, viper.GetViper(), tools.ZSKRole)
+		if err != nil {
+			return err
+		}
+		defer session.End()
+		ksr, err := ctx.CreateKSR(session, extra, &tools.KSRSchedule{
+			Start:    start,
+			Bundles:  viper.GetInt("bundles"),
+			Interval: viper.GetString("interval"),
+			Validity: viper.GetString("validity"),
+			TTL:      uint32(viper.GetInt("dnskey-ttl")),
+		})
+		if err != nil {
+			return err
+		}
+		return writeJSONFile(viper.GetString("output"), ksr)
+	}
+}
+
+// signKSR returns a command function that signs a KSR with the KSK of a session of the backend provided.
+func signKSR(name string) func(cmd *cobra.Command, _ []string) error {
+	return func(cmd *cobra.Command, _ []string) error {
+		if err := viper.BindPFlags(cmd.Flags()); err != nil {
+			return err
+		}
+		ksr, err := tools.ReadKSRFile(viper.GetString("ksr"))
+		if err != nil {
+			return err
+		}
+		ctx, err := tools.NewContext(&tools.ContextConfig{}, commandLog)
+		if err != nil {
+			return err
+		}
+		session, err := ctx.NewSession(name, viper.GetViper(), tools.KSKRole)
+		if err != nil {
+			return err
+		}
+		defer session.End()
+		skr, err := ctx.SignKSR(session, ksr)
+		if err != nil {
+			return err
+		}
+		return writeJSONFile(viper.GetString("output"), skr)
+	}
+}
+
+// writeJSONFile writes value as indented JSON in the file in path.
+func writeJSONFile(path string, value interface{}) error {
+	encoded, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, encoded, 0644); err != nil {
+		return fmt.Errorf("cannot write %s: %s", path, err)
+	}
+	commandLog.Printf("%s written", path)
+	return nil
+}
@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/niclabs/dns-tools/tools"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	pluginFileCmd.Flags().StringP("zsk-keyfile", "Z", "zsk.pem", "Full path to ZSK key file.")
+	pluginFileCmd.Flags().StringP("ksk-keyfile", "K", "ksk.pem", "Full path to KSK key file.")
+	pluginFileCmd.Flags().StringP("sign-algorithm", "a", "rsa", "Algorithm used in signing.")
+	pluginFileCmd.Flags().BoolP("create-keys", "c", false, "Creates a new pair of keys, overwriting the key files.")
+	pluginCmd.AddCommand(pluginFileCmd)
+}
+
+var pluginCmd = &cobra.Command{
+	Use:   "plugin",
+	Short: "Reference signer plugins, to be used with sign exec",
+}
+
+var pluginFileCmd = &cobra.Command{
+	Use:   "file",
+	Short: "Serves the keys of two PEM files with the signer plugin protocol, through the standard input and output",
+	RunE:  pluginFile,
+}
+
+func pluginFile(cmd *cobra.Command, _ []string) error {
+	if err := viper.BindPFlags(cmd.Flags()); err != nil {
+		return err
+	}
+	signAlgorithm := viper.GetString("sign-algorithm")
+	if _, ok := tools.StringToSignAlgorithm[signAlgorithm]; !ok {
+		return fmt.Errorf("unknown sign algorithm %s", signAlgorithm)
+	}
+	ctx, err := tools.NewContext(&tools.ContextConfig{
+		SignAlgorithm: signAlgorithm,
+		CreateKeys:    viper.GetBool("create-keys"),
+	}, commandLog)
+	if err != nil {
+		return err
+	}
+	session, err := ctx.NewSession("file", viper.GetViper(), tools.AllRoles)
+	if err != nil {
+		return err
+	}
+	defer session.End()
+	server := &tools.PluginServer{
+		Session: session,
+		Name:    "dns-tools-file",
+	}
+	return server.Serve(os.Stdin, os.Stdout)
+}
@@ -1,14 +1,14 @@
 package cmd
 
 import (
-	"fmt"
 	"github.com/niclabs/dns-tools/tools"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 func init() {
-	resetPKCS11KeysCmd.Flags().StringP("p11lib", "p", "", "Full path to PKCS11Type lib file")
+	resetPKCS11KeysCmd.Flags().StringSliceP("p11lib", "p", []string{}, "Full path to PKCS11Type lib file. It can be repeated (or separated by commas) to reset the keys in several targets")
+	resetPKCS11KeysCmd.Flags().StringSlice("p11-slot", []string{}, "Position of the slot with the keys in the list of slots with tokens of each --p11lib, in the same order. Default is 0 for each lib")
 	resetPKCS11KeysCmd.Flags().StringP("user-key", "k", "1234", "HSM User Login PKCS11Key")
 	resetPKCS11KeysCmd.Flags().StringP("key-label", "l", "HSM-tools", "Label of HSM Signer PKCS11Key")
 }
@@ -23,22 +23,19 @@ func resetPKCS11Keys(cmd *cobra.Command, args []string) error {
 	if err := viper.BindPFlags(cmd.Flags()); err != nil {
 		return err
 	}
-	p11lib := viper.GetString("p11lib")
-	if len(p11lib) == 0 {
-		return fmt.Errorf("p11lib not specified")
+	targets, err := tools.PKCS11TargetsFromConfig(viper.GetStringSlice("p11lib"), viper.GetStringSlice("p11-slot"))
+	if err != nil {
+		return err
 	}
 
 	key := viper.GetString("user-key")
 	label := viper.GetString("key-label")
-	if err := filesExist(p11lib); err != nil {
-		return err
-	}
 	ctx, err := tools.NewContext(&tools.ContextConfig{}, commandLog)
 	if err != nil {
 		return err
 	}
 	defer ctx.Close()
-	session, err := ctx.NewPKCS11Session(key, label, p11lib)
+	session, err := ctx.NewPKCS11FailoverSession(key, label, targets)
 	if err != nil {
 		return err
 	}
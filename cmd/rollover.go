@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/niclabs/dns-tools/tools"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	rolloverCmd.PersistentFlags().String("role", "", "Role of the compromised key: zsk or ksk.")
+	rolloverCmd.PersistentFlags().UintSlice("key-tag", []uint{}, "Key tag of the compromised key. By default, all the keys of the role in the zone are replaced. It is required in multi-signer mode. It can be repeated.")
+	rolloverCmd.PersistentFlags().String("report", "", "Full path to the timeline report to write. By default is based on the output file name, with \"-rollover.txt\" instead of its extension.")
+	rolloverCmd.PersistentFlags().Uint32("ds-ttl", tools.DefaultDSTTL, "TTL of the DS RRset in the parent zone, used in the timeline of a KSK rollover.")
+	rolloverCmd.PersistentFlags().StringP("file", "f", "", "Full path to the signed zone file currently published, with the compromised key.")
+	addSignFlags(rolloverCmd.PersistentFlags())
+}
+
+var rolloverCmd = &cobra.Command{
+	Use:   "emergency-rollover",
+	Short: "Replaces a compromised ZSK or KSK with a new key of one of the registered backends, signing the zone again",
+}
+
+// addRolloverCommands adds an emergency-rollover subcommand for each registered backend.
+func addRolloverCommands() error {
+	for _, backend := range tools.Backends() {
+		backendCmd := &cobra.Command{
+			Use:   backend.Name,
+			Short: fmt.Sprintf("Replaces a compromised key with a new key of the %s backend", backend.Name),
+			RunE:  rolloverWithBackend(backend.Name),
+		}
+		if err := addBackendOptions(backendCmd.PersistentFlags(), backend); err != nil {
+			return err
+		}
+		rolloverCmd.AddCommand(backendCmd)
+	}
+	return nil
+}
+
+// rolloverWithBackend returns a command function that replaces a compromised key with a new key of
+// a session of the backend provided.
+func rolloverWithBackend(name string) func(cmd *cobra.Command, _ []string) error {
+	return func(cmd *cobra.Command, _ []string) error {
+		if err := viper.BindPFlags(cmd.Flags()); err != nil {
+			return err
+		}
+		role, err := tools.ParseKeyRole(viper.GetString("role"))
+		if err != nil || role == tools.AllRoles {
+			return fmt.Errorf("--role must be zsk or ksk")
+		}
+		tags, err := cmd.Flags().GetUintSlice("key-tag")
+		if err != nil {
+			return err
+		}
+		var keyTags []uint16
+		for _, tag := range tags {
+			if tag > 0xFFFF {
+				return fmt.Errorf("invalid key tag %d", tag)
+			}
+			keyTags = append(keyTags, uint16(tag))
+		}
+		conf, err := newSignConfig()
+		if err != nil {
+			return err
+		}
+		reportPath := viper.GetString("report")
+		if len(reportPath) == 0 {
+			reportPath = strings.TrimSuffix(conf.OutputPath, filepath.Ext(conf.OutputPath)) + "-rollover.txt"
+		}
+		ctx, err := tools.NewContext(conf, commandLog)
+		if err != nil {
+			return err
+		}
+		defer ctx.Close()
+		if err := readRevokedKSKs(ctx); err != nil {
+			return err
+		}
+		ctx.Rollover = &tools.EmergencyRollover{
+			Role:    role,
+			KeyTags: keyTags,
+			DSTTL:   uint32(viper.GetInt("ds-ttl")),
+		}
+		session, err := ctx.NewEmergencyRolloverSession(name, viper.GetViper(), role)
+		if err != nil {
+			return err
+		}
+		defer session.End()
+		if _, err := tools.Sign(session); err != nil {
+			ctx.Log.Printf("zone could not be signed.")
+			return err
+		}
+		report, err := os.Create(reportPath)
+		if err != nil {
+			return fmt.Errorf("cannot create report file: %s", err)
+		}
+		defer report.Close()
+		if err := ctx.Rollover.WriteReport(report, conf.Zone); err != nil {
+			return err
+		}
+		if role == tools.KSKRole {
+			ctx.Log.Printf("New DS for the parent zone: %s", ctx.Rollover.DS)
+		}
+		ctx.Log.Printf("zone signed with the replacement %s. Timeline written to %s", role, reportPath)
+		return nil
+	}
+}
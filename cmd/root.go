@@ -20,6 +20,14 @@ func init() {
 	rootCmd.AddCommand(verifyCmd)
 	rootCmd.AddCommand(digestCmd)
 	rootCmd.AddCommand(resetPKCS11KeysCmd)
+	rootCmd.AddCommand(hsmCmd)
+	rootCmd.AddCommand(pluginCmd)
+	rootCmd.AddCommand(signerCmd)
+	rootCmd.AddCommand(thresholdCmd)
+	rootCmd.AddCommand(keyCmd)
+	rootCmd.AddCommand(ksrCmd)
+	rootCmd.AddCommand(skrCmd)
+	rootCmd.AddCommand(rolloverCmd)
 	commandLog = log.New(os.Stderr, "[dns-tools] ", log.Ldate|log.Ltime)
 }
 
@@ -33,8 +41,15 @@ var rootCmd = &cobra.Command{
 	For more information, visit "https://github.com/niclabs/dns-tools".`,
 }
 
-// Execute executes the command.
+// Execute executes the command. The sign, signer serve, ksr create, skr sign and emergency-rollover subcommands are created from the backends
+// registered at this point, so custom backends must be registered before calling it.
 func Execute() {
+	for _, add := range []func() error{addBackendCommands, addSignerCommands, addOfflineKSKCommands, addRolloverCommands} {
+		if err := add(); err != nil {
+			commandLog.Printf("%s", err)
+			os.Exit(1)
+		}
+	}
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(1)
 	}
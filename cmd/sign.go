@@ -9,6 +9,7 @@ import (
 
 	"github.com/niclabs/dns-tools/tools"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
@@ -20,145 +21,145 @@ var (
 
 func init() {
 	signCmd.PersistentFlags().StringP("file", "f", "", "Full path to zone file to be signed.")
-	signCmd.PersistentFlags().StringP("zone", "z", "", "Origin zone name. If it is not specified, $ORIGIN inside the file will be used as this value.")
-	signCmd.PersistentFlags().StringP("output", "o", "", "Output for the signed zone file. By default is based on zone file name, with \"-signed\" at the end of the name and before the extension")
 	signCmd.PersistentFlags().BoolP("create-keys", "c", false, "Creates a new pair of keys, deleting all previously valid keys.")
-	signCmd.PersistentFlags().StringP("sign-algorithm", "a", "rsa", "Algorithm used in signing.")
-	signCmd.PersistentFlags().BoolP("nsec3", "3", false, "Use NSEC3 instead of NSEC.")
-	signCmd.PersistentFlags().BoolP("opt-out", "x", false, "Use NSEC3 with opt-out.")
-	signCmd.PersistentFlags().BoolP("digest", "d", false, "If it is true, DigestEnabled RR is added to the signed zone")
-	signCmd.PersistentFlags().IntP("hash-digest", "Q", 1, "Hash algorithm for Digest Verification: 1=sha384, 2=sha512")
-	signCmd.PersistentFlags().BoolP("info", "i", false, "If it is true, an TXT RR is added with information about the signing process (tool and mode)")
+	signCmd.PersistentFlags().String("skr", "", "Full path to a Signed Key Response (created with skr sign). The zone is signed only with the ZSK, and the DNSKEY RRset signed by the offline KSK for the current date is added to it.")
 	signCmd.PersistentFlags().BoolP("lazy", "L", false, "If it is true, the zone will be signed only if it is needed (i.e. it is not signed already, it is signed with different key, the signatures are about to expire or the original zone is newer than the signed zone)")
+	addSignFlags(signCmd.PersistentFlags())
+}
 
-	signCmd.PersistentFlags().StringP("rrsig-expiration-date", "E", "", "RRSIG expiration Date, in YYYYMMDD format. It is ignored if --ksk-duration is set. Default is three months from now.")
-	signCmd.PersistentFlags().StringP("rrsig-duration", "D", "", "Relative RRSIG expiration Date, in human readable format (combining numbers with labels like year(s), month(s), day(s), hour(s), minute(s), second(s)). Overrides --rrsig-date-expiration. Default is empty.")
-
-	signCmd.PersistentFlags().StringP("verify-threshold-duration", "t", "", "Number of days it needs to be before a signature expiration to be considered as valid by the verifier. Default is empty")
-	signCmd.PersistentFlags().StringP("verify-threshold-date", "T", "", "Exact date it needs to be before a signature expiration to be considered as expired by the verifier. It is ignored if --verify-threshold-duration is set. Default is tomorrow")
+// addSignFlags adds the flags shared by the sign and emergency-rollover commands, which sign the zone.
+func addSignFlags(flags *pflag.FlagSet) {
+	flags.StringP("zone", "z", "", "Origin zone name. If it is not specified, $ORIGIN inside the file will be used as this value.")
+	flags.StringP("output", "o", "", "Output for the signed zone file. By default is based on zone file name, with \"-signed\" at the end of the name and before the extension")
+	flags.StringP("sign-algorithm", "a", "rsa", "Algorithm used in signing.")
+	flags.BoolP("nsec3", "3", false, "Use NSEC3 instead of NSEC.")
+	flags.BoolP("opt-out", "x", false, "Use NSEC3 with opt-out: insecure delegations (without DS) are left out of the NSEC3 chain.")
+	flags.BoolP("digest", "d", false, "If it is true, DigestEnabled RR is added to the signed zone")
+	flags.IntP("hash-digest", "Q", 1, "Hash algorithm for Digest Verification: 1=sha384, 2=sha512")
+	flags.BoolP("info", "i", false, "If it is true, an TXT RR is added with information about the signing process (tool and mode)")
+	flags.Bool("multi-signer", false, "Multi-signer mode (RFC 8901): DNSKEYs of other signers in the input zone are kept in the DNSKEY RRset signed by our KSK.")
+	flags.StringSlice("foreign-keys", []string{}, "Full path to a file with DNSKEY, CDS and CDNSKEY RRs of other signers, merged into the zone. It enables multi-signer mode. It can be repeated.")
+	flags.StringSlice("own-keys", []string{}, "Full path to a file with DNSKEY RRs of previous signatures of this signer (e.g. keys replaced by new ones), which are removed from the input zone in multi-signer mode instead of being kept as keys of other signers. It can be repeated.")
+	flags.StringSlice("revoke-ksk-file", []string{}, "Full path to the PEM private key file of an old KSK, published with the REVOKE flag (RFC 5011) and signing the DNSKEY RRset. It can be repeated.")
 
-	signCmd.PersistentFlags().Uint16("nsec3-iterations", 0, "If --nsec3 is activated, define the number of iterations of NSEC3 hashing")
-	signCmd.PersistentFlags().Uint16("nsec3-salt-length", 64, "If --nsec3 is activated and there is no --nsec3-salt-value, define the salt length in bytes.")
-	signCmd.PersistentFlags().String("nsec3-salt-value", "", "If --nsec3 is activated, define the salt value in hexadecimal. Its length overrides --nsec3-salt-length")
+	flags.StringP("rrsig-expiration-date", "E", "", "RRSIG expiration Date, in YYYYMMDD format. It is ignored if --rrsig-duration is set. Default is three months from now.")
+	flags.StringP("rrsig-duration", "D", "", "Relative RRSIG expiration Date, in human readable format (combining numbers with labels like year(s), month(s), day(s), hour(s), minute(s), second(s)). Overrides --rrsig-expiration-date. Default is empty.")
 
-	pkcs11Cmd.PersistentFlags().StringP("user-key", "k", "1234", "HSM User Login PKCS11Key.")
-	pkcs11Cmd.PersistentFlags().StringP("key-label", "l", "HSM-tools", "Label of HSM Signer PKCS11Key.")
-	pkcs11Cmd.PersistentFlags().StringP("p11lib", "p", "", "Full path to PKCS11 lib file.")
-	signCmd.AddCommand(pkcs11Cmd)
+	flags.StringP("verify-threshold-duration", "t", "", "Number of days it needs to be before a signature expiration to be considered as valid by the verifier. Default is empty")
+	flags.StringP("verify-threshold-date", "T", "", "Exact date it needs to be before a signature expiration to be considered as expired by the verifier. It is ignored if --verify-threshold-duration is set. Default is tomorrow")
 
-	fileCmd.PersistentFlags().StringP("zsk-keyfile", "Z", "zsk.pem", "Full path to ZSK key file.")
-	fileCmd.PersistentFlags().StringP("ksk-keyfile", "K", "ksk.pem", "Full path to KSK key file.")
-	signCmd.AddCommand(fileCmd)
+	flags.Uint16("nsec3-iterations", 0, "If --nsec3 is activated, define the number of iterations of NSEC3 hashing")
+	flags.Uint16("nsec3-salt-length", 0, "If --nsec3 is activated and there is no --nsec3-salt-value, define the salt length in bytes. RFC 9276 recommends an empty salt.")
+	flags.String("nsec3-salt-value", "", "If --nsec3 is activated, define the salt value in hexadecimal. Its length overrides --nsec3-salt-length")
+	flags.Bool("nsec3-rotate-salt", false, "If --nsec3 is activated and there is no --nsec3-salt-value, create a new salt instead of keeping the salt of the input zone. Use it with --denial-transition.")
+	flags.Uint32("dnskey-ttl", 0, "TTL of the DNSKEY RRset. By default, the SOA MINIMUM field is used.")
+	flags.Uint32("cds-ttl", 0, "TTL of the CDS and CDNSKEY RRsets. By default, their TTL in the zone is kept.")
+	flags.Uint32("nsec3param-ttl", 0, "TTL of the NSEC3PARAM RR. By default, the TTL of the NSEC3 RRs (the minimum of the SOA TTL and the SOA MINIMUM field) is used.")
+	flags.Uint32("max-zone-ttl", 0, "Maximum TTL of the zone. The signature fails if a TTL is larger, unless --clamp-ttl is set. By default, TTLs are not limited.")
+	flags.Bool("clamp-ttl", false, "Lower the TTLs larger than --max-zone-ttl to it, instead of failing.")
+	flags.Bool("denial-transition", false, "Keep the NSEC/NSEC3 chain of the input zone and add the new chain without publishing it. Signing the output again without this flag completes the transition.")
 }
 
 var signCmd = &cobra.Command{
 	Use:   "sign",
-	Short: "Signs a DNS Zone using a PKCS#11 library or a file",
-}
-
-var pkcs11Cmd = &cobra.Command{
-	Use:   "pkcs11",
-	Short: "uses a PKCS#11 library to sign the zone",
-	RunE:  signPKCS11,
+	Short: "Signs a DNS Zone using one of the registered backends (PKCS#11 library, file, etc.)",
 }
 
-var fileCmd = &cobra.Command{
-	Use:   "file",
-	Short: "uses keys from a file to sign the zone",
-	RunE:  signFile,
-}
-
-func signPKCS11(cmd *cobra.Command, _ []string) error {
-	if err := viper.BindPFlags(cmd.Flags()); err != nil {
-		return err
-	}
-	conf, err := newSignConfig()
-	if err != nil {
-		return err
-	}
-	if conf.Lazy && !needsToBeSigned(conf) {
-		return fmt.Errorf("file does not need to be signed")
-	}
-	p11lib := viper.GetString("p11lib")
-	if len(p11lib) == 0 {
-		return fmt.Errorf("p11lib not specified")
-	}
-	key := viper.GetString("user-key")
-	if len(key) == 0 {
-		return fmt.Errorf("user-key not specified")
-	}
-	label := viper.GetString("key-label")
-	if len(label) == 0 {
-		return fmt.Errorf("key-label not specified")
-	}
-	if err := filesExist(p11lib); err != nil {
-		return err
-	}
-	ctx, err := tools.NewContext(conf, commandLog)
-	if err != nil {
-		return err
-	}
-	defer ctx.Close()
-	session, err := ctx.NewPKCS11Session(key, label, p11lib)
-	if err != nil {
-		return err
-	}
-	defer session.End()
-	if _, err := tools.Sign(session); err != nil {
-		ctx.Log.Printf("zone could not be signed.")
-		return err
+// addBackendCommands adds a sign subcommand for each registered backend, with a flag for each backend option.
+func addBackendCommands() error {
+	for _, backend := range tools.Backends() {
+		backendCmd := &cobra.Command{
+			Use:   backend.Name,
+			Short: backend.Description,
+			RunE:  signWithBackend(backend.Name),
+		}
+		if err := addBackendOptions(backendCmd.PersistentFlags(), backend); err != nil {
+			return err
+		}
+		signCmd.AddCommand(backendCmd)
 	}
-	ctx.Log.Printf("zone signed successfully.")
 	return nil
 }
 
-func signFile(cmd *cobra.Command, _ []string) error {
-	if err := viper.BindPFlags(cmd.Flags()); err != nil {
-		return err
-	}
-	conf, err := newSignConfig()
-	if err != nil {
-		return err
-	}
-	if conf.Lazy && !needsToBeSigned(conf) {
-		return fmt.Errorf("file does not need to be signed")
-	}
-	ctx, err := tools.NewContext(conf, commandLog)
-	if err != nil {
-		return err
-	}
-	defer ctx.Close()
-	zskKeypath := viper.GetString("ksk-keyfile")
-	if len(zskKeypath) == 0 {
-		return fmt.Errorf("ZSK keyfile not specified")
-	}
-	kskKeypath := viper.GetString("zsk-keyfile")
-	if len(kskKeypath) == 0 {
-		return fmt.Errorf("KSK keyfile not specified")
+// addBackendOptions adds a flag for each option of the backend provided.
+func addBackendOptions(flags *pflag.FlagSet, backend *tools.SessionBackend) error {
+	for _, option := range backend.Options {
+		switch option.Type {
+		case tools.StringOption:
+			def, _ := option.Default.(string)
+			flags.StringP(option.Name, option.Shorthand, def, option.Usage)
+		case tools.StringSliceOption:
+			def, _ := option.Default.([]string)
+			flags.StringSliceP(option.Name, option.Shorthand, def, option.Usage)
+		case tools.BoolOption:
+			def, _ := option.Default.(bool)
+			flags.BoolP(option.Name, option.Shorthand, def, option.Usage)
+		case tools.IntOption:
+			def, _ := option.Default.(int)
+			flags.IntP(option.Name, option.Shorthand, def, option.Usage)
+		default:
+			return fmt.Errorf("option %s of backend %s has an unknown type", option.Name, backend.Name)
+		}
 	}
+	return nil
+}
 
-	fileFlags := os.O_RDWR | os.O_CREATE
-	if ctx.Config.CreateKeys {
-		fileFlags |= os.O_TRUNC // Truncate old file
+// signWithBackend returns a command function that signs the zone using a session of the backend provided.
+func signWithBackend(name string) func(cmd *cobra.Command, _ []string) error {
+	return func(cmd *cobra.Command, _ []string) error {
+		if err := viper.BindPFlags(cmd.Flags()); err != nil {
+			return err
+		}
+		conf, err := newSignConfig()
+		if err != nil {
+			return err
+		}
+		if conf.Lazy && !needsToBeSigned(conf) {
+			return fmt.Errorf("file does not need to be signed")
+		}
+		roles := tools.AllRoles
+		var skr *tools.SignedKeyResponse
+		if skrPath := viper.GetString("skr"); len(skrPath) > 0 {
+			if conf.CreateKeys {
+				return fmt.Errorf("keys cannot be created when signing with a SKR")
+			}
+			if skr, err = tools.ReadSKRFile(skrPath); err != nil {
+				return err
+			}
+			roles = tools.ZSKRole
+		}
+		ctx, err := tools.NewContext(conf, commandLog)
+		if err != nil {
+			return err
+		}
+		defer ctx.Close()
+		ctx.SKR = skr
+		if err := readRevokedKSKs(ctx); err != nil {
+			return err
+		}
+		session, err := ctx.NewSession(name, viper.GetViper(), roles)
+		if err != nil {
+			return err
+		}
+		defer session.End()
+		if _, err := tools.Sign(session); err != nil {
+			ctx.Log.Printf("zone could not be signed.")
+			return err
+		}
+		ctx.Log.Printf("zone signed successfully.")
+		return nil
 	}
+}
 
-	zskFile, err := os.OpenFile(zskKeypath, fileFlags, 0600)
-	if err != nil {
-		return err
-	}
-	kskFile, err := os.OpenFile(kskKeypath, fileFlags, 0600)
-	if err != nil {
-		return err
-	}
-	session, err := ctx.NewFileSession(kskFile, zskFile)
-	if err != nil {
-		return err
-	}
-	defer session.End()
-	if _, err := tools.Sign(session); err != nil {
-		return err
+// readRevokedKSKs adds to the context the old KSKs of the --revoke-ksk-file flags.
+func readRevokedKSKs(ctx *tools.Context) error {
+	for _, path := range viper.GetStringSlice("revoke-ksk-file") {
+		signer, err := tools.ReadPrivateKeyFile(path, nil)
+		if err != nil {
+			return err
+		}
+		ctx.RevokedKSKs = append(ctx.RevokedKSKs, signer)
 	}
-	ctx.Log.Printf("zone signed successfully.")
 	return nil
 }
 
@@ -170,6 +171,9 @@ func newSignConfig() (*tools.ContextConfig, error) {
 	digest := viper.GetBool("digest")
 	info := viper.GetBool("info")
 	lazy := viper.GetBool("lazy")
+	foreignKeys := viper.GetStringSlice("foreign-keys")
+	ownKeys := viper.GetStringSlice("own-keys")
+	multiSigner := viper.GetBool("multi-signer") || len(foreignKeys) > 0
 
 	path := viper.GetString("file")
 	out := viper.GetString("output")
@@ -178,6 +182,13 @@ func newSignConfig() (*tools.ContextConfig, error) {
 	nsec3Iterations := uint16(viper.GetInt("nsec3-iterations"))
 	nsec3SaltLength := uint8(viper.GetInt("nsec3-salt-length"))
 	nsec3SaltValue := viper.GetString("nsec3-salt-value")
+	nsec3RotateSalt := viper.GetBool("nsec3-rotate-salt")
+	denialTransition := viper.GetBool("denial-transition")
+	dnskeyTTL := viper.GetUint32("dnskey-ttl")
+	cdsTTL := viper.GetUint32("cds-ttl")
+	nsec3ParamTTL := viper.GetUint32("nsec3param-ttl")
+	maxZoneTTL := viper.GetUint32("max-zone-ttl")
+	clampTTLs := viper.GetBool("clamp-ttl")
 
 	if hashDigest == 0 {
 		return nil, fmt.Errorf("hash-digest not specified")
@@ -211,22 +222,32 @@ func newSignConfig() (*tools.ContextConfig, error) {
 	}
 
 	return &tools.ContextConfig{
-		Zone:            zone,
-		CreateKeys:      createKeys,
-		NSEC3:           nsec3,
-		DigestEnabled:   digest,
-		OptOut:          optOut,
-		SignAlgorithm:   signAlgorithm,
-		RRSIGExpDate:    rrsigExpDate,
-		FilePath:        path,
-		OutputPath:      out,
-		Info:            info,
-		Lazy:            lazy,
-		VerifyThreshold: verifyThreshold,
-		HashAlg:         hashDigest,
-		NSEC3Iterations: nsec3Iterations,
-		NSEC3SaltLength: nsec3SaltLength,
-		NSEC3SaltValue:  nsec3SaltValue,
+		Zone:             zone,
+		CreateKeys:       createKeys,
+		NSEC3:            nsec3,
+		DigestEnabled:    digest,
+		OptOut:           optOut,
+		SignAlgorithm:    signAlgorithm,
+		RRSIGExpDate:     rrsigExpDate,
+		FilePath:         path,
+		OutputPath:       out,
+		Info:             info,
+		Lazy:             lazy,
+		VerifyThreshold:  verifyThreshold,
+		HashAlg:          hashDigest,
+		NSEC3Iterations:  nsec3Iterations,
+		NSEC3SaltLength:  nsec3SaltLength,
+		NSEC3SaltValue:   nsec3SaltValue,
+		NSEC3RotateSalt:  nsec3RotateSalt,
+		DNSKEYTTL:        dnskeyTTL,
+		CDSTTL:           cdsTTL,
+		NSEC3PARAMTTL:    nsec3ParamTTL,
+		MaxZoneTTL:       maxZoneTTL,
+		ClampTTLs:        clampTTLs,
+		DenialTransition: denialTransition,
+		MultiSigner:      multiSigner,
+		ForeignKeyFiles:  foreignKeys,
+		OwnKeyFiles:      ownKeys,
 	}, nil
 }
 
@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/niclabs/dns-tools/tools"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	signerServeCmd.PersistentFlags().String("listen", ":9853", "Address (host:port) to listen on.")
+	signerServeCmd.PersistentFlags().String("tls-cert", "", "Full path to the PEM server certificate.")
+	signerServeCmd.PersistentFlags().String("tls-key", "", "Full path to the PEM server private key.")
+	signerServeCmd.PersistentFlags().String("client-ca", "", "Full path to the PEM CA certificate used to verify client certificates.")
+	signerServeCmd.PersistentFlags().StringSlice("allow", []string{}, "Authorizes a client, in CN=ROLES format, where CN is the common name of its certificate and ROLES is zsk, ksk or zsk+ksk. It can be repeated.")
+	signerServeCmd.PersistentFlags().String("audit-log", "", "Full path to the audit log file. Default is the standard error.")
+	signerServeCmd.PersistentFlags().StringP("sign-algorithm", "a", "rsa", "Algorithm used in signing.")
+	signerServeCmd.PersistentFlags().BoolP("create-keys", "c", false, "Creates a new pair of keys, deleting all previously valid keys.")
+	signerCmd.AddCommand(signerServeCmd)
+}
+
+var signerCmd = &cobra.Command{
+	Use:   "signer",
+	Short: "Remote signer, keeping the keys in a dedicated host",
+}
+
+var signerServeCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serves the keys of one of the registered backends over mutual TLS, to be used with sign remote",
+}
+
+// addSignerCommands adds a signer serve subcommand for each registered backend.
+func addSignerCommands() error {
+	for _, backend := range tools.Backends() {
+		backendCmd := &cobra.Command{
+			Use:   backend.Name,
+			Short: fmt.Sprintf("Serves the keys of the %s backend", backend.Name),
+			RunE:  serveBackend(backend.Name),
+		}
+		if err := addBackendOptions(backendCmd.PersistentFlags(), backend); err != nil {
+			return err
+		}
+		signerServeCmd.AddCommand(backendCmd)
+	}
+	return nil
+}
+
+// serveBackend returns a command function that serves the keys of a session of the backend provided.
+func serveBackend(name string) func(cmd *cobra.Command, _ []string) error {
+	return func(cmd *cobra.Command, _ []string) error {
+		if err := viper.BindPFlags(cmd.Flags()); err != nil {
+			return err
+		}
+		signAlgorithm := viper.GetString("sign-algorithm")
+		if _, ok := tools.StringToSignAlgorithm[signAlgorithm]; !ok {
+			return fmt.Errorf("unknown sign algorithm %s", signAlgorithm)
+		}
+		authorized, err := parseAllowed(viper.GetStringSlice("allow"))
+		if err != nil {
+			return err
+		}
+		tlsConfig, err := tools.NewMutualTLSConfig(viper.GetString("tls-cert"), viper.GetString("tls-key"), viper.GetString("client-ca"), true)
+		if err != nil {
+			return err
+		}
+		audit := log.New(os.Stderr, "[dns-tools audit] ", log.Ldate|log.Ltime)
+		if auditPath := viper.GetString("audit-log"); len(auditPath) > 0 {
+			auditFile, err := os.OpenFile(auditPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+			if err != nil {
+				return fmt.Errorf("cannot open audit log: %s", err)
+			}
+			defer auditFile.Close()
+			audit = log.New(auditFile, "", log.Ldate|log.Ltime|log.LUTC)
+		}
+		ctx, err := tools.NewContext(&tools.ContextConfig{
+			SignAlgorithm: signAlgorithm,
+			CreateKeys:    viper.GetBool("create-keys"),
+		}, commandLog)
+		if err != nil {
+			return err
+		}
+		session, err := ctx.NewSession(name, viper.GetViper(), tools.AllRoles)
+		if err != nil {
+			return err
+		}
+		defer session.End()
+		listener, err := net.Listen("tcp", viper.GetString("listen"))
+		if err != nil {
+			return err
+		}
+		ctx.Log.Printf("serving keys of %s backend on %s", name, listener.Addr())
+		server := &tools.RemoteSignerServer{
+			Session:    session,
+			TLSConfig:  tlsConfig,
+			Authorized: authorized,
+			Audit:      audit,
+			Log:        ctx.Log,
+		}
+		return server.Serve(listener)
+	}
+}
+
+// parseAllowed returns the roles authorized for each client, from a list of CN=ROLES values.
+func parseAllowed(allowed []string) (map[string]tools.KeyRole, error) {
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("no clients authorized. Use --allow to authorize them")
+	}
+	authorized := make(map[string]tools.KeyRole)
+	for _, value := range allowed {
+		eq := strings.LastIndex(value, "=")
+		if eq <= 0 {
+			return nil, fmt.Errorf("invalid --allow value %q. It must be in CN=ROLES format", value)
+		}
+		role, err := tools.ParseKeyRole(value[eq+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid --allow value %q: %s", value, err)
+		}
+		authorized[value[:eq]] |= role
+	}
+	return authorized, nil
+}
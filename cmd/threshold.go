@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/niclabs/dns-tools/tools"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	thresholdDealCmd.Flags().IntP("threshold", "t", 2, "Number of nodes needed to sign.")
+	thresholdDealCmd.Flags().IntP("nodes", "n", 3, "Number of nodes receiving a share of the keys.")
+	thresholdDealCmd.Flags().Int("bits", 2048, "Size of the RSA modulus of the keys, in bits.")
+	thresholdDealCmd.Flags().String("out-dir", ".", "Directory where the share file of each node (node-<index>.json) is written.")
+	thresholdNodeCmd.Flags().String("share", "", "Full path to the share file of the node.")
+	thresholdNodeCmd.Flags().String("listen", "127.0.0.1:9871", "Address (host:port) to listen on.")
+	thresholdNodeCmd.Flags().String("tls-cert", "", "Full path to the PEM node certificate.")
+	thresholdNodeCmd.Flags().String("tls-key", "", "Full path to the PEM node private key.")
+	thresholdNodeCmd.Flags().String("client-ca", "", "Full path to the PEM CA certificate used to verify client certificates.")
+	thresholdNodeCmd.Flags().Bool("insecure", false, "Serve over plain TCP without authenticating clients, instead of mutual TLS. Any client reaching the node gets partial signatures.")
+	thresholdCmd.AddCommand(thresholdDealCmd)
+	thresholdCmd.AddCommand(thresholdNodeCmd)
+}
+
+var thresholdCmd = &cobra.Command{
+	Use:   "threshold",
+	Short: "Threshold RSA signing, with the keys split among several nodes",
+}
+
+var thresholdDealCmd = &cobra.Command{
+	Use:   "deal",
+	Short: "Creates a ZSK and a KSK and splits them in shares, writing a share file for each node",
+	RunE:  thresholdDeal,
+}
+
+var thresholdNodeCmd = &cobra.Command{
+	Use:   "node",
+	Short: "Serves the partial signatures of the shares of a node, to be used with sign threshold",
+	RunE:  thresholdNode,
+}
+
+func thresholdDeal(cmd *cobra.Command, _ []string) error {
+	if err := viper.BindPFlags(cmd.Flags()); err != nil {
+		return err
+	}
+	threshold, nodes, bits := viper.GetInt("threshold"), viper.GetInt("nodes"), viper.GetInt("bits")
+	outDir := viper.GetString("out-dir")
+	if stat, err := os.Stat(outDir); err != nil || !stat.IsDir() {
+		return fmt.Errorf("directory %s doesn't exist", outDir)
+	}
+	keys := make([]*tools.ThresholdNodeKeys, nodes)
+	for i := range keys {
+		keys[i] = &tools.ThresholdNodeKeys{}
+	}
+	for _, role := range []tools.KeyRole{tools.ZSKRole, tools.KSKRole} {
+		commandLog.Printf("Creating %s (%d bits). This can take some minutes", role, bits)
+		shares, err := tools.GenerateThresholdKey(bits, threshold, nodes)
+		if err != nil {
+			return err
+		}
+		for i, share := range shares {
+			if role == tools.ZSKRole {
+				keys[i].ZSK = share
+			} else {
+				keys[i].KSK = share
+			}
+		}
+	}
+	for i, nodeKeys := range keys {
+		encoded, err := json.MarshalIndent(nodeKeys, "", "  ")
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(outDir, fmt.Sprintf("node-%d.json", i+1))
+		if err := ioutil.WriteFile(path, encoded, 0600); err != nil {
+			return fmt.Errorf("cannot write share file: %s", err)
+		}
+		commandLog.Printf("Share of node %d written to %s", i+1, path)
+	}
+	commandLog.Printf("[Warn ] Share files are not encrypted and they are only protected by their permissions (0600). Move each of them to its node and delete it here")
+	commandLog.Printf("Keys dealt to %d nodes. Any %d of them can sign", nodes, threshold)
+	return nil
+}
+
+func thresholdNode(cmd *cobra.Command, _ []string) error {
+	if err := viper.BindPFlags(cmd.Flags()); err != nil {
+		return err
+	}
+	sharePath := viper.GetString("share")
+	if err := filesExist(sharePath); err != nil {
+		return err
+	}
+	cert, key, clientCA := viper.GetString("tls-cert"), viper.GetString("tls-key"), viper.GetString("client-ca")
+	insecure := viper.GetBool("insecure")
+	if len(cert) == 0 && len(key) == 0 && len(clientCA) == 0 {
+		if !insecure {
+			return fmt.Errorf("--tls-cert, --tls-key and --client-ca are needed to serve with mutual TLS. Use --insecure to serve over plain TCP without authenticating clients")
+		}
+	} else if len(cert) == 0 || len(key) == 0 || len(clientCA) == 0 {
+		return fmt.Errorf("--tls-cert, --tls-key and --client-ca must be set together")
+	} else if insecure {
+		return fmt.Errorf("--insecure cannot be used with --tls-cert, --tls-key and --client-ca")
+	}
+	if stat, err := os.Stat(sharePath); err == nil && stat.Mode().Perm()&0077 != 0 {
+		commandLog.Printf("[Warn ] share file %s can be read by other users (permissions %o). It should only be readable by its owner (0600)", sharePath, stat.Mode().Perm())
+	}
+	encoded, err := ioutil.ReadFile(sharePath)
+	if err != nil {
+		return err
+	}
+	var keys tools.ThresholdNodeKeys
+	if err := json.Unmarshal(encoded, &keys); err != nil {
+		return fmt.Errorf("cannot parse share file: %s", err)
+	}
+	node := &tools.ThresholdNode{
+		Keys: &keys,
+		Log:  log.New(os.Stderr, "[dns-tools node] ", log.Ldate|log.Ltime),
+	}
+	if insecure {
+		node.Insecure = true
+		commandLog.Printf("[Warn ] serving over plain TCP: any client reaching the node gets partial signatures of the digests it chooses")
+	} else if node.TLSConfig, err = tools.NewMutualTLSConfig(cert, key, clientCA, true); err != nil {
+		return err
+	}
+	info, err := node.Info()
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", viper.GetString("listen"))
+	if err != nil {
+		return err
+	}
+	commandLog.Printf("serving node %d of %d (threshold %d) on %s", info.Index, info.Nodes, info.Threshold, listener.Addr())
+	return node.Serve(listener)
+}
@@ -15,6 +15,13 @@ func init() {
 	verifyCmd.PersistentFlags().StringP("zone", "z", "", "Zone name")
 	verifyCmd.PersistentFlags().BoolP("skip-signatures", "S", false, "Skip verification of DNSSEC signatures")
 	verifyCmd.PersistentFlags().BoolP("skip-digests", "D", false, "Skip verification of ZONEMD digests")
+	verifyCmd.PersistentFlags().Bool("skip-denial", false, "Skip verification of the NSEC/NSEC3 chains")
+	verifyCmd.PersistentFlags().Bool("multi-signer", false, "Multi-signer zone (RFC 8901): ignore RRSIGs of keys not in the DNSKEY RRset and allow DNSKEYs of other signers with algorithms that do not sign the DNSKEY RRset")
+	verifyCmd.PersistentFlags().StringSlice("wildcard-answer", []string{}, "Query in name/TYPE format that must be provably answered by a wildcard of the zone. It can be repeated.")
+	verifyCmd.PersistentFlags().StringSlice("ds", []string{}, "DS RR in presentation format matching a key that signs the DNSKEY RRset. It can be repeated.")
+	verifyCmd.PersistentFlags().String("trust-anchor", "", "File with DS and DNSKEY RRs, or a trust anchor in RFC 7958 XML format, matching a key that signs the DNSKEY RRset")
+	verifyCmd.PersistentFlags().String("parent-zone", "", "Signed parent zone file. Its DS RRset of the zone is validated, and it must match a key that signs the DNSKEY RRset")
+	verifyCmd.PersistentFlags().StringSlice("parent-ds", []string{}, "DS RR of the parent zone in presentation format, matching a key that signs the DNSKEY RRset of --parent-zone. It is required with --parent-zone and it can be repeated.")
 	verifyCmd.PersistentFlags().StringP("verify-threshold-duration", "t", "", "Number of days it needs to be before a signature expiration to be considered as valid by the verifier. Default is empty")
 	verifyCmd.PersistentFlags().StringP("verify-threshold-date", "T", "", "Exact date it needs to be before a signature expiration to be considered as expired by the verifier. It is ignored if --verify-threshold-duration is set. Default is tomorrow")
 }
@@ -33,6 +40,7 @@ func verify(cmd *cobra.Command, args []string) error {
 	zone := tools.NormalizeFQDN(viper.GetString("zone"))
 	skipSignatures := viper.GetBool("skip-signatures")
 	skipDigests := viper.GetBool("skip-digests")
+	skipDenial := viper.GetBool("skip-denial")
 
 	if skipSignatures && skipDigests {
 		return fmt.Errorf("at least one of the following flags should not be set: [skip-signatures, skip-digests]")
@@ -42,6 +50,34 @@ func verify(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	wildcardAnswers := make([]tools.Query, 0)
+	for _, s := range viper.GetStringSlice("wildcard-answer") {
+		q, err := tools.ParseQuery(s)
+		if err != nil {
+			return err
+		}
+		wildcardAnswers = append(wildcardAnswers, q)
+	}
+	trustAnchorDS := viper.GetStringSlice("ds")
+	trustAnchor := viper.GetString("trust-anchor")
+	parentZone := viper.GetString("parent-zone")
+	parentDS := viper.GetStringSlice("parent-ds")
+	if skipSignatures && (len(trustAnchorDS) > 0 || len(trustAnchor) > 0 || len(parentZone) > 0) {
+		return fmt.Errorf("the chain of trust is not checked with --skip-signatures: remove it or the flags [ds, trust-anchor, parent-zone]")
+	}
+	if len(parentDS) > 0 && len(parentZone) == 0 {
+		return fmt.Errorf("--parent-ds requires --parent-zone")
+	}
+	if len(parentZone) > 0 && len(parentDS) == 0 {
+		return fmt.Errorf("--parent-zone requires --parent-ds to anchor the parent zone")
+	}
+	for _, anchorPath := range []string{trustAnchor, parentZone} {
+		if len(anchorPath) > 0 {
+			if err := filesExist(anchorPath); err != nil {
+				return err
+			}
+		}
+	}
 	var file io.Reader
 	if len(path) == 0 {
 		file = os.Stdin
@@ -59,9 +95,16 @@ func verify(cmd *cobra.Command, args []string) error {
 
 	ctx := &tools.Context{
 		Config: &tools.ContextConfig{
-			Zone:            zone,
-			FilePath:        path,
-			VerifyThreshold: verifyThreshold,
+			Zone:             zone,
+			FilePath:         path,
+			VerifyThreshold:  verifyThreshold,
+			WildcardAnswers:  wildcardAnswers,
+			SkipDenialChecks: skipDenial,
+			MultiSigner:      viper.GetBool("multi-signer"),
+			TrustAnchorDS:    trustAnchorDS,
+			TrustAnchorFile:  trustAnchor,
+			ParentZoneFile:   parentZone,
+			ParentDS:         parentDS,
 		},
 		File: file,
 		Log:  commandLog,
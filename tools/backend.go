@@ -0,0 +1,364 @@
+package tools
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// BackendOptionType represents the type of the value of a backend option.
+type BackendOptionType int
+
+// Types of backend options.
+const (
+	StringOption      BackendOptionType = iota // string value
+	StringSliceOption                          // list of strings, separated by commas or repeated
+	BoolOption                                 // boolean value
+	IntOption                                  // integer value
+)
+
+// BackendOption describes a configuration option of a session backend.
+// The command line exposes each option as a flag of the backend sign command,
+// and it can also be defined in the config file.
+type BackendOption struct {
+	Name      string            // Option name, as used in flags and config file
+	Shorthand string            // One letter flag shorthand (optional)
+	Type      BackendOptionType // Type of the option value
+	Default   interface{}       // Default value. Its type must match the option type (string, []string, bool or int)
+	Usage     string            // Help message
+}
+
+// BackendConfig gives access to the values of the backend options.
+// *viper.Viper implements it.
+type BackendConfig interface {
+	GetString(key string) string
+	GetStringSlice(key string) []string
+	GetBool(key string) bool
+	GetInt(key string) int
+}
+
+// SessionBackend describes a SignSession implementation that can be selected by name.
+type SessionBackend struct {
+	Name        string          // Backend name, used as sign subcommand
+	Description string          // Short description of the backend
+	Options     []BackendOption // Options used by the backend
+	// New creates a new session in the context provided, using the values of the options in conf.
+	// The session must provide the keys of the roles received, and it should not require, create
+	// or destroy the keys of the other roles.
+	New func(ctx *Context, conf BackendConfig, roles KeyRole) (SignSession, error)
+}
+
+// hybridBackendName is the name of the backend combining the other backends.
+const hybridBackendName = "hybrid"
+
+var backends = struct {
+	sync.Mutex
+	registered map[string]*SessionBackend
+}{registered: make(map[string]*SessionBackend)}
+
+func init() {
+	for _, backend := range []*SessionBackend{pkcs11Backend, fileBackend, vaultBackend, kmsBackend, execBackend, remoteBackend, thresholdBackend, hybridBackend} {
+		if err := RegisterBackend(backend); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RegisterBackend registers a session backend, so it can be used by name with NewSession
+// and as a sign subcommand. Backends must be registered before the commands are executed.
+// Its options are also available with "ksk-" and "zsk-" prefixes in the hybrid backend.
+func RegisterBackend(backend *SessionBackend) error {
+	if backend == nil || len(backend.Name) == 0 || backend.New == nil {
+		return fmt.Errorf("backend must have a name and a constructor")
+	}
+	backends.Lock()
+	defer backends.Unlock()
+	if _, ok := backends.registered[backend.Name]; ok {
+		return fmt.Errorf("backend %s already registered", backend.Name)
+	}
+	backends.registered[backend.Name] = backend
+	if hybrid, ok := backends.registered[hybridBackendName]; ok {
+		hybrid.Options = hybridOptions()
+	}
+	return nil
+}
+
+// Backends returns the registered backends, sorted by name.
+func Backends() []*SessionBackend {
+	backends.Lock()
+	defer backends.Unlock()
+	list := make([]*SessionBackend, 0, len(backends.registered))
+	for _, backend := range backends.registered {
+		list = append(list, backend)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// GetBackend returns the backend registered with the name provided.
+func GetBackend(name string) (*SessionBackend, error) {
+	backends.Lock()
+	defer backends.Unlock()
+	backend, ok := backends.registered[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q", name)
+	}
+	return backend, nil
+}
+
+// NewSession creates a new session using the backend registered with the name provided.
+// The session provides the keys of the roles received.
+func (ctx *Context) NewSession(name string, conf BackendConfig, roles KeyRole) (SignSession, error) {
+	backend, err := GetBackend(name)
+	if err != nil {
+		return nil, err
+	}
+	session, err := backend.New(ctx, conf, roles)
+	if err != nil {
+		return nil, err
+	}
+	if restricter, ok := session.(roleRestricter); ok && roles != AllRoles {
+		restricter.restrictRoles(roles)
+	}
+	return session, nil
+}
+
+// roleConfig gives access to the options of a backend used for one key role in the hybrid backend.
+// Options are prefixed by the role name, unless they are already specific to a role.
+type roleConfig struct {
+	BackendConfig
+	role KeyRole
+}
+
+func (conf *roleConfig) key(key string) string {
+	if isRoleOption(key) {
+		return key
+	}
+	return conf.role.String() + "-" + key
+}
+
+func (conf *roleConfig) GetString(key string) string {
+	return conf.BackendConfig.GetString(conf.key(key))
+}
+
+func (conf *roleConfig) GetStringSlice(key string) []string {
+	return conf.BackendConfig.GetStringSlice(conf.key(key))
+}
+
+func (conf *roleConfig) GetBool(key string) bool {
+	return conf.BackendConfig.GetBool(conf.key(key))
+}
+
+func (conf *roleConfig) GetInt(key string) int {
+	return conf.BackendConfig.GetInt(conf.key(key))
+}
+
+// isRoleOption returns true if the option name is already specific to a key role.
+func isRoleOption(name string) bool {
+	return strings.HasPrefix(name, ZSKRole.String()+"-") || strings.HasPrefix(name, KSKRole.String()+"-")
+}
+
+// hybridOptions returns the options of the hybrid backend: the backend used by each role and
+// the options of the registered backends, prefixed by each role.
+func hybridOptions() []BackendOption {
+	options := []BackendOption{
+		{Name: "ksk-backend", Type: StringOption, Default: "pkcs11", Usage: "Backend used for the KSK."},
+		{Name: "zsk-backend", Type: StringOption, Default: "file", Usage: "Backend used for the ZSK."},
+	}
+	seen := make(map[string]bool)
+	names := make([]string, 0)
+	for name := range backends.registered {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == hybridBackendName {
+			continue
+		}
+		for _, option := range backends.registered[name].Options {
+			for _, role := range []KeyRole{KSKRole, ZSKRole} {
+				prefixed := option
+				prefixed.Shorthand = ""
+				if !isRoleOption(option.Name) {
+					prefixed.Name = role.String() + "-" + option.Name
+					prefixed.Usage = fmt.Sprintf("%s (%s backend, for the %s)", option.Usage, name, strings.ToUpper(role.String()))
+				}
+				if seen[prefixed.Name] {
+					continue
+				}
+				seen[prefixed.Name] = true
+				options = append(options, prefixed)
+			}
+		}
+	}
+	return options
+}
+
+var pkcs11Backend = &SessionBackend{
+	Name:        "pkcs11",
+	Description: "uses a PKCS#11 library to sign the zone",
+	Options: []BackendOption{
+		{Name: "user-key", Shorthand: "k", Type: StringOption, Default: "1234", Usage: "HSM User Login PKCS11Key."},
+		{Name: "key-label", Shorthand: "l", Type: StringOption, Default: "HSM-tools", Usage: "Label of HSM Signer PKCS11Key."},
+		{Name: "p11lib", Shorthand: "p", Type: StringSliceOption, Default: []string{}, Usage: "Full path to PKCS11 lib file. It can be repeated (or separated by commas) to define failover targets, which are used in order."},
+		{Name: "p11-slot", Type: StringSliceOption, Default: []string{}, Usage: "Position of the slot with the keys in the list of slots with tokens of each --p11lib, in the same order. Default is 0 for each lib."},
+	},
+	New: func(ctx *Context, conf BackendConfig, roles KeyRole) (SignSession, error) {
+		targets, err := PKCS11TargetsFromConfig(conf.GetStringSlice("p11lib"), conf.GetStringSlice("p11-slot"))
+		if err != nil {
+			return nil, err
+		}
+		key := conf.GetString("user-key")
+		if len(key) == 0 {
+			return nil, fmt.Errorf("user-key not specified")
+		}
+		label := conf.GetString("key-label")
+		if len(label) == 0 {
+			return nil, fmt.Errorf("key-label not specified")
+		}
+		return ctx.NewPKCS11FailoverSession(key, label, targets)
+	},
+}
+
+var fileBackend = &SessionBackend{
+	Name:        "file",
+	Description: "uses keys from a file to sign the zone",
+	Options: []BackendOption{
+		{Name: "zsk-keyfile", Shorthand: "Z", Type: StringOption, Default: "zsk.pem", Usage: "Full path to ZSK key file."},
+		{Name: "ksk-keyfile", Shorthand: "K", Type: StringOption, Default: "ksk.pem", Usage: "Full path to KSK key file."},
+		{Name: "ksk-share", Type: StringSliceOption, Default: []string{}, Usage: "Full path to a KSK share file (dns-tools key split), used instead of --ksk-keyfile. It can be repeated."},
+		{Name: "ksk-share-passphrase-file", Type: StringSliceOption, Default: []string{}, Usage: "Full path to a file with the passphrase of each --ksk-share, in the same order, or a single one for all of them."},
+		{Name: "key-passphrase-file", Type: StringOption, Default: "", Usage: "Full path to a file with the passphrase of encrypted key files. If a passphrase source is set, created keys are encrypted."},
+		{Name: "key-passphrase-env", Type: StringOption, Default: "", Usage: "Name of the environment variable with the passphrase of encrypted key files."},
+		{Name: "key-passphrase-prompt", Type: BoolOption, Default: false, Usage: "Asks for the passphrase of encrypted key files in the terminal."},
+	},
+	New: func(ctx *Context, conf BackendConfig, roles KeyRole) (SignSession, error) {
+		passphrase, err := passphraseFromConfig(conf)
+		if err != nil {
+			return nil, err
+		}
+		sharePaths := conf.GetStringSlice("ksk-share")
+		useShares := roles.Has(KSKRole) && len(sharePaths) > 0
+		files := make(map[KeyRole]*os.File)
+		for _, role := range []KeyRole{ZSKRole, KSKRole} {
+			if !roles.Has(role) || role == KSKRole && useShares {
+				continue
+			}
+			path := conf.GetString(role.String() + "-keyfile")
+			if len(path) == 0 {
+				return nil, fmt.Errorf("%s keyfile not specified", strings.ToUpper(role.String()))
+			}
+			file, err := openKeyFile(path, ctx.Config.CreateKeys)
+			if err != nil {
+				for _, f := range files {
+					f.Close()
+				}
+				return nil, err
+			}
+			files[role] = file
+		}
+		session := &FileSession{ctx: ctx, passphrase: passphrase}
+		// Unused roles must remain as nil interfaces
+		if file, ok := files[ZSKRole]; ok {
+			session.zskFile = file
+		}
+		if file, ok := files[KSKRole]; ok {
+			session.kskFile = file
+		}
+		if useShares {
+			shares, err := ReadKeyShareFiles(sharePaths)
+			if err == nil {
+				session.kskPassphrases, err = ReadPassphraseFiles(conf.GetStringSlice("ksk-share-passphrase-file"))
+			}
+			if err != nil {
+				session.End()
+				return nil, err
+			}
+			session.kskShares = shares
+		}
+		return session, nil
+	},
+}
+
+var hybridBackend = &SessionBackend{
+	Name:        hybridBackendName,
+	Description: "uses a different backend for the KSK and the ZSK to sign the zone",
+	New: func(ctx *Context, conf BackendConfig, roles KeyRole) (SignSession, error) {
+		sessions := make(map[KeyRole]SignSession)
+		for _, role := range []KeyRole{KSKRole, ZSKRole} {
+			name := conf.GetString(role.String() + "-backend")
+			if name == hybridBackendName {
+				return nil, fmt.Errorf("%s backend cannot be %s", role, hybridBackendName)
+			}
+			session, err := ctx.NewSession(name, &roleConfig{conf, role}, role)
+			if err != nil {
+				for _, s := range sessions {
+					s.End()
+				}
+				return nil, fmt.Errorf("cannot create %s session: %s", role, err)
+			}
+			sessions[role] = session
+		}
+		return ctx.NewHybridSession(sessions[KSKRole], sessions[ZSKRole])
+	},
+}
+
+// PKCS11TargetsFromConfig returns the PKCS#11 targets defined by a list of library paths and a list
+// of slot positions, matched by their order. Libraries without slot use the first slot. Libraries are
+// not checked here, so the failover session can skip the targets that cannot be opened.
+func PKCS11TargetsFromConfig(p11libs, slots []string) ([]PKCS11Target, error) {
+	if len(p11libs) == 0 {
+		return nil, fmt.Errorf("p11lib not specified")
+	}
+	if len(slots) > len(p11libs) {
+		return nil, fmt.Errorf("more p11-slot values (%d) than p11lib values (%d)", len(slots), len(p11libs))
+	}
+	targets := make([]PKCS11Target, len(p11libs))
+	for i, p11lib := range p11libs {
+		targets[i].Lib = p11lib
+		if i < len(slots) {
+			slot, err := strconv.Atoi(slots[i])
+			if err != nil || slot < 0 {
+				return nil, fmt.Errorf("invalid p11-slot value %q", slots[i])
+			}
+			targets[i].Slot = slot
+		}
+	}
+	return targets, nil
+}
+
+// passphraseFromConfig returns the passphrase source of encrypted key files defined in the file backend
+// options, or nil if none is defined.
+func passphraseFromConfig(conf BackendConfig) (PassphraseFunc, error) {
+	sources := make([]PassphraseFunc, 0)
+	if path := conf.GetString("key-passphrase-file"); len(path) > 0 {
+		sources = append(sources, FilePassphrase(path))
+	}
+	if name := conf.GetString("key-passphrase-env"); len(name) > 0 {
+		sources = append(sources, EnvPassphrase(name))
+	}
+	if conf.GetBool("key-passphrase-prompt") {
+		sources = append(sources, TerminalPassphrase())
+	}
+	switch len(sources) {
+	case 0:
+		return nil, nil
+	case 1:
+		return sources[0], nil
+	}
+	return nil, fmt.Errorf("only one of key-passphrase-file, key-passphrase-env and key-passphrase-prompt can be used")
+}
+
+// openKeyFile opens a key file for reading and writing. If the keys are going to be created, it truncates the file.
+func openKeyFile(path string, createKeys bool) (*os.File, error) {
+	fileFlags := os.O_RDWR | os.O_CREATE
+	if createKeys {
+		fileFlags |= os.O_TRUNC // Truncate old file
+	}
+	return os.OpenFile(path, fileFlags, 0600)
+}
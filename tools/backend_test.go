@@ -0,0 +1,151 @@
+package tools_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/niclabs/dns-tools/tools"
+)
+
+// memoryBackend uses the RSA test keys, selected by the "memory-keys" option.
+var memoryBackend = &tools.SessionBackend{
+	Name:        "memory",
+	Description: "uses keys stored in memory",
+	Options: []tools.BackendOption{
+		{Name: "memory-keys", Type: tools.StringOption, Default: "rsa", Usage: "Test keys used."},
+	},
+	New: func(ctx *tools.Context, conf tools.BackendConfig, roles tools.KeyRole) (tools.SignSession, error) {
+		if conf.GetString("memory-keys") != "rsa" {
+			return nil, os.ErrNotExist
+		}
+		return ctx.NewFileSession(&vFile{data: []byte(RSAZSK)}, &vFile{data: []byte(RSAKSK)})
+	},
+}
+
+func init() {
+	if err := tools.RegisterBackend(memoryBackend); err != nil {
+		panic(err)
+	}
+}
+
+func TestBackend_Register(t *testing.T) {
+	if err := tools.RegisterBackend(memoryBackend); err == nil {
+		t.Errorf("backend registered twice")
+	}
+	if err := tools.RegisterBackend(&tools.SessionBackend{Name: "incomplete"}); err == nil {
+		t.Errorf("backend without constructor registered")
+	}
+	names := make(map[string]bool)
+	for _, backend := range tools.Backends() {
+		names[backend.Name] = true
+	}
+	for _, name := range []string{"file", "pkcs11", "hybrid", "memory"} {
+		if !names[name] {
+			t.Errorf("backend %s not registered", name)
+		}
+	}
+	hybrid, err := tools.GetBackend("hybrid")
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	options := make(map[string]bool)
+	for _, option := range hybrid.Options {
+		options[option.Name] = true
+	}
+	for _, name := range []string{"ksk-memory-keys", "zsk-memory-keys", "ksk-p11lib", "zsk-keyfile"} {
+		if !options[name] {
+			t.Errorf("hybrid backend does not have option %s", name)
+		}
+	}
+	if _, err := tools.GetBackend("unknown"); err == nil {
+		t.Errorf("unknown backend found")
+	}
+}
+
+func TestBackend_CustomSign(t *testing.T) {
+	ctx := &tools.Context{
+		Config: &tools.ContextConfig{
+			Zone:            zone,
+			Info:            true,
+			VerifyThreshold: time.Now(),
+		},
+		SignAlgorithm: tools.RsaSha256,
+		Log:           Log,
+	}
+	if _, err := ctx.NewSession("memory", mapConfig{"memory-keys": "ec"}, tools.AllRoles); err == nil {
+		t.Errorf("session created with invalid options")
+	}
+	session, err := ctx.NewSession("memory", mapConfig{"memory-keys": "rsa"}, tools.AllRoles)
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	out, err := sign(t, ctx, session)
+	if err != nil {
+		t.Errorf("signing failed: %s", err)
+		return
+	}
+	defer out.Close()
+	if err := ctx.VerifyFile(); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+}
+
+func TestBackend_HybridWithCustomBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dns-tools-backend")
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	zskPath := filepath.Join(dir, "zsk.pem")
+	if err := ioutil.WriteFile(zskPath, []byte(RSAZSK), 0600); err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	ctx := &tools.Context{
+		Config: &tools.ContextConfig{
+			Zone:            zone,
+			Info:            true,
+			VerifyThreshold: time.Now(),
+		},
+		SignAlgorithm: tools.RsaSha256,
+		Log:           Log,
+	}
+	session, err := ctx.NewSession("hybrid", mapConfig{
+		"ksk-backend":     "memory",
+		"ksk-memory-keys": "rsa",
+		"zsk-backend":     "file",
+		"zsk-keyfile":     zskPath,
+	}, tools.AllRoles)
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	out, err := sign(t, ctx, session)
+	if err != nil {
+		t.Errorf("signing failed: %s", err)
+		return
+	}
+	defer out.Close()
+	if err := ctx.VerifyFile(); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+}
+
+func TestBackend_PKCS11TargetsMissingLib(t *testing.T) {
+	targets, err := tools.PKCS11TargetsFromConfig([]string{"/nonexistent/libpkcs11.so", "/other/libpkcs11.so"}, []string{"1"})
+	if err != nil {
+		t.Fatalf("targets with a missing library not accepted: %s", err)
+	}
+	if len(targets) != 2 || targets[0].Slot != 1 || targets[1].Slot != 0 {
+		t.Errorf("unexpected targets: %v", targets)
+	}
+	if _, err := tools.PKCS11TargetsFromConfig([]string{"/nonexistent/libpkcs11.so"}, []string{"a"}); err == nil {
+		t.Errorf("invalid slot accepted")
+	}
+}
@@ -0,0 +1,62 @@
+package tools
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"time"
+)
+
+// BenchResult contains the results of a signing benchmark.
+type BenchResult struct {
+	Signatures int           // Number of signatures created
+	Duration   time.Duration // Time spent creating the signatures
+}
+
+// PerSecond returns the number of signatures per second.
+func (result *BenchResult) PerSecond() float64 {
+	if result.Duration <= 0 {
+		return 0
+	}
+	return float64(result.Signatures) / result.Duration.Seconds()
+}
+
+// Estimate returns the time needed to create the number of signatures provided at the benchmark rate.
+func (result *BenchResult) Estimate(signatures int) time.Duration {
+	if result.Signatures == 0 {
+		return 0
+	}
+	return time.Duration(int64(result.Duration) / int64(result.Signatures) * int64(signatures))
+}
+
+// BenchSign creates n signatures of random digests with the ZSK of the session and measures the time spent.
+// Signatures are requested one after another, as Sign does when it signs a zone.
+func BenchSign(session SignSession, n int) (*BenchResult, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("number of signatures must be positive")
+	}
+	keys, err := session.GetKeys()
+	if err != nil {
+		return nil, err
+	}
+	digests := make([][]byte, n)
+	for i := range digests {
+		data := make([]byte, 64)
+		if _, err := rand.Read(data); err != nil {
+			return nil, err
+		}
+		digest := sha256.Sum256(data)
+		digests[i] = digest[:]
+	}
+	start := time.Now()
+	for i, digest := range digests {
+		if _, err := keys.zskSigner.Sign(rand.Reader, digest, crypto.SHA256); err != nil {
+			return nil, fmt.Errorf("signature %d/%d failed: %s", i+1, n, err)
+		}
+	}
+	return &BenchResult{
+		Signatures: n,
+		Duration:   time.Since(start),
+	}, nil
+}
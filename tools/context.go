@@ -1,11 +1,11 @@
 package tools
 
 import (
+	"crypto"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -28,27 +28,49 @@ type Context struct {
 	WithDS         map[string]struct{} // Map with zones with a DS RR
 	DNSKEYS        struct {
 		ZSK, KSK map[uint16]*dns.DNSKEY // DNSKEYS
+		Revoked  map[uint16]*dns.DNSKEY // DNSKEYS with the REVOKE flag (RFC 5011)
 	}
+	SKR          *SignedKeyResponse // Pre-signed DNSKEY RRsets. If it is set, the zone is signed without a KSK
+	foreignKeys  RRArray            // DNSKEYs of other signers, in multi-signer mode
+	RevokedKSKs  []crypto.Signer    // Old KSKs published with the REVOKE flag, self-signing the DNSKEY RRset (RFC 5011)
+	Rollover     *EmergencyRollover // Emergency rollover of a compromised key. If it is set, the zone is signed with a replacement key
+	denialChains *denialChains      // NSEC and NSEC3 chains of the input zone
 }
 
 // ContextConfig contains the common args to sign and verify files
 type ContextConfig struct {
-	Zone            string    // Zone name
-	CreateKeys      bool      // If True, the sign process creates new keys for the signature.
-	NSEC3           bool      // If true, the zone is signed using NSEC3
-	OptOut          bool      // If true and NSEC3 is true, the zone is signed using OptOut NSEC3 flag.
-	DigestEnabled   bool      // If true, the zone is hashed and DigestEnabled is used
-	SignAlgorithm   string    // Signature algorithm
-	FilePath        string    // Output Path
-	OutputPath      string    // Output Path
-	RRSIGExpDate    time.Time // RRSIG Expiration Date
-	Info            bool      // If true, a credits txt will be added to _dnstools subdomain.
-	Lazy            bool      // If true, the zone will not be signed if it is not needed.
-	VerifyThreshold time.Time // Verification Threshold
-	HashAlg         uint8     // 1:sha384 (default), 2:sha512
-	NSEC3Iterations uint16
-	NSEC3SaltLength uint8
-	NSEC3SaltValue  string
+	Zone             string    // Zone name
+	CreateKeys       bool      // If True, the sign process creates new keys for the signature.
+	NSEC3            bool      // If true, the zone is signed using NSEC3
+	OptOut           bool      // If true and NSEC3 is true, the zone is signed using OptOut NSEC3 flag.
+	DigestEnabled    bool      // If true, the zone is hashed and DigestEnabled is used
+	SignAlgorithm    string    // Signature algorithm
+	FilePath         string    // Output Path
+	OutputPath       string    // Output Path
+	RRSIGExpDate     time.Time // RRSIG Expiration Date
+	Info             bool      // If true, a credits txt will be added to _dnstools subdomain.
+	Lazy             bool      // If true, the zone will not be signed if it is not needed.
+	VerifyThreshold  time.Time // Verification Threshold
+	HashAlg          uint8     // 1:sha384 (default), 2:sha512
+	NSEC3Iterations  uint16
+	NSEC3SaltLength  uint8
+	NSEC3SaltValue   string
+	NSEC3RotateSalt  bool     // If true, a new NSEC3 salt is created instead of keeping the salt of the input zone
+	DNSKEYTTL        uint32   // TTL of the DNSKEY RRset. If it is zero, the SOA MINIMUM field is used
+	CDSTTL           uint32   // TTL of the CDS and CDNSKEY RRsets. If it is zero, their TTL in the zone is kept
+	NSEC3PARAMTTL    uint32   // TTL of the NSEC3PARAM RR. If it is zero, the TTL of the NSEC and NSEC3 RRs is used
+	MaxZoneTTL       uint32   // Maximum TTL of the zone. If it is zero, TTLs are not limited
+	ClampTTLs        bool     // If true, TTLs larger than MaxZoneTTL are lowered to it. If not, they are an error
+	DenialTransition bool     // If true, the NSEC/NSEC3 chain of the input zone is kept and the new chain is not published yet (RFC5155 sections 10.4 and 12.1.3)
+	SkipDenialChecks bool     // If true, VerifyFile does not check the NSEC and NSEC3 chains
+	WildcardAnswers  []Query  // Queries that VerifyFile checks to be provably answered by a wildcard
+	TrustAnchorDS    []string // DS RRs in presentation format. VerifyFile checks that a key matching one of them signs the DNSKEY RRset
+	TrustAnchorFile  string   // File with DS and DNSKEY RRs, or with a trust anchor in RFC 7958 XML format, anchoring the DNSKEY RRset
+	ParentZoneFile   string   // Signed parent zone file. Its DS RRset of the zone is validated and anchors the DNSKEY RRset
+	ParentDS         []string // DS RRs of the parent zone in presentation format. A key matching one of them must sign the DNSKEY RRset of ParentZoneFile
+	MultiSigner      bool     // If true, DNSKEYs of other signers are kept in the DNSKEY RRset (RFC 8901), and VerifyFile allows their algorithms
+	ForeignKeyFiles  []string // Files with DNSKEY, CDS and CDNSKEY RRs of other signers, used in multi-signer mode
+	OwnKeyFiles      []string // Files with DNSKEYs of previous signatures of this signer, removed from the input zone in multi-signer mode
 }
 
 // NewContext creates a new context based on a configuration structure. It also receives
@@ -123,6 +145,10 @@ func (ctx *Context) ReadAndParseZone(updateSerial bool) error {
 		ctx.DNSKEYS.ZSK = make(map[uint16]*dns.DNSKEY)
 	}
 
+	if ctx.DNSKEYS.Revoked == nil {
+		ctx.DNSKEYS.Revoked = make(map[uint16]*dns.DNSKEY)
+	}
+
 	rrs := make(RRArray, 0)
 
 	if len(ctx.Config.Zone) > 0 && !strings.HasSuffix(ctx.Config.Zone, ".") {
@@ -175,13 +201,7 @@ func (ctx *Context) ReadAndParseZone(updateSerial bool) error {
 				delegatedZones[rr.Header().Name] = struct{}{}
 			}
 		case dns.TypeDNSKEY:
-			key := rr.(*dns.DNSKEY)
-			switch key.Flags {
-			case 256:
-				ctx.DNSKEYS.ZSK[key.KeyTag()] = key
-			case 257:
-				ctx.DNSKEYS.KSK[key.KeyTag()] = key
-			}
+			ctx.registerDNSKEY(rr.(*dns.DNSKEY))
 		case dns.TypeDS:
 			ctx.WithDS[rr.Header().Name] = struct{}{}
 		case dns.TypeMD:
@@ -258,50 +278,108 @@ func (ctx *Context) ReadAndParseZone(updateSerial bool) error {
 }
 
 // AddNSEC13 adds NSEC 1 and 3 rrs to the RR list.
-func (ctx *Context) AddNSEC13() {
+// If DenialTransition is set, the chain of the input zone is kept and the new one is not published.
+func (ctx *Context) AddNSEC13() error {
+	data := append(make(RRArray, 0, len(ctx.rrs)), ctx.rrs...)
 	if ctx.Config.NSEC3 {
-		errors := 0
-		for {
-			if err := ctx.addNSEC3Records(); err != nil {
-				ctx.Log.Printf("%s", err)
-				errors++
-				if errors == 3 {
-					panic("cannot add NSEC3 Records. Chech your --nsec3-* params and try again.")
-				}
-			} else {
+		if err := ctx.checkNSEC3Algorithms(); err != nil {
+			return err
+		}
+		var err error
+		for tries := 0; tries < 3; tries++ {
+			// A hash collision could be caused by the salt, so the next tries use a new one
+			if err = ctx.addNSEC3Records(tries > 0); err == nil {
 				break
 			}
+			ctx.Log.Printf("%s", err)
 		}
+		if err != nil {
+			return fmt.Errorf("cannot add NSEC3 RRs, check your --nsec3-* params and try again: %s", err)
+		}
+		ctx.checkNSEC3Params(ctx.newNSEC3Param())
 	} else {
 		ctx.addNSECRecords()
 	}
+	if ctx.Config.DenialTransition {
+		return ctx.startDenialTransition(data)
+	}
+	ctx.checkDenialChange()
+	return nil
 }
 
 // NewPKCS11Session creates a new session.
 // The arguments also define the HSM user key and the pkcs11 label the keys will use when created or retrieved.
+// It uses the first slot with a token present in the library.
 func (ctx *Context) NewPKCS11Session(key, label, p11lib string) (SignSession, error) {
-	p := pkcs11.New(p11lib)
-	if p == nil {
-		return nil, fmt.Errorf("error initializing %s: file not found", p11lib)
+	if err := ctx.checkSignAlgorithm("PKCS#11", RsaSha256, EcdsaP256Sha256); err != nil {
+		return nil, err
 	}
-	err := p.Initialize()
+	session, err := ctx.newPKCS11Session(key, label, PKCS11Target{Lib: p11lib})
 	if err != nil {
-		return nil, fmt.Errorf("error initializing %s: %s. (Has the .db RW permission?)", p11lib, err)
+		return nil, err
+	}
+	return session, nil
+}
+
+// NewPKCS11FailoverSession creates a new session over an ordered list of PKCS#11 targets holding the same keys.
+// Targets which cannot be initialized or logged in are skipped, and signatures are requested to the
+// next target if the current one fails. It returns an error only if no target could be opened.
+func (ctx *Context) NewPKCS11FailoverSession(key, label string, targets []PKCS11Target) (SignSession, error) {
+	if err := ctx.checkSignAlgorithm("PKCS#11", RsaSha256, EcdsaP256Sha256); err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no PKCS#11 targets defined")
+	}
+	failover := &PKCS11FailoverSession{
+		ctx:      ctx,
+		Sessions: make([]*PKCS11Session, 0),
+	}
+	errs := make([]string, 0)
+	for _, target := range targets {
+		session, err := ctx.newPKCS11Session(key, label, target)
+		if err != nil {
+			ctx.Log.Printf("skipping PKCS#11 target %s: %s", target, err)
+			errs = append(errs, fmt.Sprintf("%s: %s", target, err))
+			continue
+		}
+		failover.Sessions = append(failover.Sessions, session)
+	}
+	if len(failover.Sessions) == 0 {
+		return nil, fmt.Errorf("cannot open any PKCS#11 target (%s)", strings.Join(errs, "; "))
+	}
+	return failover, nil
+}
+
+// newPKCS11Session opens and logs in a session in the token located at the target library and slot.
+func (ctx *Context) newPKCS11Session(key, label string, target PKCS11Target) (*PKCS11Session, error) {
+	p, err := loadPKCS11Module(target.Lib)
+	if err != nil {
+		return nil, err
 	}
 	slots, err := p.GetSlotList(true)
 	if err != nil {
+		releasePKCS11Module(target.Lib)
 		return nil, fmt.Errorf("error checking slots: %s", err)
 	}
-	session, err := p.OpenSession(slots[0], pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if target.Slot < 0 || target.Slot >= len(slots) {
+		releasePKCS11Module(target.Lib)
+		return nil, fmt.Errorf("slot %d not found (%d slots with tokens present)", target.Slot, len(slots))
+	}
+	session, err := p.OpenSession(slots[target.Slot], pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
 	if err != nil {
+		releasePKCS11Module(target.Lib)
 		return nil, fmt.Errorf("error creating session: %s", err)
 	}
 	err = p.Login(session, pkcs11.CKU_USER, key)
 	if err != nil {
+		p.CloseSession(session)
+		releasePKCS11Module(target.Lib)
 		return nil, fmt.Errorf("error login with provided key: %s", err)
 	}
 	return &PKCS11Session{
-		libPath:    p11lib,
+		libPath:    target.Lib,
+		slot:       slots[target.Slot],
 		ctx:        ctx,
 		P11Context: p,
 		Handle:     session,
@@ -313,6 +391,9 @@ func (ctx *Context) NewPKCS11Session(key, label, p11lib string) (SignSession, er
 // NewFileSession creates a new File session.
 // The arguments define the readers for the zone signing and key signing keys.
 func (ctx *Context) NewFileSession(zsk, ksk io.ReadWriteSeeker) (SignSession, error) {
+	if err := ctx.checkSignAlgorithm("file", RsaSha256, EcdsaP256Sha256); err != nil {
+		return nil, err
+	}
 	return &FileSession{
 		ctx:     ctx,
 		kskFile: ksk,
@@ -320,6 +401,38 @@ func (ctx *Context) NewFileSession(zsk, ksk io.ReadWriteSeeker) (SignSession, er
 	}, nil
 }
 
+// NewEncryptedFileSession creates a new File session with encrypted keys, decrypted with the
+// passphrase returned by passphrase. Keys created by the session are also encrypted with it.
+func (ctx *Context) NewEncryptedFileSession(zsk, ksk io.ReadWriteSeeker, passphrase PassphraseFunc) (SignSession, error) {
+	if err := ctx.checkSignAlgorithm("file", RsaSha256, EcdsaP256Sha256); err != nil {
+		return nil, err
+	}
+	return &FileSession{
+		ctx:        ctx,
+		kskFile:    ksk,
+		zskFile:    zsk,
+		passphrase: passphrase,
+	}, nil
+}
+
+// NewFileSessionWithKSKShares creates a new File session that reads the ZSK from a file and rebuilds
+// the KSK in memory from key shares, decrypted with their passphrases (one for each share, or a single
+// one for all of them). The KSK and the passphrases are zeroed when the session ends.
+func (ctx *Context) NewFileSessionWithKSKShares(zsk io.ReadWriteSeeker, kskShares []*KeyShare, passphrases [][]byte) (SignSession, error) {
+	if err := ctx.checkSignAlgorithm("file", RsaSha256, EcdsaP256Sha256); err != nil {
+		return nil, err
+	}
+	if len(kskShares) == 0 {
+		return nil, fmt.Errorf("no KSK shares received")
+	}
+	return &FileSession{
+		ctx:            ctx,
+		zskFile:        zsk,
+		kskShares:      kskShares,
+		kskPassphrases: passphrases,
+	}, nil
+}
+
 // Close closes the output file if it is defined.
 func (ctx *Context) Close() error {
 	if ctx.Output != nil {
@@ -334,14 +447,15 @@ func (ctx *Context) Close() error {
 // Returns a signing/digesting info string with the library name and signing mode
 func (ctx *Context) genInfo(session SignSession) string {
 	now := time.Now().Unix()
-	switch s := session.(type) {
-	case *PKCS11Session:
-		return fmt.Sprintf("signer=dns-tools;timestamp=%d;mode=pkcs11;libname=%s;", now, path.Base(s.libPath))
-	case *FileSession:
-		return fmt.Sprintf("signer=dns-tools;timestamp=%d;mode=file;", now)
-	}
-	// I assume that no session implies digest mode
-	return fmt.Sprintf("signer=dns-tools;timestamp=%d;mode=digest", now)
+	if session == nil {
+		// I assume that no session implies digest mode
+		return fmt.Sprintf("signer=dns-tools;timestamp=%d;mode=digest", now)
+	}
+	info := "mode=unknown;"
+	if describer, ok := session.(SessionInfo); ok {
+		info = describer.Info()
+	}
+	return fmt.Sprintf("signer=dns-tools;timestamp=%d;%s", now, info)
 }
 
 // isDelegated returns true if the rr requires to be signed.
@@ -350,7 +464,7 @@ func (ctx *Context) genInfo(session SignSession) string {
 func (ctx *Context) isDelegated(ownerName string) bool {
 	splitDomain := dns.SplitDomainName(dns.Fqdn(ownerName))
 	for i := 0; i < len(splitDomain); i++ {
-		domain := strings.Join(splitDomain[i:], ".")
+		domain := dns.Fqdn(strings.Join(splitDomain[i:], "."))
 		if _, ok := ctx.DelegatedZones[domain]; ok {
 			return true
 		}
@@ -358,6 +472,42 @@ func (ctx *Context) isDelegated(ownerName string) bool {
 	return false
 }
 
+// isBelowZoneCut returns true if the owner name is below a delegation, so the zone is not authoritative
+// for its RRs (they can only be glue).
+func (ctx *Context) isBelowZoneCut(ownerName string) bool {
+	for _, ancestor := range ctx.ancestors(ownerName) {
+		if _, ok := ctx.DelegatedZones[ancestor]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isInsecureDelegation returns true if the owner name is a delegation without a DS RR.
+func (ctx *Context) isInsecureDelegation(ownerName string) bool {
+	_, isCut := ctx.DelegatedZones[ownerName]
+	_, hasDS := ctx.WithDS[ownerName]
+	return isCut && !hasDS
+}
+
+// ancestors returns the names between the owner name provided and the zone apex, both excluded.
+func (ctx *Context) ancestors(ownerName string) []string {
+	names := make([]string, 0)
+	name := ownerName
+	for {
+		next, end := dns.NextLabel(name, 0)
+		if end {
+			break
+		}
+		name = name[next:]
+		if name == ctx.Config.Zone || !dns.IsSubDomain(ctx.Config.Zone, name) {
+			break
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
 // CreateNewDNSKEY creates a new DNSKEY RR, using the parameters provided.
 func (ctx *Context) CreateNewDNSKEY(flags uint16, publicKey string) *dns.DNSKEY {
 	dnskey := &dns.DNSKEY{
@@ -368,18 +518,27 @@ func (ctx *Context) CreateNewDNSKEY(flags uint16, publicKey string) *dns.DNSKEY
 			Name:   ctx.Config.Zone,
 			Rrtype: dns.TypeDNSKEY,
 			Class:  dns.ClassINET,
-			Ttl:    ctx.soa.Minttl,
+			Ttl:    ctx.dnskeyTTL(),
 		},
 		PublicKey: publicKey,
 	}
-	if flags == 256 {
-		ctx.DNSKEYS.ZSK[dnskey.KeyTag()] = dnskey
-	} else if flags == 257 {
-		ctx.DNSKEYS.KSK[dnskey.KeyTag()] = dnskey
-	}
+	ctx.registerDNSKEY(dnskey)
 	return dnskey
 }
 
+// registerDNSKEY adds a DNSKEY to the ZSK, KSK or revoked keys of the context, depending on its flags.
+// Keys with the REVOKE flag are only registered as revoked, so they are not used to validate the zone.
+func (ctx *Context) registerDNSKEY(key *dns.DNSKEY) {
+	switch {
+	case key.Flags&dns.REVOKE != 0:
+		ctx.DNSKEYS.Revoked[key.KeyTag()] = key
+	case key.Flags == 256:
+		ctx.DNSKEYS.ZSK[key.KeyTag()] = key
+	case key.Flags == 257:
+		ctx.DNSKEYS.KSK[key.KeyTag()] = key
+	}
+}
+
 // PrintDS prints to log device DS value of zone:
 func (ctx *Context) PrintDS() {
 	for _, key := range ctx.DNSKEYS.KSK {
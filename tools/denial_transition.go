@@ -0,0 +1,229 @@
+package tools
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// denialChains has the denial of existence chains of the input zone. The published chain is the NSEC3 chain
+// of the NSEC3PARAM RR of the apex, or the NSEC chain if there is no NSEC3PARAM RR. A pending chain is a chain
+// added by a previous denial transition, which is not published yet.
+type denialChains struct {
+	published   RRArray         // NSEC or NSEC3 RRs of the published chain
+	param       *dns.NSEC3PARAM // Parameters of the published chain, if it is a NSEC3 chain
+	optOut      bool            // True if the published chain is a NSEC3 chain with opt-out
+	pending     *dns.NSEC3PARAM // Parameters of the pending chain, if it is a NSEC3 chain
+	pendingNSEC bool            // True if the pending chain is a NSEC chain
+	maxTTL      uint32          // Longest TTL of the published chain RRs
+}
+
+// readDenialChains reads the denial of existence chains of the input zone. It must be called before removing
+// the NSEC and NSEC3 RRs of the input zone.
+func (ctx *Context) readDenialChains() {
+	chains := &denialChains{}
+	nsecs := make(RRArray, 0)
+	nsec3s := make([]*dns.NSEC3, 0)
+	for _, rr := range ctx.rrs {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, rr)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, rr)
+		case *dns.NSEC3PARAM:
+			if rr.Hdr.Name == ctx.Config.Zone {
+				chains.param = rr
+			}
+		}
+	}
+	if chains.param == nil {
+		chains.published = nsecs
+	} else {
+		chains.pendingNSEC = len(nsecs) > 0
+	}
+	for _, nsec3 := range nsec3s {
+		param := nsec3Params(nsec3)
+		switch {
+		case chains.param != nil && sameNSEC3Params(param, chains.param):
+			chains.published = append(chains.published, nsec3)
+			chains.optOut = chains.optOut || nsec3.Flags&1 != 0
+		case chains.pending == nil:
+			chains.pending = param
+		}
+	}
+	for _, rr := range chains.published {
+		if rr.Header().Ttl > chains.maxTTL {
+			chains.maxTTL = rr.Header().Ttl
+		}
+	}
+	ctx.denialChains = chains
+}
+
+// nsec3Params returns the parameters of the NSEC3 chain of a NSEC3 RR.
+func nsec3Params(nsec3 *dns.NSEC3) *dns.NSEC3PARAM {
+	return &dns.NSEC3PARAM{
+		Hash:       nsec3.Hash,
+		Iterations: nsec3.Iterations,
+		SaltLength: nsec3.SaltLength,
+		Salt:       nsec3.Salt,
+	}
+}
+
+// sameNSEC3Params returns true if both NSEC3 parameters define the same chain.
+func sameNSEC3Params(a, b *dns.NSEC3PARAM) bool {
+	return a.Hash == b.Hash && a.Iterations == b.Iterations && strings.EqualFold(a.Salt, b.Salt)
+}
+
+// nsec3Salt returns the salt of the new NSEC3 chain. It is the configured salt value if it is set. If not, the
+// salt of the pending chain is used to complete a denial transition, and the salt of the published chain is
+// kept, so the chain does not change on every signature. A new random salt is created if newSalt is true,
+// if the salt rotation is requested or if there is no chain with the configured iterations.
+func (ctx *Context) nsec3Salt(newSalt bool) (string, error) {
+	if ctx.Config.NSEC3SaltValue != "" {
+		return ctx.Config.NSEC3SaltValue, nil
+	}
+	if chains := ctx.denialChains; !newSalt && chains != nil {
+		for _, param := range []*dns.NSEC3PARAM{chains.pending, chains.param} {
+			if param != nil && param.Hash == dns.SHA1 && param.Iterations == ctx.Config.NSEC3Iterations &&
+				(param == chains.pending || !ctx.Config.NSEC3RotateSalt) {
+				return param.Salt, nil
+			}
+		}
+	}
+	return generateSalt(ctx.Config.NSEC3SaltLength)
+}
+
+// checkNSEC3Algorithms returns an error if a key of the DNSKEY RRset uses an algorithm that cannot sign
+// NSEC3 zones. DSA and RSASHA1 zones must use their NSEC3 aliases (RFC5155 section 2).
+func (ctx *Context) checkNSEC3Algorithms() error {
+	aliases := map[uint8]uint8{
+		dns.DSA:     dns.DSANSEC3SHA1,
+		dns.RSASHA1: dns.RSASHA1NSEC3SHA1,
+	}
+	keys := append(RRArray{}, ctx.foreignKeys...)
+	for _, key := range ctx.rolloverKeys() {
+		keys = append(keys, key)
+	}
+	for _, rr := range keys {
+		key := rr.(*dns.DNSKEY)
+		if alias, ok := aliases[key.Algorithm]; ok {
+			return fmt.Errorf("DNSKEY %d uses algorithm %s, which cannot be used with NSEC3: use its alias %s",
+				key.KeyTag(), dns.AlgorithmToString[key.Algorithm], dns.AlgorithmToString[alias])
+		}
+	}
+	return nil
+}
+
+// newNSEC3Param returns the NSEC3PARAM RR of the new NSEC3 chain, or nil if the zone is signed with NSEC.
+func (ctx *Context) newNSEC3Param() *dns.NSEC3PARAM {
+	for _, rr := range ctx.rrs {
+		if param, ok := rr.(*dns.NSEC3PARAM); ok {
+			return param
+		}
+	}
+	return nil
+}
+
+// isPublishedChain returns true if the new chain is the published chain of the input zone.
+func (ctx *Context) isPublishedChain(param *dns.NSEC3PARAM) bool {
+	chains := ctx.denialChains
+	if param == nil || chains.param == nil {
+		return param == nil && chains.param == nil
+	}
+	return sameNSEC3Params(param, chains.param)
+}
+
+// startDenialTransition keeps the published chain of the input zone, rebuilt from the RRs of the zone without
+// denial of existence RRs provided, and removes the NSEC3PARAM RR of the new chain, so both chains are in the
+// zone but only the old one is used (RFC5155 sections 10.4 and 12.1.3).
+// Signing the zone again without denial transition publishes the new chain and removes the old one.
+func (ctx *Context) startDenialTransition(data RRArray) error {
+	chains := ctx.denialChains
+	if chains == nil || len(chains.published) == 0 {
+		return fmt.Errorf("the input zone has no NSEC or NSEC3 chain to transition from")
+	}
+	if chains.pending != nil || chains.pendingNSEC {
+		return fmt.Errorf("the input zone is already in a denial transition: sign it without denial transition to complete it")
+	}
+	param := ctx.newNSEC3Param()
+	if ctx.isPublishedChain(param) {
+		return fmt.Errorf("the new denial of existence chain is the published one: change the NSEC3 parameters or rotate the salt")
+	}
+	published, err := ctx.publishedChain(data)
+	if err != nil {
+		return err
+	}
+	rrs := make(RRArray, 0, len(ctx.rrs)+len(published))
+	for _, rr := range ctx.rrs {
+		if rr.Header().Rrtype != dns.TypeNSEC3PARAM {
+			rrs = append(rrs, rr)
+		}
+	}
+	ctx.rrs = append(rrs, published...)
+	wait := chains.maxTTL
+	if ctx.soa.Minttl > wait {
+		wait = ctx.soa.Minttl
+	}
+	ctx.Log.Printf("Denial transition: the new %s chain is added without publishing it, and the current %s chain is kept",
+		chainName(param), chainName(chains.param))
+	ctx.Log.Printf("Denial transition: publish this zone on every server, and sign it again without denial transition after %s",
+		time.Now().Add(time.Duration(wait)*time.Second).UTC().Format(time.RFC3339))
+	return nil
+}
+
+// publishedChain returns the published chain of the input zone built again with its parameters from the RRs
+// provided, so it covers the changes of the zone since it was signed, and its NSEC3PARAM RR if it is a NSEC3
+// chain.
+func (ctx *Context) publishedChain(data RRArray) (RRArray, error) {
+	chains := ctx.denialChains
+	rrs := ctx.rrs
+	defer func() { ctx.rrs = rrs }()
+	ctx.rrs = append(make(RRArray, 0, len(data)), data...)
+	if chains.param == nil {
+		ctx.addNSECRecords()
+	} else {
+		param := &dns.NSEC3PARAM{
+			Hash:       chains.param.Hash,
+			Iterations: chains.param.Iterations,
+			SaltLength: chains.param.SaltLength,
+			Salt:       chains.param.Salt,
+		}
+		if err := ctx.addNSEC3Chain(param, chains.optOut); err != nil {
+			return nil, fmt.Errorf("cannot build the %s chain of the input zone again: %s", chainName(chains.param), err)
+		}
+	}
+	return ctx.rrs[len(data):], nil
+}
+
+// checkDenialChange logs the change of the denial of existence chain when the zone is signed without
+// denial transition.
+func (ctx *Context) checkDenialChange() {
+	chains := ctx.denialChains
+	if chains == nil || len(chains.published) == 0 {
+		return
+	}
+	param := ctx.newNSEC3Param()
+	switch {
+	case ctx.isPublishedChain(param):
+	case param == nil && chains.pendingNSEC, param != nil && chains.pending != nil && sameNSEC3Params(param, chains.pending):
+		ctx.Log.Printf("Denial transition completed: the new %s chain is published and the %s chain is removed",
+			chainName(param), chainName(chains.param))
+	default:
+		ctx.Log.Printf("[Warn ] The %s chain of the input zone is replaced by a %s chain without denial transition",
+			chainName(chains.param), chainName(param))
+	}
+}
+
+// chainName returns the name of the chain with the NSEC3 parameters provided, or NSEC if they are nil.
+func chainName(param *dns.NSEC3PARAM) string {
+	if param == nil {
+		return "NSEC"
+	}
+	salt := param.Salt
+	if salt == "" {
+		salt = "-"
+	}
+	return fmt.Sprintf("NSEC3 (%d iterations, salt %s)", param.Iterations, salt)
+}
@@ -0,0 +1,173 @@
+package tools_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/niclabs/dns-tools/tools"
+)
+
+// nsec3Context returns a context signing with NSEC3 and random salts of 8 bytes.
+func nsec3Context(transition, rotateSalt bool) *tools.Context {
+	ctx := testContext(tools.RsaSha256, true, false)
+	ctx.Config.NSEC3SaltLength = 8
+	ctx.Config.DenialTransition = transition
+	ctx.Config.NSEC3RotateSalt = rotateSalt
+	return ctx
+}
+
+// nsec3Salts returns the salts of the NSEC3PARAM RRs and of the NSEC3 chains of a signed zone.
+func nsec3Salts(t *testing.T, signed string) (params []string, chains map[string]bool) {
+	chains = make(map[string]bool)
+	parser := dns.NewZoneParser(strings.NewReader(signed), zone, "")
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		switch rr := rr.(type) {
+		case *dns.NSEC3PARAM:
+			params = append(params, rr.Salt)
+		case *dns.NSEC3:
+			chains[rr.Salt] = true
+		}
+	}
+	if err := parser.Err(); err != nil {
+		t.Fatalf("%s", err)
+	}
+	return params, chains
+}
+
+func TestSession_TransitionNSECToNSEC3(t *testing.T) {
+	signed, err := signZone(t, testContext(tools.RsaSha256, false, false), entZone)
+	if err != nil {
+		t.Fatalf("signing failed: %s", err)
+	}
+	transitional, err := signZone(t, nsec3Context(true, false), signed)
+	if err != nil {
+		t.Fatalf("transition failed: %s", err)
+	}
+	nsecs, nsec3s := denialRRs(t, transitional)
+	params, chains := nsec3Salts(t, transitional)
+	if len(nsecs) == 0 || len(nsec3s) == 0 || len(chains) != 1 {
+		t.Fatalf("transitional zone should have the NSEC chain and a new NSEC3 chain:\n%s", transitional)
+	}
+	if len(params) != 0 {
+		t.Errorf("NSEC3PARAM published before completing the transition")
+	}
+	if err := verifyZone(transitional); err != nil {
+		t.Errorf("Error verifying transitional zone: %s", err)
+	}
+	if _, err := signZone(t, nsec3Context(true, false), transitional); err == nil {
+		t.Errorf("transition started on a zone already in transition")
+	}
+
+	final, err := signZone(t, nsec3Context(false, false), transitional)
+	if err != nil {
+		t.Fatalf("completing the transition failed: %s", err)
+	}
+	nsecs, _ = denialRRs(t, final)
+	params, finalChains := nsec3Salts(t, final)
+	if len(nsecs) != 0 {
+		t.Errorf("NSEC chain not removed")
+	}
+	if len(params) != 1 || !chains[params[0]] || len(finalChains) != 1 {
+		t.Errorf("the NSEC3 chain of the transition should be published: %v %v", params, finalChains)
+	}
+	if err := verifyZone(final); err != nil {
+		t.Errorf("Error verifying final zone: %s", err)
+	}
+}
+
+func TestSession_NSEC3SaltRotation(t *testing.T) {
+	signed, err := signZone(t, nsec3Context(false, false), entZone)
+	if err != nil {
+		t.Fatalf("signing failed: %s", err)
+	}
+	params, _ := nsec3Salts(t, signed)
+	resigned, err := signZone(t, nsec3Context(false, false), signed)
+	if err != nil {
+		t.Fatalf("signing failed: %s", err)
+	}
+	if newParams, _ := nsec3Salts(t, resigned); newParams[0] != params[0] {
+		t.Errorf("salt changed signing the zone again: %s %s", params[0], newParams[0])
+	}
+
+	transitional, err := signZone(t, nsec3Context(true, true), resigned)
+	if err != nil {
+		t.Fatalf("transition failed: %s", err)
+	}
+	newParams, chains := nsec3Salts(t, transitional)
+	if len(newParams) != 1 || newParams[0] != params[0] || len(chains) != 2 {
+		t.Fatalf("transitional zone should publish only the old salt and have both chains: %v %v", newParams, chains)
+	}
+	if err := verifyZone(transitional); err != nil {
+		t.Errorf("Error verifying transitional zone: %s", err)
+	}
+
+	final, err := signZone(t, nsec3Context(false, false), transitional)
+	if err != nil {
+		t.Fatalf("completing the transition failed: %s", err)
+	}
+	finalParams, finalChains := nsec3Salts(t, final)
+	if len(finalParams) != 1 || finalParams[0] == params[0] || !chains[finalParams[0]] || len(finalChains) != 1 {
+		t.Errorf("the rotated salt should be published alone: %v %v", finalParams, finalChains)
+	}
+	if err := verifyZone(final); err != nil {
+		t.Errorf("Error verifying final zone: %s", err)
+	}
+}
+
+func TestSession_TransitionErrors(t *testing.T) {
+	if _, err := signZone(t, nsec3Context(true, false), fileString); err == nil {
+		t.Errorf("transition started on an unsigned zone")
+	}
+	signed, err := signZone(t, nsec3Context(false, false), fileString)
+	if err != nil {
+		t.Fatalf("signing failed: %s", err)
+	}
+	if _, err := signZone(t, nsec3Context(true, false), signed); err == nil {
+		t.Errorf("transition started without changing the NSEC3 chain")
+	}
+	ctx := nsec3Context(false, false)
+	ctx.Config.MultiSigner = true
+	rsaSHA1Key := strings.Replace(foreignZSK, " 3 13 ", " 3 5 ", 1)
+	if _, err := signZone(t, ctx, fileString+rsaSHA1Key+"\n"); err == nil {
+		t.Errorf("zone signed with NSEC3 and a RSASHA1 DNSKEY")
+	}
+}
+
+func TestSession_TransitionWithZoneChanges(t *testing.T) {
+	oldChains := map[string]*tools.Context{
+		"NSEC":  testContext(tools.RsaSha256, false, false),
+		"NSEC3": nsec3Context(false, false),
+	}
+	for name, ctx := range oldChains {
+		signed, err := signZone(t, ctx, entZone)
+		if err != nil {
+			t.Fatalf("%s: signing failed: %s", name, err)
+		}
+		// x.example.com. is removed and new.example.com. is added before starting the transition.
+		edited := dropRRs(signed, "x.example.com.", "A", "NSEC") + "\nnew.example.com.	86400	IN	A	127.0.0.7\n"
+		transitional, err := signZone(t, nsec3Context(true, true), edited)
+		if err != nil {
+			t.Fatalf("%s: transition failed: %s", name, err)
+		}
+		if name == "NSEC" {
+			nsecs, _ := denialRRs(t, transitional)
+			if _, ok := nsecs["new.example.com."]; !ok {
+				t.Errorf("%s: the kept chain does not have the name added to the zone", name)
+			}
+			if _, ok := nsecs["x.example.com."]; ok {
+				t.Errorf("%s: the kept chain has the name removed from the zone", name)
+			}
+		}
+		if err := verifyZone(transitional); err != nil {
+			t.Errorf("%s: Error verifying transitional zone: %s", name, err)
+		}
+		final, err := signZone(t, nsec3Context(false, false), transitional)
+		if err != nil {
+			t.Fatalf("%s: completing the transition failed: %s", name, err)
+		}
+		if err := verifyZone(final); err != nil {
+			t.Errorf("%s: Error verifying final zone: %s", name, err)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package tools
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// checkDenialChains checks the NSEC chain and the NSEC3 chains of the zone: each chain must be closed and
+// follow the canonical order (or the order of the hashes), each authoritative name must have its denial of
+// existence RR with the types of the name in its bitmap, and each NSEC3 RR must be the hash of a name of the
+// zone with the parameters of its chain. Names can be left out of NSEC3 chains only with opt-out.
+// The NSEC3PARAM type is not compared, because it is not published with the new chain of a denial transition.
+func (ctx *Context) checkDenialChains() error {
+	types := ctx.authoritativeTypes()
+	nsecs := make([]*dns.NSEC, 0)
+	chains := make(map[string][]*dns.NSEC3)
+	params := make([]*dns.NSEC3PARAM, 0)
+	for _, rr := range ctx.rrs {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, rr)
+		case *dns.NSEC3:
+			key := chainName(nsec3Params(rr))
+			chains[key] = append(chains[key], rr)
+		case *dns.NSEC3PARAM:
+			if rr.Hdr.Name == ctx.Config.Zone {
+				params = append(params, rr)
+			}
+		}
+	}
+	if len(nsecs) > 0 {
+		if err := ctx.checkNSECChain(nsecs, types); err != nil {
+			return err
+		}
+	}
+	for _, param := range params {
+		if param.Flags != 0 {
+			return fmt.Errorf("NSEC3PARAM RR flags must be zero, but they are %d", param.Flags)
+		}
+		if _, ok := chains[chainName(param)]; !ok {
+			return fmt.Errorf("there is no NSEC3 chain with the parameters of the NSEC3PARAM RR, %s", chainName(param))
+		}
+	}
+	for name, chain := range chains {
+		if err := ctx.checkNSEC3Chain(chain, types); err != nil {
+			return fmt.Errorf("%s chain: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// authoritativeTypes returns the types of the RRsets of each name the zone is authoritative for, with RRSIG
+// if they are signed. NSEC and NSEC3 RRs and their signatures are not included.
+func (ctx *Context) authoritativeTypes() map[string]map[uint16]bool {
+	types := make(map[string]map[uint16]bool)
+	for _, rr := range ctx.rrs {
+		name, rrtype := rr.Header().Name, rr.Header().Rrtype
+		if sig, ok := rr.(*dns.RRSIG); ok && (sig.TypeCovered == dns.TypeNSEC || sig.TypeCovered == dns.TypeNSEC3) {
+			continue
+		}
+		if rrtype == dns.TypeNSEC || rrtype == dns.TypeNSEC3 || ctx.isBelowZoneCut(name) {
+			continue
+		}
+		if types[name] == nil {
+			types[name] = make(map[uint16]bool)
+		}
+		types[name][rrtype] = true
+	}
+	return types
+}
+
+// checkBitmap returns an error if the type bitmap does not have the types expected, ignoring NSEC3PARAM.
+func checkBitmap(name string, bitmap []uint16, expected map[uint16]bool) error {
+	found := make(map[uint16]bool)
+	for _, t := range bitmap {
+		found[t] = true
+	}
+	for _, typeMap := range []map[uint16]bool{found, expected} {
+		delete(typeMap, dns.TypeNSEC3PARAM)
+	}
+	missing, extra := make([]string, 0), make([]string, 0)
+	for t := range expected {
+		if !found[t] {
+			missing = append(missing, dns.TypeToString[t])
+		}
+	}
+	for t := range found {
+		if !expected[t] {
+			extra = append(extra, dns.TypeToString[t])
+		}
+	}
+	if len(missing) > 0 || len(extra) > 0 {
+		sort.Strings(missing)
+		sort.Strings(extra)
+		return fmt.Errorf("type bitmap of %s does not match its RRsets (missing: %v, extra: %v)", name, missing, extra)
+	}
+	return nil
+}
+
+// checkNSECChain checks that every authoritative name has a NSEC RR with its types, and that the NSEC RRs
+// link them in canonical order from the apex back to it.
+func (ctx *Context) checkNSECChain(nsecs []*dns.NSEC, types map[string]map[uint16]bool) error {
+	byOwner := make(map[string]*dns.NSEC)
+	for _, nsec := range nsecs {
+		owner := strings.ToLower(nsec.Hdr.Name)
+		if _, ok := byOwner[owner]; ok {
+			return fmt.Errorf("%s has more than one NSEC RR", owner)
+		}
+		if ctx.isBelowZoneCut(owner) {
+			return fmt.Errorf("NSEC RR for %s, which is below a zone cut", owner)
+		}
+		byOwner[owner] = nsec
+	}
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return canonicalLess(names[i], names[j]) })
+	for i, name := range names {
+		nsec, ok := byOwner[name]
+		if !ok {
+			return fmt.Errorf("%s has no NSEC RR", name)
+		}
+		next := names[(i+1)%len(names)]
+		if !strings.EqualFold(nsec.NextDomain, next) {
+			return fmt.Errorf("NSEC chain is broken at %s: next name is %s instead of %s", name, nsec.NextDomain, next)
+		}
+		expected := map[uint16]bool{dns.TypeNSEC: true, dns.TypeRRSIG: true}
+		for t := range types[name] {
+			expected[t] = true
+		}
+		if err := checkBitmap(name, nsec.TypeBitMap, expected); err != nil {
+			return err
+		}
+	}
+	if len(byOwner) > len(names) {
+		for owner := range byOwner {
+			if types[owner] == nil {
+				return fmt.Errorf("NSEC RR for %s, which has no RRsets", owner)
+			}
+		}
+	}
+	return nil
+}
+
+// checkNSEC3Chain checks a chain of NSEC3 RRs with the same parameters: every NSEC3 RR must be the hash of
+// a name of the zone, with its types in its bitmap, and the chain must link the hashes in order. Insecure
+// delegations, and empty non-terminals leading only to them, can be left out if an opt-out span covers them.
+func (ctx *Context) checkNSEC3Chain(chain []*dns.NSEC3, types map[string]map[uint16]bool) error {
+	param := nsec3Params(chain[0])
+	// needed has the names that must be in the chain, even with opt-out
+	names, needed := make(map[string]bool), make(map[string]bool)
+	for name := range types {
+		names[name] = true
+		ancestors := ctx.ancestors(name)
+		for _, ancestor := range ancestors {
+			names[ancestor] = true
+		}
+		if ctx.isInsecureDelegation(name) {
+			continue
+		}
+		needed[name] = true
+		for _, ancestor := range ancestors {
+			needed[ancestor] = true
+		}
+	}
+	byHash := make(map[string]*dns.NSEC3)
+	for _, nsec3 := range chain {
+		hash := strings.ToUpper(strings.SplitN(nsec3.Hdr.Name, ".", 2)[0])
+		if _, ok := byHash[hash]; ok {
+			return fmt.Errorf("%s has more than one NSEC3 RR", nsec3.Hdr.Name)
+		}
+		byHash[hash] = nsec3
+	}
+	hashes := make([]string, 0, len(byHash))
+	for hash := range byHash {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	for i, hash := range hashes {
+		next := hashes[(i+1)%len(hashes)]
+		if nextDomain := byHash[hash].NextDomain; !strings.EqualFold(nextDomain, next) {
+			return fmt.Errorf("chain is broken at %s: next hash is %s instead of %s", hash, nextDomain, next)
+		}
+	}
+	matched := make(map[string]bool)
+	for name := range names {
+		hash := strings.ToUpper(dns.HashName(name, param.Hash, param.Iterations, param.Salt))
+		nsec3, ok := byHash[hash]
+		if !ok {
+			if needed[name] {
+				return fmt.Errorf("%s has no NSEC3 RR", name)
+			}
+			if covering := coveringNSEC3(hashes, byHash, hash); covering == nil || covering.Flags&1 == 0 {
+				return fmt.Errorf("%s has no NSEC3 RR, and it is not covered by an opt-out span", name)
+			}
+			continue
+		}
+		matched[hash] = true
+		if types[name] == nil && len(nsec3.TypeBitMap) > 0 {
+			return fmt.Errorf("NSEC3 RR of empty non-terminal %s has types in its bitmap", name)
+		}
+		if err := checkBitmap(name, nsec3.TypeBitMap, types[name]); err != nil {
+			return err
+		}
+	}
+	for _, hash := range hashes {
+		if !matched[hash] {
+			return fmt.Errorf("NSEC3 RR %s is not the hash of any name of the zone", byHash[hash].Hdr.Name)
+		}
+	}
+	return nil
+}
+
+// coveringNSEC3 returns the NSEC3 RR whose span covers the hash, from a chain sorted by hash.
+func coveringNSEC3(hashes []string, byHash map[string]*dns.NSEC3, hash string) *dns.NSEC3 {
+	for _, owner := range hashes {
+		nsec3 := byHash[owner]
+		if covers(owner, strings.ToUpper(nsec3.NextDomain), hash, func(a, b string) bool { return a < b }) {
+			return nsec3
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package tools_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/niclabs/dns-tools/tools"
+)
+
+// dropRRs removes from a signed zone the RRs of the owner name and types provided, and their RRSIGs.
+func dropRRs(signed, owner string, types ...string) string {
+	lines := strings.Split(signed, "\n")
+	kept := make([]string, 0, len(lines))
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		drop := false
+		if len(fields) > 4 && strings.EqualFold(fields[0], owner) {
+			for _, t := range types {
+				drop = drop || fields[3] == t || fields[3] == "RRSIG" && fields[4] == t
+			}
+		}
+		if !drop {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
+
+// verifyDenial verifies a signed zone, checking its NSEC/NSEC3 chains unless skip is true.
+func verifyDenial(signed string, skip bool) error {
+	ctx := testContext(tools.RsaSha256, false, false)
+	ctx.Config.SkipDenialChecks = skip
+	ctx.File = strings.NewReader(signed)
+	return ctx.VerifyFile()
+}
+
+func TestVerify_BrokenNSECChain(t *testing.T) {
+	signed, err := signZone(t, testContext(tools.RsaSha256, false, false), entZone)
+	if err != nil {
+		t.Fatalf("signing failed: %s", err)
+	}
+	broken := map[string]string{
+		"missing NSEC RR":        dropRRs(signed, "www.example.com.", "NSEC"),
+		"removed RRset":          dropRRs(signed, zone, "MX"),
+		"removed RR, signed yet": strings.Replace(signed, "x.example.com.\t86400\tIN\tA\t127.0.0.6\n", "", 1),
+	}
+	for name, zoneText := range broken {
+		if zoneText == signed {
+			t.Fatalf("%s: zone not modified", name)
+		}
+		if err := verifyDenial(zoneText, false); err == nil {
+			t.Errorf("%s: zone verified", name)
+		}
+	}
+	// Removing the MX RRset and its signatures keeps every signature valid.
+	if err := verifyDenial(broken["removed RRset"], true); err != nil {
+		t.Errorf("zone not verified skipping the denial checks: %s", err)
+	}
+}
+
+func TestVerify_BrokenNSEC3Chain(t *testing.T) {
+	signed, err := signZone(t, testContext(tools.RsaSha256, true, false), entZone)
+	if err != nil {
+		t.Fatalf("signing failed: %s", err)
+	}
+	_, nsec3s := denialRRs(t, signed)
+	owner := nsec3Owner("www.example.com.", anyNSEC3(nsec3s))
+	noNSEC3 := dropRRs(signed, owner, "NSEC3")
+	if err := verifyDenial(noNSEC3, false); err == nil || !strings.Contains(err.Error(), "chain") {
+		t.Errorf("zone without the NSEC3 RR of a name verified: %v", err)
+	}
+	if err := verifyDenial(noNSEC3, true); err != nil {
+		t.Errorf("zone not verified skipping the denial checks: %s", err)
+	}
+	if err := verifyDenial(dropRRs(signed, zone, "MX"), false); err == nil {
+		t.Errorf("zone with a NSEC3 type bitmap not matching its RRsets verified")
+	}
+	otherParams := strings.Replace(signed, "\tNSEC3PARAM\t1 0 0 -", "\tNSEC3PARAM\t1 0 5 -", 1)
+	if err := verifyDenial(otherParams, false); err == nil || !strings.Contains(err.Error(), "NSEC3PARAM") {
+		t.Errorf("zone with NSEC3PARAM parameters not matching the chain verified: %v", err)
+	}
+}
@@ -0,0 +1,216 @@
+package tools
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultDSTTL is the TTL assumed for the DS RRset in the parent zone when it is not known.
+const DefaultDSTTL = 86400
+
+// EmergencyRollover has the state of the emergency rollover of a compromised ZSK or KSK. When it is set in the
+// context, Sign keeps the compromised keys found in the input zone in the DNSKEY RRset, but it removes their
+// signatures and signs the zone with the replacement key created by the session.
+type EmergencyRollover struct {
+	Role      KeyRole       // Role of the compromised key (ZSKRole or KSKRole)
+	KeyTags   []uint16      // Key tags of the compromised keys. If it is empty, all the keys of the role in the input zone are replaced
+	DSTTL     uint32        // TTL of the DS RRset in the parent zone. If it is zero, DefaultDSTTL is used
+	OldKeys   []*dns.DNSKEY // Compromised keys found in the input zone
+	NewKey    *dns.DNSKEY   // Replacement key
+	DS        *dns.DS       // DS of the replacement KSK, for the parent zone
+	SignedAt  time.Time     // Time of the signature with the replacement key
+	oldSigTTL uint32        // Longest TTL of the RRSIGs made by the compromised keys
+	keyTTL    uint32        // TTL of the DNSKEY RRset
+}
+
+// rolloverSession is a session creating the keys of its roles in GetKeys, even if CreateKeys is disabled
+// in the context, so the other session of an emergency rollover reuses its keys.
+type rolloverSession struct {
+	SignSession
+}
+
+// GetKeys creates the keys of the session and returns them.
+func (session rolloverSession) GetKeys() (*SigKeys, error) {
+	config := session.Context().Config
+	createKeys := config.CreateKeys
+	config.CreateKeys = true
+	defer func() { config.CreateKeys = createKeys }()
+	return session.SignSession.GetKeys()
+}
+
+// Info returns the information of the wrapped session.
+func (session rolloverSession) Info() string {
+	if describer, ok := session.SignSession.(SessionInfo); ok {
+		return describer.Info()
+	}
+	return "mode=unknown;"
+}
+
+// NewEmergencyRolloverSession returns a session of the backend with the name provided for the emergency
+// rollover of the keys of role: a replacement key of that role is created in the backend, and the current
+// key of the other role is kept.
+func (ctx *Context) NewEmergencyRolloverSession(name string, conf BackendConfig, role KeyRole) (SignSession, error) {
+	if role != ZSKRole && role != KSKRole {
+		return nil, fmt.Errorf("emergency rollover role must be zsk or ksk")
+	}
+	createKeys := ctx.Config.CreateKeys
+	defer func() { ctx.Config.CreateKeys = createKeys }()
+	ctx.Config.CreateKeys = true
+	replacement, err := ctx.NewSession(name, conf, role)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create session for the replacement %s: %s", role, err)
+	}
+	ctx.Config.CreateKeys = false
+	current, err := ctx.NewSession(name, conf, AllRoles&^role)
+	if err != nil {
+		replacement.End()
+		return nil, fmt.Errorf("cannot create session for the current %s: %s", AllRoles&^role, err)
+	}
+	var session SignSession
+	if role == KSKRole {
+		session, err = ctx.NewHybridSession(rolloverSession{replacement}, current)
+	} else {
+		session, err = ctx.NewHybridSession(current, rolloverSession{replacement})
+	}
+	if err != nil {
+		replacement.End()
+		current.End()
+		return nil, err
+	}
+	return session, nil
+}
+
+// isCompromised returns true if the key is one of the compromised keys of the rollover.
+func (rollover *EmergencyRollover) isCompromised(key *dns.DNSKEY) bool {
+	if key.Flags&dns.REVOKE != 0 || rollover.Role == ZSKRole && key.Flags != 256 || rollover.Role == KSKRole && key.Flags != 257 {
+		return false
+	}
+	if len(rollover.KeyTags) == 0 {
+		return true
+	}
+	for _, tag := range rollover.KeyTags {
+		if key.KeyTag() == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareRollover looks for the compromised keys and their signatures in the zone. It must be called before
+// removing the signatures of the input zone.
+func (ctx *Context) prepareRollover() error {
+	rollover := ctx.Rollover
+	if rollover.Role != ZSKRole && rollover.Role != KSKRole {
+		return fmt.Errorf("emergency rollover role must be zsk or ksk")
+	}
+	if ctx.Config.MultiSigner && len(rollover.KeyTags) == 0 {
+		return fmt.Errorf("the key tags of the compromised keys must be set in multi-signer mode")
+	}
+	rollover.OldKeys = nil
+	for _, rr := range ctx.rrs {
+		if key, ok := rr.(*dns.DNSKEY); ok && key.Hdr.Name == ctx.Config.Zone && rollover.isCompromised(key) {
+			rollover.OldKeys = append(rollover.OldKeys, key)
+		}
+	}
+	if len(rollover.OldKeys) == 0 {
+		return fmt.Errorf("the input zone has no %s to replace", rollover.Role)
+	}
+	for _, rr := range ctx.rrs {
+		sig, ok := rr.(*dns.RRSIG)
+		if !ok || sig.Hdr.Ttl <= rollover.oldSigTTL {
+			continue
+		}
+		for _, key := range rollover.OldKeys {
+			if sig.KeyTag == key.KeyTag() && sig.SignerName == ctx.Config.Zone {
+				rollover.oldSigTTL = sig.Hdr.Ttl
+			}
+		}
+	}
+	for _, key := range rollover.OldKeys {
+		ctx.Log.Printf("Emergency rollover: compromised %s %d kept published, its signatures are removed", rollover.Role, key.KeyTag())
+	}
+	return nil
+}
+
+// setRolloverKeys sets the replacement key of the rollover, checking that it is not one of the compromised keys.
+func (ctx *Context) setRolloverKeys(zsk, ksk *dns.DNSKEY) error {
+	rollover := ctx.Rollover
+	rollover.NewKey = zsk
+	if rollover.Role == KSKRole {
+		rollover.NewKey = ksk
+		rollover.DS = ksk.ToDS(dns.SHA256)
+	}
+	for _, key := range rollover.OldKeys {
+		if key.PublicKey == rollover.NewKey.PublicKey {
+			return fmt.Errorf("the backend did not create a new %s: the replacement key is the compromised one", rollover.Role)
+		}
+	}
+	rollover.keyTTL = ksk.Hdr.Ttl
+	rollover.SignedAt = time.Now()
+	ctx.Log.Printf("Emergency rollover: replacement %s %d", rollover.Role, rollover.NewKey.KeyTag())
+	return nil
+}
+
+// rolloverKeys returns the compromised keys to add to the DNSKEY RRset, or nil if there is no rollover.
+func (ctx *Context) rolloverKeys() []*dns.DNSKEY {
+	if ctx.Rollover == nil {
+		return nil
+	}
+	return ctx.Rollover.OldKeys
+}
+
+// WriteReport writes the timeline of the emergency rollover: when the new signatures are valid everywhere,
+// and when each of the records kept in the zone can be removed.
+func (rollover *EmergencyRollover) WriteReport(w io.Writer, zone string) error {
+	if rollover.NewKey == nil {
+		return fmt.Errorf("the zone has not been signed with the replacement key")
+	}
+	at := func(ttl uint32) string {
+		return rollover.SignedAt.Add(time.Duration(ttl) * time.Second).UTC().Format(time.RFC3339)
+	}
+	lines := []string{
+		fmt.Sprintf("Emergency %s rollover of %s", rollover.Role, zone),
+		"",
+	}
+	for _, key := range rollover.OldKeys {
+		lines = append(lines, fmt.Sprintf("Compromised key: %d (%s)", key.KeyTag(), key.String()))
+	}
+	lines = append(lines,
+		fmt.Sprintf("Replacement key: %d (%s)", rollover.NewKey.KeyTag(), rollover.NewKey.String()),
+		"",
+		"Timeline:",
+		fmt.Sprintf("%s  Zone signed with the replacement key. The signatures of the compromised keys were removed. Publish it now on every server.", rollover.SignedAt.UTC().Format(time.RFC3339)),
+	)
+	if rollover.Role == KSKRole {
+		dsTTL := rollover.DSTTL
+		if dsTTL == 0 {
+			dsTTL = DefaultDSTTL
+		}
+		lines = append(lines,
+			fmt.Sprintf("%s  Now: send the new DS to the parent zone and ask for the removal of the old ones:", rollover.SignedAt.UTC().Format(time.RFC3339)),
+			fmt.Sprintf("    %s", rollover.DS.String()),
+			"    Resolvers using the old DS cannot validate the zone until the parent publishes the new DS.",
+			fmt.Sprintf("%s  Resolvers have the DNSKEY RRset with the replacement key (DNSKEY TTL).", at(rollover.keyTTL)),
+			fmt.Sprintf("Parent DS publication + %s  The old DS expired from caches (DS TTL). The compromised KSK can be removed signing the zone again with dns-tools sign, not before %s.",
+				time.Duration(dsTTL)*time.Second, at(rollover.keyTTL)),
+		)
+	} else {
+		removable := rollover.keyTTL
+		if rollover.oldSigTTL > removable {
+			removable = rollover.oldSigTTL
+		}
+		lines = append(lines,
+			fmt.Sprintf("%s  Resolvers have the DNSKEY RRset with the replacement key (DNSKEY TTL), so its signatures validate everywhere.", at(rollover.keyTTL)),
+			fmt.Sprintf("%s  The signatures of the compromised key expired from caches (longest RRSIG TTL). The compromised ZSK can be removed signing the zone again with dns-tools sign.", at(removable)),
+		)
+	}
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
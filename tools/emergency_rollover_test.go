@@ -0,0 +1,118 @@
+package tools_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/niclabs/dns-tools/tools"
+)
+
+// rolloverZone signs the zone provided replacing the key of the role provided, using key files
+// with the test keys. It returns the signed zone, the rollover and the key files.
+func rolloverZone(t *testing.T, role tools.KeyRole, zoneText string) (string, *tools.EmergencyRollover, mapConfig, error) {
+	dir := t.TempDir()
+	conf := mapConfig{}
+	for name, key := range map[string]string{"zsk": RSAZSK, "ksk": RSAKSK} {
+		path := filepath.Join(dir, name+".pem")
+		if err := ioutil.WriteFile(path, []byte(key), 0600); err != nil {
+			t.Fatalf("%s", err)
+		}
+		conf[name+"-keyfile"] = path
+	}
+	ctx := testContext(tools.RsaSha256, false, false)
+	ctx.Rollover = &tools.EmergencyRollover{Role: role}
+	session, err := ctx.NewEmergencyRolloverSession("file", conf, role)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer session.End()
+	out := nopWriteCloser{&bytes.Buffer{}}
+	ctx.File = strings.NewReader(zoneText)
+	ctx.Output = out
+	if _, err := tools.Sign(session); err != nil {
+		return "", nil, conf, err
+	}
+	return out.String(), ctx.Rollover, conf, nil
+}
+
+// keyFileChanged returns true if the key file of the role has not the test key anymore.
+func keyFileChanged(t *testing.T, conf mapConfig, role tools.KeyRole, original string) bool {
+	content, err := ioutil.ReadFile(conf.GetString(role.String() + "-keyfile"))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	return string(content) != original
+}
+
+func TestEmergencyRollover_ZSK(t *testing.T) {
+	signed, err := signZone(t, testContext(tools.RsaSha256, false, false), fileString)
+	if err != nil {
+		t.Fatalf("signing failed: %s", err)
+	}
+	rolled, rollover, conf, err := rolloverZone(t, tools.ZSKRole, signed)
+	if err != nil {
+		t.Fatalf("rollover failed: %s", err)
+	}
+	if !keyFileChanged(t, conf, tools.ZSKRole, RSAZSK) || keyFileChanged(t, conf, tools.KSKRole, RSAKSK) {
+		t.Errorf("only the ZSK should be replaced")
+	}
+	if len(rollover.OldKeys) != 1 || !strings.Contains(rolled, rollover.OldKeys[0].PublicKey) {
+		t.Fatalf("compromised ZSK not kept in the DNSKEY RRset")
+	}
+	if strings.Contains(rolled, fmt.Sprintf(" %d %s", rollover.OldKeys[0].KeyTag(), zone)) {
+		t.Errorf("signatures of the compromised ZSK kept")
+	}
+	if strings.Count(rolled, "\tDNSKEY\t256 ") != 2 {
+		t.Errorf("DNSKEY RRset should have both ZSKs:\n%s", rolled)
+	}
+	if err := verifyZone(rolled); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+	report := &bytes.Buffer{}
+	if err := rollover.WriteReport(report, zone); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if !strings.Contains(report.String(), "The compromised ZSK can be removed") {
+		t.Errorf("report without the removal time of the compromised ZSK:\n%s", report)
+	}
+}
+
+func TestEmergencyRollover_KSK(t *testing.T) {
+	signed, err := signZone(t, testContext(tools.RsaSha256, false, false), fileString)
+	if err != nil {
+		t.Fatalf("signing failed: %s", err)
+	}
+	rolled, rollover, conf, err := rolloverZone(t, tools.KSKRole, signed)
+	if err != nil {
+		t.Fatalf("rollover failed: %s", err)
+	}
+	if keyFileChanged(t, conf, tools.ZSKRole, RSAZSK) || !keyFileChanged(t, conf, tools.KSKRole, RSAKSK) {
+		t.Errorf("only the KSK should be replaced")
+	}
+	if rollover.DS == nil || rollover.DS.KeyTag != rollover.NewKey.KeyTag() {
+		t.Fatalf("DS of the replacement KSK not created")
+	}
+	if strings.Count(rolled, "\tDNSKEY\t257 ") != 2 || strings.Count(rolled, "\tRRSIG\tDNSKEY ") != 1 {
+		t.Errorf("DNSKEY RRset should have both KSKs, signed only by the new one:\n%s", rolled)
+	}
+	if err := verifyZone(rolled); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+	report := &bytes.Buffer{}
+	if err := rollover.WriteReport(report, zone); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if !strings.Contains(report.String(), rollover.DS.String()) {
+		t.Errorf("report without the new DS:\n%s", report)
+	}
+}
+
+func TestEmergencyRollover_UnsignedZone(t *testing.T) {
+	if _, _, _, err := rolloverZone(t, tools.ZSKRole, fileString); err == nil {
+		t.Errorf("rollover of a zone without the compromised key")
+	}
+}
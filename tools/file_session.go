@@ -14,10 +14,17 @@ import (
 
 // FileSession represents a File session. It includes the context and a Label String,
 // used in creation and retrieval of DNS keys.
+// If one of the key files is nil, the session does not provide that key.
+// The KSK can also be rebuilt in memory from key shares, instead of reading it from a file.
 type FileSession struct {
-	ctx     *Context // HSM Tools Context
-	zskFile io.ReadWriteSeeker
-	kskFile io.ReadWriteSeeker
+	ctx            *Context // HSM Tools Context
+	zskFile        io.ReadWriteSeeker
+	kskFile        io.ReadWriteSeeker
+	kskShares      []*KeyShare         // Shares of the KSK, used if kskFile is nil
+	kskPassphrases [][]byte            // Passphrases of the KSK shares
+	rebuiltKeys    []crypto.PrivateKey // Keys rebuilt from shares, zeroed when the session ends
+	passphrase     PassphraseFunc      // Passphrase of encrypted keys. If it is set, created keys are encrypted
+	keyPassphrase  []byte              // Passphrase returned by passphrase, asked only once
 }
 
 // Context returns the session context
@@ -28,32 +35,51 @@ func (session *FileSession) Context() *Context {
 // GetKeys returns the keys (zsk, ksk) related to the session
 func (session *FileSession) GetKeys() (keys *SigKeys, err error) {
 	if session.ctx.Config.CreateKeys {
+		if len(session.kskShares) > 0 {
+			return nil, fmt.Errorf("keys cannot be created when the KSK is rebuilt from shares")
+		}
 		session.ctx.Log.Printf("create-keys flag activated. Creating or overwriting keys")
 		if err = session.generateKeys(); err != nil {
 			return
 		}
 	}
-	zsk, err := readerToPrivateKey(session.zskFile)
-	if err != nil {
-		return
-	}
-	ksk, err := readerToPrivateKey(session.kskFile)
-	if err != nil {
-		return
-	}
-	return &SigKeys{
-		zskSigner: &fileRRSigner{
+	keys = &SigKeys{}
+	if session.zskFile != nil {
+		zsk, err := readerToPrivateKey(session.zskFile, session.passphraseFunc(), "ZSK")
+		if err != nil {
+			return nil, err
+		}
+		keys.zskSigner = &fileRRSigner{
 			Session: session,
 			Key:     zsk,
-		},
-		kskSigner: &fileRRSigner{
+		}
+	}
+	if session.kskFile != nil {
+		ksk, err := readerToPrivateKey(session.kskFile, session.passphraseFunc(), "KSK")
+		if err != nil {
+			return nil, err
+		}
+		keys.kskSigner = &fileRRSigner{
+			Session: session,
+			Key:     ksk,
+		}
+	} else if len(session.kskShares) > 0 {
+		session.ctx.Log.Printf("Rebuilding KSK from %d key shares", len(session.kskShares))
+		ksk, err := privateKeyFromShares(session.kskShares, session.kskPassphrases, session.passphraseFunc())
+		if err != nil {
+			return nil, fmt.Errorf("cannot rebuild KSK: %s", err)
+		}
+		session.rebuiltKeys = append(session.rebuiltKeys, ksk)
+		keys.kskSigner = &fileRRSigner{
 			Session: session,
 			Key:     ksk,
-		},
-	}, nil
+		}
+	}
+	return keys, nil
 }
 
-// GetPublicKeyBytes returns the public key bytes for ZSK and KSK keys
+// GetPublicKeyBytes returns the public key bytes for ZSK and KSK keys.
+// The bytes of a key not provided by the session are nil.
 func (session *FileSession) GetPublicKeyBytes(keys *SigKeys) (zskBytes, kskBytes []byte, err error) {
 	var keyFun func(signer crypto.Signer) ([]byte, error)
 	ctx := session.Context()
@@ -66,11 +92,15 @@ func (session *FileSession) GetPublicKeyBytes(keys *SigKeys) (zskBytes, kskBytes
 		err = fmt.Errorf("undefined sign algorithm")
 		return
 	}
-	kskBytes, err = keyFun(keys.kskSigner)
-	if err != nil {
-		return
+	if keys.kskSigner != nil {
+		kskBytes, err = keyFun(keys.kskSigner)
+		if err != nil {
+			return
+		}
+	}
+	if keys.zskSigner != nil {
+		zskBytes, err = keyFun(keys.zskSigner)
 	}
-	zskBytes, err = keyFun(keys.zskSigner)
 	return
 }
 
@@ -79,63 +109,111 @@ func (session *FileSession) DestroyAllKeys() error {
 	return nil
 }
 
-// End ends the session. In FileSession it does nothing
+// End ends the session, closing the key files if they can be closed and zeroing the keys
+// rebuilt from shares and their passphrases.
 func (session *FileSession) End() error {
+	for _, key := range session.rebuiltKeys {
+		zeroPrivateKey(key)
+	}
+	session.rebuiltKeys = nil
+	for _, passphrase := range session.kskPassphrases {
+		zeroBytes(passphrase)
+	}
+	zeroBytes(session.keyPassphrase)
+	for _, file := range []io.ReadWriteSeeker{session.zskFile, session.kskFile} {
+		if closer, ok := file.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
+// Info returns the signing mode of the session.
+func (session *FileSession) Info() string {
+	return "mode=file;"
+}
+
 // Writes new PKCS#8-formatted keys into the zsk and ksk files.
 func (session *FileSession) generateKeys() (err error) {
 	ctx := session.Context()
-	var zskBytes, kskBytes []byte
+	var kskGen, zskGen func() ([]byte, error)
 	switch ctx.SignAlgorithm {
 	case RsaSha256:
-		kskBytes, err = session.generateRSAKey(2048)
-		if err != nil {
-			return
-		}
-		session.kskFile.Write(kskBytes)
-		session.kskFile.Seek(0, io.SeekStart)
-		zskBytes, err = session.generateRSAKey(1024)
-		if err != nil {
-			return
-		}
-		session.zskFile.Write(zskBytes)
-		session.zskFile.Seek(0, io.SeekStart)
+		kskGen = func() ([]byte, error) { return session.generateRSAKey(2048) }
+		zskGen = func() ([]byte, error) { return session.generateRSAKey(1024) }
 	case EcdsaP256Sha256:
-		kskBytes, err = session.generateECDSAKey()
-		if err != nil {
-			return
-		}
-		session.kskFile.Write(kskBytes)
-		session.kskFile.Seek(0, io.SeekStart)
-		zskBytes, err = session.generateECDSAKey()
-		if err != nil {
-			return
-		}
-		session.zskFile.Write(zskBytes)
-		session.zskFile.Seek(0, io.SeekStart)
+		kskGen = session.generateECDSAKey
+		zskGen = session.generateECDSAKey
 	default:
 		err = fmt.Errorf("undefined sign algorithm")
 		return
 	}
+	for _, k := range []struct {
+		file io.ReadWriteSeeker
+		gen  func() ([]byte, error)
+	}{
+		{session.kskFile, kskGen},
+		{session.zskFile, zskGen},
+	} {
+		if k.file == nil {
+			continue
+		}
+		keyBytes, err := k.gen()
+		if err != nil {
+			return err
+		}
+		k.file.Write(keyBytes)
+		k.file.Seek(0, io.SeekStart)
+	}
 	return
 }
 
+// passphraseFunc returns the function used to get the passphrase of encrypted keys, or nil if the
+// session does not have a passphrase source.
+func (session *FileSession) passphraseFunc() PassphraseFunc {
+	if session.passphrase == nil {
+		return nil
+	}
+	return session.cachedPassphrase
+}
+
+// cachedPassphrase returns a copy of the passphrase of the keys, asking for it only the first time.
+func (session *FileSession) cachedPassphrase(prompt string, confirm bool) ([]byte, error) {
+	if session.keyPassphrase == nil {
+		passphrase, err := session.passphrase(prompt, confirm)
+		if err != nil {
+			return nil, err
+		}
+		session.keyPassphrase = passphrase
+	}
+	return append([]byte{}, session.keyPassphrase...), nil
+}
+
+// restrictRoles makes the session ignore the key files of the roles not provided.
+func (session *FileSession) restrictRoles(roles KeyRole) {
+	if !roles.Has(ZSKRole) {
+		session.zskFile = nil
+	}
+	if !roles.Has(KSKRole) {
+		session.kskFile = nil
+		session.kskShares = nil
+	}
+}
+
 // returns a pkcs#8 formatted RSA key, ready to be written in a file
 func (session *FileSession) generateRSAKey(bits int) ([]byte, error) {
 	sk, err := rsa.GenerateKey(rand.Reader, bits)
 	if err != nil {
 		return nil, err
 	}
+	defer zeroPrivateKey(sk)
 	pkcs8Bytes, err := x509.MarshalPKCS8PrivateKey(sk)
 	if err != nil {
 		return nil, err
 	}
-	return pem.EncodeToMemory(&pem.Block{
-		Type:  "PRIVATE KEY",
-		Bytes: pkcs8Bytes,
-	}), nil
+	return session.encodeKey(pkcs8Bytes)
 }
 
 // returns a pkcs#8 formatted RSA key, ready to be written in a file
@@ -144,12 +222,31 @@ func (session *FileSession) generateECDSAKey() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer zeroPrivateKey(sk)
 	pkcs8Bytes, err := x509.MarshalPKCS8PrivateKey(sk)
 	if err != nil {
 		return nil, err
 	}
-	return pem.EncodeToMemory(&pem.Block{
-		Type:  "PRIVATE KEY",
-		Bytes: pkcs8Bytes,
-	}), nil
+	return session.encodeKey(pkcs8Bytes)
+}
+
+// encodeKey returns the PEM encoding of a PKCS#8 key. If the session has a passphrase, the key
+// is encrypted with it. The DER bytes received are zeroed.
+func (session *FileSession) encodeKey(pkcs8Bytes []byte) ([]byte, error) {
+	defer zeroBytes(pkcs8Bytes)
+	if session.passphrase == nil {
+		return pem.EncodeToMemory(&pem.Block{
+			Type:  "PRIVATE KEY",
+			Bytes: pkcs8Bytes,
+		}), nil
+	}
+	passphrase, err := session.cachedPassphrase("the new keys", true)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroBytes(passphrase)
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("key passphrase cannot be empty")
+	}
+	return encryptPKCS8(pkcs8Bytes, passphrase)
 }
@@ -269,3 +269,36 @@ func TestSession_FileExpiredSig(t *testing.T) {
 		t.Errorf("Error expected, but nil received")
 	}
 }
+
+func TestSession_FileBenchSign(t *testing.T) {
+	ctx := &tools.Context{
+		Config: &tools.ContextConfig{
+			Zone: zone,
+		},
+		SignAlgorithm: tools.EcdsaP256Sha256,
+		Log:           Log,
+	}
+	zsk := &vFile{data: []byte(ECZSK)}
+	ksk := &vFile{data: []byte(ECKSK)}
+	session, err := ctx.NewFileSession(zsk, ksk)
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	defer session.End()
+	result, err := tools.BenchSign(session, 10)
+	if err != nil {
+		t.Errorf("bench failed: %s", err)
+		return
+	}
+	if result.Signatures != 10 || result.PerSecond() <= 0 {
+		t.Errorf("unexpected bench result: %d signatures, %f per second", result.Signatures, result.PerSecond())
+	}
+}
+
+func TestSession_FileUnsupportedAlgorithm(t *testing.T) {
+	ctx := testContext(tools.Ed25519, false, true)
+	if _, err := ctx.NewFileSession(&vFile{}, &vFile{}); err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Errorf("file session created with Ed25519 keys: %v", err)
+	}
+}
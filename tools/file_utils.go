@@ -4,34 +4,51 @@ import (
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/rsa"
-	"crypto/x509"
 	"encoding/binary"
 	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"reflect"
 )
 
-// readerToKeyPair transforms a reader into a RSA or ECDSA KeyPair
-func readerToPrivateKey(r io.Reader) (crypto.PrivateKey, error) {
+// readerToPrivateKey transforms a reader with a PEM key into a RSA or ECDSA private key.
+// Encrypted keys are decrypted with the passphrase returned by passphrase, and prompt describes the key.
+func readerToPrivateKey(r io.Reader, passphrase PassphraseFunc, prompt string) (crypto.PrivateKey, error) {
 	rawBytes, err := ioutil.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
-	pem, rest := pem.Decode(rawBytes)
+	defer zeroBytes(rawBytes)
+	block, rest := pem.Decode(rawBytes)
 	if len(rest) > 0 {
 		return nil, fmt.Errorf("file should only contain one key block")
 	}
-	if pem == nil {
+	if block == nil {
 		return nil, fmt.Errorf("key file is empty. If you want to create new keys, use --create-keys flag")
 	}
-	switch pem.Type {
-	case "PRIVATE KEY":
-		return x509.ParsePKCS8PrivateKey(pem.Bytes)
-	default:
-		return nil, fmt.Errorf("key not supported. It should be a RSA or EC private key only")
+	defer zeroBytes(block.Bytes)
+	return pemToPrivateKey(block, passphrase, prompt)
+}
+
+// ReadPrivateKeyFile reads a PEM private key file. Encrypted keys are decrypted with the passphrase
+// returned by passphrase.
+func ReadPrivateKeyFile(path string, passphrase PassphraseFunc) (crypto.Signer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open key file: %s", err)
+	}
+	defer file.Close()
+	key, err := readerToPrivateKey(file, passphrase, path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read key file %s: %s", path, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("key in %s cannot sign", path)
 	}
+	return signer, nil
 }
 
 func (session *FileSession) getRSAPubKeyBytes(signer crypto.Signer) (bytes []byte, err error) {
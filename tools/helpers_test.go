@@ -0,0 +1,104 @@
+package tools_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/niclabs/dns-tools/tools"
+)
+
+// testContext returns a context for the test zone, signing with the algorithm provided.
+func testContext(algorithm tools.SignAlgorithm, nsec3, createKeys bool) *tools.Context {
+	return &tools.Context{
+		Config: &tools.ContextConfig{
+			Zone:            zone,
+			NSEC3:           nsec3,
+			CreateKeys:      createKeys,
+			VerifyThreshold: time.Now(),
+		},
+		SignAlgorithm: algorithm,
+		Log:           Log,
+	}
+}
+
+// mapConfig is a BackendConfig with the values defined in a map.
+type mapConfig map[string]interface{}
+
+func (conf mapConfig) GetString(key string) string {
+	value, _ := conf[key].(string)
+	return value
+}
+
+func (conf mapConfig) GetStringSlice(key string) []string {
+	value, _ := conf[key].([]string)
+	return value
+}
+
+func (conf mapConfig) GetBool(key string) bool {
+	value, _ := conf[key].(bool)
+	return value
+}
+
+func (conf mapConfig) GetInt(key string) int {
+	value, _ := conf[key].(int)
+	return value
+}
+
+// nopWriteCloser is a buffer used as the output of a signature.
+type nopWriteCloser struct {
+	*bytes.Buffer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// signZone signs the zone provided with the test keys and returns the signed zone.
+func signZone(t *testing.T, ctx *tools.Context, zoneText string) (string, error) {
+	session, err := ctx.NewFileSession(&vFile{data: []byte(RSAZSK)}, &vFile{data: []byte(RSAKSK)})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer session.End()
+	out := nopWriteCloser{&bytes.Buffer{}}
+	ctx.File = strings.NewReader(zoneText)
+	ctx.Output = out
+	if _, err := tools.Sign(session); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// verifyZone verifies a signed zone with a new context.
+func verifyZone(signed string) error {
+	ctx := testContext(tools.RsaSha256, false, false)
+	ctx.File = strings.NewReader(signed)
+	return ctx.VerifyFile()
+}
+
+// signZoneWithKeys signs the zone provided with the keys provided and returns the signed zone.
+func signZoneWithKeys(t *testing.T, ctx *tools.Context, zsk, ksk, zoneText string) string {
+	session, err := ctx.NewFileSession(&vFile{data: []byte(zsk)}, &vFile{data: []byte(ksk)})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer session.End()
+	out := nopWriteCloser{&bytes.Buffer{}}
+	ctx.File = strings.NewReader(zoneText)
+	ctx.Output = out
+	if _, err := tools.Sign(session); err != nil {
+		t.Fatalf("signing failed: %s", err)
+	}
+	return out.String()
+}
+
+// linesOf returns the lines of a zone with the RR type provided.
+func linesOf(zoneText, rrtype string) string {
+	lines := make([]string, 0)
+	for _, line := range strings.Split(zoneText, "\n") {
+		if fields := strings.Fields(line); len(fields) > 3 && fields[3] == rrtype {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
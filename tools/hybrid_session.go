@@ -0,0 +1,129 @@
+package tools
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HybridSession combines two sessions, using the KSK provided by one of them and the ZSK
+// provided by the other one. It allows, for example, to keep the KSK in a PKCS#11 device
+// while the ZSK is stored in a file.
+type HybridSession struct {
+	ctx     *Context
+	KSK     SignSession // Session providing the KSK
+	ZSK     SignSession // Session providing the ZSK
+	kskKeys *SigKeys    // Keys returned by the KSK session
+	zskKeys *SigKeys    // Keys returned by the ZSK session
+}
+
+// NewHybridSession creates a new session using the KSK from the ksk session and the ZSK from the zsk session.
+// Both sessions must be created from this context. If the sessions are able to provide only some of their keys,
+// they are restricted to the role they are used for, so they do not require, create or destroy the other key.
+func (ctx *Context) NewHybridSession(ksk, zsk SignSession) (SignSession, error) {
+	if ksk == nil || zsk == nil {
+		return nil, fmt.Errorf("hybrid session needs a KSK and a ZSK session")
+	}
+	if ksk.Context() != ctx || zsk.Context() != ctx {
+		return nil, fmt.Errorf("hybrid session backends must use the same context")
+	}
+	if restricter, ok := ksk.(roleRestricter); ok {
+		restricter.restrictRoles(KSKRole)
+	}
+	if restricter, ok := zsk.(roleRestricter); ok {
+		restricter.restrictRoles(ZSKRole)
+	}
+	return &HybridSession{
+		ctx: ctx,
+		KSK: ksk,
+		ZSK: zsk,
+	}, nil
+}
+
+// Context returns the session context
+func (session *HybridSession) Context() *Context {
+	return session.ctx
+}
+
+// GetKeys returns the KSK of the KSK session and the ZSK of the ZSK session.
+func (session *HybridSession) GetKeys() (*SigKeys, error) {
+	kskKeys, err := session.KSK.GetKeys()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get KSK: %s", err)
+	}
+	if kskKeys.kskSigner == nil {
+		return nil, fmt.Errorf("KSK session does not provide a KSK")
+	}
+	zskKeys, err := session.ZSK.GetKeys()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get ZSK: %s", err)
+	}
+	if zskKeys.zskSigner == nil {
+		return nil, fmt.Errorf("ZSK session does not provide a ZSK")
+	}
+	session.kskKeys, session.zskKeys = kskKeys, zskKeys
+	return &SigKeys{
+		zskSigner: zskKeys.zskSigner,
+		kskSigner: kskKeys.kskSigner,
+	}, nil
+}
+
+// GetPublicKeyBytes returns the public ZSK bytes from the ZSK session and the public KSK bytes from the KSK session.
+func (session *HybridSession) GetPublicKeyBytes(keys *SigKeys) (zskBytes, kskBytes []byte, err error) {
+	if session.kskKeys == nil || session.zskKeys == nil {
+		err = fmt.Errorf("keys not retrieved from session")
+		return
+	}
+	zskBytes, _, err = session.ZSK.GetPublicKeyBytes(session.zskKeys)
+	if err != nil {
+		return
+	}
+	_, kskBytes, err = session.KSK.GetPublicKeyBytes(session.kskKeys)
+	return
+}
+
+// DestroyAllKeys destroys the keys of both sessions.
+func (session *HybridSession) DestroyAllKeys() error {
+	if err := session.KSK.DestroyAllKeys(); err != nil {
+		return fmt.Errorf("cannot destroy KSK: %s", err)
+	}
+	if err := session.ZSK.DestroyAllKeys(); err != nil {
+		return fmt.Errorf("cannot destroy ZSK: %s", err)
+	}
+	return nil
+}
+
+// Info returns the hybrid signing mode and the information of both sessions,
+// prefixed by the role of their keys.
+func (session *HybridSession) Info() string {
+	info := "mode=hybrid;"
+	for _, role := range []KeyRole{KSKRole, ZSKRole} {
+		s := session.KSK
+		if role == ZSKRole {
+			s = session.ZSK
+		}
+		describer, ok := s.(SessionInfo)
+		if !ok {
+			info += role.String() + "-mode=unknown;"
+			continue
+		}
+		for _, field := range strings.Split(describer.Info(), ";") {
+			if len(field) > 0 {
+				info += role.String() + "-" + field + ";"
+			}
+		}
+	}
+	return info
+}
+
+// End ends both sessions. It returns the first error found, if any.
+func (session *HybridSession) End() error {
+	kskErr := session.KSK.End()
+	zskErr := session.ZSK.End()
+	if kskErr != nil {
+		return fmt.Errorf("cannot end KSK session: %s", kskErr)
+	}
+	if zskErr != nil {
+		return fmt.Errorf("cannot end ZSK session: %s", zskErr)
+	}
+	return nil
+}
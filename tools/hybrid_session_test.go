@@ -0,0 +1,83 @@
+package tools_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/niclabs/dns-tools/tools"
+)
+
+func TestSession_HybridFileSign(t *testing.T) {
+	ctx := &tools.Context{
+		Config: &tools.ContextConfig{
+			Zone:            zone,
+			NSEC3:           false,
+			OptOut:          false,
+			VerifyThreshold: time.Now(),
+		},
+		SignAlgorithm: tools.RsaSha256,
+		Log:           Log,
+	}
+	kskSession, err := ctx.NewFileSession(nil, &vFile{data: []byte(RSAKSK)})
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	zskSession, err := ctx.NewFileSession(&vFile{data: []byte(RSAZSK)}, nil)
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	session, err := ctx.NewHybridSession(kskSession, zskSession)
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	out, err := sign(t, ctx, session)
+	if err != nil {
+		t.Errorf("signing failed: %s", err)
+		return
+	}
+	defer out.Close()
+	if err := ctx.VerifyFile(); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+}
+
+func TestSession_HybridRestrictsRoles(t *testing.T) {
+	ctx := &tools.Context{
+		Config: &tools.ContextConfig{
+			Zone:            zone,
+			NSEC3:           true,
+			VerifyThreshold: time.Now(),
+		},
+		SignAlgorithm: tools.EcdsaP256Sha256,
+		Log:           Log,
+	}
+	// The ZSK of the KSK session and the KSK of the ZSK session are not valid keys,
+	// so signing only works if the hybrid session ignores them.
+	kskSession, err := ctx.NewFileSession(&vFile{}, &vFile{data: []byte(ECKSK)})
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	zskSession, err := ctx.NewFileSession(&vFile{data: []byte(ECZSK)}, &vFile{})
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	session, err := ctx.NewHybridSession(kskSession, zskSession)
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	out, err := sign(t, ctx, session)
+	if err != nil {
+		t.Errorf("signing failed: %s", err)
+		return
+	}
+	defer out.Close()
+	if err := ctx.VerifyFile(); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+}
@@ -0,0 +1,372 @@
+package tools
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"os"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+// PassphraseFunc returns the passphrase of a key file. prompt describes the key, and confirm is true
+// when the passphrase is used to encrypt a new key, so interactive sources can ask for it twice.
+type PassphraseFunc func(prompt string, confirm bool) ([]byte, error)
+
+// FilePassphrase returns a PassphraseFunc that reads the passphrase from a file.
+func FilePassphrase(path string) PassphraseFunc {
+	return func(string, bool) ([]byte, error) {
+		passphrases, err := ReadPassphraseFiles([]string{path})
+		if err != nil {
+			return nil, err
+		}
+		return passphrases[0], nil
+	}
+}
+
+// EnvPassphrase returns a PassphraseFunc that reads the passphrase from an environment variable.
+func EnvPassphrase(name string) PassphraseFunc {
+	return func(string, bool) ([]byte, error) {
+		passphrase, ok := os.LookupEnv(name)
+		if !ok || len(passphrase) == 0 {
+			return nil, fmt.Errorf("environment variable %s is not set", name)
+		}
+		return []byte(passphrase), nil
+	}
+}
+
+// TerminalPassphrase returns a PassphraseFunc that asks for the passphrase in the terminal of the
+// standard input, without echoing it.
+func TerminalPassphrase() PassphraseFunc {
+	return func(prompt string, confirm bool) ([]byte, error) {
+		fd := int(os.Stdin.Fd())
+		if !term.IsTerminal(fd) {
+			return nil, fmt.Errorf("cannot ask for the passphrase of %s: standard input is not a terminal", prompt)
+		}
+		fmt.Fprintf(os.Stderr, "Passphrase for %s: ", prompt)
+		passphrase, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		if confirm {
+			fmt.Fprintf(os.Stderr, "Repeat the passphrase for %s: ", prompt)
+			repeated, err := term.ReadPassword(fd)
+			fmt.Fprintln(os.Stderr)
+			if err != nil {
+				return nil, err
+			}
+			defer zeroBytes(repeated)
+			if string(repeated) != string(passphrase) {
+				zeroBytes(passphrase)
+				return nil, fmt.Errorf("passphrases do not match")
+			}
+		}
+		return passphrase, nil
+	}
+}
+
+// Object identifiers of PKCS#5 v2.0 (RFC 8018), scrypt (RFC 7914) and AES (RFC 3565 and RFC 5084).
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidScrypt         = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11591, 4, 11}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidAES128GCM      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 6}
+	oidAES192GCM      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 26}
+	oidAES256GCM      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 46}
+)
+
+// Parameters of the scrypt key derivation used when encrypting keys.
+const (
+	keyScryptN = 1 << 15
+	keyScryptR = 8
+	keyScryptP = 1
+)
+
+// Limits of the key derivation parameters read from encrypted keys, so a malformed key cannot make the
+// derivation take hours or exhaust the memory. scrypt uses 128*N*r bytes of memory.
+const (
+	maxPBKDF2Iterations = 10000000
+	maxScryptN          = 1 << 20
+	maxScryptR          = 16
+	maxScryptP          = 16
+	maxScryptMemory     = 1 << 30
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                      `asn1:"optional"`
+	PRF        pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+type scryptParams struct {
+	Salt      []byte
+	N         int
+	R         int
+	P         int
+	KeyLength int `asn1:"optional"`
+}
+
+type gcmParams struct {
+	Nonce  []byte
+	ICVLen int `asn1:"default:12"`
+}
+
+// pemToPrivateKey parses a PEM block with a PKCS#8 private key, encrypted or not, a PKCS#1 RSA
+// private key or a SEC1 EC private key. Encrypted keys are decrypted with the passphrase returned
+// by passphrase, which can be nil if the key is not encrypted.
+func pemToPrivateKey(block *pem.Block, passphrase PassphraseFunc, prompt string) (crypto.PrivateKey, error) {
+	if _, ok := block.Headers["DEK-Info"]; ok {
+		return nil, fmt.Errorf("legacy PEM encryption is not supported. Convert the key to an encrypted PKCS#8 key")
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "ENCRYPTED PRIVATE KEY":
+		if passphrase == nil {
+			return nil, fmt.Errorf("%s is encrypted, but no passphrase source was defined", prompt)
+		}
+		secret, err := passphrase(prompt, false)
+		if err != nil {
+			return nil, err
+		}
+		defer zeroBytes(secret)
+		der, err := decryptPKCS8(block.Bytes, secret)
+		if err != nil {
+			return nil, err
+		}
+		defer zeroBytes(der)
+		return x509.ParsePKCS8PrivateKey(der)
+	}
+	return nil, fmt.Errorf("key not supported. It should be a RSA or EC private key only")
+}
+
+// isPrivateKeyPEM returns true if the PEM block has a type of private key parsed by pemToPrivateKey.
+func isPrivateKeyPEM(block *pem.Block) bool {
+	switch block.Type {
+	case "PRIVATE KEY", "RSA PRIVATE KEY", "EC PRIVATE KEY", "ENCRYPTED PRIVATE KEY":
+		return true
+	}
+	return false
+}
+
+// decryptPKCS8 decrypts the DER encoding of a PKCS#5 v2.0 (PBES2) encrypted PKCS#8 key.
+func decryptPKCS8(encrypted, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if rest, err := asn1.Unmarshal(encrypted, &info); err != nil || len(rest) > 0 {
+		return nil, fmt.Errorf("cannot parse encrypted key")
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("key encryption algorithm %s not supported. Only PBES2 is supported", info.Algorithm.Algorithm)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("cannot parse PBES2 parameters: %s", err)
+	}
+	scheme := params.EncryptionScheme
+	var keyLength int
+	var gcm bool
+	switch {
+	case scheme.Algorithm.Equal(oidAES128CBC):
+		keyLength = 16
+	case scheme.Algorithm.Equal(oidAES192CBC):
+		keyLength = 24
+	case scheme.Algorithm.Equal(oidAES256CBC):
+		keyLength = 32
+	case scheme.Algorithm.Equal(oidAES128GCM):
+		keyLength, gcm = 16, true
+	case scheme.Algorithm.Equal(oidAES192GCM):
+		keyLength, gcm = 24, true
+	case scheme.Algorithm.Equal(oidAES256GCM):
+		keyLength, gcm = 32, true
+	default:
+		return nil, fmt.Errorf("key encryption scheme %s not supported", scheme.Algorithm)
+	}
+	key, err := deriveKeyEncryptionKey(params.KeyDerivationFunc, passphrase, keyLength)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroBytes(key)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if gcm {
+		var gcmParameters gcmParams
+		if _, err := asn1.Unmarshal(scheme.Parameters.FullBytes, &gcmParameters); err != nil {
+			return nil, fmt.Errorf("cannot parse AES-GCM parameters: %s", err)
+		}
+		var aead cipher.AEAD
+		switch {
+		case gcmParameters.ICVLen == 16:
+			aead, err = cipher.NewGCMWithNonceSize(block, len(gcmParameters.Nonce))
+		case len(gcmParameters.Nonce) == 12:
+			aead, err = cipher.NewGCMWithTagSize(block, gcmParameters.ICVLen)
+		default:
+			err = fmt.Errorf("AES-GCM parameters not supported")
+		}
+		if err != nil {
+			return nil, err
+		}
+		der, err := aead.Open(nil, gcmParameters.Nonce, info.EncryptedData, nil)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decrypt key: wrong passphrase or corrupted key")
+		}
+		return der, nil
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(scheme.Parameters.FullBytes, &iv); err != nil || len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("cannot parse AES-CBC parameters")
+	}
+	if len(info.EncryptedData) == 0 || len(info.EncryptedData)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("encrypted key has an invalid length")
+	}
+	der := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(der, info.EncryptedData)
+	// PKCS#7 padding. A wrong passphrase is detected here or when parsing the key.
+	padding := int(der[len(der)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		zeroBytes(der)
+		return nil, fmt.Errorf("cannot decrypt key: wrong passphrase or corrupted key")
+	}
+	for _, b := range der[len(der)-padding:] {
+		if int(b) != padding {
+			zeroBytes(der)
+			return nil, fmt.Errorf("cannot decrypt key: wrong passphrase or corrupted key")
+		}
+	}
+	return der[:len(der)-padding], nil
+}
+
+// deriveKeyEncryptionKey derives the key that encrypts a PKCS#8 key from the passphrase,
+// with the PBKDF2 or scrypt parameters provided.
+func deriveKeyEncryptionKey(kdf pkix.AlgorithmIdentifier, passphrase []byte, keyLength int) ([]byte, error) {
+	switch {
+	case kdf.Algorithm.Equal(oidPBKDF2):
+		var params pbkdf2Params
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &params); err != nil {
+			return nil, fmt.Errorf("cannot parse PBKDF2 parameters: %s", err)
+		}
+		if params.KeyLength != 0 && params.KeyLength != keyLength {
+			return nil, fmt.Errorf("PBKDF2 key length does not match the encryption scheme")
+		}
+		var prf func() hash.Hash
+		switch {
+		case len(params.PRF.Algorithm) == 0 || params.PRF.Algorithm.Equal(oidHMACWithSHA1):
+			prf = sha1.New
+		case params.PRF.Algorithm.Equal(oidHMACWithSHA256):
+			prf = sha256.New
+		case params.PRF.Algorithm.Equal(oidHMACWithSHA384):
+			prf = sha512.New384
+		case params.PRF.Algorithm.Equal(oidHMACWithSHA512):
+			prf = sha512.New
+		default:
+			return nil, fmt.Errorf("PBKDF2 function %s not supported", params.PRF.Algorithm)
+		}
+		if params.Iterations < 1 || params.Iterations > maxPBKDF2Iterations {
+			return nil, fmt.Errorf("PBKDF2 iterations %d out of range (1 to %d)", params.Iterations, maxPBKDF2Iterations)
+		}
+		return pbkdf2.Key(prf, string(passphrase), params.Salt, params.Iterations, keyLength)
+	case kdf.Algorithm.Equal(oidScrypt):
+		var params scryptParams
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &params); err != nil {
+			return nil, fmt.Errorf("cannot parse scrypt parameters: %s", err)
+		}
+		if params.KeyLength != 0 && params.KeyLength != keyLength {
+			return nil, fmt.Errorf("scrypt key length does not match the encryption scheme")
+		}
+		if params.N < 2 || params.N > maxScryptN || params.R < 1 || params.R > maxScryptR ||
+			params.P < 1 || params.P > maxScryptP || 128*params.N*params.R > maxScryptMemory {
+			return nil, fmt.Errorf("scrypt parameters N=%d r=%d p=%d out of range (N up to %d, r and p up to %d, and up to %d bytes of memory)",
+				params.N, params.R, params.P, maxScryptN, maxScryptR, maxScryptMemory)
+		}
+		return scrypt.Key(passphrase, params.Salt, params.N, params.R, params.P, keyLength)
+	}
+	return nil, fmt.Errorf("key derivation function %s not supported", kdf.Algorithm)
+}
+
+// encryptPKCS8 encrypts the DER encoding of a PKCS#8 key with the passphrase, using PBES2 with
+// scrypt and AES-256-GCM, and returns it as an "ENCRYPTED PRIVATE KEY" PEM block.
+func encryptPKCS8(der, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key(passphrase, salt, keyScryptN, keyScryptR, keyScryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroBytes(key)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	kdfParams, err := asn1.Marshal(scryptParams{Salt: salt, N: keyScryptN, R: keyScryptR, P: keyScryptP, KeyLength: 32})
+	if err != nil {
+		return nil, err
+	}
+	schemeParams, err := asn1.Marshal(gcmParams{Nonce: nonce, ICVLen: aead.Overhead()})
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidScrypt, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256GCM, Parameters: asn1.RawValue{FullBytes: schemeParams}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: aead.Seal(nil, nonce, der, nil),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "ENCRYPTED PRIVATE KEY",
+		Bytes: encrypted,
+	}), nil
+}
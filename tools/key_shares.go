@@ -0,0 +1,346 @@
+package tools
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+)
+
+// KeyShareVersion is the version of the key share format.
+const KeyShareVersion = 1
+
+// keyShareIterations is the number of PBKDF2-SHA256 iterations used to derive the key that
+// encrypts a share from its passphrase.
+const keyShareIterations = 600000
+
+// KeyShare is a Shamir share of a PEM private key file, encrypted with a passphrase.
+// The secret is split byte by byte over GF(256), so any Threshold shares of the same split
+// (same KeyID) rebuild the file, and fewer shares reveal nothing about it.
+type KeyShare struct {
+	Version    int    `json:"version"`
+	KeyID      string `json:"key_id"`     // Random identifier common to the shares of a split
+	Index      int    `json:"index"`      // Share index, from 1 to Shares
+	Threshold  int    `json:"threshold"`  // Number of shares needed to rebuild the key
+	Shares     int    `json:"shares"`     // Number of shares of the split
+	Iterations int    `json:"iterations"` // PBKDF2-SHA256 iterations
+	Salt       []byte `json:"salt"`       // PBKDF2 salt
+	Nonce      []byte `json:"nonce"`      // AES-256-GCM nonce
+	Ciphertext []byte `json:"ciphertext"` // Encrypted share value
+}
+
+// SplitKey splits a PEM file with a private key in shares, so any threshold of them can rebuild it.
+// Each share is encrypted with a passphrase: passphrases must contain one passphrase for every share,
+// or a single passphrase used for all of them.
+func SplitKey(keyPEM []byte, threshold, shares int, passphrases [][]byte) ([]*KeyShare, error) {
+	if threshold < 1 || threshold > shares {
+		return nil, fmt.Errorf("threshold must be between 1 and the number of shares (%d)", shares)
+	}
+	if shares > 255 {
+		return nil, fmt.Errorf("a key cannot be split in more than 255 shares")
+	}
+	if len(passphrases) != 1 && len(passphrases) != shares {
+		return nil, fmt.Errorf("%d passphrases received, but 1 or %d are needed", len(passphrases), shares)
+	}
+	for _, passphrase := range passphrases {
+		if len(passphrase) == 0 {
+			return nil, fmt.Errorf("passphrases cannot be empty")
+		}
+	}
+	block, rest := pem.Decode(keyPEM)
+	if block == nil || len(rest) > 0 || !isPrivateKeyPEM(block) {
+		return nil, fmt.Errorf("key file should contain only one private key block")
+	}
+	zeroBytes(block.Bytes)
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	values := make([][]byte, shares)
+	for i := range values {
+		values[i] = make([]byte, len(keyPEM))
+	}
+	defer func() {
+		for _, value := range values {
+			zeroBytes(value)
+		}
+	}()
+	coefficients := make([]byte, threshold)
+	defer zeroBytes(coefficients)
+	for pos, secret := range keyPEM {
+		coefficients[0] = secret
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+		for i := range values {
+			// Horner evaluation of the polynomial in x = i+1
+			x := byte(i + 1)
+			var y byte
+			for j := threshold - 1; j >= 0; j-- {
+				y = gf256Mul(y, x) ^ coefficients[j]
+			}
+			values[i][pos] = y
+		}
+	}
+	list := make([]*KeyShare, shares)
+	for i := range list {
+		passphrase := passphrases[0]
+		if len(passphrases) > 1 {
+			passphrase = passphrases[i]
+		}
+		share := &KeyShare{
+			Version:    KeyShareVersion,
+			KeyID:      hex.EncodeToString(id),
+			Index:      i + 1,
+			Threshold:  threshold,
+			Shares:     shares,
+			Iterations: keyShareIterations,
+			Salt:       make([]byte, 16),
+		}
+		if _, err := rand.Read(share.Salt); err != nil {
+			return nil, err
+		}
+		aead, err := share.cipher(passphrase)
+		if err != nil {
+			return nil, err
+		}
+		share.Nonce = make([]byte, aead.NonceSize())
+		if _, err := rand.Read(share.Nonce); err != nil {
+			return nil, err
+		}
+		share.Ciphertext = aead.Seal(nil, share.Nonce, values[i], share.additionalData())
+		list[i] = share
+	}
+	return list, nil
+}
+
+// CombineKeyShares decrypts the shares with their passphrases (one for each share, in the same order,
+// or a single one for all of them) and rebuilds the PEM key file. The caller should zero the returned
+// bytes when it does not need them anymore.
+func CombineKeyShares(shares []*KeyShare, passphrases [][]byte) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, fmt.Errorf("no key shares received")
+	}
+	if len(passphrases) != 1 && len(passphrases) != len(shares) {
+		return nil, fmt.Errorf("%d passphrases received, but 1 or %d are needed", len(passphrases), len(shares))
+	}
+	first := shares[0]
+	values := make(map[byte][]byte)
+	defer func() {
+		for _, value := range values {
+			zeroBytes(value)
+		}
+	}()
+	for i, share := range shares {
+		if share.Version != KeyShareVersion {
+			return nil, fmt.Errorf("key share version %d not supported", share.Version)
+		}
+		if share.KeyID != first.KeyID || share.Threshold != first.Threshold || share.Shares != first.Shares {
+			return nil, fmt.Errorf("key shares %d and %d do not belong to the same split", first.Index, share.Index)
+		}
+		if share.Index < 1 || share.Index > share.Shares {
+			return nil, fmt.Errorf("invalid key share index %d", share.Index)
+		}
+		if _, ok := values[byte(share.Index)]; ok {
+			return nil, fmt.Errorf("key share %d received twice", share.Index)
+		}
+		passphrase := passphrases[0]
+		if len(passphrases) > 1 {
+			passphrase = passphrases[i]
+		}
+		aead, err := share.cipher(passphrase)
+		if err != nil {
+			return nil, err
+		}
+		value, err := aead.Open(nil, share.Nonce, share.Ciphertext, share.additionalData())
+		if err != nil {
+			return nil, fmt.Errorf("cannot decrypt key share %d: wrong passphrase or corrupted share", share.Index)
+		}
+		if len(values) > 0 && len(value) != len(values[byte(first.Index)]) {
+			zeroBytes(value)
+			return nil, fmt.Errorf("key shares have different lengths")
+		}
+		values[byte(share.Index)] = value
+	}
+	if len(values) < first.Threshold {
+		return nil, fmt.Errorf("%d key shares received, but %d are needed", len(values), first.Threshold)
+	}
+	// Lagrange interpolation in x = 0 of threshold shares
+	xs := make([]byte, 0, first.Threshold)
+	for x := range values {
+		if len(xs) < first.Threshold {
+			xs = append(xs, x)
+		}
+	}
+	weights := make([]byte, len(xs))
+	for i, xi := range xs {
+		weight := byte(1)
+		for _, xj := range xs {
+			if xj != xi {
+				weight = gf256Mul(weight, gf256Div(xj, xj^xi))
+			}
+		}
+		weights[i] = weight
+	}
+	secret := make([]byte, len(values[xs[0]]))
+	for pos := range secret {
+		var b byte
+		for i, x := range xs {
+			b ^= gf256Mul(weights[i], values[x][pos])
+		}
+		secret[pos] = b
+	}
+	return secret, nil
+}
+
+// privateKeyFromShares rebuilds the private key split in the shares. If it is encrypted, it is decrypted
+// with the passphrase returned by passphrase. Intermediate copies of the key are zeroed before returning.
+func privateKeyFromShares(shares []*KeyShare, passphrases [][]byte, passphrase PassphraseFunc) (crypto.PrivateKey, error) {
+	keyPEM, err := CombineKeyShares(shares, passphrases)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroBytes(keyPEM)
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("key rebuilt from shares is not a PEM key")
+	}
+	defer zeroBytes(block.Bytes)
+	return pemToPrivateKey(block, passphrase, "KSK")
+}
+
+// cipher returns the AEAD used to encrypt the share with the passphrase provided.
+func (share *KeyShare) cipher(passphrase []byte) (cipher.AEAD, error) {
+	if share.Iterations < 1 {
+		return nil, fmt.Errorf("invalid key share iterations %d", share.Iterations)
+	}
+	key, err := pbkdf2.Key(sha256.New, string(passphrase), share.Salt, share.Iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroBytes(key)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// additionalData returns the authenticated data of the share encryption, so the share metadata
+// cannot be modified.
+func (share *KeyShare) additionalData() []byte {
+	return []byte(fmt.Sprintf("dns-tools-key-share:%d:%s:%d:%d:%d", share.Version, share.KeyID, share.Index, share.Threshold, share.Shares))
+}
+
+// ReadKeyShareFiles reads key shares from JSON files.
+func ReadKeyShareFiles(paths []string) ([]*KeyShare, error) {
+	shares := make([]*KeyShare, len(paths))
+	for i, path := range paths {
+		encoded, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read key share: %s", err)
+		}
+		var share KeyShare
+		if err := json.Unmarshal(encoded, &share); err != nil {
+			return nil, fmt.Errorf("cannot parse key share %s: %s", path, err)
+		}
+		shares[i] = &share
+	}
+	return shares, nil
+}
+
+// ReadPassphraseFiles reads a passphrase from each file, removing the trailing line break.
+func ReadPassphraseFiles(paths []string) ([][]byte, error) {
+	passphrases := make([][]byte, len(paths))
+	for i, path := range paths {
+		passphrase, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read passphrase: %s", err)
+		}
+		passphrases[i] = []byte(strings.TrimRight(string(passphrase), "\r\n"))
+		zeroBytes(passphrase)
+	}
+	return passphrases, nil
+}
+
+// zeroBytes overwrites a byte slice with zeros.
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// zeroPrivateKey overwrites the private values of a key with zeros. It is a best effort:
+// copies made by the standard library while signing cannot be reached.
+func zeroPrivateKey(key crypto.PrivateKey) {
+	zeroInt := func(n *big.Int) {
+		if n == nil {
+			return
+		}
+		words := n.Bits()
+		for i := range words {
+			words[i] = 0
+		}
+		n.SetInt64(0)
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		zeroInt(k.D)
+		for _, prime := range k.Primes {
+			zeroInt(prime)
+		}
+		zeroInt(k.Precomputed.Dp)
+		zeroInt(k.Precomputed.Dq)
+		zeroInt(k.Precomputed.Qinv)
+	case *ecdsa.PrivateKey:
+		zeroInt(k.D)
+	case ed25519.PrivateKey:
+		zeroBytes(k)
+	}
+}
+
+// gf256Exp and gf256Log are the exponential and logarithm tables of GF(256), with the AES polynomial
+// (x^8 + x^4 + x^3 + x + 1) and generator 3.
+var gf256Exp, gf256Log = func() (exp [510]byte, log [256]byte) {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		exp[i], exp[i+255] = x, x
+		log[x] = byte(i)
+		// x *= 3
+		high := x & 0x80
+		x2 := x << 1
+		if high != 0 {
+			x2 ^= 0x1b
+		}
+		x ^= x2
+	}
+	return
+}()
+
+// gf256Mul multiplies two elements of GF(256).
+func gf256Mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gf256Exp[int(gf256Log[a])+int(gf256Log[b])]
+}
+
+// gf256Div divides two elements of GF(256). b must not be zero.
+func gf256Div(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gf256Exp[int(gf256Log[a])+255-int(gf256Log[b])]
+}
@@ -0,0 +1,121 @@
+package tools_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/niclabs/dns-tools/tools"
+)
+
+var testPassphrases = [][]byte{[]byte("first custodian"), []byte("second custodian"), []byte("third custodian")}
+
+func TestKeyShares_SplitAndCombine(t *testing.T) {
+	shares, err := tools.SplitKey([]byte(RSAKSK), 2, 3, testPassphrases)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	for _, pair := range [][2]int{{0, 1}, {0, 2}, {2, 1}} {
+		selected := []*tools.KeyShare{shares[pair[0]], shares[pair[1]]}
+		passphrases := [][]byte{testPassphrases[pair[0]], testPassphrases[pair[1]]}
+		keyPEM, err := tools.CombineKeyShares(selected, passphrases)
+		if err != nil {
+			t.Errorf("shares %v: %s", pair, err)
+			continue
+		}
+		if !bytes.Equal(keyPEM, []byte(RSAKSK)) {
+			t.Errorf("shares %v rebuilt a different key", pair)
+		}
+	}
+	if _, err := tools.CombineKeyShares(shares[:1], testPassphrases[:1]); err == nil {
+		t.Errorf("key rebuilt with less shares than the threshold")
+	}
+	if _, err := tools.CombineKeyShares(shares[:2], [][]byte{testPassphrases[1], testPassphrases[0]}); err == nil {
+		t.Errorf("key share decrypted with a wrong passphrase")
+	}
+	other, err := tools.SplitKey([]byte(RSAKSK), 2, 3, testPassphrases[:1])
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if _, err := tools.CombineKeyShares([]*tools.KeyShare{shares[0], other[1]}, testPassphrases[:1]); err == nil {
+		t.Errorf("key rebuilt with shares of different splits")
+	}
+	if _, err := tools.SplitKey([]byte("not a key"), 2, 3, testPassphrases); err == nil {
+		t.Errorf("invalid key split")
+	}
+}
+
+func TestSession_FileSignKSKShares(t *testing.T) {
+	shares, err := tools.SplitKey([]byte(RSAKSK), 2, 3, testPassphrases[:1])
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	ctx := testContext(tools.RsaSha256, false, false)
+	session, err := ctx.NewFileSessionWithKSKShares(&vFile{data: []byte(RSAZSK)}, shares[1:], testPassphrases[:1])
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	out, err := sign(t, ctx, session)
+	if err != nil {
+		t.Errorf("signing failed: %s", err)
+		return
+	}
+	defer out.Close()
+	if err := ctx.VerifyFile(); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+}
+
+func TestSession_FileBackendKSKShares(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dns-tools-shares")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+	shares, err := tools.SplitKey([]byte(RSAKSK), 2, 3, testPassphrases)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	var sharePaths, passphrasePaths []string
+	for _, i := range []int{2, 0} {
+		encoded, err := json.Marshal(shares[i])
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		sharePath := filepath.Join(dir, fmt.Sprintf("share-%d.json", i+1))
+		passphrasePath := filepath.Join(dir, fmt.Sprintf("passphrase-%d", i+1))
+		if err := ioutil.WriteFile(sharePath, encoded, 0600); err != nil {
+			t.Fatalf("%s", err)
+		}
+		if err := ioutil.WriteFile(passphrasePath, append(testPassphrases[i], '\n'), 0600); err != nil {
+			t.Fatalf("%s", err)
+		}
+		sharePaths, passphrasePaths = append(sharePaths, sharePath), append(passphrasePaths, passphrasePath)
+	}
+	zskPath := filepath.Join(dir, "zsk.pem")
+	if err := ioutil.WriteFile(zskPath, []byte(RSAZSK), 0600); err != nil {
+		t.Fatalf("%s", err)
+	}
+	ctx := testContext(tools.RsaSha256, true, false)
+	session, err := ctx.NewSession("file", mapConfig{
+		"zsk-keyfile":               zskPath,
+		"ksk-share":                 sharePaths,
+		"ksk-share-passphrase-file": passphrasePaths,
+	}, tools.AllRoles)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	out, err := sign(t, ctx, session)
+	if err != nil {
+		t.Errorf("signing failed: %s", err)
+		return
+	}
+	defer out.Close()
+	if err := ctx.VerifyFile(); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+}
@@ -0,0 +1,380 @@
+package tools
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// KMSConfig contains the parameters used to connect to a KMS exposing the AWS KMS API.
+type KMSConfig struct {
+	Endpoint        string       // KMS endpoint URL. Default is the AWS KMS endpoint of the region
+	Region          string       // Region, used in the endpoint and the request signatures
+	AccessKeyID     string       // Access key ID
+	SecretAccessKey string       // Secret access key
+	SessionToken    string       // Session token, if the credentials are temporary
+	ZSKKeyID        string       // ARN, ID or alias of the key used as ZSK
+	KSKKeyID        string       // ARN, ID or alias of the key used as KSK
+	Client          *http.Client // HTTP client used to connect to the KMS. If it is nil, a client with a timeout is used
+}
+
+// kmsKeySpecs relates the KMS key specs with the signing algorithms.
+var kmsKeySpecs = map[string]SignAlgorithm{
+	"ECC_NIST_P256": EcdsaP256Sha256,
+	"RSA_2048":      RsaSha256,
+}
+
+// kmsSigningAlgorithms relates the signing algorithms with the KMS signing algorithms.
+var kmsSigningAlgorithms = map[SignAlgorithm]string{
+	EcdsaP256Sha256: "ECDSA_SHA_256",
+	RsaSha256:       "RSASSA_PKCS1_V1_5_SHA_256",
+}
+
+// KMSSession signs the zone with asymmetric keys held in a KMS exposing the AWS KMS Sign and GetPublicKey API.
+// Keys cannot be created or destroyed through the session: they are managed in the KMS.
+type KMSSession struct {
+	ctx       *Context
+	config    *KMSConfig
+	roles     KeyRole    // Roles of the keys provided by the session. Zero means all of them
+	zskSigner *kmsSigner // ZSK signer, after GetKeys
+	kskSigner *kmsSigner // KSK signer, after GetKeys
+}
+
+// NewKMSSession creates a new session using the keys and credentials defined in the config.
+func (ctx *Context) NewKMSSession(config *KMSConfig) (SignSession, error) {
+	if err := ctx.checkSignAlgorithm("KMS", RsaSha256, EcdsaP256Sha256); err != nil {
+		return nil, err
+	}
+	conf := *config
+	if len(conf.Region) == 0 {
+		return nil, fmt.Errorf("KMS region not specified")
+	}
+	if len(conf.AccessKeyID) == 0 || len(conf.SecretAccessKey) == 0 {
+		return nil, fmt.Errorf("KMS credentials not specified")
+	}
+	if len(conf.Endpoint) == 0 {
+		conf.Endpoint = fmt.Sprintf("https://kms.%s.amazonaws.com", conf.Region)
+	}
+	if _, err := url.Parse(conf.Endpoint); err != nil {
+		return nil, fmt.Errorf("invalid KMS endpoint: %s", err)
+	}
+	if conf.Client == nil {
+		conf.Client = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &KMSSession{
+		ctx:    ctx,
+		config: &conf,
+	}, nil
+}
+
+// Context returns the session context
+func (session *KMSSession) Context() *Context {
+	return session.ctx
+}
+
+// GetKeys reads the public keys from the KMS and returns signers using them.
+// The key specs must match the sign algorithm of the context.
+func (session *KMSSession) GetKeys() (*SigKeys, error) {
+	if session.ctx.Config.CreateKeys {
+		return nil, fmt.Errorf("keys cannot be created in the KMS by dns-tools. Create them in the KMS and set their ARNs")
+	}
+	if _, ok := kmsSigningAlgorithms[session.ctx.SignAlgorithm]; !ok {
+		return nil, fmt.Errorf("undefined sign algorithm")
+	}
+	keys := &SigKeys{}
+	for _, role := range []KeyRole{ZSKRole, KSKRole} {
+		if !session.providedRoles().Has(role) {
+			continue
+		}
+		keyID := session.config.ZSKKeyID
+		if role == KSKRole {
+			keyID = session.config.KSKKeyID
+		}
+		if len(keyID) == 0 {
+			return nil, fmt.Errorf("%s key ARN not specified", strings.ToUpper(role.String()))
+		}
+		signer, err := session.getSigner(keyID)
+		if err != nil {
+			return nil, err
+		}
+		if role == ZSKRole {
+			session.zskSigner, keys.zskSigner = signer, signer
+		} else {
+			session.kskSigner, keys.kskSigner = signer, signer
+		}
+	}
+	return keys, nil
+}
+
+// GetPublicKeyBytes returns the public key bytes of the ZSK and KSK, read from the KMS in GetKeys.
+func (session *KMSSession) GetPublicKeyBytes(keys *SigKeys) (zskBytes, kskBytes []byte, err error) {
+	if session.zskSigner == nil && session.kskSigner == nil {
+		err = fmt.Errorf("keys not retrieved from session")
+		return
+	}
+	if session.zskSigner != nil {
+		if zskBytes, err = publicKeyToBytes(session.zskSigner.publicKey); err != nil {
+			return
+		}
+	}
+	if session.kskSigner != nil {
+		kskBytes, err = publicKeyToBytes(session.kskSigner.publicKey)
+	}
+	return
+}
+
+// DestroyAllKeys is not supported by KMS sessions. Key deletion must be scheduled in the KMS.
+func (session *KMSSession) DestroyAllKeys() error {
+	return fmt.Errorf("keys cannot be destroyed in the KMS by dns-tools. Schedule their deletion in the KMS")
+}
+
+// End ends the session. In KMSSession it does nothing
+func (session *KMSSession) End() error {
+	return nil
+}
+
+// Info returns the signing mode of the session.
+func (session *KMSSession) Info() string {
+	return "mode=kms;"
+}
+
+// restrictRoles makes the session use only the keys of the roles provided.
+func (session *KMSSession) restrictRoles(roles KeyRole) {
+	session.roles = roles
+}
+
+// providedRoles returns the roles of the keys provided by the session.
+func (session *KMSSession) providedRoles() KeyRole {
+	if session.roles == 0 {
+		return AllRoles
+	}
+	return session.roles
+}
+
+// getSigner reads a public key from the KMS and returns a signer using its key.
+func (session *KMSSession) getSigner(keyID string) (*kmsSigner, error) {
+	var resp struct {
+		KeyID                 string `json:"KeyId"`
+		PublicKey             []byte `json:"PublicKey"`
+		KeySpec               string `json:"KeySpec"`
+		CustomerMasterKeySpec string `json:"CustomerMasterKeySpec"`
+		KeyUsage              string `json:"KeyUsage"`
+	}
+	if err := session.request("GetPublicKey", map[string]string{"KeyId": keyID}, &resp); err != nil {
+		return nil, fmt.Errorf("cannot get public key of %s: %s", keyID, err)
+	}
+	spec := resp.KeySpec
+	if len(spec) == 0 {
+		spec = resp.CustomerMasterKeySpec
+	}
+	algorithm, ok := kmsKeySpecs[spec]
+	if !ok {
+		return nil, fmt.Errorf("key %s has unsupported key spec %s", keyID, spec)
+	}
+	if algorithm != session.ctx.SignAlgorithm {
+		return nil, fmt.Errorf("key %s has key spec %s, which uses DNSKEY algorithm %d instead of %d", keyID, spec, algorithm, session.ctx.SignAlgorithm)
+	}
+	if resp.KeyUsage != "SIGN_VERIFY" {
+		return nil, fmt.Errorf("key %s has usage %s instead of SIGN_VERIFY", keyID, resp.KeyUsage)
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(resp.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse public key of %s: %s", keyID, err)
+	}
+	return &kmsSigner{
+		session:   session,
+		keyID:     keyID,
+		publicKey: publicKey,
+	}, nil
+}
+
+// request calls an action of the KMS JSON API, signing the request with AWS Signature Version 4,
+// and decodes the JSON response into out.
+func (session *KMSSession) request(action string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, session.config.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	signAWSRequest(req, body, session.config, time.Now())
+	resp, err := session.config.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var kmsErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(respBody, &kmsErr) == nil && len(kmsErr.Type) > 0 {
+			return fmt.Errorf("KMS returned %s: %s", kmsErr.Type, kmsErr.Message)
+		}
+		return fmt.Errorf("KMS returned %s", resp.Status)
+	}
+	return json.Unmarshal(respBody, out)
+}
+
+// signAWSRequest adds the headers of an AWS Signature Version 4 for the KMS service to the request.
+func signAWSRequest(req *http.Request, body []byte, config *KMSConfig, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	scope := fmt.Sprintf("%s/%s/kms/aws4_request", now.Format("20060102"), config.Region)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if len(config.SessionToken) > 0 {
+		req.Header.Set("X-Amz-Security-Token", config.SessionToken)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if len(path) == 0 {
+		path = "/"
+	}
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+	key := []byte("AWS4" + config.SecretAccessKey)
+	for _, part := range []string{now.Format("20060102"), config.Region, "kms", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		config.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// kmsSigner signs with a KMS key.
+type kmsSigner struct {
+	session   *KMSSession
+	keyID     string           // ARN, ID or alias of the key
+	publicKey crypto.PublicKey // Public key, as returned by the KMS
+}
+
+// Public returns the public key of the signer.
+func (signer *kmsSigner) Public() crypto.PublicKey {
+	return signer.publicKey
+}
+
+// Sign signs the SHA256 digest with the KMS Sign action.
+func (signer *kmsSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, fmt.Errorf("only SHA256 digests are supported")
+	}
+	ctx := signer.session.Context()
+	var resp struct {
+		Signature []byte `json:"Signature"`
+	}
+	err := signer.session.request("Sign", map[string]interface{}{
+		"KeyId":            signer.keyID,
+		"Message":          digest,
+		"MessageType":      "DIGEST",
+		"SigningAlgorithm": kmsSigningAlgorithms[ctx.SignAlgorithm],
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if pk, ok := signer.publicKey.(*ecdsa.PublicKey); ok {
+		return ecdsaSignatureToASN1(resp.Signature, (pk.Curve.Params().BitSize+7)/8)
+	}
+	return resp.Signature, nil
+}
+
+// ecdsaSignatureToASN1 returns the ECDSA signature as the ASN.1 sequence of R and S that
+// dns.RRSIG.Sign expects, without trailing data. It accepts DER encoded signatures, as
+// returned by AWS KMS, and R || S signatures with the size of the curve.
+func ecdsaSignatureToASN1(sig []byte, size int) ([]byte, error) {
+	var parsed struct{ R, S *big.Int }
+	if rest, err := asn1.Unmarshal(sig, &parsed); err == nil {
+		if len(rest) > 0 {
+			return nil, fmt.Errorf("ECDSA signature has trailing data")
+		}
+	} else if len(sig) == 2*size {
+		parsed.R = new(big.Int).SetBytes(sig[:size])
+		parsed.S = new(big.Int).SetBytes(sig[size:])
+	} else {
+		return nil, fmt.Errorf("cannot parse ECDSA signature: %s", err)
+	}
+	if parsed.R.Sign() <= 0 || parsed.S.Sign() <= 0 || parsed.R.BitLen() > 8*size || parsed.S.BitLen() > 8*size {
+		return nil, fmt.Errorf("ECDSA signature values out of range")
+	}
+	return asn1.Marshal(parsed)
+}
+
+var kmsBackend = &SessionBackend{
+	Name:        "kms",
+	Description: "uses keys in a KMS exposing the AWS KMS API to sign the zone",
+	Options: []BackendOption{
+		{Name: "kms-region", Type: StringOption, Default: "", Usage: "KMS region. Default is the value of AWS_REGION."},
+		{Name: "kms-endpoint", Type: StringOption, Default: "", Usage: "KMS endpoint URL. Default is the AWS KMS endpoint of the region."},
+		{Name: "kms-access-key-id", Type: StringOption, Default: "", Usage: "Access key ID. Default is the value of AWS_ACCESS_KEY_ID."},
+		{Name: "kms-secret-access-key", Type: StringOption, Default: "", Usage: "Secret access key. Default is the value of AWS_SECRET_ACCESS_KEY."},
+		{Name: "kms-session-token", Type: StringOption, Default: "", Usage: "Session token. Default is the value of AWS_SESSION_TOKEN."},
+		{Name: "zsk-kms-key", Type: StringOption, Default: "", Usage: "ARN, ID or alias of the KMS key used as ZSK."},
+		{Name: "ksk-kms-key", Type: StringOption, Default: "", Usage: "ARN, ID or alias of the KMS key used as KSK."},
+	},
+	New: func(ctx *Context, conf BackendConfig, roles KeyRole) (SignSession, error) {
+		return ctx.NewKMSSession(&KMSConfig{
+			Endpoint:        conf.GetString("kms-endpoint"),
+			Region:          withEnvDefault(conf.GetString("kms-region"), "AWS_REGION"),
+			AccessKeyID:     withEnvDefault(conf.GetString("kms-access-key-id"), "AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: withEnvDefault(conf.GetString("kms-secret-access-key"), "AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    withEnvDefault(conf.GetString("kms-session-token"), "AWS_SESSION_TOKEN"),
+			ZSKKeyID:        conf.GetString("zsk-kms-key"),
+			KSKKeyID:        conf.GetString("ksk-kms-key"),
+		})
+	},
+}
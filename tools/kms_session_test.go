@@ -0,0 +1,269 @@
+package tools_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/niclabs/dns-tools/tools"
+)
+
+const (
+	kmsRegion    = "us-east-1"
+	kmsAccessKey = "AKIDEXAMPLE"
+	kmsSecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+)
+
+// kmsMock implements the GetPublicKey and Sign actions of the AWS KMS JSON API,
+// checking the Signature Version 4 of every request.
+type kmsMock struct {
+	keys     map[string]crypto.Signer
+	specs    map[string]string
+	rawECDSA bool // If true, ECDSA signatures are returned as R || S instead of DER
+	signs    int
+}
+
+func newKMSMock() *kmsMock {
+	return &kmsMock{
+		keys:  make(map[string]crypto.Signer),
+		specs: make(map[string]string),
+	}
+}
+
+func (m *kmsMock) addKey(arn, spec string) error {
+	var signer crypto.Signer
+	var err error
+	switch spec {
+	case "ECC_NIST_P256":
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "RSA_2048":
+		signer, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		return fmt.Errorf("unsupported spec %s", spec)
+	}
+	if err != nil {
+		return err
+	}
+	m.keys[arn], m.specs[arn] = signer, spec
+	return nil
+}
+
+func (m *kmsMock) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	if err := checkSigV4(r, body); err != nil {
+		kmsError(w, http.StatusForbidden, "InvalidSignatureException", err.Error())
+		return
+	}
+	var req struct {
+		KeyID            string `json:"KeyId"`
+		Message          []byte `json:"Message"`
+		MessageType      string `json:"MessageType"`
+		SigningAlgorithm string `json:"SigningAlgorithm"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		kmsError(w, http.StatusBadRequest, "SerializationException", err.Error())
+		return
+	}
+	key, ok := m.keys[req.KeyID]
+	if !ok {
+		kmsError(w, http.StatusBadRequest, "NotFoundException", "key not found")
+		return
+	}
+	switch r.Header.Get("X-Amz-Target") {
+	case "TrentService.GetPublicKey":
+		der, err := x509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			kmsError(w, http.StatusInternalServerError, "KMSInternalException", err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"KeyId":     req.KeyID,
+			"PublicKey": der,
+			"KeySpec":   m.specs[req.KeyID],
+			"KeyUsage":  "SIGN_VERIFY",
+		})
+	case "TrentService.Sign":
+		expected := map[string]string{"ECC_NIST_P256": "ECDSA_SHA_256", "RSA_2048": "RSASSA_PKCS1_V1_5_SHA_256"}
+		if req.MessageType != "DIGEST" || req.SigningAlgorithm != expected[m.specs[req.KeyID]] {
+			kmsError(w, http.StatusBadRequest, "ValidationException", "unexpected message type or signing algorithm")
+			return
+		}
+		sig, err := key.Sign(rand.Reader, req.Message, crypto.SHA256)
+		if err != nil {
+			kmsError(w, http.StatusInternalServerError, "KMSInternalException", err.Error())
+			return
+		}
+		if _, ok := key.(*ecdsa.PrivateKey); ok && m.rawECDSA {
+			var parsed struct{ R, S *big.Int }
+			asn1.Unmarshal(sig, &parsed)
+			raw := make([]byte, 64)
+			parsed.R.FillBytes(raw[:32])
+			parsed.S.FillBytes(raw[32:])
+			sig = raw
+		}
+		m.signs++
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"KeyId":            req.KeyID,
+			"Signature":        sig,
+			"SigningAlgorithm": req.SigningAlgorithm,
+		})
+	default:
+		kmsError(w, http.StatusBadRequest, "UnknownOperationException", "unknown operation")
+	}
+}
+
+// checkSigV4 recomputes the Signature Version 4 of the request and compares it with the one received.
+func checkSigV4(r *http.Request, body []byte) error {
+	auth := r.Header.Get("Authorization")
+	var credential, signedHeaders, signature string
+	for _, part := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ", ") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("malformed authorization header")
+		}
+		switch kv[0] {
+		case "Credential":
+			credential = kv[1]
+		case "SignedHeaders":
+			signedHeaders = kv[1]
+		case "Signature":
+			signature = kv[1]
+		}
+	}
+	scope := strings.SplitN(credential, "/", 2)
+	if len(scope) != 2 || scope[0] != kmsAccessKey {
+		return fmt.Errorf("unknown access key")
+	}
+	date := r.Header.Get("X-Amz-Date")
+	if scope[1] != date[:8]+"/"+kmsRegion+"/kms/aws4_request" {
+		return fmt.Errorf("wrong credential scope")
+	}
+	names := strings.Split(signedHeaders, ";")
+	if !sort.StringsAreSorted(names) {
+		return fmt.Errorf("signed headers are not sorted")
+	}
+	canonical := r.Method + "\n/\n" + r.URL.RawQuery + "\n"
+	for _, name := range names {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		canonical += name + ":" + value + "\n"
+	}
+	bodyHash := sha256.Sum256(body)
+	canonical += "\n" + signedHeaders + "\n" + hex.EncodeToString(bodyHash[:])
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + date + "\n" + scope[1] + "\n" + hex.EncodeToString(canonicalHash[:])
+	key := []byte("AWS4" + kmsSecretKey)
+	for _, part := range []string{date[:8], kmsRegion, "kms", "aws4_request"} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stringToSign))
+	if hex.EncodeToString(mac.Sum(nil)) != signature {
+		return fmt.Errorf("signature does not match")
+	}
+	return nil
+}
+
+func kmsError(w http.ResponseWriter, status int, errType, msg string) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"__type": errType, "message": msg})
+}
+
+func kmsSignTest(t *testing.T, algorithm tools.SignAlgorithm, spec string, rawECDSA bool) {
+	mock := newKMSMock()
+	mock.rawECDSA = rawECDSA
+	zskARN := "arn:aws:kms:us-east-1:111122223333:key/zsk"
+	kskARN := "arn:aws:kms:us-east-1:111122223333:key/ksk"
+	for _, arn := range []string{zskARN, kskARN} {
+		if err := mock.addKey(arn, spec); err != nil {
+			t.Errorf("%s", err)
+			return
+		}
+	}
+	server := httptest.NewServer(mock)
+	defer server.Close()
+	ctx := testContext(algorithm, true, false)
+	session, err := ctx.NewKMSSession(&tools.KMSConfig{
+		Endpoint:        server.URL,
+		Region:          kmsRegion,
+		AccessKeyID:     kmsAccessKey,
+		SecretAccessKey: kmsSecretKey,
+		ZSKKeyID:        zskARN,
+		KSKKeyID:        kskARN,
+	})
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	out, err := sign(t, ctx, session)
+	if err != nil {
+		t.Errorf("signing failed: %s", err)
+		return
+	}
+	defer out.Close()
+	if err := ctx.VerifyFile(); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+	if mock.signs == 0 {
+		t.Errorf("no signatures were requested to the KMS")
+	}
+}
+
+func TestSession_KMSRSASign(t *testing.T) {
+	kmsSignTest(t, tools.RsaSha256, "RSA_2048", false)
+}
+
+func TestSession_KMSECDSASign(t *testing.T) {
+	kmsSignTest(t, tools.EcdsaP256Sha256, "ECC_NIST_P256", false)
+}
+
+func TestSession_KMSECDSARawSignature(t *testing.T) {
+	kmsSignTest(t, tools.EcdsaP256Sha256, "ECC_NIST_P256", true)
+}
+
+func TestSession_KMSErrors(t *testing.T) {
+	mock := newKMSMock()
+	if err := mock.addKey("zsk", "ECC_NIST_P256"); err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	server := httptest.NewServer(mock)
+	defer server.Close()
+	ctx := testContext(tools.RsaSha256, false, false)
+	for name, conf := range map[string]*tools.KMSConfig{
+		"key spec does not match the algorithm": {ZSKKeyID: "zsk", KSKKeyID: "zsk", SecretAccessKey: kmsSecretKey},
+		"key does not exist":                    {ZSKKeyID: "unknown", KSKKeyID: "zsk", SecretAccessKey: kmsSecretKey},
+		"wrong secret key":                      {ZSKKeyID: "zsk", KSKKeyID: "zsk", SecretAccessKey: "wrong"},
+	} {
+		conf.Endpoint, conf.Region, conf.AccessKeyID = server.URL, kmsRegion, kmsAccessKey
+		session, err := ctx.NewKMSSession(conf)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if _, err := session.GetKeys(); err == nil {
+			t.Errorf("%s: keys were accepted", name)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package tools
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// prepareZoneKeys removes from the zone the DNSSEC RRs of previous signatures, so they are not mixed
+// with the new ones: RRSIG, NSEC, NSEC3 and NSEC3PARAM RRs, and the DNSKEY RRs of the apex.
+// In multi-signer mode, the apex DNSKEYs are kept as foreign keys, unless they are our own keys of a
+// previous signature, and the DNSKEY, CDS and CDNSKEY RRs of the foreign key files are merged into the zone.
+func (ctx *Context) prepareZoneKeys() error {
+	var previous map[*dns.DNSKEY]bool
+	if ctx.Config.MultiSigner {
+		var err error
+		if previous, err = ctx.previousOwnKeys(); err != nil {
+			return err
+		}
+	}
+	rrs := make(RRArray, 0, len(ctx.rrs))
+	dropped := 0
+	for _, rr := range ctx.rrs {
+		switch rr.Header().Rrtype {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3, dns.TypeNSEC3PARAM:
+			dropped++
+			continue
+		case dns.TypeDNSKEY:
+			if rr.Header().Name == ctx.Config.Zone {
+				key := rr.(*dns.DNSKEY)
+				if ctx.Config.MultiSigner && !previous[key] && (ctx.Rollover == nil || !ctx.Rollover.isCompromised(key)) {
+					ctx.addForeignKey(key)
+				}
+				continue
+			}
+		}
+		rrs = append(rrs, rr)
+	}
+	if len(previous) > 0 {
+		ctx.Log.Printf("Multi-signer mode: %d DNSKEYs of previous signatures of this signer removed", len(previous))
+	}
+	ctx.rrs = rrs
+	if dropped > 0 {
+		ctx.Log.Printf("Removed %d RRSIG and NSEC/NSEC3 RRs of previous signatures", dropped)
+	}
+	if !ctx.Config.MultiSigner {
+		ctx.DNSKEYS.ZSK = make(map[uint16]*dns.DNSKEY)
+		ctx.DNSKEYS.KSK = make(map[uint16]*dns.DNSKEY)
+		ctx.DNSKEYS.Revoked = make(map[uint16]*dns.DNSKEY)
+		return nil
+	}
+	foreign, err := ctx.readForeignKeyFiles(ctx.Config.ForeignKeyFiles)
+	if err != nil {
+		return err
+	}
+	for _, rr := range foreign {
+		if key, ok := rr.(*dns.DNSKEY); ok {
+			ctx.addForeignKey(key)
+			continue
+		}
+		if !containsRR(ctx.rrs, rr) {
+			ctx.rrs = append(ctx.rrs, rr)
+		}
+	}
+	ctx.Log.Printf("Multi-signer mode: %d foreign DNSKEYs merged into the DNSKEY RRset", len(ctx.foreignKeys))
+	return nil
+}
+
+// previousOwnKeys returns the apex DNSKEYs of the input zone which are keys of previous signatures of this
+// signer: the keys of the own key files, with or without the REVOKE flag. Signatures of the input zone cannot
+// tell them apart, because the KSKs of other signers sign the DNSKEY RRset too (RFC8901 section 2.1.2). Keys
+// listed in the foreign key files are never considered our own.
+func (ctx *Context) previousOwnKeys() (map[*dns.DNSKEY]bool, error) {
+	ownKeys, err := ctx.readKeyFiles(ctx.Config.OwnKeyFiles, "own keys", dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	listed, err := ctx.readForeignKeyFiles(ctx.Config.ForeignKeyFiles)
+	if err != nil {
+		listed = nil // The error is returned when the files are merged
+	}
+	own := make(map[*dns.DNSKEY]bool)
+	for _, rr := range ctx.rrs {
+		key, ok := rr.(*dns.DNSKEY)
+		if !ok || key.Hdr.Name != ctx.Config.Zone || containsRR(listed, key) {
+			continue
+		}
+		for _, ownKey := range ownKeys {
+			if sameKeyMaterial(key, ownKey.(*dns.DNSKEY)) {
+				own[key] = true
+				break
+			}
+		}
+	}
+	return own, nil
+}
+
+// dropOwnForeignKeys removes from the foreign keys the keys with the key material of our keys, which could
+// be in the input zone with other flags, like the REVOKE flag.
+func (ctx *Context) dropOwnForeignKeys(ownKeys ...*dns.DNSKEY) {
+	kept := make(RRArray, 0, len(ctx.foreignKeys))
+	for _, rr := range ctx.foreignKeys {
+		key := rr.(*dns.DNSKEY)
+		own := false
+		for _, ownKey := range ownKeys {
+			own = own || ownKey != nil && sameKeyMaterial(key, ownKey)
+		}
+		if !own {
+			kept = append(kept, key)
+			continue
+		}
+		for _, keys := range []map[uint16]*dns.DNSKEY{ctx.DNSKEYS.ZSK, ctx.DNSKEYS.KSK, ctx.DNSKEYS.Revoked} {
+			if keys[key.KeyTag()] == key {
+				delete(keys, key.KeyTag())
+			}
+		}
+		ctx.Log.Printf("Multi-signer mode: DNSKEY %d of the input zone has the key material of our keys, so it is removed", key.KeyTag())
+	}
+	ctx.foreignKeys = kept
+}
+
+// sameKeyMaterial returns true if both DNSKEYs have the same algorithm and public key, whatever their flags.
+func sameKeyMaterial(a, b *dns.DNSKEY) bool {
+	return a.Algorithm == b.Algorithm && a.PublicKey == b.PublicKey
+}
+
+// addForeignKey adds a DNSKEY of other signer to the DNSKEY RRset, if it is not already in it.
+func (ctx *Context) addForeignKey(key *dns.DNSKEY) {
+	if containsRR(ctx.foreignKeys, key) {
+		return
+	}
+	ctx.foreignKeys = append(ctx.foreignKeys, key)
+	ctx.registerDNSKEY(key)
+}
+
+// dnskeyRRSet returns the DNSKEY RRset of the zone, with our keys, the foreign keys of multi-signer mode
+// and the compromised keys of an emergency rollover. All the keys use the TTL of our KSK.
+func (ctx *Context) dnskeyRRSet(zsk, ksk *dns.DNSKEY) RRArray {
+	rrSet := RRArray{zsk, ksk}
+	others := append(RRArray{}, ctx.foreignKeys...)
+	for _, key := range ctx.rolloverKeys() {
+		others = append(others, key)
+	}
+	for _, rr := range others {
+		if containsRR(rrSet, rr) {
+			continue
+		}
+		key := dns.Copy(rr)
+		key.Header().Ttl = ksk.Hdr.Ttl
+		rrSet = append(rrSet, key)
+	}
+	return rrSet
+}
+
+// addOwnCDS adds the CDS and CDNSKEY RRs of our KSK to the zone in multi-signer mode, if the zone
+// already has CDS or CDNSKEY RRsets, so they list the KSKs of every signer.
+func (ctx *Context) addOwnCDS(ksk *dns.DNSKEY) {
+	if !ctx.Config.MultiSigner {
+		return
+	}
+	var cds, cdnskey dns.RR
+	for _, rr := range ctx.rrs {
+		if rr.Header().Name != ctx.Config.Zone {
+			continue
+		}
+		switch rr.Header().Rrtype {
+		case dns.TypeCDS:
+			cds = rr
+		case dns.TypeCDNSKEY:
+			cdnskey = rr
+		}
+	}
+	if cds != nil {
+		own := ksk.ToDS(dns.SHA256).ToCDS()
+		own.Hdr.Ttl = cds.Header().Ttl
+		if !containsRR(ctx.rrs, own) {
+			ctx.rrs = append(ctx.rrs, own)
+		}
+	}
+	if cdnskey != nil {
+		own := ksk.ToCDNSKEY()
+		own.Hdr.Ttl = cdnskey.Header().Ttl
+		if !containsRR(ctx.rrs, own) {
+			ctx.rrs = append(ctx.rrs, own)
+		}
+	}
+}
+
+// readForeignKeyFiles reads the DNSKEY, CDS and CDNSKEY RRs of the zone apex from files in presentation format.
+func (ctx *Context) readForeignKeyFiles(paths []string) (RRArray, error) {
+	return ctx.readKeyFiles(paths, "foreign keys", dns.TypeDNSKEY, dns.TypeCDS, dns.TypeCDNSKEY)
+}
+
+// readKeyFiles reads RRs of the zone apex from files in presentation format. Only the RR types provided are
+// allowed, and kind describes the files in errors.
+func (ctx *Context) readKeyFiles(paths []string, kind string, allowed ...uint16) (RRArray, error) {
+	names := make([]string, len(allowed))
+	for i, rrtype := range allowed {
+		names[i] = dns.TypeToString[rrtype]
+	}
+	rrs := make(RRArray, 0)
+	for _, path := range paths {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read %s file: %s", kind, err)
+		}
+		parser := dns.NewZoneParser(strings.NewReader(string(content)), ctx.Config.Zone, path)
+		for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+			rr.Header().Name = NormalizeFQDN(rr.Header().Name)
+			isAllowed := false
+			for _, rrtype := range allowed {
+				isAllowed = isAllowed || rr.Header().Rrtype == rrtype
+			}
+			if !isAllowed {
+				return nil, fmt.Errorf("%s file %s has a %s RR, but only %s RRs are allowed",
+					kind, path, dns.TypeToString[rr.Header().Rrtype], strings.Join(names, ", "))
+			}
+			if rr.Header().Name != ctx.Config.Zone {
+				return nil, fmt.Errorf("%s file %s has RRs of %s, which is not the zone apex", kind, path, rr.Header().Name)
+			}
+			rrs = append(rrs, rr)
+		}
+		if err := parser.Err(); err != nil {
+			return nil, fmt.Errorf("cannot parse %s file %s: %s", kind, path, err)
+		}
+	}
+	return rrs, nil
+}
+
+// containsRR returns true if the list contains a RR with the same owner, type and data as rr, ignoring its TTL.
+func containsRR(rrs RRArray, rr dns.RR) bool {
+	for _, other := range rrs {
+		if dns.IsDuplicate(other, rr) {
+			return true
+		}
+	}
+	return false
+}
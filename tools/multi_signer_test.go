@@ -0,0 +1,173 @@
+package tools_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/niclabs/dns-tools/tools"
+)
+
+// Keys and signatures of another signer of the test zone.
+const (
+	foreignZSK   = "example.com. 3600 IN DNSKEY 256 3 13 AQIDBAUGBwgJCgsMDQ4PEBESExQVFhcYGRobHB0eHyAhIiMkJSYnKCkqKywtLi8wMTIzNDU2Nzg5Ojs8PT4/QA=="
+	foreignKSK   = "example.com. 3600 IN DNSKEY 257 3 13 QUJDREVGR0hJSktMTU5PUFFSU1RVVldYWVpbXF1eX2BhYmNkZWZnaGlqa2xtbm9wcXJzdHV2d3h5ent8fX5/gA=="
+	foreignRRSIG = "www.example.com. 86400 IN RRSIG A 13 3 86400 20300101000000 20200101000000 12345 example.com. AwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8gISIjJCUmJygpKissLS4vMDEyMzQ1Njc4OTo7PD0+P0BBQg=="
+	foreignCDS   = "example.com. 3600 IN CDS 12345 13 2 0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20"
+)
+
+// verifyMultiSignerZone verifies a signed zone allowing keys of other signers with algorithms that do not sign
+// the DNSKEY RRset.
+func verifyMultiSignerZone(signed string) error {
+	ctx := testContext(tools.RsaSha256, false, false)
+	ctx.Config.MultiSigner = true
+	ctx.File = strings.NewReader(signed)
+	return ctx.VerifyFile()
+}
+
+func TestSession_MultiSignerMergesForeignKeys(t *testing.T) {
+	ctx := testContext(tools.RsaSha256, false, false)
+	ctx.Config.MultiSigner = true
+	signed, err := signZone(t, ctx, fileString+foreignZSK+"\n"+foreignKSK+"\n"+foreignRRSIG+"\n")
+	if err != nil {
+		t.Fatalf("signing failed: %s", err)
+	}
+	for _, key := range []string{"AQIDBAUGBwgJCgsMDQ4PEBESExQVFhcYGRobHB0eHyAhIiMkJSYnKCkqKywtLi8wMTIzNDU2Nzg5Ojs8PT4/QA==",
+		"QUJDREVGR0hJSktMTU5PUFFSU1RVVldYWVpbXF1eX2BhYmNkZWZnaGlqa2xtbm9wcXJzdHV2d3h5ent8fX5/gA=="} {
+		if !strings.Contains(signed, key) {
+			t.Errorf("foreign key not in the DNSKEY RRset")
+		}
+	}
+	if strings.Contains(signed, "12345 example.com.") {
+		t.Errorf("foreign RRSIG not removed")
+	}
+	// The keys of the other signer use other algorithm, so the zone verifies only in multi-signer mode.
+	if err := verifyZone(signed); err == nil {
+		t.Errorf("zone with an algorithm that does not sign the DNSKEY RRset verified without multi-signer mode")
+	}
+	if err := verifyMultiSignerZone(signed); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+	// A zone with signatures of both signers verifies too.
+	if err := verifyMultiSignerZone(signed + foreignRRSIG + "\n"); err != nil {
+		t.Errorf("Error verifying output with foreign signatures: %s", err)
+	}
+}
+
+func TestSession_MultiSignerForeignKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "foreign.keys")
+	if err := ioutil.WriteFile(path, []byte(foreignZSK+"\n"+foreignKSK+"\n"+foreignCDS+"\n"), 0600); err != nil {
+		t.Fatalf("%s", err)
+	}
+	ctx := testContext(tools.RsaSha256, true, false)
+	ctx.Config.MultiSigner = true
+	ctx.Config.ForeignKeyFiles = []string{path}
+	signed, err := signZone(t, ctx, fileString)
+	if err != nil {
+		t.Fatalf("signing failed: %s", err)
+	}
+	if strings.Count(signed, "\tDNSKEY\t") != 4 {
+		t.Errorf("DNSKEY RRset should have 4 keys:\n%s", signed)
+	}
+	// Our KSK is added to the CDS RRset of the other signer.
+	if strings.Count(signed, "\tCDS\t") != 2 {
+		t.Errorf("CDS RRset should have 2 RRs:\n%s", signed)
+	}
+	if err := verifyMultiSignerZone(signed); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+
+	// Only DNSKEY, CDS and CDNSKEY RRs are allowed.
+	if err := ioutil.WriteFile(path, []byte(foreignRRSIG+"\n"), 0600); err != nil {
+		t.Fatalf("%s", err)
+	}
+	ctx = testContext(tools.RsaSha256, false, false)
+	ctx.Config.MultiSigner = true
+	ctx.Config.ForeignKeyFiles = []string{path}
+	if _, err := signZone(t, ctx, fileString); err == nil {
+		t.Errorf("zone signed with a foreign keys file with other RRs")
+	}
+}
+
+func TestSession_SignDropsInputKeys(t *testing.T) {
+	ctx := testContext(tools.RsaSha256, false, false)
+	signed, err := signZone(t, ctx, fileString+foreignZSK+"\n"+foreignKSK+"\n"+foreignRRSIG+"\n")
+	if err != nil {
+		t.Fatalf("signing failed: %s", err)
+	}
+	if strings.Count(signed, "\tDNSKEY\t") != 2 || strings.Contains(signed, "12345 example.com.") {
+		t.Errorf("DNSKEYs and RRSIGs of the input zone kept:\n%s", signed)
+	}
+	if err := verifyZone(signed); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+}
+
+func TestSession_MultiSignerDropsPreviousOwnKeys(t *testing.T) {
+	ctx := testContext(tools.RsaSha256, false, false)
+	ctx.Config.MultiSigner = true
+	signed, err := signZone(t, ctx, fileString+foreignZSK+"\n"+foreignKSK+"\n")
+	if err != nil {
+		t.Fatalf("signing failed: %s", err)
+	}
+	// Our keys change, and the RSA keys of the previous signature, listed as our own keys, are not kept as
+	// foreign keys. Their revoked versions are not kept either.
+	rsaKeys := linesOf(signZoneWithKeys(t, testContext(tools.RsaSha256, false, false), RSAZSK, RSAKSK, fileString), "DNSKEY")
+	var revokedRSAKSK string
+	for _, line := range strings.Split(rsaKeys, "\n") {
+		if strings.Contains(line, "\tDNSKEY\t257 3 8 ") {
+			revokedRSAKSK = strings.Replace(line, "\tDNSKEY\t257 3 8 ", "\tDNSKEY\t385 3 8 ", 1) + "\n"
+		}
+	}
+	ctx = testContext(tools.EcdsaP256Sha256, false, false)
+	ctx.Config.MultiSigner = true
+	ctx.Config.OwnKeyFiles = []string{writeFile(t, "own.keys", rsaKeys)}
+	resigned := signZoneWithKeys(t, ctx, ECZSK, ECKSK, signed+revokedRSAKSK)
+	if n := strings.Count(resigned, "\tDNSKEY\t"); n != 4 {
+		t.Errorf("DNSKEY RRset should have our 2 keys and the 2 foreign keys, but it has %d keys:\n%s", n, linesOf(resigned, "DNSKEY"))
+	}
+	if strings.Contains(linesOf(resigned, "DNSKEY"), " 3 8 ") {
+		t.Errorf("RSA keys of the previous signature kept in the DNSKEY RRset:\n%s", linesOf(resigned, "DNSKEY"))
+	}
+	if err := verifyZone(resigned); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+
+	// Without the list of our own keys, the keys of the previous signature are kept as foreign keys.
+	ctx = testContext(tools.EcdsaP256Sha256, false, false)
+	ctx.Config.MultiSigner = true
+	resigned = signZoneWithKeys(t, ctx, ECZSK, ECKSK, signed)
+	if n := strings.Count(resigned, "\tDNSKEY\t"); n != 6 {
+		t.Errorf("DNSKEY RRset should have 6 keys, but it has %d keys:\n%s", n, linesOf(resigned, "DNSKEY"))
+	}
+
+	// A revoked key of other signer is kept, and a revoked version of our current KSK is not.
+	revoked := strings.Replace(foreignKSK, "DNSKEY 257 3 13", "DNSKEY 385 3 13", 1)
+	ctx = testContext(tools.RsaSha256, false, false)
+	ctx.Config.MultiSigner = true
+	signed, err = signZone(t, ctx, fileString+foreignZSK+"\n"+revoked+"\n"+revokedRSAKSK)
+	if err != nil {
+		t.Fatalf("signing failed: %s", err)
+	}
+	if !strings.Contains(signed, "\tDNSKEY\t385 3 13 ") || strings.Contains(signed, "\tDNSKEY\t385 3 8 ") ||
+		strings.Count(signed, "\tDNSKEY\t") != 4 {
+		t.Errorf("DNSKEY RRset should have our 2 keys, the foreign ZSK and the revoked foreign KSK:\n%s", linesOf(signed, "DNSKEY"))
+	}
+}
+
+func TestSession_MultiSignerKeepsSignedForeignKeys(t *testing.T) {
+	// The zone of both signers has valid RRSIGs of the ECDSA signer, whose KSK signs the shared DNSKEY
+	// RRset too (RFC8901 model 2). Its keys are still foreign keys for the RSA signer.
+	merged := twoAlgorithmZone(t)
+	ctx := testContext(tools.RsaSha256, false, false)
+	ctx.Config.MultiSigner = true
+	resigned := signZoneWithKeys(t, ctx, RSAZSK, RSAKSK, merged)
+	keys := linesOf(resigned, "DNSKEY")
+	if strings.Count(keys, "\tDNSKEY\t") != 4 || strings.Count(keys, " 3 13 ") != 2 {
+		t.Errorf("DNSKEY RRset should have the 2 RSA keys and the 2 ECDSA keys:\n%s", keys)
+	}
+	if err := verifyMultiSignerZone(resigned); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+}
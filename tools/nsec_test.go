@@ -0,0 +1,226 @@
+package tools_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/niclabs/dns-tools/tools"
+)
+
+// entZone has deep names, wildcards and empty non-terminals (b.c, c, w and y.x).
+const entZone = fileString + `
+a.b.c.example.com.	86400	IN	A	127.0.0.5
+*.w.example.com.	86400	IN	TXT	"wildcard"
+z.y.x.example.com.	86400	IN	MX	10 mail.example.com.
+x.example.com.	86400	IN	A	127.0.0.6
+`
+
+// entNames are the empty non-terminals of entZone.
+var entNames = []string{"b.c.example.com.", "c.example.com.", "w.example.com.", "y.x.example.com."}
+
+// denialRRs returns the NSEC and NSEC3 RRs of a signed zone, indexed by owner name.
+func denialRRs(t *testing.T, signed string) (map[string]*dns.NSEC, map[string]*dns.NSEC3) {
+	nsecs := make(map[string]*dns.NSEC)
+	nsec3s := make(map[string]*dns.NSEC3)
+	parser := dns.NewZoneParser(strings.NewReader(signed), zone, "")
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			nsecs[rr.Hdr.Name] = rr
+		case *dns.NSEC3:
+			nsec3s[strings.ToLower(rr.Hdr.Name)] = rr
+		}
+	}
+	if err := parser.Err(); err != nil {
+		t.Fatalf("%s", err)
+	}
+	return nsecs, nsec3s
+}
+
+func TestSession_NSECSkipsEmptyNonTerminals(t *testing.T) {
+	// Enough names to notice a chain not following the canonical order.
+	zoneText := entZone
+	for i := 0; i < 30; i++ {
+		zoneText += fmt.Sprintf("host%d.example.com.	86400	IN	A	127.0.1.%d\n", i, i)
+	}
+	signed, err := signZone(t, testContext(tools.RsaSha256, false, false), zoneText)
+	if err != nil {
+		t.Fatalf("signing failed: %s", err)
+	}
+	nsecs, _ := denialRRs(t, signed)
+	for _, ent := range entNames {
+		if _, ok := nsecs[ent]; ok {
+			t.Errorf("NSEC RR created for empty non-terminal %s", ent)
+		}
+	}
+	// The chain visits every NSEC owner in canonical order and returns to the apex.
+	name, visited := zone, 0
+	for {
+		nsec, ok := nsecs[name]
+		if !ok {
+			t.Fatalf("NSEC chain broken at %s", name)
+		}
+		visited++
+		if nsec.NextDomain == zone {
+			break
+		}
+		if cmp := (tools.RRArray{nsec, &dns.ANY{Hdr: dns.RR_Header{Name: nsec.NextDomain}}}); !cmp.Less(0, 1) {
+			t.Errorf("NSEC chain not in canonical order: %s before %s", name, nsec.NextDomain)
+		}
+		name = nsec.NextDomain
+	}
+	if visited != len(nsecs) {
+		t.Errorf("NSEC chain visits %d of %d NSEC RRs", visited, len(nsecs))
+	}
+	if err := verifyZone(signed); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+}
+
+func TestSession_NSEC3EmptyNonTerminals(t *testing.T) {
+	signed, err := signZone(t, testContext(tools.RsaSha256, true, false), entZone)
+	if err != nil {
+		t.Fatalf("signing failed: %s", err)
+	}
+	_, nsec3s := denialRRs(t, signed)
+	sample := anyNSEC3(nsec3s)
+	for _, ent := range entNames {
+		nsec3, ok := nsec3s[nsec3Owner(ent, sample)]
+		if !ok {
+			t.Errorf("no NSEC3 RR for empty non-terminal %s", ent)
+			continue
+		}
+		if len(nsec3.TypeBitMap) > 0 {
+			t.Errorf("NSEC3 RR of empty non-terminal %s has types %v", ent, nsec3.TypeBitMap)
+		}
+	}
+	// The wildcard has its own types.
+	if nsec3, ok := nsec3s[nsec3Owner("*.w."+zone, sample)]; !ok || len(nsec3.TypeBitMap) != 2 || nsec3.TypeBitMap[0] != dns.TypeTXT {
+		t.Errorf("wrong NSEC3 RR for the wildcard: %v", nsec3)
+	}
+	if err := verifyZone(signed); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+}
+
+func TestVerify_EmptyNonTerminalDenial(t *testing.T) {
+	signed, err := signZone(t, testContext(tools.RsaSha256, true, false), entZone)
+	if err != nil {
+		t.Fatalf("signing failed: %s", err)
+	}
+	// An NSEC3 RR of an empty non-terminal claiming the types of its descendant.
+	_, nsec3s := denialRRs(t, signed)
+	ent := nsec3s[nsec3Owner("b.c."+zone, anyNSEC3(nsec3s))]
+	wrong := dns.Copy(ent).(*dns.NSEC3)
+	wrong.TypeBitMap = []uint16{dns.TypeA, dns.TypeRRSIG}
+	tampered := strings.Replace(signed, ent.String(), wrong.String(), 1)
+	if tampered == signed {
+		t.Fatalf("NSEC3 RR of the empty non-terminal not found in the signed zone")
+	}
+	if err := verifyZone(tampered); err == nil || !strings.Contains(err.Error(), "empty non-terminal") {
+		t.Errorf("zone with types in the NSEC3 RR of an empty non-terminal verified: %v", err)
+	}
+
+	// An NSEC RR of an empty non-terminal.
+	signed, err = signZone(t, testContext(tools.RsaSha256, false, false), entZone)
+	if err != nil {
+		t.Fatalf("signing failed: %s", err)
+	}
+	extra := "b.c.example.com.	86400	IN	NSEC	c.example.com. RRSIG NSEC\n"
+	if err := verifyZone(signed + extra); err == nil || !strings.Contains(err.Error(), "has no RRsets") {
+		t.Errorf("zone with an NSEC RR for an empty non-terminal verified: %v", err)
+	}
+}
+
+// delegationsZone has a secure delegation, insecure delegations with glue, and an empty non-terminal
+// (unsigned) leading only to an insecure delegation.
+const delegationsZone = fileString + `
+secure.example.com.	86400	IN	NS	ns.secure.example.com.
+secure.example.com.	86400	IN	DS	12345 8 2 0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20
+ns.secure.example.com.	86400	IN	A	127.0.0.10
+insecure.example.com.	86400	IN	NS	ns.insecure.example.com.
+ns.insecure.example.com.	86400	IN	A	127.0.0.11
+child.unsigned.example.com.	86400	IN	NS	ns.other.net.
+`
+
+// nsec3Owner returns the NSEC3 owner name of the name provided, using the parameters of the NSEC3 RR provided.
+func nsec3Owner(name string, sample *dns.NSEC3) string {
+	return strings.ToLower(dns.HashName(name, sample.Hash, sample.Iterations, sample.Salt)) + "." + zone
+}
+
+// anyNSEC3 returns one of the NSEC3 RRs provided.
+func anyNSEC3(nsec3s map[string]*dns.NSEC3) *dns.NSEC3 {
+	for _, nsec3 := range nsec3s {
+		return nsec3
+	}
+	return nil
+}
+
+func TestSession_NSEC3CoversAllDelegations(t *testing.T) {
+	signed, err := signZone(t, testContext(tools.RsaSha256, true, false), delegationsZone)
+	if err != nil {
+		t.Fatalf("signing failed: %s", err)
+	}
+	_, nsec3s := denialRRs(t, signed)
+	sample := anyNSEC3(nsec3s)
+	for _, name := range []string{"secure.example.com.", "insecure.example.com.", "delegate.example.com.", "child.unsigned.example.com.", "unsigned.example.com."} {
+		if _, ok := nsec3s[nsec3Owner(name, sample)]; !ok {
+			t.Errorf("no NSEC3 RR for %s", name)
+		}
+	}
+	for _, name := range []string{"ns.secure.example.com.", "ns.insecure.example.com."} {
+		if _, ok := nsec3s[nsec3Owner(name, sample)]; ok {
+			t.Errorf("NSEC3 RR for glue %s", name)
+		}
+	}
+	for _, nsec3 := range nsec3s {
+		if nsec3.Flags != 0 {
+			t.Errorf("NSEC3 RR with Opt-Out flag without opt-out: %s", nsec3)
+		}
+	}
+	if err := verifyZone(signed); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+}
+
+func TestSession_NSEC3OptOutInsecureDelegations(t *testing.T) {
+	ctx := testContext(tools.RsaSha256, true, false)
+	ctx.Config.OptOut = true
+	signed, err := signZone(t, ctx, delegationsZone)
+	if err != nil {
+		t.Fatalf("signing failed: %s", err)
+	}
+	if !strings.Contains(signed, "\tNSEC3PARAM\t1 0 ") {
+		t.Errorf("NSEC3PARAM flags must be zero")
+	}
+	_, nsec3s := denialRRs(t, signed)
+	sample := anyNSEC3(nsec3s)
+	if _, ok := nsec3s[nsec3Owner("secure.example.com.", sample)]; !ok {
+		t.Errorf("no NSEC3 RR for the secure delegation")
+	}
+	for _, name := range []string{"insecure.example.com.", "delegate.example.com.", "child.unsigned.example.com.", "unsigned.example.com."} {
+		if _, ok := nsec3s[nsec3Owner(name, sample)]; ok {
+			t.Errorf("NSEC3 RR for %s, which leads only to insecure delegations", name)
+		}
+		// The span covering the name has the Opt-Out flag.
+		hash := strings.ToUpper(strings.TrimSuffix(nsec3Owner(name, sample), "."+zone))
+		covered := false
+		for _, nsec3 := range nsec3s {
+			owner := strings.ToUpper(strings.TrimSuffix(nsec3.Hdr.Name, "."+zone))
+			if owner < hash && (hash < nsec3.NextDomain || nsec3.NextDomain < owner) || owner > nsec3.NextDomain && hash < nsec3.NextDomain {
+				covered = true
+				if nsec3.Flags&1 == 0 {
+					t.Errorf("NSEC3 RR covering %s without Opt-Out flag: %s", name, nsec3)
+				}
+			}
+		}
+		if !covered {
+			t.Errorf("no NSEC3 RR covers %s", name)
+		}
+	}
+	if err := verifyZone(signed); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+}
@@ -0,0 +1,81 @@
+package tools
+
+import (
+	"github.com/miekg/dns"
+)
+
+// removeOccludedRRs removes from the zone the RRs the zone is not authoritative for, so they are not signed
+// nor added to the denial of existence chain: names below a DNAME, RRs below a delegation that are not glue
+// (A and AAAA RRs of the name servers of the delegation), and RRs at a delegation other than NS, DS and glue.
+// Each removed RR is logged.
+func (ctx *Context) removeOccludedRRs() {
+	dnames := make(map[string]struct{})
+	nsTargets := make(map[string]struct{}) // Name servers of the delegations
+	for _, rr := range ctx.rrs {
+		switch rr := rr.(type) {
+		case *dns.DNAME:
+			dnames[rr.Hdr.Name] = struct{}{}
+		case *dns.NS:
+			if _, isCut := ctx.DelegatedZones[rr.Hdr.Name]; isCut {
+				nsTargets[rr.Ns] = struct{}{}
+			}
+		}
+	}
+	rrs := make(RRArray, 0, len(ctx.rrs))
+	glue := 0
+	for _, rr := range ctx.rrs {
+		name, rrtype := rr.Header().Name, rr.Header().Rrtype
+		_, isNSTarget := nsTargets[name]
+		isGlue := isNSTarget && (rrtype == dns.TypeA || rrtype == dns.TypeAAAA)
+		_, isCut := ctx.DelegatedZones[name]
+		switch {
+		case ctx.isBelowDNAME(name, dnames):
+			ctx.Log.Printf("[Warn ] Removing RR occluded by a DNAME: %s", rr)
+		case ctx.isBelowZoneCut(name) && !isGlue:
+			ctx.Log.Printf("[Warn ] Removing RR below a delegation that is not glue: %s", rr)
+		case isCut && !isGlue && rrtype != dns.TypeNS && rrtype != dns.TypeDS:
+			ctx.Log.Printf("[Warn ] Removing RR at a delegation that is not NS, DS or glue: %s", rr)
+		default:
+			if isGlue && (isCut || ctx.isBelowZoneCut(name)) {
+				glue++
+			}
+			rrs = append(rrs, rr)
+		}
+	}
+	if removed := len(ctx.rrs) - len(rrs); removed > 0 {
+		ctx.Log.Printf("Removed %d occluded RRs", removed)
+	}
+	if glue > 0 {
+		ctx.Log.Printf("Keeping %d glue RRs unsigned", glue)
+	}
+	ctx.rrs = rrs
+}
+
+// isBelowDNAME returns true if the owner name is below one of the DNAME owners provided.
+func (ctx *Context) isBelowDNAME(ownerName string, dnames map[string]struct{}) bool {
+	if len(dnames) == 0 {
+		return false
+	}
+	if _, ok := dnames[ctx.Config.Zone]; ok && ownerName != ctx.Config.Zone {
+		return true
+	}
+	for _, ancestor := range ctx.ancestors(ownerName) {
+		if _, ok := dnames[ancestor]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isSignedRRSet returns true if the RRset has to be signed. The zone is not authoritative for the NS RRsets
+// of its delegations and for glue, so they are not signed.
+func (ctx *Context) isSignedRRSet(set RRArray) bool {
+	name, rrtype := set[0].Header().Name, set[0].Header().Rrtype
+	if ctx.isBelowZoneCut(name) {
+		return false
+	}
+	if _, isCut := ctx.DelegatedZones[name]; isCut {
+		return rrtype == dns.TypeDS || rrtype == dns.TypeNSEC
+	}
+	return true
+}
@@ -0,0 +1,74 @@
+package tools_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/niclabs/dns-tools/tools"
+)
+
+// occludedZone has names below a DNAME and below a secure delegation, besides the A RR at
+// delegate.example.com. of fileString, which is not glue.
+const occludedZone = fileString + `
+dname.example.com.	86400	IN	DNAME	other.net.
+www.dname.example.com.	86400	IN	A	127.0.0.20
+deleg.example.com.	86400	IN	NS	ns.deleg.example.com.
+deleg.example.com.	86400	IN	DS	12345 8 2 0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20
+ns.deleg.example.com.	86400	IN	A	127.0.0.21
+txt.deleg.example.com.	86400	IN	TXT	"occluded"
+`
+
+// ownedRRs returns the lines of the signed zone owned by the name provided.
+func ownedRRs(signed, name string) []string {
+	lines := make([]string, 0)
+	for _, line := range strings.Split(signed, "\n") {
+		if strings.HasPrefix(line, name+"\t") {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func TestSession_SignRemovesOccludedRRs(t *testing.T) {
+	for _, nsec3 := range []bool{false, true} {
+		signed, err := signZone(t, testContext(tools.RsaSha256, nsec3, false), occludedZone)
+		if err != nil {
+			t.Fatalf("signing failed: %s", err)
+		}
+		for _, name := range []string{"www.dname.example.com.", "txt.deleg.example.com."} {
+			if rrs := ownedRRs(signed, name); len(rrs) > 0 {
+				t.Errorf("occluded RRs kept: %v", rrs)
+			}
+		}
+		if strings.Contains(signed, "127.0.0.4") {
+			t.Errorf("A RR at a delegation that is not glue kept")
+		}
+		// Glue is kept, but it is not signed nor in the NSEC chain.
+		if glue := ownedRRs(signed, "ns.deleg.example.com."); len(glue) != 1 || !strings.Contains(glue[0], "127.0.0.21") {
+			t.Errorf("glue should be kept alone, found %v", glue)
+		}
+		// At the delegation, only the DS and NSEC RRsets are signed.
+		for _, rr := range ownedRRs(signed, "deleg.example.com.") {
+			if strings.Contains(rr, "\tRRSIG\tNS ") {
+				t.Errorf("delegation NS RRset signed")
+			}
+		}
+		if !strings.Contains(signed, "deleg.example.com.\t86400\tIN\tRRSIG\tDS ") {
+			t.Errorf("DS RRset of the delegation not signed")
+		}
+		nsecs, nsec3s := denialRRs(t, signed)
+		for _, name := range []string{"www.dname.example.com.", "txt.deleg.example.com.", "ns.deleg.example.com."} {
+			if _, ok := nsecs[name]; ok {
+				t.Errorf("NSEC RR for %s", name)
+			}
+			if nsec3 && len(nsec3s) > 0 {
+				if _, ok := nsec3s[nsec3Owner(name, anyNSEC3(nsec3s))]; ok {
+					t.Errorf("NSEC3 RR for %s", name)
+				}
+			}
+		}
+		if err := verifyZone(signed); err != nil {
+			t.Errorf("Error verifying output: %s", err)
+		}
+	}
+}
@@ -0,0 +1,460 @@
+package tools
+
+import (
+	"crypto"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// KeyBundleVersion is the version of the Key Signing Request and Signed Key Response formats.
+const KeyBundleVersion = 1
+
+// KeyBundle is a DNSKEY RRset with its RRSIGs, valid for a period of time. In a Key Signing Request
+// the RRset contains the ZSKs, and the RRSIGs are made by them to prove that the requester holds
+// them. In a Signed Key Response the RRset also contains the KSK, and the RRSIGs are made by it.
+type KeyBundle struct {
+	Inception  time.Time `json:"inception"`  // Inception of the RRSIGs of the bundle
+	Expiration time.Time `json:"expiration"` // Expiration of the RRSIGs of the bundle
+	DNSKEYs    []string  `json:"dnskeys"`    // DNSKEY RRs, in presentation format
+	RRSIGs     []string  `json:"rrsigs"`     // RRSIG RRs covering the DNSKEY RRset, in presentation format
+}
+
+// KeySigningRequest (KSR) contains the ZSK bundles that the offline KSK has to sign.
+type KeySigningRequest struct {
+	Version   int          `json:"version"`
+	ID        string       `json:"id"`        // Random identifier of the request
+	Zone      string       `json:"zone"`      // Zone name
+	Algorithm uint8        `json:"algorithm"` // DNSSEC algorithm of the keys
+	Bundles   []*KeyBundle `json:"bundles"`   // ZSK bundles, sorted by inception
+}
+
+// SignedKeyResponse (SKR) contains the DNSKEY RRsets signed by the offline KSK for each bundle
+// of a Key Signing Request.
+type SignedKeyResponse struct {
+	Version   int          `json:"version"`
+	RequestID string       `json:"request_id"` // Identifier of the signed request
+	Zone      string       `json:"zone"`       // Zone name
+	Algorithm uint8        `json:"algorithm"`  // DNSSEC algorithm of the keys
+	Bundles   []*KeyBundle `json:"bundles"`    // Signed DNSKEY bundles, sorted by inception
+}
+
+// KSRSchedule defines the validity periods of the bundles of a Key Signing Request.
+type KSRSchedule struct {
+	Start    time.Time // Inception of the first bundle
+	Bundles  int       // Number of bundles
+	Interval string    // Time between the inceptions of two consecutive bundles, in human readable format
+	Validity string    // Validity of the signatures of each bundle, in human readable format
+	TTL      uint32    // TTL of the DNSKEY RRset
+}
+
+// CreateKSR creates a Key Signing Request with the ZSK of the session and the extra DNSKEYs provided
+// (for example, the next ZSK of a rollover), for each period of the schedule. Each bundle is signed
+// with the ZSK of the session.
+func (ctx *Context) CreateKSR(session SignSession, extra []*dns.DNSKEY, schedule *KSRSchedule) (*KeySigningRequest, error) {
+	if schedule.Bundles < 1 {
+		return nil, fmt.Errorf("a KSR needs at least one bundle")
+	}
+	keys, err := session.GetKeys()
+	if err != nil {
+		return nil, err
+	}
+	if keys.zskSigner == nil {
+		return nil, fmt.Errorf("session does not provide a ZSK")
+	}
+	zskBytes, _, err := session.GetPublicKeyBytes(keys)
+	if err != nil {
+		return nil, err
+	}
+	zsk := &dns.DNSKEY{
+		Hdr: dns.RR_Header{
+			Name:   ctx.Config.Zone,
+			Rrtype: dns.TypeDNSKEY,
+			Class:  dns.ClassINET,
+			Ttl:    schedule.TTL,
+		},
+		Flags:     256,
+		Protocol:  3,
+		Algorithm: uint8(ctx.SignAlgorithm),
+		PublicKey: base64.StdEncoding.EncodeToString(zskBytes),
+	}
+	rrSet := RRArray{zsk}
+	for _, key := range extra {
+		if err := checkZSK(key, ctx.Config.Zone, uint8(ctx.SignAlgorithm)); err != nil {
+			return nil, err
+		}
+		copied := dns.Copy(key).(*dns.DNSKEY)
+		copied.Hdr.Ttl = schedule.TTL
+		if !containsDNSKEY(rrSet, copied) {
+			rrSet = append(rrSet, copied)
+		}
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	ksr := &KeySigningRequest{
+		Version:   KeyBundleVersion,
+		ID:        hex.EncodeToString(id),
+		Zone:      ctx.Config.Zone,
+		Algorithm: uint8(ctx.SignAlgorithm),
+		Bundles:   make([]*KeyBundle, schedule.Bundles),
+	}
+	// RRSIG times have a precision of seconds
+	inception := schedule.Start.UTC().Truncate(time.Second)
+	for i := range ksr.Bundles {
+		expiration, err := DurationToTime(inception, schedule.Validity)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bundle validity: %s", err)
+		}
+		next, err := DurationToTime(inception, schedule.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bundle interval: %s", err)
+		}
+		if !next.After(inception) {
+			return nil, fmt.Errorf("bundle interval must be positive")
+		}
+		if expiration.Before(next) {
+			return nil, fmt.Errorf("bundle validity is shorter than the interval between bundles, so there would be periods without a valid bundle")
+		}
+		bundle := &KeyBundle{
+			Inception:  inception,
+			Expiration: expiration,
+		}
+		rrSig, err := signDNSKEYBundle(rrSet, zsk, keys.zskSigner, bundle)
+		if err != nil {
+			return nil, fmt.Errorf("cannot sign bundle %d with the ZSK: %s", i+1, err)
+		}
+		bundle.DNSKEYs, bundle.RRSIGs = rrStrings(rrSet), []string{rrSig.String()}
+		ksr.Bundles[i] = bundle
+		inception = next
+	}
+	ctx.Log.Printf("KSR %s created with %d bundles of %d ZSKs, from %s to %s", ksr.ID, len(ksr.Bundles), len(rrSet),
+		ksr.Bundles[0].Inception.Format(time.RFC3339), ksr.Bundles[len(ksr.Bundles)-1].Expiration.Format(time.RFC3339))
+	return ksr, nil
+}
+
+// SignKSR checks the bundles of a Key Signing Request and signs them with the KSK of the session,
+// returning the Signed Key Response. The zone and the sign algorithm of the context are taken from the request.
+func (ctx *Context) SignKSR(session SignSession, ksr *KeySigningRequest) (*SignedKeyResponse, error) {
+	if ksr.Version != KeyBundleVersion {
+		return nil, fmt.Errorf("KSR version %d not supported", ksr.Version)
+	}
+	if len(ksr.Bundles) == 0 {
+		return nil, fmt.Errorf("KSR has no bundles")
+	}
+	ctx.Config.Zone = NormalizeFQDN(dns.Fqdn(ksr.Zone))
+	ctx.SignAlgorithm = SignAlgorithm(ksr.Algorithm)
+	keys, err := session.GetKeys()
+	if err != nil {
+		return nil, err
+	}
+	if keys.kskSigner == nil {
+		return nil, fmt.Errorf("session does not provide a KSK")
+	}
+	_, kskBytes, err := session.GetPublicKeyBytes(keys)
+	if err != nil {
+		return nil, err
+	}
+	skr := &SignedKeyResponse{
+		Version:   KeyBundleVersion,
+		RequestID: ksr.ID,
+		Zone:      ctx.Config.Zone,
+		Algorithm: ksr.Algorithm,
+		Bundles:   make([]*KeyBundle, len(ksr.Bundles)),
+	}
+	now := time.Now()
+	for i, request := range ksr.Bundles {
+		if i > 0 && request.Inception.After(ksr.Bundles[i-1].Expiration) {
+			return nil, fmt.Errorf("bundle %d starts after the expiration of bundle %d", i+1, i)
+		}
+		if !request.Expiration.After(now) {
+			return nil, fmt.Errorf("bundle %d is already expired", i+1)
+		}
+		zsks, err := ctx.checkKSRBundle(request)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bundle %d: %s", i+1, err)
+		}
+		ksk := &dns.DNSKEY{
+			Hdr:       *zsks[0].Header(),
+			Flags:     257,
+			Protocol:  3,
+			Algorithm: ksr.Algorithm,
+			PublicKey: base64.StdEncoding.EncodeToString(kskBytes),
+		}
+		rrSet := append(zsks, ksk)
+		bundle := &KeyBundle{
+			Inception:  request.Inception,
+			Expiration: request.Expiration,
+		}
+		rrSig, err := signDNSKEYBundle(rrSet, ksk, keys.kskSigner, bundle)
+		if err != nil {
+			return nil, fmt.Errorf("cannot sign bundle %d with the KSK: %s", i+1, err)
+		}
+		bundle.DNSKEYs, bundle.RRSIGs = rrStrings(rrSet), []string{rrSig.String()}
+		skr.Bundles[i] = bundle
+		ctx.Log.Printf("[Bundle %d/%d] DNSKEY RRset signed by KSK %d, valid from %s to %s", i+1, len(ksr.Bundles), ksk.KeyTag(),
+			bundle.Inception.Format(time.RFC3339), bundle.Expiration.Format(time.RFC3339))
+	}
+	return skr, nil
+}
+
+// checkKSRBundle checks that a KSR bundle contains only ZSKs of the zone with the same TTL, and that
+// its RRSIGs are valid signatures of one of them. It returns the ZSKs.
+func (ctx *Context) checkKSRBundle(bundle *KeyBundle) (RRArray, error) {
+	if !bundle.Expiration.After(bundle.Inception) {
+		return nil, fmt.Errorf("expiration is not after inception")
+	}
+	zsks, rrSigs, err := parseKeyBundle(bundle)
+	if err != nil {
+		return nil, err
+	}
+	if len(zsks) == 0 {
+		return nil, fmt.Errorf("bundle has no DNSKEYs")
+	}
+	for _, rr := range zsks {
+		key := rr.(*dns.DNSKEY)
+		if err := checkZSK(key, ctx.Config.Zone, uint8(ctx.SignAlgorithm)); err != nil {
+			return nil, err
+		}
+		if key.Hdr.Ttl != zsks[0].Header().Ttl {
+			return nil, fmt.Errorf("DNSKEYs have different TTLs")
+		}
+	}
+	if err := verifyKeyBundle(zsks, rrSigs, zsks, bundle); err != nil {
+		return nil, fmt.Errorf("ZSK signature: %s", err)
+	}
+	return zsks, nil
+}
+
+// addSKRBundle adds to the zone the DNSKEY RRset and RRSIGs of the SKR bundle valid at the time provided.
+// The bundle must contain the ZSK used to sign the zone.
+func (ctx *Context) addSKRBundle(zsk *dns.DNSKEY, now time.Time) error {
+	skr := ctx.SKR
+	if skr.Version != KeyBundleVersion {
+		return fmt.Errorf("SKR version %d not supported", skr.Version)
+	}
+	if !strings.EqualFold(dns.Fqdn(skr.Zone), ctx.Config.Zone) {
+		return fmt.Errorf("SKR is for zone %s, not %s", skr.Zone, ctx.Config.Zone)
+	}
+	if SignAlgorithm(skr.Algorithm) != ctx.SignAlgorithm {
+		return fmt.Errorf("SKR keys use algorithm %d, but the zone is signed with algorithm %d", skr.Algorithm, ctx.SignAlgorithm)
+	}
+	// The valid bundle with the latest inception is used, so its signatures last longer.
+	var current *KeyBundle
+	for _, bundle := range skr.Bundles {
+		if !bundle.Inception.After(now) && bundle.Expiration.After(now) &&
+			(current == nil || bundle.Inception.After(current.Inception)) {
+			current = bundle
+		}
+	}
+	if current == nil {
+		return fmt.Errorf("SKR has no bundle valid at %s", now.Format(time.RFC3339))
+	}
+	keys, rrSigs, err := parseKeyBundle(current)
+	if err != nil {
+		return fmt.Errorf("invalid SKR bundle: %s", err)
+	}
+	if !containsDNSKEY(keys, zsk) {
+		return fmt.Errorf("ZSK %d is not in the SKR bundle valid from %s", zsk.KeyTag(), current.Inception.Format(time.RFC3339))
+	}
+	ksks := make(RRArray, 0)
+	for _, rr := range keys {
+		if key := rr.(*dns.DNSKEY); key.Flags&dns.SEP != 0 {
+			ksks = append(ksks, key)
+		}
+	}
+	if err := verifyKeyBundle(keys, rrSigs, ksks, current); err != nil {
+		return fmt.Errorf("SKR bundle valid from %s: %s", current.Inception.Format(time.RFC3339), err)
+	}
+	for _, rr := range keys {
+		ctx.registerDNSKEY(rr.(*dns.DNSKEY))
+	}
+	if current.Expiration.Before(ctx.Config.RRSIGExpDate) {
+		ctx.Log.Printf("DNSKEY RRset signatures expire on %s, before the other signatures of the zone. Sign the zone again before that date",
+			current.Expiration.Format(time.RFC3339))
+	}
+	ctx.Log.Printf("Adding DNSKEY RRset of the SKR bundle valid from %s to %s",
+		current.Inception.Format(time.RFC3339), current.Expiration.Format(time.RFC3339))
+	ctx.rrs = append(ctx.rrs, keys...)
+	ctx.rrs = append(ctx.rrs, rrSigs...)
+	return nil
+}
+
+// signDNSKEYBundle signs a DNSKEY RRset with the validity period of the bundle.
+func signDNSKEYBundle(rrSet RRArray, key *dns.DNSKEY, signer crypto.Signer, bundle *KeyBundle) (*dns.RRSIG, error) {
+	rrSig := &dns.RRSIG{
+		Hdr: dns.RR_Header{
+			Ttl: rrSet[0].Header().Ttl,
+		},
+		Algorithm:  key.Algorithm,
+		SignerName: key.Hdr.Name,
+		KeyTag:     key.KeyTag(),
+		Inception:  uint32(bundle.Inception.Unix()),
+		Expiration: uint32(bundle.Expiration.Unix()),
+	}
+	if err := rrSig.Sign(signer, rrSet); err != nil {
+		return nil, err
+	}
+	if err := rrSig.Verify(key, rrSet); err != nil {
+		return nil, fmt.Errorf("RRSig does not validate: %s", err)
+	}
+	return rrSig, nil
+}
+
+// verifyKeyBundle checks that the bundle RRSIGs cover its validity period, that they are valid
+// signatures of the DNSKEY RRset and that at least one of them was made by one of the signers.
+func verifyKeyBundle(keys, rrSigs, signers RRArray, bundle *KeyBundle) error {
+	signed := false
+	for _, rr := range rrSigs {
+		rrSig := rr.(*dns.RRSIG)
+		if rrSig.TypeCovered != dns.TypeDNSKEY {
+			return fmt.Errorf("RRSIG does not cover the DNSKEY RRset")
+		}
+		if rrSig.Inception != uint32(bundle.Inception.Unix()) || rrSig.Expiration != uint32(bundle.Expiration.Unix()) {
+			return fmt.Errorf("RRSIG validity does not match the bundle")
+		}
+		var signer *dns.DNSKEY
+		for _, key := range keys {
+			key := key.(*dns.DNSKEY)
+			if key.KeyTag() == rrSig.KeyTag && key.Algorithm == rrSig.Algorithm {
+				signer = key
+				break
+			}
+		}
+		if signer == nil {
+			return fmt.Errorf("RRSIG made by key %d, which is not in the bundle", rrSig.KeyTag)
+		}
+		if err := rrSig.Verify(signer, keys); err != nil {
+			return fmt.Errorf("RRSIG made by key %d does not validate: %s", rrSig.KeyTag, err)
+		}
+		if containsDNSKEY(signers, signer) {
+			signed = true
+		}
+	}
+	if !signed {
+		return fmt.Errorf("no valid RRSIG made by the expected keys")
+	}
+	return nil
+}
+
+// parseKeyBundle parses the DNSKEYs and RRSIGs of a bundle.
+func parseKeyBundle(bundle *KeyBundle) (keys, rrSigs RRArray, err error) {
+	for _, text := range bundle.DNSKEYs {
+		rr, err := dns.NewRR(text)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot parse DNSKEY: %s", err)
+		}
+		key, ok := rr.(*dns.DNSKEY)
+		if !ok {
+			return nil, nil, fmt.Errorf("%s is not a DNSKEY RR", text)
+		}
+		key.Hdr.Name = NormalizeFQDN(key.Hdr.Name)
+		keys = append(keys, key)
+	}
+	for _, text := range bundle.RRSIGs {
+		rr, err := dns.NewRR(text)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot parse RRSIG: %s", err)
+		}
+		rrSig, ok := rr.(*dns.RRSIG)
+		if !ok {
+			return nil, nil, fmt.Errorf("%s is not a RRSIG RR", text)
+		}
+		rrSig.Hdr.Name = NormalizeFQDN(rrSig.Hdr.Name)
+		rrSig.SignerName = NormalizeFQDN(rrSig.SignerName)
+		rrSigs = append(rrSigs, rrSig)
+	}
+	return keys, rrSigs, nil
+}
+
+// checkZSK returns an error if the DNSKEY is not a ZSK of the zone with the algorithm provided.
+func checkZSK(key *dns.DNSKEY, zone string, algorithm uint8) error {
+	if !strings.EqualFold(key.Hdr.Name, zone) {
+		return fmt.Errorf("DNSKEY %d is not from zone %s", key.KeyTag(), zone)
+	}
+	if key.Flags != 256 || key.Protocol != 3 {
+		return fmt.Errorf("DNSKEY %d is not a ZSK", key.KeyTag())
+	}
+	if key.Algorithm != algorithm {
+		return fmt.Errorf("DNSKEY %d uses algorithm %d instead of %d", key.KeyTag(), key.Algorithm, algorithm)
+	}
+	return nil
+}
+
+// containsDNSKEY returns true if the list contains a DNSKEY with the same data as key, ignoring its TTL.
+func containsDNSKEY(keys RRArray, key *dns.DNSKEY) bool {
+	for _, rr := range keys {
+		other, ok := rr.(*dns.DNSKEY)
+		if ok && strings.EqualFold(other.Hdr.Name, key.Hdr.Name) && other.Flags == key.Flags &&
+			other.Protocol == key.Protocol && other.Algorithm == key.Algorithm && other.PublicKey == key.PublicKey {
+			return true
+		}
+	}
+	return false
+}
+
+// rrStrings returns the presentation format of each RR.
+func rrStrings(rrs RRArray) []string {
+	texts := make([]string, len(rrs))
+	for i, rr := range rrs {
+		texts[i] = rr.String()
+	}
+	return texts
+}
+
+// ReadDNSKEYFiles reads the DNSKEY RRs of zone files in presentation format. Other RRs are ignored.
+func ReadDNSKEYFiles(paths []string) ([]*dns.DNSKEY, error) {
+	keys := make([]*dns.DNSKEY, 0)
+	for _, path := range paths {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read DNSKEY file: %s", err)
+		}
+		parser := dns.NewZoneParser(strings.NewReader(string(content)), "", path)
+		for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+			if key, isKey := rr.(*dns.DNSKEY); isKey {
+				key.Hdr.Name = NormalizeFQDN(key.Hdr.Name)
+				keys = append(keys, key)
+			}
+		}
+		if err := parser.Err(); err != nil {
+			return nil, fmt.Errorf("cannot parse DNSKEY file %s: %s", path, err)
+		}
+	}
+	return keys, nil
+}
+
+// ReadKSRFile reads a Key Signing Request from a JSON file.
+func ReadKSRFile(path string) (*KeySigningRequest, error) {
+	var ksr KeySigningRequest
+	if err := readJSONFile(path, &ksr); err != nil {
+		return nil, fmt.Errorf("cannot read KSR: %s", err)
+	}
+	return &ksr, nil
+}
+
+// ReadSKRFile reads a Signed Key Response from a JSON file.
+func ReadSKRFile(path string) (*SignedKeyResponse, error) {
+	var skr SignedKeyResponse
+	if err := readJSONFile(path, &skr); err != nil {
+		return nil, fmt.Errorf("cannot read SKR: %s", err)
+	}
+	return &skr, nil
+}
+
+// readJSONFile decodes the JSON file in path into value.
+func readJSONFile(path string, value interface{}) error {
+	encoded, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(encoded, value)
+}
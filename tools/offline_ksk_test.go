@@ -0,0 +1,118 @@
+package tools_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/niclabs/dns-tools/tools"
+)
+
+var testSchedule = tools.KSRSchedule{
+	Bundles:  3,
+	Interval: "10 days",
+	Validity: "21 days",
+	TTL:      3600,
+}
+
+// newKeyFileSession returns a file session providing only the key of the role received.
+func newKeyFileSession(t *testing.T, ctx *tools.Context, key string, role tools.KeyRole) tools.SignSession {
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := ioutil.WriteFile(path, []byte(key), 0600); err != nil {
+		t.Fatalf("%s", err)
+	}
+	session, err := ctx.NewSession("file", mapConfig{role.String() + "-keyfile": path}, role)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	return session
+}
+
+// signExpectingError signs the test zone, returning the error of the signing process.
+func signExpectingError(t *testing.T, ctx *tools.Context, session tools.SignSession) error {
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer devNull.Close()
+	defer session.End()
+	ctx.File = bytes.NewBufferString(fileString)
+	ctx.Output = devNull
+	_, err = tools.Sign(session)
+	return err
+}
+
+// createTestSKR creates a KSR with the ZSK starting at start and signs it with the KSK.
+func createTestSKR(t *testing.T, zsk, ksk string, start time.Time) *tools.SignedKeyResponse {
+	ctx := testContext(tools.RsaSha256, false, false)
+	zskSession := newKeyFileSession(t, ctx, zsk, tools.ZSKRole)
+	schedule := testSchedule
+	schedule.Start = start
+	ksr, err := ctx.CreateKSR(zskSession, nil, &schedule)
+	if err != nil {
+		t.Fatalf("cannot create KSR: %s", err)
+	}
+	offline := testContext(0, false, false)
+	offline.Config.Zone = ""
+	kskSession := newKeyFileSession(t, offline, ksk, tools.KSKRole)
+	skr, err := offline.SignKSR(kskSession, ksr)
+	if err != nil {
+		t.Fatalf("cannot sign KSR: %s", err)
+	}
+	return skr
+}
+
+func TestSession_FileSignSKR(t *testing.T) {
+	skr := createTestSKR(t, RSAZSK, RSAKSK, time.Now().Add(-time.Hour))
+	ctx := testContext(tools.RsaSha256, false, false)
+	ctx.SKR = skr
+	session := newKeyFileSession(t, ctx, RSAZSK, tools.ZSKRole)
+	out, err := sign(t, ctx, session)
+	if err != nil {
+		t.Errorf("signing failed: %s", err)
+		return
+	}
+	defer out.Close()
+	if err := ctx.VerifyFile(); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+}
+
+func TestSession_FileSignSKRWithoutValidBundle(t *testing.T) {
+	ctx := testContext(tools.RsaSha256, false, false)
+	ctx.SKR = createTestSKR(t, RSAZSK, RSAKSK, time.Now().AddDate(0, 1, 0))
+	session := newKeyFileSession(t, ctx, RSAZSK, tools.ZSKRole)
+	if err := signExpectingError(t, ctx, session); err == nil {
+		t.Errorf("zone signed with a SKR without bundles valid now")
+	}
+}
+
+func TestSession_FileSignSKRWrongZSK(t *testing.T) {
+	ctx := testContext(tools.RsaSha256, false, false)
+	ctx.SKR = createTestSKR(t, RSAZSK, RSAKSK, time.Now().Add(-time.Hour))
+	session := newKeyFileSession(t, ctx, RSAKSK, tools.ZSKRole)
+	if err := signExpectingError(t, ctx, session); err == nil {
+		t.Errorf("zone signed with a ZSK that is not in the SKR")
+	}
+}
+
+func TestOfflineKSK_SignKSRChecksZSKSignatures(t *testing.T) {
+	ctx := testContext(tools.RsaSha256, false, false)
+	session := newKeyFileSession(t, ctx, RSAZSK, tools.ZSKRole)
+	schedule := testSchedule
+	schedule.Start = time.Now()
+	ksr, err := ctx.CreateKSR(session, nil, &schedule)
+	if err != nil {
+		t.Fatalf("cannot create KSR: %s", err)
+	}
+	// A key added to the request after it was created is not signed by the ZSK.
+	other := ksr.Bundles[0].DNSKEYs[0]
+	ksr.Bundles[1].DNSKEYs = append(ksr.Bundles[1].DNSKEYs, other[:len(other)-4]+"AQAB")
+	kskSession := newKeyFileSession(t, ctx, RSAKSK, tools.KSKRole)
+	if _, err := ctx.SignKSR(kskSession, ksr); err == nil {
+		t.Errorf("KSR with a modified bundle signed")
+	}
+}
@@ -0,0 +1,215 @@
+package tools
+
+import (
+	"crypto"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/miekg/pkcs11"
+)
+
+// checkZone is the zone used in test signatures if the context does not define one.
+const checkZone = "dns-tools-check."
+
+// Token flags reported by the check. The ones marked as problems make the check fail.
+var p11TokenFlags = []struct {
+	flag    uint
+	name    string
+	problem bool
+}{
+	{pkcs11.CKF_RNG, "RNG", false},
+	{pkcs11.CKF_WRITE_PROTECTED, "WRITE_PROTECTED", false},
+	{pkcs11.CKF_LOGIN_REQUIRED, "LOGIN_REQUIRED", false},
+	{pkcs11.CKF_USER_PIN_INITIALIZED, "USER_PIN_INITIALIZED", false},
+	{pkcs11.CKF_RESTORE_KEY_NOT_NEEDED, "RESTORE_KEY_NOT_NEEDED", false},
+	{pkcs11.CKF_CLOCK_ON_TOKEN, "CLOCK_ON_TOKEN", false},
+	{pkcs11.CKF_PROTECTED_AUTHENTICATION_PATH, "PROTECTED_AUTHENTICATION_PATH", false},
+	{pkcs11.CKF_DUAL_CRYPTO_OPERATIONS, "DUAL_CRYPTO_OPERATIONS", false},
+	{pkcs11.CKF_TOKEN_INITIALIZED, "TOKEN_INITIALIZED", false},
+	{pkcs11.CKF_SECONDARY_AUTHENTICATION, "SECONDARY_AUTHENTICATION", false},
+	{pkcs11.CKF_USER_PIN_COUNT_LOW, "USER_PIN_COUNT_LOW", false},
+	{pkcs11.CKF_USER_PIN_FINAL_TRY, "USER_PIN_FINAL_TRY", true},
+	{pkcs11.CKF_USER_PIN_LOCKED, "USER_PIN_LOCKED", true},
+	{pkcs11.CKF_USER_PIN_TO_BE_CHANGED, "USER_PIN_TO_BE_CHANGED", true},
+	{pkcs11.CKF_SO_PIN_COUNT_LOW, "SO_PIN_COUNT_LOW", false},
+	{pkcs11.CKF_SO_PIN_FINAL_TRY, "SO_PIN_FINAL_TRY", false},
+	{pkcs11.CKF_SO_PIN_LOCKED, "SO_PIN_LOCKED", false},
+	{pkcs11.CKF_SO_PIN_TO_BE_CHANGED, "SO_PIN_TO_BE_CHANGED", false},
+	{pkcs11.CKF_ERROR_STATE, "ERROR_STATE", true},
+}
+
+// Names of the mechanisms related to DNSSEC signing. Other mechanisms are reported by number.
+var p11MechanismNames = map[uint]string{
+	pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN: "RSA_PKCS_KEY_PAIR_GEN",
+	pkcs11.CKM_RSA_PKCS:              "RSA_PKCS",
+	pkcs11.CKM_SHA256_RSA_PKCS:       "SHA256_RSA_PKCS",
+	pkcs11.CKM_SHA512_RSA_PKCS:       "SHA512_RSA_PKCS",
+	pkcs11.CKM_EC_KEY_PAIR_GEN:       "EC_KEY_PAIR_GEN",
+	pkcs11.CKM_ECDSA:                 "ECDSA",
+	pkcs11.CKM_ECDSA_SHA256:          "ECDSA_SHA256",
+	pkcs11.CKM_SHA256:                "SHA256",
+	pkcs11.CKM_SHA384:                "SHA384",
+	pkcs11.CKM_SHA512:                "SHA512",
+}
+
+// Mechanisms used by PKCS11RRSigner for each sign algorithm.
+var p11SignMechanism = map[SignAlgorithm]uint{
+	RsaSha256:       pkcs11.CKM_RSA_PKCS,
+	EcdsaP256Sha256: pkcs11.CKM_ECDSA,
+}
+
+// PKCS11CheckReport contains the results of the health check of a PKCS#11 target.
+type PKCS11CheckReport struct {
+	Target     PKCS11Target      // Checked target
+	TokenLabel string            // Label of the token in the slot
+	TokenFlags []string          // Flags set in the token
+	Mechanisms []string          // Mechanisms supported by the token
+	Keys       map[string]uint16 // Key tags of the keys found, by role (zsk or ksk)
+	Problems   []string          // Problems found. If it is empty, the target is usable.
+}
+
+// OK returns true if the check found no problems.
+func (report *PKCS11CheckReport) OK() bool {
+	return len(report.Problems) == 0
+}
+
+func (report *PKCS11CheckReport) addProblem(format string, args ...interface{}) {
+	report.Problems = append(report.Problems, fmt.Sprintf(format, args...))
+}
+
+// CheckPKCS11Targets opens a session in each target and checks that it is usable to sign the zone:
+// the token is in a good state, it supports the mechanisms needed by the sign algorithm and the zone keys
+// are present and produce signatures that can be verified. It returns a report for each target.
+func (ctx *Context) CheckPKCS11Targets(key, label string, targets []PKCS11Target) []*PKCS11CheckReport {
+	reports := make([]*PKCS11CheckReport, len(targets))
+	for i, target := range targets {
+		session, err := ctx.newPKCS11Session(key, label, target)
+		if err != nil {
+			reports[i] = &PKCS11CheckReport{Target: target}
+			reports[i].addProblem("cannot open session: %s", err)
+			continue
+		}
+		reports[i] = session.check()
+		reports[i].Target = target
+		if err := session.End(); err != nil {
+			reports[i].addProblem("cannot end session: %s", err)
+		}
+	}
+	return reports
+}
+
+// check checks the state of the token and the keys of the session.
+func (session *PKCS11Session) check() *PKCS11CheckReport {
+	ctx := session.Context()
+	report := &PKCS11CheckReport{
+		Keys: make(map[string]uint16),
+	}
+	info, err := session.P11Context.GetTokenInfo(session.slot)
+	if err != nil {
+		report.addProblem("cannot get token info: %s", err)
+	} else {
+		report.TokenLabel = info.Label
+		for _, f := range p11TokenFlags {
+			if info.Flags&f.flag != 0 {
+				report.TokenFlags = append(report.TokenFlags, f.name)
+				if f.problem {
+					report.addProblem("token flag %s is set", f.name)
+				}
+			}
+		}
+		if info.Flags&pkcs11.CKF_TOKEN_INITIALIZED == 0 {
+			report.addProblem("token is not initialized")
+		}
+	}
+	mechanisms, err := session.P11Context.GetMechanismList(session.slot)
+	if err != nil {
+		report.addProblem("cannot get mechanism list: %s", err)
+	} else {
+		signMechanism, ok := p11SignMechanism[ctx.SignAlgorithm]
+		if !ok {
+			report.addProblem("undefined sign algorithm")
+		}
+		found := false
+		for _, m := range mechanisms {
+			name, ok := p11MechanismNames[m.Mechanism]
+			if !ok {
+				name = fmt.Sprintf("0x%08x", m.Mechanism)
+			}
+			report.Mechanisms = append(report.Mechanisms, name)
+			if m.Mechanism == signMechanism {
+				found = true
+			}
+		}
+		sort.Strings(report.Mechanisms)
+		if signMechanism != 0 && !found {
+			report.addProblem("mechanism %s needed by the sign algorithm is not supported", p11MechanismNames[signMechanism])
+		}
+	}
+	keys, err := session.searchValidKeys()
+	if err != nil {
+		report.addProblem("zone keys with label %s not found: %s", session.Label, err)
+		return report
+	}
+	zskBytes, kskBytes, err := session.GetPublicKeyBytes(keys)
+	if err != nil {
+		report.addProblem("cannot get public keys: %s", err)
+		return report
+	}
+	for _, k := range []struct {
+		role   string
+		flags  uint16
+		signer crypto.Signer
+		bytes  []byte
+	}{
+		{"zsk", 256, keys.zskSigner, zskBytes},
+		{"ksk", 257, keys.kskSigner, kskBytes},
+	} {
+		tag, err := checkSigner(ctx, k.flags, k.signer, k.bytes)
+		if err != nil {
+			report.addProblem("test signature with %s failed: %s", k.role, err)
+			continue
+		}
+		report.Keys[k.role] = tag
+	}
+	return report
+}
+
+// checkSigner signs a test RRSet with the signer provided and verifies the signature using
+// the public key bytes provided. It returns the key tag of the key.
+func checkSigner(ctx *Context, flags uint16, signer crypto.Signer, publicKey []byte) (uint16, error) {
+	zone := ctx.Config.Zone
+	if len(zone) == 0 {
+		zone = checkZone
+	}
+	dnskey := &dns.DNSKEY{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeDNSKEY,
+			Class:  dns.ClassINET,
+		},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: uint8(ctx.SignAlgorithm),
+		PublicKey: base64.StdEncoding.EncodeToString(publicKey),
+	}
+	rrSet := RRArray{&dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   "_check." + zone,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		},
+		Txt: []string{fmt.Sprintf("dns-tools check %d", time.Now().Unix())},
+	}}
+	rrSig := CreateNewRRSIG(zone, dnskey, time.Now().Add(time.Hour), 3600)
+	if err := rrSig.Sign(signer, rrSet); err != nil {
+		return 0, fmt.Errorf("cannot sign: %s", err)
+	}
+	if err := rrSig.Verify(dnskey, rrSet); err != nil {
+		return 0, fmt.Errorf("signature does not validate: %s", err)
+	}
+	return dnskey.KeyTag(), nil
+}
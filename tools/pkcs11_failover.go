@@ -0,0 +1,154 @@
+package tools
+
+import (
+	"crypto"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// PKCS11Target identifies a PKCS#11 module and the slot of the token with the zone keys.
+type PKCS11Target struct {
+	Lib  string // Full path to the PKCS#11 module
+	Slot int    // Position of the slot in the list of slots with a token present (0 is the first one)
+}
+
+// String returns a printable representation of the target.
+func (target PKCS11Target) String() string {
+	return fmt.Sprintf("%s#%d", target.Lib, target.Slot)
+}
+
+// PKCS11FailoverSession groups PKCS#11 sessions over several tokens holding the same keys.
+// Signatures are requested to the first session able to produce them, moving to the next
+// one when a session fails.
+type PKCS11FailoverSession struct {
+	ctx      *Context
+	Sessions []*PKCS11Session // Sessions, in the order they are used
+	current  int              // Index of the session currently used to sign
+	zskBytes []byte           // Public ZSK, as exposed by all the sessions
+	kskBytes []byte           // Public KSK, as exposed by all the sessions
+}
+
+// Context returns the session context
+func (session *PKCS11FailoverSession) Context() *Context {
+	return session.ctx
+}
+
+// GetKeys retrieves the keys from every session and checks they are the same keys,
+// comparing their DNSKEY key tags. It returns signers that fall over to the next
+// session when one fails to sign.
+func (session *PKCS11FailoverSession) GetKeys() (*SigKeys, error) {
+	ctx := session.Context()
+	if ctx.Config.CreateKeys && len(session.Sessions) > 1 {
+		return nil, fmt.Errorf("cannot create the same keys in %d PKCS#11 targets. "+
+			"Create them in one target and replicate them to the others", len(session.Sessions))
+	}
+	zskSigner := &failoverRRSigner{Session: session}
+	kskSigner := &failoverRRSigner{Session: session}
+	var zskTag, kskTag uint16
+	for i, s := range session.Sessions {
+		keys, err := s.GetKeys()
+		if err != nil {
+			return nil, fmt.Errorf("cannot get keys from %s: %s", s.target(), err)
+		}
+		zskBytes, kskBytes, err := s.GetPublicKeyBytes(keys)
+		if err != nil {
+			return nil, fmt.Errorf("cannot get public keys from %s: %s", s.target(), err)
+		}
+		curZSKTag := keyTag(256, ctx.SignAlgorithm, zskBytes)
+		curKSKTag := keyTag(257, ctx.SignAlgorithm, kskBytes)
+		ctx.Log.Printf("target %s exposes keys zsk=%d ksk=%d", s.target(), curZSKTag, curKSKTag)
+		if i == 0 {
+			zskTag, kskTag = curZSKTag, curKSKTag
+			session.zskBytes, session.kskBytes = zskBytes, kskBytes
+		} else if curZSKTag != zskTag || curKSKTag != kskTag {
+			return nil, fmt.Errorf("target %s exposes different keys (zsk=%d ksk=%d) than %s (zsk=%d ksk=%d)",
+				s.target(), curZSKTag, curKSKTag, session.Sessions[0].target(), zskTag, kskTag)
+		}
+		zskSigner.Signers = append(zskSigner.Signers, keys.zskSigner)
+		kskSigner.Signers = append(kskSigner.Signers, keys.kskSigner)
+	}
+	keys := &SigKeys{}
+	if session.zskBytes != nil {
+		keys.zskSigner = zskSigner
+	}
+	if session.kskBytes != nil {
+		keys.kskSigner = kskSigner
+	}
+	return keys, nil
+}
+
+// GetPublicKeyBytes returns the public key bytes for ZSK and KSK keys, which were
+// retrieved and compared between targets in GetKeys.
+func (session *PKCS11FailoverSession) GetPublicKeyBytes(keys *SigKeys) (zskBytes, kskBytes []byte, err error) {
+	if session.zskBytes == nil && session.kskBytes == nil {
+		err = fmt.Errorf("keys not retrieved from session")
+		return
+	}
+	return session.zskBytes, session.kskBytes, nil
+}
+
+// DestroyAllKeys destroys the keys in all the targets.
+func (session *PKCS11FailoverSession) DestroyAllKeys() error {
+	for _, s := range session.Sessions {
+		if err := s.DestroyAllKeys(); err != nil {
+			return fmt.Errorf("cannot destroy keys in %s: %s", s.target(), err)
+		}
+	}
+	return nil
+}
+
+// End ends the sessions in all the targets. It returns the first error found, if any.
+func (session *PKCS11FailoverSession) End() (err error) {
+	for _, s := range session.Sessions {
+		if e := s.End(); e != nil && err == nil {
+			err = fmt.Errorf("cannot end session in %s: %s", s.target(), e)
+		}
+	}
+	return
+}
+
+// Info returns the signing mode of the session and the names of the libraries of the targets.
+func (session *PKCS11FailoverSession) Info() string {
+	libs := make([]string, len(session.Sessions))
+	for i, s := range session.Sessions {
+		libs[i] = path.Base(s.libPath)
+	}
+	return fmt.Sprintf("mode=pkcs11;libname=%s;", strings.Join(libs, ","))
+}
+
+// restrictRoles makes the sessions in all the targets use only the keys of the roles provided.
+func (session *PKCS11FailoverSession) restrictRoles(roles KeyRole) {
+	for _, s := range session.Sessions {
+		s.restrictRoles(roles)
+	}
+}
+
+// failoverRRSigner signs using the signer of the current session of a failover session,
+// moving to the next session if it fails.
+type failoverRRSigner struct {
+	Session *PKCS11FailoverSession
+	Signers []crypto.Signer // Signers in the same order than the sessions
+}
+
+// Public returns the public key of the signer of the current session.
+func (rs *failoverRRSigner) Public() crypto.PublicKey {
+	return rs.Signers[rs.Session.current].Public()
+}
+
+// Sign signs the digest with the current session, or with the following ones if it fails.
+func (rs *failoverRRSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	errs := make([]string, 0)
+	for i := rs.Session.current; i < len(rs.Signers); i++ {
+		sig, err := rs.Signers[i].Sign(rand, digest, opts)
+		if err == nil {
+			rs.Session.current = i
+			return sig, nil
+		}
+		target := rs.Session.Sessions[i].target()
+		rs.Session.ctx.Log.Printf("target %s failed to sign: %s", target, err)
+		errs = append(errs, fmt.Sprintf("%s: %s", target, err))
+	}
+	return nil, fmt.Errorf("no PKCS#11 target could sign (%s)", strings.Join(errs, "; "))
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/asn1"
 	"encoding/binary"
 	"fmt"
+	"path"
 
 	"github.com/miekg/pkcs11"
 )
@@ -13,11 +14,13 @@ import (
 // used in creation and retrieval of DNS keys.
 type PKCS11Session struct {
 	libPath    string               // Library Path
+	slot       uint                 // Slot ID
 	ctx        *Context             // HSM Tools Context
 	P11Context *pkcs11.Ctx          // PKCS#11 Context
 	Handle     pkcs11.SessionHandle // PKCS11Session Handle
 	Label      string               // Signature Label
 	Key        string               // Signature key
+	roles      KeyRole              // Roles of the keys provided by the session (zero means all)
 }
 
 // Context Returns the session context
@@ -63,11 +66,15 @@ func (session *PKCS11Session) GetPublicKeyBytes(keys *SigKeys) (zskBytes, kskByt
 		err = fmt.Errorf("undefined sign algorithm")
 		return
 	}
-	zskBytes, err = keyFun(keys.zskSigner)
-	if err != nil {
-		return
+	if keys.zskSigner != nil {
+		zskBytes, err = keyFun(keys.zskSigner)
+		if err != nil {
+			return
+		}
+	}
+	if keys.kskSigner != nil {
+		kskBytes, err = keyFun(keys.kskSigner)
 	}
-	kskBytes, err = keyFun(keys.kskSigner)
 	return
 }
 
@@ -83,6 +90,13 @@ func (session *PKCS11Session) DestroyAllKeys() error {
 	if err != nil {
 		return err
 	}
+	if roles := session.providedRoles(); roles != AllRoles {
+		// Only the keys of the roles provided are deleted
+		deleteTemplate = append(deleteTemplate, pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(roles.String())))
+		if objects, err = session.findObject(deleteTemplate); err != nil {
+			return err
+		}
+	}
 	if len(objects) > 0 {
 		session.ctx.Log.Printf("SigKeys found. Deleting them")
 		foundDeleteTemplate := []*pkcs11.Attribute{
@@ -120,40 +134,63 @@ func (session *PKCS11Session) End() error {
 	if err := session.P11Context.CloseSession(session.Handle); err != nil {
 		return err
 	}
-	if err := session.P11Context.Finalize(); err != nil {
-		return err
-	}
-	session.P11Context.Destroy()
-	return nil
+	return releasePKCS11Module(session.libPath)
+}
+
+// Info returns the signing mode of the session and the name of its library.
+func (session *PKCS11Session) Info() string {
+	return fmt.Sprintf("mode=pkcs11;libname=%s;", path.Base(session.libPath))
+}
+
+// target returns a printable representation of the library and slot used by the session.
+func (session *PKCS11Session) target() string {
+	return fmt.Sprintf("%s (slot id %d)", session.libPath, session.slot)
 }
 
 func (session *PKCS11Session) newSigners() (keys *SigKeys, err error) {
 	keys = &SigKeys{}
-	session.ctx.Log.Printf("generating zsk")
-	public, private, err := session.generateKeyPair("zsk")
-	if err != nil {
-		return
-	}
-	keys.zskSigner = &PKCS11RRSigner{
-		Session: session,
-		PK:      public,
-		SK:      private,
-	}
-
-	session.ctx.Log.Printf("generating ksk")
-	public, private, err = session.generateKeyPair("ksk")
-	if err != nil {
-		return
+	roles := session.providedRoles()
+	if roles.Has(ZSKRole) {
+		session.ctx.Log.Printf("generating zsk")
+		public, private, err := session.generateKeyPair("zsk")
+		if err != nil {
+			return nil, err
+		}
+		keys.zskSigner = &PKCS11RRSigner{
+			Session: session,
+			PK:      public,
+			SK:      private,
+		}
 	}
-	keys.kskSigner = &PKCS11RRSigner{
-		Session: session,
-		PK:      public,
-		SK:      private,
+	if roles.Has(KSKRole) {
+		session.ctx.Log.Printf("generating ksk")
+		public, private, err := session.generateKeyPair("ksk")
+		if err != nil {
+			return nil, err
+		}
+		keys.kskSigner = &PKCS11RRSigner{
+			Session: session,
+			PK:      public,
+			SK:      private,
+		}
 	}
 	session.ctx.Log.Printf("keys generated")
 	return
 }
 
+// providedRoles returns the roles of the keys provided by the session.
+func (session *PKCS11Session) providedRoles() KeyRole {
+	if session.roles == 0 {
+		return AllRoles
+	}
+	return session.roles
+}
+
+// restrictRoles makes the session use only the keys of the roles provided.
+func (session *PKCS11Session) restrictRoles(roles KeyRole) {
+	session.roles = roles
+}
+
 // generateKeyPair returns a public-private key handle pair of the signAlgorithm defined
 // for the session.
 func (session *PKCS11Session) generateKeyPair(label string) (pk, sk pkcs11.ObjectHandle, err error) {
@@ -220,7 +257,18 @@ func (session *PKCS11Session) searchValidKeys() (*SigKeys, error) {
 		kskSigner: kskSigner,
 		zskSigner: zskSigner,
 	}
-	found := 0
+	roles := session.providedRoles()
+	found, expected := 0, 0
+	if roles.Has(ZSKRole) {
+		expected += 2
+	} else {
+		validKeys.zskSigner = nil
+	}
+	if roles.Has(KSKRole) {
+		expected += 2
+	} else {
+		validKeys.kskSigner = nil
+	}
 	for _, object := range objects {
 		attr, err := session.P11Context.GetAttributeValue(session.Handle, object, keyTemplate)
 		if err != nil {
@@ -230,6 +278,10 @@ func (session *PKCS11Session) searchValidKeys() (*SigKeys, error) {
 		id := string(attr[1].Value)
 
 		session.ctx.Log.Printf("Checking key class=%v and id=%s", class, id)
+		if (id == "zsk" && !roles.Has(ZSKRole)) || (id == "ksk" && !roles.Has(KSKRole)) {
+			session.ctx.Log.Printf("Ignoring key not used by the session")
+			continue
+		}
 
 		if class == pkcs11.CKO_PUBLIC_KEY {
 			if id == "zsk" {
@@ -257,12 +309,12 @@ func (session *PKCS11Session) searchValidKeys() (*SigKeys, error) {
 	switch {
 	case found == 0:
 		return validKeys, ErrNoValidKeys
-	case found == 4:
+	case found == expected:
 		return validKeys, nil
-	case found > 4:
-		return nil, fmt.Errorf("more keys (%d) than expected (4)", found)
+	case found > expected:
+		return nil, fmt.Errorf("more keys (%d) than expected (%d)", found, expected)
 	default:
-		return nil, fmt.Errorf("less keys (%d) than expected (4)", found)
+		return nil, fmt.Errorf("less keys (%d) than expected (%d)", found, expected)
 	}
 }
 
@@ -211,3 +211,119 @@ func TestSession_PKCS11ExpiredSig(t *testing.T) {
 		t.Errorf("Error expected, but nil received")
 	}
 }
+
+func TestSession_PKCS11FailoverSign(t *testing.T) {
+	ctx := &tools.Context{
+		Config: &tools.ContextConfig{
+			Zone:            zone,
+			CreateKeys:      true,
+			NSEC3:           false,
+			OptOut:          false,
+			VerifyThreshold: time.Now(),
+		},
+		SignAlgorithm: tools.RsaSha256,
+		Log:           Log,
+	}
+	targets := []tools.PKCS11Target{
+		{Lib: "/nonexistent/libpkcs11.so"},
+		{Lib: p11Lib},
+	}
+	session, err := ctx.NewPKCS11FailoverSession(p11Key, p11LabelRSA, targets)
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	out, err := sign(t, ctx, session)
+	if err != nil {
+		t.Errorf("signing failed: %s", err)
+		return
+	}
+	defer out.Close()
+	if err := ctx.VerifyFile(); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+}
+
+func TestSession_PKCS11FailoverNoTargets(t *testing.T) {
+	ctx := &tools.Context{
+		Config: &tools.ContextConfig{
+			Zone: zone,
+		},
+		SignAlgorithm: tools.RsaSha256,
+		Log:           Log,
+	}
+	targets := []tools.PKCS11Target{
+		{Lib: "/nonexistent/libpkcs11.so"},
+		{Lib: "/nonexistent/libpkcs11.so", Slot: 1},
+	}
+	if _, err := ctx.NewPKCS11FailoverSession(p11Key, p11LabelRSA, targets); err == nil {
+		t.Errorf("Error expected, but nil received")
+	}
+}
+
+func TestSession_PKCS11FailoverBackendMissingLib(t *testing.T) {
+	ctx := &tools.Context{
+		Config: &tools.ContextConfig{
+			Zone:            zone,
+			CreateKeys:      true,
+			VerifyThreshold: time.Now(),
+		},
+		SignAlgorithm: tools.RsaSha256,
+		Log:           Log,
+	}
+	conf := mapConfig{
+		"user-key":  p11Key,
+		"key-label": p11LabelRSA,
+		"p11lib":    []string{"/nonexistent/libpkcs11.so", p11Lib},
+	}
+	session, err := ctx.NewSession("pkcs11", conf, tools.AllRoles)
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	out, err := sign(t, ctx, session)
+	if err != nil {
+		t.Errorf("signing failed: %s", err)
+		return
+	}
+	defer out.Close()
+	if err := ctx.VerifyFile(); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+}
+
+func TestSession_PKCS11Check(t *testing.T) {
+	ctx := &tools.Context{
+		Config: &tools.ContextConfig{
+			Zone:            zone,
+			CreateKeys:      true,
+			VerifyThreshold: time.Now(),
+		},
+		SignAlgorithm: tools.RsaSha256,
+		Log:           Log,
+	}
+	session, err := ctx.NewPKCS11Session(p11Key, p11LabelRSA, p11Lib)
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	out, err := sign(t, ctx, session)
+	if err != nil {
+		t.Errorf("signing failed: %s", err)
+		return
+	}
+	defer out.Close()
+	targets := []tools.PKCS11Target{{Lib: p11Lib}}
+	for _, report := range ctx.CheckPKCS11Targets(p11Key, p11LabelRSA, targets) {
+		if !report.OK() {
+			t.Errorf("Check failed: %v", report.Problems)
+		}
+		if len(report.Keys) != 2 {
+			t.Errorf("Expected 2 keys, found %d", len(report.Keys))
+		}
+	}
+	reports := ctx.CheckPKCS11Targets(p11Key, "nonexistent-label", targets)
+	if reports[0].OK() {
+		t.Errorf("Check with a label without keys should fail")
+	}
+}
@@ -3,9 +3,61 @@ package tools
 import (
 	"crypto"
 	"fmt"
+	"sync"
+
 	"github.com/miekg/pkcs11"
 )
 
+// p11Modules keeps the PKCS#11 modules loaded by the sessions, so two sessions
+// using different slots of the same module share its initialization.
+var p11Modules = struct {
+	sync.Mutex
+	loaded map[string]*p11Module
+}{loaded: make(map[string]*p11Module)}
+
+type p11Module struct {
+	ctx  *pkcs11.Ctx
+	refs int
+}
+
+// loadPKCS11Module returns an initialized context for the module in the path provided,
+// initializing it if it is not already loaded.
+func loadPKCS11Module(p11lib string) (*pkcs11.Ctx, error) {
+	p11Modules.Lock()
+	defer p11Modules.Unlock()
+	if module, ok := p11Modules.loaded[p11lib]; ok {
+		module.refs++
+		return module.ctx, nil
+	}
+	p := pkcs11.New(p11lib)
+	if p == nil {
+		return nil, fmt.Errorf("error initializing %s: file not found", p11lib)
+	}
+	if err := p.Initialize(); err != nil {
+		p.Destroy()
+		return nil, fmt.Errorf("error initializing %s: %s. (Has the .db RW permission?)", p11lib, err)
+	}
+	p11Modules.loaded[p11lib] = &p11Module{ctx: p, refs: 1}
+	return p, nil
+}
+
+// releasePKCS11Module finalizes the module in the path provided if there are no more sessions using it.
+func releasePKCS11Module(p11lib string) error {
+	p11Modules.Lock()
+	defer p11Modules.Unlock()
+	module, ok := p11Modules.loaded[p11lib]
+	if !ok {
+		return fmt.Errorf("module %s not loaded", p11lib)
+	}
+	module.refs--
+	if module.refs > 0 {
+		return nil
+	}
+	delete(p11Modules.loaded, p11lib)
+	defer module.ctx.Destroy()
+	return module.ctx.Finalize()
+}
+
 func (session *PKCS11Session) getRSAPubKeyBytes(signer crypto.Signer) ([]byte, error) {
 	if session == nil || session.P11Context == nil {
 		return nil, fmt.Errorf("session not initialized")
@@ -0,0 +1,355 @@
+package tools
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+)
+
+// PluginProtocolVersion is the version of the signer plugin protocol implemented by dns-tools.
+//
+// The protocol exchanges JSON objects, one per line. The client sends requests with an id, a method
+// and its params, and the server answers each request, in order, with the same id and either a result
+// or an error. Byte strings are base64 encoded. The methods are:
+//   - hello {version, algorithm}: checks that both sides use the same protocol version and DNSKEY
+//     algorithm. It returns {version, name}. It must be the first request.
+//   - list_keys {}: returns {keys: [{id, role, algorithm}]}, where role is "zsk" or "ksk".
+//   - get_public_key {key_id}: returns {public_key}, the public key field of the DNSKEY.
+//   - sign {key_id, digest, hash}: signs the digest (or the data, if hash is empty) and returns
+//     {signature}, with the format returned by crypto.Signer.
+//   - end {}: ends the session. The server closes the connection after answering it.
+const PluginProtocolVersion = 1
+
+// PluginRequest is a request of the signer plugin protocol.
+type PluginRequest struct {
+	ID     uint64          `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// PluginResponse is a response of the signer plugin protocol.
+type PluginResponse struct {
+	ID     uint64          `json:"id"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// PluginHello contains the params and result of the hello method.
+type PluginHello struct {
+	Version   int           `json:"version"`
+	Algorithm SignAlgorithm `json:"algorithm,omitempty"`
+	Name      string        `json:"name,omitempty"`
+}
+
+// PluginKey describes a key listed by the list_keys method.
+type PluginKey struct {
+	ID        string        `json:"id"`
+	Role      string        `json:"role"`
+	Algorithm SignAlgorithm `json:"algorithm"`
+}
+
+// PluginKeyList is the result of the list_keys method.
+type PluginKeyList struct {
+	Keys []PluginKey `json:"keys"`
+}
+
+// PluginKeyParams are the params of the get_public_key method.
+type PluginKeyParams struct {
+	KeyID string `json:"key_id"`
+}
+
+// PluginPublicKey is the result of the get_public_key method.
+type PluginPublicKey struct {
+	PublicKey []byte `json:"public_key"`
+}
+
+// PluginSignParams are the params of the sign method.
+type PluginSignParams struct {
+	KeyID  string `json:"key_id"`
+	Digest []byte `json:"digest"`
+	Hash   string `json:"hash,omitempty"`
+}
+
+// PluginSignature is the result of the sign method.
+type PluginSignature struct {
+	Signature []byte `json:"signature"`
+}
+
+// PluginError is an error returned by the server in the response of a request.
+type PluginError struct {
+	Method  string // Method of the request
+	Message string // Error message sent by the server
+}
+
+func (err *PluginError) Error() string {
+	return fmt.Sprintf("%s failed: %s", err.Method, err.Message)
+}
+
+// pluginHashes relates the hash names used in the protocol with the hash functions.
+var pluginHashes = map[string]crypto.Hash{
+	"":       crypto.Hash(0),
+	"sha256": crypto.SHA256,
+	"sha384": crypto.SHA384,
+	"sha512": crypto.SHA512,
+}
+
+// pluginHashName returns the name used in the protocol for the hash function provided.
+func pluginHashName(hash crypto.Hash) (string, error) {
+	for name, h := range pluginHashes {
+		if h == hash {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("hash function %d not supported by the plugin protocol", hash)
+}
+
+// PluginClient sends requests of the signer plugin protocol and waits for their responses.
+// It can be used by several goroutines at the same time.
+type PluginClient struct {
+	mutex   sync.Mutex
+	encoder *json.Encoder
+	decoder *json.Decoder
+	lastID  uint64
+}
+
+// NewPluginClient returns a client that writes requests to w and reads the responses from r.
+func NewPluginClient(r io.Reader, w io.Writer) *PluginClient {
+	return &PluginClient{
+		encoder: json.NewEncoder(w),
+		decoder: json.NewDecoder(bufio.NewReader(r)),
+	}
+}
+
+// Call sends a request with the method and params provided and decodes the result into result,
+// if it is not nil. Errors returned by the server are returned as *PluginError.
+func (client *PluginClient) Call(method string, params, result interface{}) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.lastID++
+	req := &PluginRequest{ID: client.lastID, Method: method}
+	if params != nil {
+		encoded, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		req.Params = encoded
+	}
+	if err := client.encoder.Encode(req); err != nil {
+		return fmt.Errorf("cannot send %s request: %s", method, err)
+	}
+	var resp PluginResponse
+	if err := client.decoder.Decode(&resp); err != nil {
+		return fmt.Errorf("cannot read %s response: %s", method, err)
+	}
+	if resp.ID != req.ID {
+		return fmt.Errorf("response id %d does not match request id %d", resp.ID, req.ID)
+	}
+	if len(resp.Error) > 0 {
+		return &PluginError{Method: method, Message: resp.Error}
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(resp.Result, result)
+}
+
+// PluginServer serves the keys of a session with the signer plugin protocol.
+// Keys are identified by their role, "zsk" or "ksk". A server can serve several clients at the same time.
+type PluginServer struct {
+	Session SignSession // Session with the served keys
+	Name    string      // Name returned by hello
+	Audit   *log.Logger // If it is not nil, a line is logged for every request
+	mutex   sync.Mutex
+	keys    *SigKeys
+	zsk     []byte // Public ZSK bytes
+	ksk     []byte // Public KSK bytes
+}
+
+// Serve reads requests from r and writes the responses to w, until the end method is received
+// or r is closed. Sessions are used by one request at a time.
+func (server *PluginServer) Serve(r io.Reader, w io.Writer) error {
+	return server.ServeClient(r, w, "", AllRoles)
+}
+
+// ServeClient serves the requests of a client as Serve does, but the client can only use the keys of
+// the roles provided. The client name is used in the audit log.
+func (server *PluginServer) ServeClient(r io.Reader, w io.Writer, client string, roles KeyRole) error {
+	helloDone := false
+	return servePluginRequests(r, w, func(req *PluginRequest) (interface{}, error) {
+		var result interface{}
+		var err error
+		if !helloDone && req.Method != "hello" {
+			err = fmt.Errorf("hello must be the first request")
+		} else {
+			result, err = server.handle(req, roles)
+			if err == nil && req.Method == "hello" {
+				helloDone = true
+			}
+		}
+		server.audit(client, req, err)
+		return result, err
+	})
+}
+
+// servePluginRequests reads requests from r, answers them with the results returned by handle and writes
+// the responses to w, until the end method is answered successfully or r is closed.
+func servePluginRequests(r io.Reader, w io.Writer, handle func(req *PluginRequest) (interface{}, error)) error {
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	encoder := json.NewEncoder(w)
+	for {
+		var req PluginRequest
+		if err := decoder.Decode(&req); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("cannot read request: %s", err)
+		}
+		resp := &PluginResponse{ID: req.ID}
+		result, err := handle(&req)
+		if err != nil {
+			resp.Error = err.Error()
+		} else if result != nil {
+			if resp.Result, err = json.Marshal(result); err != nil {
+				resp.Error = err.Error()
+			}
+		}
+		if err := encoder.Encode(resp); err != nil {
+			return fmt.Errorf("cannot write response: %s", err)
+		}
+		if req.Method == "end" && len(resp.Error) == 0 {
+			return nil
+		}
+	}
+}
+
+// audit logs a request and its result in the audit log, if it is defined.
+func (server *PluginServer) audit(client string, req *PluginRequest, err error) {
+	if server.Audit == nil {
+		return
+	}
+	var params PluginSignParams // Includes the key_id of get_public_key
+	json.Unmarshal(req.Params, &params)
+	result := "ok"
+	if err != nil {
+		result = "error: " + err.Error()
+	}
+	line := fmt.Sprintf("client=%q method=%s", client, req.Method)
+	if len(params.KeyID) > 0 {
+		line += " key=" + params.KeyID
+	}
+	if req.Method == "sign" {
+		line += fmt.Sprintf(" digest=%x", params.Digest)
+	}
+	server.Audit.Printf("%s result=%q", line, result)
+}
+
+// handle returns the result of a request of a client authorized to use the keys of the roles provided.
+func (server *PluginServer) handle(req *PluginRequest, roles KeyRole) (interface{}, error) {
+	switch req.Method {
+	case "hello":
+		var hello PluginHello
+		if err := json.Unmarshal(req.Params, &hello); err != nil {
+			return nil, err
+		}
+		if hello.Version != PluginProtocolVersion {
+			return nil, fmt.Errorf("protocol version %d not supported. This server uses version %d", hello.Version, PluginProtocolVersion)
+		}
+		if hello.Algorithm != server.Session.Context().SignAlgorithm {
+			return nil, fmt.Errorf("algorithm %d requested, but the keys use algorithm %d", hello.Algorithm, server.Session.Context().SignAlgorithm)
+		}
+		if err := server.loadKeys(); err != nil {
+			return nil, err
+		}
+		return &PluginHello{Version: PluginProtocolVersion, Name: server.Name}, nil
+	case "list_keys":
+		list := &PluginKeyList{Keys: make([]PluginKey, 0)}
+		algorithm := server.Session.Context().SignAlgorithm
+		for _, role := range []KeyRole{ZSKRole, KSKRole} {
+			if signer, _, _ := server.key(role.String(), roles); signer != nil {
+				list.Keys = append(list.Keys, PluginKey{ID: role.String(), Role: role.String(), Algorithm: algorithm})
+			}
+		}
+		return list, nil
+	case "get_public_key":
+		var params PluginKeyParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		_, public, err := server.key(params.KeyID, roles)
+		if err != nil {
+			return nil, err
+		}
+		return &PluginPublicKey{PublicKey: public}, nil
+	case "sign":
+		var params PluginSignParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		hash, ok := pluginHashes[params.Hash]
+		if !ok {
+			return nil, fmt.Errorf("unknown hash %q", params.Hash)
+		}
+		signer, _, err := server.key(params.KeyID, roles)
+		if err != nil {
+			return nil, err
+		}
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+		sig, err := signer.Sign(rand.Reader, params.Digest, hash)
+		if err != nil {
+			return nil, err
+		}
+		return &PluginSignature{Signature: sig}, nil
+	case "end":
+		return struct{}{}, nil
+	}
+	return nil, fmt.Errorf("unknown method %q", req.Method)
+}
+
+// loadKeys gets the keys of the session, if they were not retrieved before.
+func (server *PluginServer) loadKeys() error {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.keys != nil {
+		return nil
+	}
+	keys, err := server.Session.GetKeys()
+	if err != nil {
+		return fmt.Errorf("cannot get keys: %s", err)
+	}
+	zsk, ksk, err := server.Session.GetPublicKeyBytes(keys)
+	if err != nil {
+		return fmt.Errorf("cannot get public keys: %s", err)
+	}
+	server.keys, server.zsk, server.ksk = keys, zsk, ksk
+	return nil
+}
+
+// key returns the signer and public key bytes of the key with the id provided. It returns an error if the
+// key does not exist or its role is not one of the roles provided.
+func (server *PluginServer) key(id string, roles KeyRole) (crypto.Signer, []byte, error) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	var signer crypto.Signer
+	var public []byte
+	var role KeyRole
+	if server.keys != nil {
+		switch id {
+		case ZSKRole.String():
+			signer, public, role = server.keys.zskSigner, server.zsk, ZSKRole
+		case KSKRole.String():
+			signer, public, role = server.keys.kskSigner, server.ksk, KSKRole
+		}
+	}
+	if signer == nil {
+		return nil, nil, fmt.Errorf("unknown key %q", id)
+	}
+	if !roles.Has(role) {
+		return nil, nil, fmt.Errorf("not authorized to use key %q", id)
+	}
+	return signer, public, nil
+}
@@ -0,0 +1,252 @@
+package tools
+
+import (
+	"crypto"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// PluginSession signs the zone with the keys of a signer that talks the signer plugin protocol.
+// Keys cannot be created or destroyed through the protocol.
+type PluginSession struct {
+	ctx       *Context
+	client    *PluginClient
+	mode      string       // Signing mode, as shown in the info TXT RR
+	name      string       // Name returned by the server in hello
+	zskID     string       // ID of the ZSK. If it is empty, the first ZSK listed is used
+	kskID     string       // ID of the KSK. If it is empty, the first KSK listed is used
+	roles     KeyRole      // Roles of the keys provided by the session. Zero means all of them
+	closer    func() error // Function called at the end of the session
+	zskSigner *pluginSigner
+	kskSigner *pluginSigner
+}
+
+// NewPluginSession creates a new session over a client of the signer plugin protocol.
+// mode is used in the info TXT RR, and closer (if it is not nil) is called when the session ends.
+// zskID and kskID select the keys used, and if they are empty, the first key of each role is used.
+// The sign algorithm is not checked here: it is sent in hello, and the signer rejects it if it does not
+// support it.
+func (ctx *Context) NewPluginSession(client *PluginClient, mode, zskID, kskID string, closer func() error) (*PluginSession, error) {
+	var hello PluginHello
+	err := client.Call("hello", &PluginHello{
+		Version:   PluginProtocolVersion,
+		Algorithm: ctx.SignAlgorithm,
+	}, &hello)
+	if err != nil {
+		return nil, err
+	}
+	if hello.Version != PluginProtocolVersion {
+		return nil, fmt.Errorf("signer uses protocol version %d instead of %d", hello.Version, PluginProtocolVersion)
+	}
+	return &PluginSession{
+		ctx:    ctx,
+		client: client,
+		mode:   mode,
+		name:   hello.Name,
+		zskID:  zskID,
+		kskID:  kskID,
+		closer: closer,
+	}, nil
+}
+
+// NewExecSession starts a plugin binary and creates a session that talks the signer plugin protocol
+// through its standard input and output. The standard error of the plugin is redirected to ours.
+func (ctx *Context) NewExecSession(command string, args []string, zskID, kskID string) (SignSession, error) {
+	if len(command) == 0 {
+		return nil, fmt.Errorf("plugin command not specified")
+	}
+	cmd := exec.Command(command, args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("cannot start plugin: %s", err)
+	}
+	closer := func() error {
+		stdin.Close()
+		return cmd.Wait()
+	}
+	session, err := ctx.NewPluginSession(NewPluginClient(stdout, stdin), "exec", zskID, kskID, closer)
+	if err != nil {
+		closer()
+		return nil, fmt.Errorf("cannot start plugin session: %s", err)
+	}
+	return session, nil
+}
+
+// Context returns the session context
+func (session *PluginSession) Context() *Context {
+	return session.ctx
+}
+
+// GetKeys lists the keys of the signer and returns signers for the selected ones.
+func (session *PluginSession) GetKeys() (*SigKeys, error) {
+	if session.ctx.Config.CreateKeys {
+		return nil, fmt.Errorf("keys cannot be created through the plugin protocol. Create them in the signer")
+	}
+	var list PluginKeyList
+	if err := session.client.Call("list_keys", struct{}{}, &list); err != nil {
+		return nil, err
+	}
+	keys := &SigKeys{}
+	for _, role := range []KeyRole{ZSKRole, KSKRole} {
+		if !session.providedRoles().Has(role) {
+			continue
+		}
+		id := session.zskID
+		if role == KSKRole {
+			id = session.kskID
+		}
+		key, err := selectPluginKey(list.Keys, role, id)
+		if err != nil {
+			return nil, err
+		}
+		if key.Algorithm != session.ctx.SignAlgorithm {
+			return nil, fmt.Errorf("key %s uses algorithm %d instead of %d", key.ID, key.Algorithm, session.ctx.SignAlgorithm)
+		}
+		var public PluginPublicKey
+		if err := session.client.Call("get_public_key", &PluginKeyParams{KeyID: key.ID}, &public); err != nil {
+			return nil, err
+		}
+		publicKey, err := bytesToPublicKey(key.Algorithm, public.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse public key %s: %s", key.ID, err)
+		}
+		signer := &pluginSigner{
+			session:   session,
+			keyID:     key.ID,
+			keyBytes:  public.PublicKey,
+			publicKey: publicKey,
+		}
+		if role == ZSKRole {
+			session.zskSigner, keys.zskSigner = signer, signer
+		} else {
+			session.kskSigner, keys.kskSigner = signer, signer
+		}
+	}
+	return keys, nil
+}
+
+// selectPluginKey returns the key with the id provided, or the first key with the role if id is empty.
+func selectPluginKey(keys []PluginKey, role KeyRole, id string) (*PluginKey, error) {
+	for i, key := range keys {
+		if len(id) > 0 && key.ID == id || len(id) == 0 && key.Role == role.String() {
+			return &keys[i], nil
+		}
+	}
+	if len(id) > 0 {
+		return nil, fmt.Errorf("signer does not have a key with id %q", id)
+	}
+	return nil, fmt.Errorf("signer does not have a %s", role)
+}
+
+// GetPublicKeyBytes returns the public key bytes of the ZSK and KSK, received in GetKeys.
+func (session *PluginSession) GetPublicKeyBytes(keys *SigKeys) (zskBytes, kskBytes []byte, err error) {
+	if session.zskSigner == nil && session.kskSigner == nil {
+		err = fmt.Errorf("keys not retrieved from session")
+		return
+	}
+	if session.zskSigner != nil {
+		zskBytes = session.zskSigner.keyBytes
+	}
+	if session.kskSigner != nil {
+		kskBytes = session.kskSigner.keyBytes
+	}
+	return
+}
+
+// DestroyAllKeys is not supported by plugin sessions.
+func (session *PluginSession) DestroyAllKeys() error {
+	return fmt.Errorf("keys cannot be destroyed through the plugin protocol. Destroy them in the signer")
+}
+
+// End sends the end request and closes the session.
+func (session *PluginSession) End() error {
+	err := session.client.Call("end", struct{}{}, nil)
+	if session.closer != nil {
+		if closeErr := session.closer(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		session.closer = nil
+	}
+	return err
+}
+
+// Info returns the signing mode of the session and the name of the signer.
+func (session *PluginSession) Info() string {
+	if len(session.name) == 0 {
+		return fmt.Sprintf("mode=%s;", session.mode)
+	}
+	return fmt.Sprintf("mode=%s;signer-name=%s;", session.mode, session.name)
+}
+
+// restrictRoles makes the session use only the keys of the roles provided.
+func (session *PluginSession) restrictRoles(roles KeyRole) {
+	session.roles = roles
+}
+
+// providedRoles returns the roles of the keys provided by the session.
+func (session *PluginSession) providedRoles() KeyRole {
+	if session.roles == 0 {
+		return AllRoles
+	}
+	return session.roles
+}
+
+// pluginSigner signs with a key of a plugin session.
+type pluginSigner struct {
+	session   *PluginSession
+	keyID     string           // Key ID in the signer
+	keyBytes  []byte           // DNSKEY public key field
+	publicKey crypto.PublicKey // Parsed public key
+}
+
+// Public returns the public key of the signer.
+func (signer *pluginSigner) Public() crypto.PublicKey {
+	return signer.publicKey
+}
+
+// Sign sends the digest to the signer and returns its signature.
+func (signer *pluginSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash, err := pluginHashName(opts.HashFunc())
+	if err != nil {
+		return nil, err
+	}
+	var sig PluginSignature
+	err = signer.session.client.Call("sign", &PluginSignParams{
+		KeyID:  signer.keyID,
+		Digest: digest,
+		Hash:   hash,
+	}, &sig)
+	if err != nil {
+		return nil, err
+	}
+	return sig.Signature, nil
+}
+
+var execBackend = &SessionBackend{
+	Name:        "exec",
+	Description: "uses an external plugin binary, talking the signer plugin protocol, to sign the zone",
+	Options: []BackendOption{
+		{Name: "plugin", Type: StringOption, Default: "", Usage: "Full path to the plugin binary."},
+		{Name: "plugin-arg", Type: StringSliceOption, Default: []string{}, Usage: "Argument for the plugin binary. It can be repeated."},
+		{Name: "zsk-plugin-key", Type: StringOption, Default: "", Usage: "ID of the ZSK in the plugin. Default is the first ZSK listed."},
+		{Name: "ksk-plugin-key", Type: StringOption, Default: "", Usage: "ID of the KSK in the plugin. Default is the first KSK listed."},
+	},
+	New: func(ctx *Context, conf BackendConfig, roles KeyRole) (SignSession, error) {
+		return ctx.NewExecSession(
+			conf.GetString("plugin"),
+			conf.GetStringSlice("plugin-arg"),
+			conf.GetString("zsk-plugin-key"),
+			conf.GetString("ksk-plugin-key"),
+		)
+	},
+}
@@ -0,0 +1,108 @@
+package tools_test
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/niclabs/dns-tools/tools"
+)
+
+const pluginHelperEnv = "DNS_TOOLS_TEST_PLUGIN"
+
+// TestPluginHelperProcess is not a real test. It is the plugin started by the exec session tests,
+// serving the test file keys of the algorithm defined in pluginHelperEnv.
+func TestPluginHelperProcess(t *testing.T) {
+	algorithm := os.Getenv(pluginHelperEnv)
+	if len(algorithm) == 0 {
+		return
+	}
+	zsk, ksk := RSAZSK, RSAKSK
+	if algorithm == "ecdsa" {
+		zsk, ksk = ECZSK, ECKSK
+	}
+	ctx := &tools.Context{
+		Config:        &tools.ContextConfig{},
+		SignAlgorithm: tools.StringToSignAlgorithm[algorithm],
+		Log:           Log,
+	}
+	session, err := ctx.NewFileSession(&vFile{data: []byte(zsk)}, &vFile{data: []byte(ksk)})
+	if err != nil {
+		os.Exit(1)
+	}
+	server := &tools.PluginServer{Session: session, Name: "test-plugin"}
+	if err := server.Serve(os.Stdin, os.Stdout); err != nil {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func execSignTest(t *testing.T, algorithm string, nsec3 bool) {
+	t.Setenv(pluginHelperEnv, algorithm)
+	ctx := testContext(tools.StringToSignAlgorithm[algorithm], nsec3, false)
+	ctx.Config.Info = true
+	session, err := ctx.NewExecSession(os.Args[0], []string{"-test.run=^TestPluginHelperProcess$"}, "", "")
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	out, err := sign(t, ctx, session)
+	if err != nil {
+		t.Errorf("signing failed: %s", err)
+		return
+	}
+	defer out.Close()
+	if err := ctx.VerifyFile(); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+}
+
+func TestSession_ExecRSASign(t *testing.T) {
+	execSignTest(t, "rsa", false)
+}
+
+func TestSession_ExecECDSASignNSEC3(t *testing.T) {
+	execSignTest(t, "ecdsa", true)
+}
+
+func TestSession_ExecWrongAlgorithm(t *testing.T) {
+	t.Setenv(pluginHelperEnv, "rsa")
+	ctx := testContext(tools.EcdsaP256Sha256, false, false)
+	if _, err := ctx.NewExecSession(os.Args[0], []string{"-test.run=^TestPluginHelperProcess$"}, "", ""); err == nil {
+		t.Errorf("plugin accepted a different algorithm")
+	}
+}
+
+func TestSession_PluginUnknownKey(t *testing.T) {
+	ctx := testContext(tools.RsaSha256, false, false)
+	fileSession, err := ctx.NewFileSession(&vFile{data: []byte(RSAZSK)}, &vFile{data: []byte(RSAKSK)})
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	clientReader, serverWriter := io.Pipe()
+	serverReader, clientWriter := io.Pipe()
+	server := &tools.PluginServer{Session: fileSession}
+	go func() {
+		server.Serve(serverReader, serverWriter)
+		serverWriter.Close()
+	}()
+	client := tools.NewPluginClient(clientReader, clientWriter)
+	if err := client.Call("list_keys", struct{}{}, nil); err == nil {
+		t.Errorf("server accepted a request before hello")
+	}
+	if err := client.Call("hello", &tools.PluginHello{Version: tools.PluginProtocolVersion + 1, Algorithm: tools.RsaSha256}, nil); err == nil {
+		t.Errorf("server accepted a different protocol version")
+	}
+	session, err := ctx.NewPluginSession(client, "test", "unknown", "", nil)
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	if _, err := session.GetKeys(); err == nil {
+		t.Errorf("unknown key was accepted")
+	}
+	if err := session.End(); err != nil {
+		t.Errorf("%s", err)
+	}
+}
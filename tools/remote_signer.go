@@ -0,0 +1,157 @@
+package tools
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// RemoteSignerServer serves the keys of a session to remote clients, using the signer plugin protocol
+// over mutual TLS. Clients are identified by the common name of their certificate, and each of them
+// can only use the keys of the roles it is authorized for.
+type RemoteSignerServer struct {
+	Session    SignSession        // Session with the served keys
+	TLSConfig  *tls.Config        // Server TLS configuration. It must require and verify client certificates
+	Authorized map[string]KeyRole // Roles of the keys each client common name can use
+	Audit      *log.Logger        // Audit log, with a line for every connection and request
+	Log        *log.Logger        // Log for errors not related to a request (optional)
+	plugin     *PluginServer
+	once       sync.Once
+}
+
+// Serve accepts connections on the listener and serves each of them in its own goroutine,
+// until the listener is closed.
+func (server *RemoteSignerServer) Serve(listener net.Listener) error {
+	if server.TLSConfig == nil || server.TLSConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+		return fmt.Errorf("remote signer requires a TLS configuration verifying client certificates")
+	}
+	server.once.Do(func() {
+		server.plugin = &PluginServer{
+			Session: server.Session,
+			Name:    "dns-tools-remote",
+			Audit:   server.Audit,
+		}
+	})
+	tlsListener := tls.NewListener(listener, server.TLSConfig)
+	for {
+		conn, err := tlsListener.Accept()
+		if err != nil {
+			return err
+		}
+		go server.serveConn(conn.(*tls.Conn))
+	}
+}
+
+// serveConn authenticates a client and serves its requests.
+func (server *RemoteSignerServer) serveConn(conn *tls.Conn) {
+	defer conn.Close()
+	remote := conn.RemoteAddr().String()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := conn.Handshake(); err != nil {
+		server.audit("connection from %s rejected: %s", remote, err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		server.audit("connection from %s rejected: no client certificate", remote)
+		return
+	}
+	client := certs[0].Subject.CommonName
+	roles, ok := server.Authorized[client]
+	if !ok || roles == 0 {
+		server.audit("connection from %s rejected: client %q is not authorized", remote, client)
+		return
+	}
+	server.audit("connection from %s accepted: client %q authorized to use %s", remote, client, roles)
+	if err := server.plugin.ServeClient(conn, conn, client, roles); err != nil && server.Log != nil {
+		server.Log.Printf("connection from %s (client %q) ended with error: %s", remote, client, err)
+	}
+	server.audit("connection from %s closed", remote)
+}
+
+func (server *RemoteSignerServer) audit(format string, args ...interface{}) {
+	if server.Audit != nil {
+		server.Audit.Printf(format, args...)
+	}
+}
+
+// NewRemoteSession connects to a remote signer server with the TLS configuration provided,
+// which should include a client certificate, and creates a session using its keys.
+func (ctx *Context) NewRemoteSession(address string, tlsConfig *tls.Config) (SignSession, error) {
+	if len(address) == 0 {
+		return nil, fmt.Errorf("remote signer address not specified")
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to remote signer: %s", err)
+	}
+	session, err := ctx.NewPluginSession(NewPluginClient(conn, conn), "remote", "", "", conn.Close)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("cannot start remote signer session: %s", err)
+	}
+	return session, nil
+}
+
+// NewMutualTLSConfig returns a TLS configuration using the certificate and key in the PEM files provided,
+// and trusting only the certificates signed by the CA in caFile. If server is true, the configuration
+// requires and verifies client certificates. Otherwise, it verifies the server certificate.
+func NewMutualTLSConfig(certFile, keyFile, caFile string, server bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load certificate: %s", err)
+	}
+	caPEM, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CA file: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("CA file %s does not contain PEM certificates", caFile)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if server {
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+var remoteBackend = &SessionBackend{
+	Name:        "remote",
+	Description: "uses the keys of a remote signer (dns-tools signer serve) to sign the zone",
+	Options: []BackendOption{
+		{Name: "remote-address", Type: StringOption, Default: "", Usage: "Address (host:port) of the remote signer."},
+		{Name: "remote-cert", Type: StringOption, Default: "", Usage: "Full path to the PEM client certificate."},
+		{Name: "remote-key", Type: StringOption, Default: "", Usage: "Full path to the PEM client private key."},
+		{Name: "remote-ca", Type: StringOption, Default: "", Usage: "Full path to the PEM CA certificate used to verify the remote signer."},
+		{Name: "remote-server-name", Type: StringOption, Default: "", Usage: "Name expected in the remote signer certificate. Default is the host of --remote-address."},
+	},
+	New: func(ctx *Context, conf BackendConfig, roles KeyRole) (SignSession, error) {
+		tlsConfig, err := NewMutualTLSConfig(conf.GetString("remote-cert"), conf.GetString("remote-key"), conf.GetString("remote-ca"), false)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ServerName = conf.GetString("remote-server-name")
+		if len(tlsConfig.ServerName) == 0 {
+			host, _, err := net.SplitHostPort(conf.GetString("remote-address"))
+			if err != nil {
+				return nil, fmt.Errorf("invalid remote-address: %s", err)
+			}
+			tlsConfig.ServerName = host
+		}
+		return ctx.NewRemoteSession(conf.GetString("remote-address"), tlsConfig)
+	},
+}
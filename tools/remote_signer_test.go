@@ -0,0 +1,294 @@
+package tools_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/niclabs/dns-tools/tools"
+)
+
+// testCA issues the certificates used by the remote signer tests.
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	return &testCA{cert: cert, key: key, serial: 1}
+}
+
+// issue returns a certificate for the common name provided, valid for localhost if server is true.
+func (ca *testCA) issue(t *testing.T, cn string, server bool) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.DNSNames = []string{"localhost"}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// syncBuffer is a buffer that can be written by several goroutines.
+type syncBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+// startRemoteSigner serves the RSA test file keys with the clients authorized provided,
+// and returns the address of the server and its audit log.
+func startRemoteSigner(t *testing.T, ca *testCA, authorized map[string]tools.KeyRole) (string, *syncBuffer) {
+	serverCtx := testContext(tools.RsaSha256, false, false)
+	session, err := serverCtx.NewFileSession(&vFile{data: []byte(RSAZSK)}, &vFile{data: []byte(RSAKSK)})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	audit := &syncBuffer{}
+	server := &tools.RemoteSignerServer{
+		Session: session,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{ca.issue(t, "localhost", true)},
+			ClientCAs:    ca.pool(),
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		},
+		Authorized: authorized,
+		Audit:      log.New(audit, "", 0),
+	}
+	go server.Serve(listener)
+	return listener.Addr().String(), audit
+}
+
+func clientTLSConfig(t *testing.T, ca, clientCA *testCA, cn string) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{clientCA.issue(t, cn, false)},
+		RootCAs:      ca.pool(),
+		ServerName:   "localhost",
+	}
+}
+
+func TestRemoteSigner_Sign(t *testing.T) {
+	ca := newTestCA(t)
+	address, audit := startRemoteSigner(t, ca, map[string]tools.KeyRole{"signer-1": tools.AllRoles})
+	ctx := testContext(tools.RsaSha256, false, false)
+	ctx.Config.Info = true
+	session, err := ctx.NewRemoteSession(address, clientTLSConfig(t, ca, ca, "signer-1"))
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	out, err := sign(t, ctx, session)
+	if err != nil {
+		t.Errorf("signing failed: %s", err)
+		return
+	}
+	defer out.Close()
+	if err := ctx.VerifyFile(); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+	auditLog := audit.String()
+	for _, expected := range []string{
+		`client "signer-1" authorized to use zsk+ksk`,
+		`client="signer-1" method=sign key=ksk digest=`,
+		`client="signer-1" method=sign key=zsk digest=`,
+		`client="signer-1" method=end result="ok"`,
+	} {
+		if !strings.Contains(auditLog, expected) {
+			t.Errorf("audit log does not contain %q:\n%s", expected, auditLog)
+		}
+	}
+}
+
+func TestRemoteSigner_RoleAuthorization(t *testing.T) {
+	ca := newTestCA(t)
+	address, audit := startRemoteSigner(t, ca, map[string]tools.KeyRole{"zsk-only": tools.ZSKRole})
+	ctx := testContext(tools.RsaSha256, false, false)
+	session, err := ctx.NewRemoteSession(address, clientTLSConfig(t, ca, ca, "zsk-only"))
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	if _, err := session.GetKeys(); err == nil {
+		t.Errorf("client got a KSK it is not authorized to use")
+	}
+	session.End()
+
+	// The same client can provide the ZSK of a hybrid session.
+	zskSession, err := ctx.NewRemoteSession(address, clientTLSConfig(t, ca, ca, "zsk-only"))
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	kskSession, err := ctx.NewFileSession(&vFile{data: []byte(RSAZSK)}, &vFile{data: []byte(RSAKSK)})
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	session, err = ctx.NewHybridSession(kskSession, zskSession)
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	out, err := sign(t, ctx, session)
+	if err != nil {
+		t.Errorf("signing failed: %s", err)
+		return
+	}
+	defer out.Close()
+	if err := ctx.VerifyFile(); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+	if strings.Contains(audit.String(), `method=sign key=ksk`) {
+		t.Errorf("KSK was used by a ZSK only client:\n%s", audit.String())
+	}
+}
+
+func TestRemoteSigner_UnauthorizedClients(t *testing.T) {
+	ca := newTestCA(t)
+	address, audit := startRemoteSigner(t, ca, map[string]tools.KeyRole{"signer-1": tools.AllRoles})
+	ctx := testContext(tools.RsaSha256, false, false)
+	if _, err := ctx.NewRemoteSession(address, clientTLSConfig(t, ca, ca, "intruder")); err == nil {
+		t.Errorf("client with an unknown common name was accepted")
+	}
+	if _, err := ctx.NewRemoteSession(address, clientTLSConfig(t, ca, newTestCA(t), "signer-1")); err == nil {
+		t.Errorf("client with a certificate of another CA was accepted")
+	}
+	noCert := &tls.Config{RootCAs: ca.pool(), ServerName: "localhost"}
+	if _, err := ctx.NewRemoteSession(address, noCert); err == nil {
+		t.Errorf("client without a certificate was accepted")
+	}
+	// The server logs the rejection after closing the connection.
+	deadline := time.Now().Add(5 * time.Second)
+	for strings.Count(audit.String(), "rejected") < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(audit.String(), `client "intruder" is not authorized`) {
+		t.Errorf("rejected client not in audit log:\n%s", audit.String())
+	}
+	if strings.Count(audit.String(), "rejected") < 3 {
+		t.Errorf("audit log does not include the three rejected connections:\n%s", audit.String())
+	}
+}
+
+func TestRemoteSigner_Backend(t *testing.T) {
+	ca := newTestCA(t)
+	address, _ := startRemoteSigner(t, ca, map[string]tools.KeyRole{"signer-1": tools.AllRoles})
+	dir, err := ioutil.TempDir("", "dns-tools-remote")
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	client := ca.issue(t, "signer-1", false)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(client.PrivateKey)
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	files := map[string]*pem.Block{
+		"ca.pem":   {Type: "CERTIFICATE", Bytes: ca.cert.Raw},
+		"cert.pem": {Type: "CERTIFICATE", Bytes: client.Certificate[0]},
+		"key.pem":  {Type: "PRIVATE KEY", Bytes: keyDER},
+	}
+	for name, block := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0600); err != nil {
+			t.Errorf("%s", err)
+			return
+		}
+	}
+	ctx := testContext(tools.RsaSha256, true, false)
+	session, err := ctx.NewSession("remote", mapConfig{
+		"remote-address": address,
+		"remote-ca":      filepath.Join(dir, "ca.pem"),
+		"remote-cert":    filepath.Join(dir, "cert.pem"),
+		"remote-key":     filepath.Join(dir, "key.pem"),
+	}, tools.AllRoles)
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	out, err := sign(t, ctx, session)
+	if err != nil {
+		t.Errorf("signing failed: %s", err)
+		return
+	}
+	defer out.Close()
+	if err := ctx.VerifyFile(); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+}
@@ -0,0 +1,93 @@
+package tools
+
+import (
+	"crypto"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RFC 5011 timers.
+const (
+	MinAddHoldDown   = 30 * 24 * time.Hour // Minimum time a new trust anchor must be seen before it is trusted (RFC 5011, 2.4.1)
+	RemoveHoldDown   = 30 * 24 * time.Hour // Time a revoked trust anchor is kept by resolvers (RFC 5011, 2.4.2)
+	minActiveRefresh = time.Hour           // Bounds of the active refresh interval (RFC 5011, 2.3)
+	maxActiveRefresh = 15 * 24 * time.Hour
+	revokedKeyFlags  = 257 | dns.REVOKE // Flags of a revoked KSK (385)
+)
+
+// AddHoldDown returns the add hold-down time of a new KSK, published in a DNSKEY RRset with the TTL provided:
+// 30 days or the TTL, whichever is greater.
+func AddHoldDown(ttl uint32) time.Duration {
+	if d := time.Duration(ttl) * time.Second; d > MinAddHoldDown {
+		return d
+	}
+	return MinAddHoldDown
+}
+
+// ActiveRefresh returns the longest interval between two queries of a resolver for the DNSKEY RRset of
+// a trust anchor: half of the TTL or half of the signature validity, between one hour and 15 days.
+func ActiveRefresh(ttl uint32, sigValidity time.Duration) time.Duration {
+	refresh := time.Duration(ttl) * time.Second / 2
+	if sigValidity/2 < refresh {
+		refresh = sigValidity / 2
+	}
+	if refresh > maxActiveRefresh {
+		refresh = maxActiveRefresh
+	}
+	if refresh < minActiveRefresh {
+		refresh = minActiveRefresh
+	}
+	return refresh
+}
+
+// NewKSKTrustedAt returns when resolvers trust a new KSK first published at the time provided: after the
+// add hold-down time and one more active refresh interval, so every resolver has queried the RRset again.
+// The old KSK should not be revoked before that time.
+func NewKSKTrustedAt(published time.Time, ttl uint32, sigValidity time.Duration) time.Time {
+	return published.Add(AddHoldDown(ttl) + ActiveRefresh(ttl, sigValidity))
+}
+
+// RevokedKSKRemovableAt returns when a KSK first published with the REVOKE flag at the time provided can be
+// removed from the zone: after the remove hold-down time and one more active refresh interval, so every
+// resolver has seen the revoked key.
+func RevokedKSKRemovableAt(revoked time.Time, ttl uint32, sigValidity time.Duration) time.Time {
+	return revoked.Add(RemoveHoldDown + ActiveRefresh(ttl, sigValidity))
+}
+
+// revokedKey is a KSK published with the REVOKE flag, and the signer of its private key.
+type revokedKey struct {
+	dnskey *dns.DNSKEY
+	signer crypto.Signer
+}
+
+// revokedKeys returns the DNSKEYs with the REVOKE flag of the revoked KSKs of the context, with the owner
+// and TTL of the KSK provided.
+func (ctx *Context) revokedKeys(ksk *dns.DNSKEY) ([]*revokedKey, error) {
+	keys := make([]*revokedKey, 0, len(ctx.RevokedKSKs))
+	for _, signer := range ctx.RevokedKSKs {
+		keyBytes, err := publicKeyToBytes(signer.Public())
+		if err != nil {
+			return nil, fmt.Errorf("invalid revoked KSK: %s", err)
+		}
+		if _, err := bytesToPublicKey(ctx.SignAlgorithm, keyBytes); err != nil {
+			return nil, fmt.Errorf("revoked KSK does not use the zone algorithm: %s", err)
+		}
+		publicKey := base64.StdEncoding.EncodeToString(keyBytes)
+		if publicKey == ksk.PublicKey {
+			return nil, fmt.Errorf("the KSK of the session cannot be revoked while it signs the zone")
+		}
+		dnskey := &dns.DNSKEY{
+			Hdr:       ksk.Hdr,
+			Flags:     revokedKeyFlags,
+			Protocol:  3,
+			Algorithm: uint8(ctx.SignAlgorithm),
+			PublicKey: publicKey,
+		}
+		ctx.registerDNSKEY(dnskey)
+		keys = append(keys, &revokedKey{dnskey: dnskey, signer: signer})
+	}
+	return keys, nil
+}
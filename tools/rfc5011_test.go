@@ -0,0 +1,92 @@
+package tools_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/niclabs/dns-tools/tools"
+)
+
+func TestSession_SignWithRevokedKSK(t *testing.T) {
+	old, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	ctx := testContext(tools.RsaSha256, false, false)
+	ctx.RevokedKSKs = append(ctx.RevokedKSKs, old)
+	signed, err := signZone(t, ctx, fileString)
+	if err != nil {
+		t.Fatalf("signing failed: %s", err)
+	}
+	if !strings.Contains(signed, "\tDNSKEY\t385 3 8 ") {
+		t.Errorf("revoked KSK not published:\n%s", signed)
+	}
+	if strings.Count(signed, "\tRRSIG\tDNSKEY ") != 2 {
+		t.Errorf("DNSKEY RRset should have 2 signatures:\n%s", signed)
+	}
+	if err := verifyZone(signed); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+
+	// Both the KSK and the revoked key must sign the DNSKEY RRset.
+	for i := 0; i < 2; i++ {
+		lines := strings.Split(signed, "\n")
+		kept := make([]string, 0, len(lines))
+		found := 0
+		for _, line := range lines {
+			if strings.Contains(line, "\tRRSIG\tDNSKEY ") {
+				found++
+				if found == i+1 {
+					continue
+				}
+			}
+			kept = append(kept, line)
+		}
+		if err := verifyZone(strings.Join(kept, "\n")); err == nil {
+			t.Errorf("zone verified with a DNSKEY RRset missing one of its signatures")
+		}
+	}
+}
+
+func TestSession_SignRevokingCurrentKSK(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ksk.pem")
+	if err := ioutil.WriteFile(path, []byte(RSAKSK), 0600); err != nil {
+		t.Fatalf("%s", err)
+	}
+	current, err := tools.ReadPrivateKeyFile(path, nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	ctx := testContext(tools.RsaSha256, false, false)
+	ctx.RevokedKSKs = append(ctx.RevokedKSKs, current)
+	if _, err := signZone(t, ctx, fileString); err == nil {
+		t.Errorf("zone signed revoking the KSK of the session")
+	}
+}
+
+func TestRFC5011_Timers(t *testing.T) {
+	if d := tools.AddHoldDown(3600); d != tools.MinAddHoldDown {
+		t.Errorf("add hold-down with a short TTL should be %s, got %s", tools.MinAddHoldDown, d)
+	}
+	if d := tools.AddHoldDown(60 * 24 * 3600); d != 60*24*time.Hour {
+		t.Errorf("add hold-down with a long TTL should be the TTL, got %s", d)
+	}
+	if d := tools.ActiveRefresh(60, 24*time.Hour); d != time.Hour {
+		t.Errorf("active refresh should be at least one hour, got %s", d)
+	}
+	if d := tools.ActiveRefresh(86400, 4*time.Hour); d != 2*time.Hour {
+		t.Errorf("active refresh should be half of the signature validity, got %s", d)
+	}
+	if d := tools.ActiveRefresh(1<<31, 365*24*time.Hour); d != 15*24*time.Hour {
+		t.Errorf("active refresh should be at most 15 days, got %s", d)
+	}
+	now := time.Now()
+	if at := tools.RevokedKSKRemovableAt(now, 86400, 30*24*time.Hour); !at.Equal(now.Add(tools.RemoveHoldDown + 12*time.Hour)) {
+		t.Errorf("wrong removal time of a revoked KSK: %s", at)
+	}
+}
@@ -92,6 +92,8 @@ func (nsec3Map NSEC3List) toSortedArray() RRArray {
 	return arr
 }
 
+// add adds to the list the NSEC3 RR of the owner name provided, with the types of typeMap. If typeMap is empty,
+// the owner name is an empty non-terminal, and its NSEC3 has an empty type bitmap unless the name also owns RRsets.
 func (nsec3Map NSEC3List) add(ownerName string, param *dns.NSEC3PARAM, typeMap map[uint16]bool) error {
 	hName := dns.HashName(ownerName, param.Hash,
 		param.Iterations, param.Salt)
@@ -101,8 +103,13 @@ func (nsec3Map NSEC3List) add(ownerName string, param *dns.NSEC3PARAM, typeMap m
 	if name, hashedBefore := nsec3Map.hashed[hName]; hashedBefore && ownerName != name {
 		return fmt.Errorf("hash collision")
 	}
+	nsec3Map.hashed[hName] = ownerName
 	if nsec3, ok := nsec3Map.rrs[hName]; !ok {
 		// It does not exist in the map.
+		var typeArray []uint16
+		if len(typeMap) > 0 {
+			typeArray = newTypeArray(typeMap)
+		}
 		nsec3 := &dns.NSEC3{
 			Hdr: dns.RR_Header{
 				Name:   hName,
@@ -116,10 +123,10 @@ func (nsec3Map NSEC3List) add(ownerName string, param *dns.NSEC3PARAM, typeMap m
 			SaltLength: param.SaltLength,
 			Salt:       param.Salt,
 			HashLength: 20,
-			TypeBitMap: newTypeArray(typeMap),
+			TypeBitMap: typeArray,
 		}
 		nsec3Map.rrs[hName] = nsec3
-	} else {
+	} else if len(typeMap) > 0 {
 		// It exists in the map. We need to update it
 		subTypeMap := make(map[uint16]bool)
 		for k, v := range typeMap {
@@ -222,6 +229,17 @@ func (ctx *Context) getRRSetList(byType bool) (set RRSetList) {
 func (ctx *Context) addNSECRecords() {
 
 	set := ctx.getRRSetList(false)
+	// The chain links the names in canonical order. Empty non-terminals have no RRsets and
+	// the zone is not authoritative for glue, so they are not part of it.
+	quickSort(set)
+
+	authoritative := make(RRSetList, 0, len(set))
+	for _, rrs := range set {
+		if !ctx.isBelowZoneCut(rrs[0].Header().Name) {
+			authoritative = append(authoritative, rrs)
+		}
+	}
+	set = authoritative
 
 	n := len(set)
 	for i, rrs := range set {
@@ -231,6 +249,7 @@ func (ctx *Context) addNSECRecords() {
 			typeMap[rr.Header().Rrtype] = struct{}{}
 		}
 		typeMap[dns.TypeNSEC] = struct{}{}
+		typeMap[dns.TypeRRSIG] = struct{}{} // The NSEC RR is signed at every owner name
 
 		rrSetName := rrs[0].Header().Name
 		if rrSetName == ctx.Config.Zone {
@@ -249,7 +268,7 @@ func (ctx *Context) addNSECRecords() {
 		nsec.Hdr.Name = rrSetName
 		nsec.Hdr.Rrtype = dns.TypeNSEC
 		nsec.Hdr.Class = dns.ClassINET
-		nsec.Hdr.Ttl = rrs[0].Header().Ttl
+		nsec.Hdr.Ttl = ctx.denialTTL()
 		nsec.NextDomain = set[(i+1)%n][0].Header().Name
 		nsec.TypeBitMap = typeArray
 
@@ -257,36 +276,37 @@ func (ctx *Context) addNSECRecords() {
 	}
 }
 
-// addNSEC3Records edits an RRArray and adds the respective NSEC3 records to it.
-// If optOut is true, it sets the flag for NSEC3PARAM RR, following RFC5155 section 6.
+// addNSEC3Records edits an RRArray and adds the respective NSEC3 records to it, with the configured
+// iterations and opt-out. The salt of the input zone is kept, unless newSalt is true.
 // It returns an error if there is a colission on the hashes.
-func (ctx *Context) addNSEC3Records() (err error) {
-	setList := ctx.getRRSetList(false)
-	var salt string
-	if ctx.Config.NSEC3SaltValue == "" {
-		salt, err = generateSalt(ctx.Config.NSEC3SaltLength)
-		if err != nil {
-			return err
-		}
-	} else {
-		salt = ctx.Config.NSEC3SaltValue
+func (ctx *Context) addNSEC3Records(newSalt bool) (err error) {
+	salt, err := ctx.nsec3Salt(newSalt)
+	if err != nil {
+		return err
 	}
 	param := &dns.NSEC3PARAM{
-		Hdr: dns.RR_Header{
-			Name:   ctx.soa.Hdr.Name,
-			Rrtype: dns.TypeNSEC3PARAM,
-			Class:  dns.ClassINET,
-			Ttl:    ctx.soa.Minttl,
-		},
 		Hash:       dns.SHA1,
 		Iterations: ctx.Config.NSEC3Iterations,
 		Salt:       salt,
 		SaltLength: uint8(len(salt) / 2),
 	}
-	if ctx.Config.OptOut {
-		param.Flags = 1
+	return ctx.addNSEC3Chain(param, ctx.Config.OptOut)
+}
+
+// addNSEC3Chain adds the NSEC3 RRs of the chain with the parameters provided, and its NSEC3PARAM RR.
+// Names below a delegation have no NSEC3 RRs. If optOut is true, insecure delegations have no NSEC3 RRs
+// either, and the NSEC3 RRs whose spans cover them have the Opt-Out flag, following RFC5155 section 6.
+// It returns an error if there is a colission on the hashes.
+func (ctx *Context) addNSEC3Chain(param *dns.NSEC3PARAM, optOut bool) error {
+	setList := ctx.getRRSetList(false)
+	param.Hdr = dns.RR_Header{
+		Name:   ctx.soa.Hdr.Name,
+		Rrtype: dns.TypeNSEC3PARAM,
+		Class:  dns.ClassINET,
+		Ttl:    ctx.denialTTL(), // Used by the NSEC3 RRs, it is set to the NSEC3PARAM TTL later
 	}
 	nsec3list := newNSEC3List()
+	optedOut := make([]string, 0) // Insecure delegations left out of the chain
 	for _, rrSet := range setList {
 		typeMap := rrSet.getTypeMap()
 		if typeMap[dns.TypeSOA] {
@@ -298,7 +318,16 @@ func (ctx *Context) addNSEC3Records() (err error) {
 			typeMap[dns.TypeDNSKEY] = true
 		}
 
-		if !(ctx.isSignable(rrSetName)) {
+		if ctx.isBelowZoneCut(rrSetName) {
+			continue
+		}
+		// Only the DS RRsets are signed at delegations
+		_, isCut := ctx.DelegatedZones[rrSetName]
+		if _, hasDS := ctx.WithDS[rrSetName]; !isCut || hasDS {
+			typeMap[dns.TypeRRSIG] = true
+		}
+		if optOut && ctx.isInsecureDelegation(rrSetName) {
+			optedOut = append(optedOut, rrSetName)
 			continue
 		}
 		// Add current NSEC3 RR
@@ -306,25 +335,45 @@ func (ctx *Context) addNSEC3Records() (err error) {
 		if err != nil {
 			return err
 		}
-		// Add NSEC3 RRS for each sublabel
-		labels := dns.SplitDomainName(strings.TrimSuffix(rrSet[0].Header().Name, ctx.Config.Zone))
-		for i := range labels {
-			label := strings.Join(labels[i:], ".") + "." + ctx.Config.Zone
-			if len(label) == 0 {
-				break
-			}
-			err := nsec3list.add(label, param, typeMap) // we don't know if it is signable
-			if err != nil {
+		// Add NSEC3 RRs for the ancestors of the name. If they do not own RRsets, they are empty
+		// non-terminals, and their NSEC3 RRs have no types.
+		for _, ent := range ctx.ancestors(rrSetName) {
+			if err := nsec3list.add(ent, param, nil); err != nil {
 				return err
 			}
 		}
 	}
+	// Empty non-terminals leading only to insecure delegations are left out of the chain too.
+	optedOutHashes := make(map[string]bool)
+	for _, name := range optedOut {
+		for _, optedOutName := range append(ctx.ancestors(name), name) {
+			hName := dns.HashName(optedOutName, param.Hash, param.Iterations, param.Salt)
+			if _, inChain := nsec3list.rrs[hName]; !inChain {
+				optedOutHashes[hName] = true
+			}
+		}
+	}
 	// transform nsec3list to Sorted RRArray (to link to next hashes)
 	sortedList := nsec3list.toSortedArray()
 	// Link NSEC3s with their next domains.
 	for i, nsec3 := range sortedList {
 		nsec3.(*dns.NSEC3).NextDomain = sortedList[(i+1)%len(sortedList)].Header().Name
 	}
+	// Set the Opt-Out flag on the spans covering insecure delegations.
+	for hName := range optedOutHashes {
+		covering := sortedList[len(sortedList)-1] // The last span also covers the hashes before the first one
+		for _, nsec3 := range sortedList {
+			if nsec3.Header().Name > hName {
+				break
+			}
+			covering = nsec3
+		}
+		covering.(*dns.NSEC3).Flags |= 1
+	}
+	if len(optedOut) > 0 {
+		ctx.Log.Printf("%d insecure delegations and %d empty non-terminals left out of the NSEC3 chain with opt-out",
+			len(optedOut), len(optedOutHashes)-len(optedOut))
+	}
 	// Add zone name to each NSEC3 name.
 	for i := 0; i < len(sortedList); i++ {
 		sortedList[i].Header().Name += "."
@@ -333,6 +382,7 @@ func (ctx *Context) addNSEC3Records() (err error) {
 		}
 		ctx.rrs = append(ctx.rrs, sortedList[i])
 	}
+	param.Hdr.Ttl = ctx.nsec3ParamTTL()
 	ctx.rrs = append(ctx.rrs, param)
 	return nil
 }
@@ -1,5 +1,11 @@
 package tools
 
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
 // SignAlgorithm represents the algorithm used to sign a zone
 // The numbers are the same the RFC defined for the algorithms.
 type SignAlgorithm uint8
@@ -8,6 +14,7 @@ type SignAlgorithm uint8
 const (
 	RsaSha256       = 8  // RSA SHA256
 	EcdsaP256Sha256 = 13 // ECDSA P256 SHA256
+	Ed25519         = 15 // Ed25519
 )
 
 // StringToSignAlgorithm takes the name of an algorithm
@@ -17,4 +24,22 @@ var StringToSignAlgorithm = map[string]SignAlgorithm{
 	"ecdsa":             EcdsaP256Sha256, // Default ECDSA case
 	"ecdsa_p256":        EcdsaP256Sha256, // Alias for ecdsa_p256_sha256
 	"ecdsa_p256_sha256": EcdsaP256Sha256, // Complete name
+	"ed25519":           Ed25519,         // Supported by the Vault backend, and passed unchecked to exec and remote signers
+}
+
+// checkSignAlgorithm returns an error if the sign algorithm of the context is set and the backend does not
+// support it.
+func (ctx *Context) checkSignAlgorithm(backend string, supported ...SignAlgorithm) error {
+	if ctx.SignAlgorithm == 0 {
+		return nil
+	}
+	names := make([]string, len(supported))
+	for i, algorithm := range supported {
+		if algorithm == ctx.SignAlgorithm {
+			return nil
+		}
+		names[i] = dns.AlgorithmToString[uint8(algorithm)]
+	}
+	return fmt.Errorf("sign algorithm %s is not supported by the %s backend (supported algorithms: %v)",
+		dns.AlgorithmToString[uint8(ctx.SignAlgorithm)], backend, names)
 }
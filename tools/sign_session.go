@@ -4,6 +4,8 @@ import (
 	"crypto"
 	"encoding/base64"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -20,12 +22,78 @@ type SignSession interface {
 	End() error
 }
 
+// SessionInfo is implemented by sessions that describe their signing mode in the TXT RR
+// added when Info is enabled. Info returns a list of "key=value;" pairs starting with the mode,
+// like "mode=file;".
+type SessionInfo interface {
+	Info() string
+}
+
+// KeyRole represents the roles of the keys provided by a session.
+type KeyRole uint8
+
+// Key roles. Sessions provide the keys of all the roles unless they are restricted to some of them.
+const (
+	ZSKRole  KeyRole = 1 << iota         // Zone Signing Key
+	KSKRole                              // Key Signing Key
+	AllRoles KeyRole = ZSKRole | KSKRole // Both keys
+)
+
+// Has returns true if the role includes the role provided.
+func (role KeyRole) Has(other KeyRole) bool {
+	return role&other == other
+}
+
+// String returns the name of the role.
+func (role KeyRole) String() string {
+	switch role {
+	case ZSKRole:
+		return "zsk"
+	case KSKRole:
+		return "ksk"
+	case AllRoles:
+		return "zsk+ksk"
+	}
+	return "none"
+}
+
+// ParseKeyRole returns the role with the name provided ("zsk", "ksk" or "zsk+ksk").
+func ParseKeyRole(name string) (KeyRole, error) {
+	var role KeyRole
+	for _, part := range strings.Split(strings.ToLower(name), "+") {
+		switch part {
+		case "zsk":
+			role |= ZSKRole
+		case "ksk":
+			role |= KSKRole
+		default:
+			return 0, fmt.Errorf("unknown key role %q", part)
+		}
+	}
+	return role, nil
+}
+
+// roleRestricter is implemented by sessions able to provide only the keys of some roles,
+// so they do not require, create or destroy the keys of the other ones.
+type roleRestricter interface {
+	restrictRoles(KeyRole)
+}
+
 // SigKeys contains the four keys used in zone signing.
 type SigKeys struct {
 	zskSigner crypto.Signer
 	kskSigner crypto.Signer
 }
 
+// NewSigKeys returns the keys used by a session to sign the zone.
+// A nil signer means that the session does not provide the key of that role.
+func NewSigKeys(zsk, ksk crypto.Signer) *SigKeys {
+	return &SigKeys{
+		zskSigner: zsk,
+		kskSigner: ksk,
+	}
+}
+
 // Sign signs a zone file and outputs the result into out path (if its length is more than zero).
 // It also dumps the new signed file zone to the standard output.
 func Sign(session SignSession) (ds *dns.DS, err error) {
@@ -38,7 +106,23 @@ func Sign(session SignSession) (ds *dns.DS, err error) {
 		return
 	}
 	ctx.Log.Printf("Starting signing process for %s", ctx.Config.Zone)
-
+	if ctx.SKR != nil && (ctx.Config.MultiSigner || len(ctx.RevokedKSKs) > 0) {
+		return nil, fmt.Errorf("multi-signer mode and revoked KSKs cannot be used with a SKR, because its DNSKEY RRsets are already signed")
+	}
+	if ctx.Rollover != nil {
+		if ctx.SKR != nil {
+			return nil, fmt.Errorf("an emergency rollover cannot be done with a SKR")
+		}
+		if err = ctx.prepareRollover(); err != nil {
+			return nil, err
+		}
+	}
+	ctx.readDenialChains()
+	if err = ctx.prepareZoneKeys(); err != nil {
+		return nil, err
+	}
+	ctx.removeOccludedRRs()
+	// The _created_by TXT RR is added before applying the TTL policy, so its TTL follows it too
 	if ctx.Config.Info {
 		ctx.Log.Println("Adding _created_by TXT for marking library usage")
 		ctx.rrs = append(ctx.rrs, &dns.TXT{
@@ -51,26 +135,51 @@ func Sign(session SignSession) (ds *dns.DS, err error) {
 			Txt: []string{ctx.genInfo(session)},
 		})
 	}
+	if err = ctx.applyTTLPolicy(); err != nil {
+		return nil, err
+	}
+
 	ctx.Log.Println("Creating NSEC/NSEC3 RRs")
-	ctx.AddNSEC13()
+	if err = ctx.AddNSEC13(); err != nil {
+		return nil, err
+	}
 	keys, err := session.GetKeys()
 	if err != nil {
 		return nil, err
 	}
 	ctx.Log.Println("Signing")
-	rrSet := ctx.getRRSetList(true)
 
 	// ok, we create DNSKEYS
-	zsk, ksk, err := GetDNSKEY(keys, session)
+	var zsk, ksk *dns.DNSKEY
+	if ctx.SKR != nil {
+		// The KSK is offline, so only the ZSK is used
+		zsk, err = getZSKDNSKEY(keys, session)
+	} else {
+		zsk, ksk, err = GetDNSKEY(keys, session)
+	}
 	if err != nil {
 		return nil, err
 	}
+	ctx.dropOwnForeignKeys(zsk, ksk)
+	if ctx.Rollover != nil {
+		if err = ctx.setRolloverKeys(zsk, ksk); err != nil {
+			return nil, err
+		}
+	}
+	if ksk != nil {
+		ctx.addOwnCDS(ksk)
+	}
+	rrSet := ctx.getRRSetList(true)
 	numTries := 3
 	for i, v := range rrSet {
 		if v[0].Header().Rrtype == dns.TypeZONEMD {
 			ctx.Log.Printf("[Signature %d/%d] Skipping RRSet because it is a ZONEMD RR", i+1, len(rrSet)+1)
 			continue // Skip it, we sign it post digest
 		}
+		if !ctx.isSignedRRSet(v) {
+			ctx.Log.Printf("[Signature %d/%d] Skipping RRSet %s because it is a delegation or glue", i+1, len(rrSet)+1, v.String())
+			continue
+		}
 		for try := 1; try <= numTries; try++ {
 			rrSig := CreateNewRRSIG(ctx.Config.Zone,
 				zsk,
@@ -101,26 +210,14 @@ func Sign(session SignSession) (ds *dns.DS, err error) {
 		}
 	}
 
-	rrDNSKeys := RRArray{zsk, ksk}
-
-	rrDNSKeySig := CreateNewRRSIG(ctx.Config.Zone,
-		ksk,
-		ctx.Config.RRSIGExpDate,
-		ksk.Hdr.Ttl)
-	ctx.Log.Printf("[Signature %d/%d] Creating RRSig for DNSKEY", len(rrSet)+1, len(rrSet)+1)
-	err = rrDNSKeySig.Sign(keys.kskSigner, rrDNSKeys)
-	if err != nil {
-		return nil, err
-	}
-	ctx.Log.Printf("[Signature %d/%d] Verifying RRSig for DNSKEY", len(rrSet)+1, len(rrSet)+1)
-	err = rrDNSKeySig.Verify(ksk, rrDNSKeys)
-	if err != nil {
-		err = fmt.Errorf("cannot check ksk RRSig: %s", err)
+	if ctx.SKR != nil {
+		if err := ctx.addSKRBundle(zsk, time.Now()); err != nil {
+			return nil, err
+		}
+	} else if err := ctx.signDNSKEYs(keys, zsk, ksk, len(rrSet)+1); err != nil {
 		return nil, err
 	}
 
-	ctx.rrs = append(ctx.rrs, zsk, ksk, rrDNSKeySig)
-
 	/* begin DigestEnabled digest updating (and signing)*/
 	if ctx.Config.DigestEnabled {
 		// Sorting
@@ -167,6 +264,48 @@ func Sign(session SignSession) (ds *dns.DS, err error) {
 	return ds, err
 }
 
+// signDNSKEYs signs the DNSKEY RRset with the KSK and adds it to the zone. In multi-signer mode,
+// the RRset also contains the keys of the other signers. Revoked KSKs are added to the RRset, and
+// they sign it too, as RFC 5011 requires.
+func (ctx *Context) signDNSKEYs(keys *SigKeys, zsk, ksk *dns.DNSKEY, total int) error {
+	rrDNSKeys := ctx.dnskeyRRSet(zsk, ksk)
+	revoked, err := ctx.revokedKeys(ksk)
+	if err != nil {
+		return err
+	}
+	signers := []*revokedKey{{dnskey: ksk, signer: keys.kskSigner}}
+	for _, key := range revoked {
+		if !containsRR(rrDNSKeys, key.dnskey) {
+			rrDNSKeys = append(rrDNSKeys, key.dnskey)
+		}
+		signers = append(signers, key)
+	}
+	rrSigs := make(RRArray, 0, len(signers))
+	for _, signer := range signers {
+		rrDNSKeySig := CreateNewRRSIG(ctx.Config.Zone,
+			signer.dnskey,
+			ctx.Config.RRSIGExpDate,
+			ksk.Hdr.Ttl)
+		ctx.Log.Printf("[Signature %d/%d] Creating RRSig for DNSKEY with key %d", total, total, signer.dnskey.KeyTag())
+		if err := rrDNSKeySig.Sign(signer.signer, rrDNSKeys); err != nil {
+			return err
+		}
+		ctx.Log.Printf("[Signature %d/%d] Verifying RRSig for DNSKEY with key %d", total, total, signer.dnskey.KeyTag())
+		if err := rrDNSKeySig.Verify(signer.dnskey, rrDNSKeys); err != nil {
+			return fmt.Errorf("cannot check ksk RRSig: %s", err)
+		}
+		rrSigs = append(rrSigs, rrDNSKeySig)
+	}
+	for _, key := range revoked {
+		ctx.Log.Printf("Revoked KSK %d published. If it was first published revoked now, it can be removed after %s",
+			key.dnskey.KeyTag(),
+			RevokedKSKRemovableAt(time.Now(), ksk.Hdr.Ttl, time.Until(ctx.Config.RRSIGExpDate)).Format(time.RFC3339))
+	}
+	ctx.rrs = append(ctx.rrs, rrDNSKeys...)
+	ctx.rrs = append(ctx.rrs, rrSigs...)
+	return nil
+}
+
 // GetDNSKEY returns two DNSKEY RRs based on the session SigKeys
 func GetDNSKEY(keys *SigKeys, session SignSession) (zsk, ksk *dns.DNSKEY, err error) {
 	zskBytes, kskBytes, err := session.GetPublicKeyBytes(keys)
@@ -187,3 +326,15 @@ func GetDNSKEY(keys *SigKeys, session SignSession) (zsk, ksk *dns.DNSKEY, err er
 	)
 	return
 }
+
+// getZSKDNSKEY returns the ZSK DNSKEY RR based on the session SigKeys.
+func getZSKDNSKEY(keys *SigKeys, session SignSession) (*dns.DNSKEY, error) {
+	zskBytes, _, err := session.GetPublicKeyBytes(keys)
+	if err != nil {
+		return nil, err
+	}
+	if zskBytes == nil {
+		return nil, fmt.Errorf("session does not provide a ZSK")
+	}
+	return session.Context().CreateNewDNSKEY(256, base64.StdEncoding.EncodeToString(zskBytes)), nil
+}
@@ -0,0 +1,307 @@
+package tools
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+// Threshold RSA signatures, as defined by V. Shoup in "Practical Threshold Signatures" (EUROCRYPT 2000).
+//
+// The modulus is the product of two safe primes p = 2p'+1 and q = 2q'+1, and the private exponent d
+// is the inverse of e modulo m = p'q'. The dealer shares d with a random polynomial f of degree t-1
+// over Z_m, with f(0) = d, and node i receives s_i = f(i). A node signs a message x returning
+// x^(2Δs_i) mod n, where Δ = nodes!, and any t of these partial signatures are combined with
+// Lagrange interpolation (scaled by Δ to keep it on the integers) into a standard RSA signature.
+
+// ThresholdPublicExponent is the public exponent of the threshold RSA keys. It must be a prime
+// larger than the number of nodes.
+const ThresholdPublicExponent = 65537
+
+// MinThresholdKeyBits is the minimum size, in bits, of a threshold RSA modulus.
+const MinThresholdKeyBits = 1024
+
+// ThresholdKeyShare is the share of a threshold RSA key held by a node.
+type ThresholdKeyShare struct {
+	Index     int    `json:"index"`     // Node index, from 1 to Nodes
+	Threshold int    `json:"threshold"` // Number of partial signatures needed to sign
+	Nodes     int    `json:"nodes"`     // Number of shares dealt
+	Modulus   []byte `json:"modulus"`   // Big endian public modulus
+	Exponent  int    `json:"exponent"`  // Public exponent
+	Share     []byte `json:"share"`     // Big endian value of the share of the private exponent
+}
+
+// GenerateThresholdKey creates a new RSA key with a modulus of the size in bits provided and deals
+// its private exponent in shares for the number of nodes provided, so any threshold of them can sign.
+// Generating safe primes is slow: it can take some minutes for 2048 bit keys.
+func GenerateThresholdKey(bits, threshold, nodes int) ([]*ThresholdKeyShare, error) {
+	if bits < MinThresholdKeyBits || bits%2 != 0 {
+		return nil, fmt.Errorf("threshold key size must be an even number of bits, at least %d", MinThresholdKeyBits)
+	}
+	p, err := generateSafePrime(bits / 2)
+	if err != nil {
+		return nil, err
+	}
+	var q *big.Int
+	for q == nil || q.Cmp(p) == 0 {
+		if q, err = generateSafePrime(bits / 2); err != nil {
+			return nil, err
+		}
+	}
+	return DealThresholdKey(p, q, threshold, nodes)
+}
+
+// DealThresholdKey deals the private exponent of the RSA key defined by the safe primes p and q
+// in shares for the number of nodes provided, so any threshold of them can sign.
+func DealThresholdKey(p, q *big.Int, threshold, nodes int) ([]*ThresholdKeyShare, error) {
+	if threshold < 1 || threshold > nodes {
+		return nil, fmt.Errorf("threshold must be between 1 and the number of nodes (%d)", nodes)
+	}
+	if nodes >= ThresholdPublicExponent {
+		return nil, fmt.Errorf("the number of nodes must be lower than %d", ThresholdPublicExponent)
+	}
+	if p.Cmp(q) == 0 {
+		return nil, fmt.Errorf("p and q must be different primes")
+	}
+	pp, qq := new(big.Int).Rsh(p, 1), new(big.Int).Rsh(q, 1)
+	for _, prime := range []*big.Int{p, q, pp, qq} {
+		if !prime.ProbablyPrime(20) {
+			return nil, fmt.Errorf("p and q must be safe primes")
+		}
+	}
+	n := new(big.Int).Mul(p, q)
+	if n.BitLen() < MinThresholdKeyBits {
+		return nil, fmt.Errorf("modulus must have at least %d bits", MinThresholdKeyBits)
+	}
+	m := new(big.Int).Mul(pp, qq)
+	e := big.NewInt(ThresholdPublicExponent)
+	d := new(big.Int).ModInverse(e, m)
+	if d == nil {
+		return nil, fmt.Errorf("public exponent is not invertible modulo p'q'")
+	}
+	coefficients := []*big.Int{d}
+	for i := 1; i < threshold; i++ {
+		a, err := rand.Int(rand.Reader, m)
+		if err != nil {
+			return nil, err
+		}
+		coefficients = append(coefficients, a)
+	}
+	shares := make([]*ThresholdKeyShare, nodes)
+	for i := 1; i <= nodes; i++ {
+		// Horner evaluation of f(i) mod m
+		x := big.NewInt(int64(i))
+		s := new(big.Int)
+		for j := len(coefficients) - 1; j >= 0; j-- {
+			s.Mul(s, x).Add(s, coefficients[j]).Mod(s, m)
+		}
+		shares[i-1] = &ThresholdKeyShare{
+			Index:     i,
+			Threshold: threshold,
+			Nodes:     nodes,
+			Modulus:   n.Bytes(),
+			Exponent:  ThresholdPublicExponent,
+			Share:     s.Bytes(),
+		}
+	}
+	return shares, nil
+}
+
+// PublicKey returns the RSA public key of the share.
+func (share *ThresholdKeyShare) PublicKey() *rsa.PublicKey {
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(share.Modulus),
+		E: share.Exponent,
+	}
+}
+
+// SignPartial returns the partial signature of the share for the digest provided, which must
+// have been computed with the hash function received. It uses PKCS#1 v1.5 encoding.
+func (share *ThresholdKeyShare) SignPartial(digest []byte, hash crypto.Hash) ([]byte, error) {
+	if share.Index < 1 || share.Index > share.Nodes {
+		return nil, fmt.Errorf("invalid share index %d", share.Index)
+	}
+	public := share.PublicKey()
+	encoded, err := pkcs1v15Encode(hash, digest, (public.N.BitLen()+7)/8)
+	if err != nil {
+		return nil, err
+	}
+	x := new(big.Int).SetBytes(encoded)
+	exponent := new(big.Int).Mul(factorial(share.Nodes), new(big.Int).SetBytes(share.Share))
+	exponent.Lsh(exponent, 1)
+	return new(big.Int).Exp(x, exponent, public.N).Bytes(), nil
+}
+
+// CombineThresholdSignature combines the partial signatures of threshold nodes, indexed by node index,
+// into the PKCS#1 v1.5 signature of the digest, and verifies it. Partial signatures of more nodes
+// than the threshold are ignored.
+func CombineThresholdSignature(public *rsa.PublicKey, threshold, nodes int, digest []byte, hash crypto.Hash, partials map[int][]byte) ([]byte, error) {
+	if len(partials) < threshold {
+		return nil, fmt.Errorf("%d partial signatures received, but %d are needed", len(partials), threshold)
+	}
+	k := (public.N.BitLen() + 7) / 8
+	encoded, err := pkcs1v15Encode(hash, digest, k)
+	if err != nil {
+		return nil, err
+	}
+	indexes := make([]int, 0, threshold)
+	for index := range partials {
+		if index < 1 || index > nodes {
+			return nil, fmt.Errorf("invalid node index %d", index)
+		}
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	indexes = indexes[:threshold]
+
+	delta := factorial(nodes)
+	n := public.N
+	x := new(big.Int).SetBytes(encoded)
+	w := big.NewInt(1)
+	for _, i := range indexes {
+		// λ_i = Δ ∏ j/(j-i), for every other index j. It is always an integer.
+		num, den := new(big.Int).Set(delta), big.NewInt(1)
+		for _, j := range indexes {
+			if j != i {
+				num.Mul(num, big.NewInt(int64(j)))
+				den.Mul(den, big.NewInt(int64(j-i)))
+			}
+		}
+		lambda := num.Quo(num, den)
+		lambda.Lsh(lambda, 1)
+		xi := new(big.Int).SetBytes(partials[i])
+		if xi.Sign() <= 0 || xi.Cmp(n) >= 0 {
+			return nil, fmt.Errorf("partial signature of node %d out of range", i)
+		}
+		term := new(big.Int).Exp(xi, lambda, n)
+		if term == nil {
+			return nil, fmt.Errorf("partial signature of node %d is not invertible", i)
+		}
+		w.Mul(w, term).Mod(w, n)
+	}
+	// w^e = x^e', with e' = 4Δ². As e and e' are coprime, a*e' + b*e = 1 gives y = w^a * x^b.
+	ePrime := new(big.Int).Mul(delta, delta)
+	ePrime.Lsh(ePrime, 2)
+	a, b := new(big.Int), new(big.Int)
+	new(big.Int).GCD(a, b, ePrime, big.NewInt(int64(public.E)))
+	wa := new(big.Int).Exp(w, a, n)
+	xb := new(big.Int).Exp(x, b, n)
+	if wa == nil || xb == nil {
+		return nil, fmt.Errorf("cannot combine partial signatures")
+	}
+	y := wa.Mul(wa, xb).Mod(wa, n)
+	signature := make([]byte, k)
+	y.FillBytes(signature)
+	if err := rsa.VerifyPKCS1v15(public, hash, digest, signature); err != nil {
+		return nil, fmt.Errorf("combined signature does not verify: %s", err)
+	}
+	return signature, nil
+}
+
+// pkcs1v15Prefixes are the DER encoded DigestInfo prefixes of the hash functions supported.
+var pkcs1v15Prefixes = map[crypto.Hash][]byte{
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// pkcs1v15Encode returns the EMSA-PKCS1-v1_5 encoding of the digest, with the length k provided.
+func pkcs1v15Encode(hash crypto.Hash, digest []byte, k int) ([]byte, error) {
+	prefix, ok := pkcs1v15Prefixes[hash]
+	if !ok {
+		return nil, fmt.Errorf("hash function %d not supported by threshold signatures", hash)
+	}
+	if len(digest) != hash.Size() {
+		return nil, fmt.Errorf("digest length is %d, but it must be %d", len(digest), hash.Size())
+	}
+	tLen := len(prefix) + len(digest)
+	if k < tLen+11 {
+		return nil, fmt.Errorf("modulus too short for the digest")
+	}
+	encoded := make([]byte, 0, k)
+	encoded = append(encoded, 0x00, 0x01)
+	encoded = append(encoded, bytes.Repeat([]byte{0xff}, k-tLen-3)...)
+	encoded = append(encoded, 0x00)
+	encoded = append(encoded, prefix...)
+	return append(encoded, digest...), nil
+}
+
+// generateSafePrime returns a random prime p of the size in bits provided, such that (p-1)/2 is also
+// prime. Candidates are sieved with small primes before testing them.
+func generateSafePrime(bits int) (*big.Int, error) {
+	if bits < 16 {
+		return nil, fmt.Errorf("safe prime size too small")
+	}
+	max := new(big.Int).Lsh(big.NewInt(1), uint(bits-1))
+	residues := make([]uint64, len(smallPrimes))
+	for {
+		q, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return nil, err
+		}
+		// The two top bits of p are set, so the product of two of them has the expected size.
+		q.SetBit(q, bits-2, 1)
+		q.SetBit(q, bits-3, 1)
+		q.SetBit(q, 0, 1)
+		q.SetBit(q, 1, 1) // q = 3 mod 4, so p = 7 mod 8
+		mod := new(big.Int)
+		for i, prime := range smallPrimes {
+			residues[i] = mod.Mod(q, new(big.Int).SetUint64(prime)).Uint64()
+		}
+		for delta := uint64(0); delta < 1<<20; delta += 4 {
+			skip := false
+			for i, prime := range smallPrimes {
+				// q and 2q+1 must not be divisible by a small prime
+				r := (residues[i] + delta) % prime
+				if r == 0 || r == (prime-1)/2 {
+					skip = true
+					break
+				}
+			}
+			if skip {
+				continue
+			}
+			candidate := new(big.Int).Add(q, new(big.Int).SetUint64(delta))
+			if candidate.BitLen() != bits-1 {
+				break
+			}
+			if !candidate.ProbablyPrime(1) {
+				continue
+			}
+			p := new(big.Int).Lsh(candidate, 1)
+			p.SetBit(p, 0, 1)
+			if p.ProbablyPrime(20) && candidate.ProbablyPrime(20) {
+				return p, nil
+			}
+		}
+	}
+}
+
+// smallPrimes are the odd primes lower than 20000, used to sieve safe prime candidates.
+var smallPrimes = func() []uint64 {
+	primes := make([]uint64, 0)
+	for n := uint64(3); n < 20000; n += 2 {
+		isPrime := true
+		for _, p := range primes {
+			if p*p > n {
+				break
+			}
+			if n%p == 0 {
+				isPrime = false
+				break
+			}
+		}
+		if isPrime {
+			primes = append(primes, n)
+		}
+	}
+	return primes
+}()
+
+// factorial returns n!.
+func factorial(n int) *big.Int {
+	return new(big.Int).MulRange(1, int64(n))
+}
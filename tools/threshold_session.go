@@ -0,0 +1,543 @@
+package tools
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ThresholdProtocolVersion is the version of the protocol used between threshold sessions and nodes.
+//
+// It uses the request and response format of the signer plugin protocol, over TCP (or TLS).
+// The methods are:
+//   - hello {version}: returns {version, index, threshold, nodes, keys: [{id, modulus, exponent}]},
+//     where id is "zsk" or "ksk". It must be the first request.
+//   - sign_share {key_id, digest, hash}: returns {index, signature_share}, the partial signature of the
+//     node for the PKCS#1 v1.5 encoding of the digest.
+//   - end {}: ends the session. The node closes the connection after answering it.
+const ThresholdProtocolVersion = 1
+
+// thresholdTimeout is the time a threshold session waits for a node to connect or answer a request.
+const thresholdTimeout = 30 * time.Second
+
+// ThresholdNodeKeys contains the shares of the ZSK and KSK dealt to a threshold node.
+type ThresholdNodeKeys struct {
+	ZSK *ThresholdKeyShare `json:"zsk"`
+	KSK *ThresholdKeyShare `json:"ksk"`
+}
+
+// ThresholdPublicKey describes a key of a threshold node.
+type ThresholdPublicKey struct {
+	ID       string `json:"id"`
+	Modulus  []byte `json:"modulus"`
+	Exponent int    `json:"exponent"`
+}
+
+// ThresholdNodeInfo is the result of the hello method of a threshold node.
+type ThresholdNodeInfo struct {
+	Version   int                  `json:"version"`
+	Index     int                  `json:"index"`
+	Threshold int                  `json:"threshold"`
+	Nodes     int                  `json:"nodes"`
+	Keys      []ThresholdPublicKey `json:"keys"`
+}
+
+// ThresholdSignatureShare is the result of the sign_share method of a threshold node.
+type ThresholdSignatureShare struct {
+	Index          int    `json:"index"`
+	SignatureShare []byte `json:"signature_share"`
+}
+
+// ThresholdNode serves the partial signatures of the key shares of one node.
+type ThresholdNode struct {
+	Keys      *ThresholdNodeKeys // Key shares of the node
+	TLSConfig *tls.Config        // TLS configuration of the connections. It must require and verify client certificates
+	Insecure  bool               // If true and TLSConfig is nil, the node serves plain TCP connections of any client
+	Log       *log.Logger        // Log for connections, signatures and errors (optional)
+}
+
+// shares returns the key shares of the node, indexed by key id.
+func (node *ThresholdNode) shares() map[string]*ThresholdKeyShare {
+	shares := make(map[string]*ThresholdKeyShare)
+	if node.Keys.ZSK != nil {
+		shares[ZSKRole.String()] = node.Keys.ZSK
+	}
+	if node.Keys.KSK != nil {
+		shares[KSKRole.String()] = node.Keys.KSK
+	}
+	return shares
+}
+
+// Info returns the description of the node sent in hello. It fails if the shares of the node
+// were not dealt together.
+func (node *ThresholdNode) Info() (*ThresholdNodeInfo, error) {
+	if node.Keys == nil {
+		return nil, fmt.Errorf("node has no key shares")
+	}
+	info := &ThresholdNodeInfo{Version: ThresholdProtocolVersion, Keys: make([]ThresholdPublicKey, 0)}
+	for _, role := range []KeyRole{ZSKRole, KSKRole} {
+		share, ok := node.shares()[role.String()]
+		if !ok {
+			continue
+		}
+		if info.Index == 0 {
+			info.Index, info.Threshold, info.Nodes = share.Index, share.Threshold, share.Nodes
+		} else if share.Index != info.Index || share.Threshold != info.Threshold || share.Nodes != info.Nodes {
+			return nil, fmt.Errorf("ZSK and KSK shares have different index, threshold or number of nodes")
+		}
+		info.Keys = append(info.Keys, ThresholdPublicKey{
+			ID:       role.String(),
+			Modulus:  share.Modulus,
+			Exponent: share.Exponent,
+		})
+	}
+	if len(info.Keys) == 0 {
+		return nil, fmt.Errorf("node has no key shares")
+	}
+	return info, nil
+}
+
+// Serve accepts connections on the listener and serves each of them in its own goroutine,
+// until the listener is closed. Any client of the node gets partial signatures of the digests it chooses,
+// so the node only serves clients authenticated with mutual TLS, unless it is explicitly insecure.
+func (node *ThresholdNode) Serve(listener net.Listener) error {
+	info, err := node.Info()
+	if err != nil {
+		return err
+	}
+	switch {
+	case node.TLSConfig != nil:
+		if node.TLSConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+			return fmt.Errorf("threshold node TLS configuration must require and verify client certificates")
+		}
+		listener = tls.NewListener(listener, node.TLSConfig)
+	case !node.Insecure:
+		return fmt.Errorf("threshold node needs a mutual TLS configuration, or to be explicitly insecure")
+	default:
+		node.log("serving plain TCP connections without client authentication")
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			remote := conn.RemoteAddr().String()
+			node.log("connection from %s accepted", remote)
+			if err := node.serveConn(conn, conn, info, remote); err != nil {
+				node.log("connection from %s ended with error: %s", remote, err)
+			}
+		}()
+	}
+}
+
+// serveConn serves the requests read from r, writing the responses to w.
+func (node *ThresholdNode) serveConn(r io.Reader, w io.Writer, info *ThresholdNodeInfo, remote string) error {
+	helloDone := false
+	shares := node.shares()
+	return servePluginRequests(r, w, func(req *PluginRequest) (interface{}, error) {
+		if !helloDone && req.Method != "hello" {
+			return nil, fmt.Errorf("hello must be the first request")
+		}
+		switch req.Method {
+		case "hello":
+			var hello PluginHello
+			if err := json.Unmarshal(req.Params, &hello); err != nil {
+				return nil, err
+			}
+			if hello.Version != ThresholdProtocolVersion {
+				return nil, fmt.Errorf("protocol version %d not supported. This node uses version %d", hello.Version, ThresholdProtocolVersion)
+			}
+			helloDone = true
+			return info, nil
+		case "sign_share":
+			var params PluginSignParams
+			if err := json.Unmarshal(req.Params, &params); err != nil {
+				return nil, err
+			}
+			share, ok := shares[params.KeyID]
+			if !ok {
+				return nil, fmt.Errorf("unknown key %q", params.KeyID)
+			}
+			hash, ok := pluginHashes[params.Hash]
+			if !ok {
+				return nil, fmt.Errorf("unknown hash %q", params.Hash)
+			}
+			partial, err := share.SignPartial(params.Digest, hash)
+			if err != nil {
+				node.log("partial signature for %s with key %s failed: %s", remote, params.KeyID, err)
+				return nil, err
+			}
+			node.log("partial signature for %s with key %s digest=%x", remote, params.KeyID, params.Digest)
+			return &ThresholdSignatureShare{Index: share.Index, SignatureShare: partial}, nil
+		case "end":
+			return struct{}{}, nil
+		}
+		return nil, fmt.Errorf("unknown method %q", req.Method)
+	})
+}
+
+func (node *ThresholdNode) log(format string, args ...interface{}) {
+	if node.Log != nil {
+		node.Log.Printf(format, args...)
+	}
+}
+
+// thresholdNodeClient is a connection of a threshold session with a node.
+type thresholdNodeClient struct {
+	address string
+	conn    net.Conn
+	client  *PluginClient
+	info    *ThresholdNodeInfo
+	failed  bool // If true, the connection failed and the node is not used anymore
+}
+
+// call sends a request to the node, with a deadline. If the request cannot be sent or answered,
+// the node is not used anymore.
+func (node *thresholdNodeClient) call(method string, params, result interface{}) error {
+	if node.failed {
+		return fmt.Errorf("connection with node %s failed before", node.address)
+	}
+	node.conn.SetDeadline(time.Now().Add(thresholdTimeout))
+	err := node.client.Call(method, params, result)
+	if _, ok := err.(*PluginError); err != nil && !ok {
+		// Errors not returned by the node break the request and response sequence
+		node.failed = true
+		node.conn.Close()
+	}
+	return err
+}
+
+// ThresholdSession signs the zone with threshold RSA keys, whose shares are held by several nodes.
+// Each signature gathers the partial signatures of the available nodes and combines them.
+// Keys are created by dealing their shares (dns-tools threshold deal), so they cannot be created
+// or destroyed by the session.
+type ThresholdSession struct {
+	ctx       *Context
+	nodes     []*thresholdNodeClient
+	threshold int
+	total     int // Number of nodes the keys were dealt to
+	roles     KeyRole
+	zskSigner *thresholdSigner
+	kskSigner *thresholdSigner
+}
+
+// NewThresholdSession connects to the threshold nodes with the addresses provided, using TLS if
+// tlsConfig is not nil. Unreachable nodes are skipped, but at least threshold nodes must be available.
+func (ctx *Context) NewThresholdSession(addresses []string, tlsConfig *tls.Config) (*ThresholdSession, error) {
+	if ctx.SignAlgorithm != RsaSha256 {
+		return nil, fmt.Errorf("threshold signing only supports the rsa sign algorithm")
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("threshold nodes not specified")
+	}
+	session := &ThresholdSession{ctx: ctx}
+	indexes := make(map[int]string)
+	for _, address := range addresses {
+		node, err := connectThresholdNode(address, tlsConfig)
+		if err != nil {
+			ctx.Log.Printf("skipping threshold node %s: %s", address, err)
+			continue
+		}
+		if other, ok := indexes[node.info.Index]; ok {
+			node.conn.Close()
+			session.End()
+			return nil, fmt.Errorf("threshold nodes %s and %s have the same index %d", other, address, node.info.Index)
+		}
+		if len(session.nodes) > 0 && !sameThresholdKeys(session.nodes[0].info, node.info) {
+			node.conn.Close()
+			session.End()
+			return nil, fmt.Errorf("threshold node %s has different keys than %s", address, session.nodes[0].address)
+		}
+		indexes[node.info.Index] = address
+		session.nodes = append(session.nodes, node)
+	}
+	if len(session.nodes) == 0 {
+		return nil, fmt.Errorf("cannot connect to any threshold node")
+	}
+	session.threshold, session.total = session.nodes[0].info.Threshold, session.nodes[0].info.Nodes
+	if len(session.nodes) < session.threshold {
+		session.End()
+		return nil, fmt.Errorf("%d threshold nodes available, but %d are needed", len(indexes), session.threshold)
+	}
+	return session, nil
+}
+
+// connectThresholdNode connects to a threshold node and sends hello.
+func connectThresholdNode(address string, tlsConfig *tls.Config) (*thresholdNodeClient, error) {
+	dialer := &net.Dialer{Timeout: thresholdTimeout}
+	var conn net.Conn
+	var err error
+	if tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	node := &thresholdNodeClient{address: address, conn: conn, client: NewPluginClient(conn, conn)}
+	var info ThresholdNodeInfo
+	if err := node.call("hello", &PluginHello{Version: ThresholdProtocolVersion}, &info); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if info.Version != ThresholdProtocolVersion {
+		conn.Close()
+		return nil, fmt.Errorf("node uses protocol version %d instead of %d", info.Version, ThresholdProtocolVersion)
+	}
+	if info.Threshold < 1 || info.Threshold > info.Nodes || info.Index < 1 || info.Index > info.Nodes {
+		conn.Close()
+		return nil, fmt.Errorf("node has an invalid index %d, threshold %d or number of nodes %d", info.Index, info.Threshold, info.Nodes)
+	}
+	node.info = &info
+	return node, nil
+}
+
+// sameThresholdKeys returns true if two nodes have shares of the same keys.
+func sameThresholdKeys(a, b *ThresholdNodeInfo) bool {
+	if a.Threshold != b.Threshold || a.Nodes != b.Nodes || len(a.Keys) != len(b.Keys) {
+		return false
+	}
+	for i := range a.Keys {
+		if a.Keys[i].ID != b.Keys[i].ID || a.Keys[i].Exponent != b.Keys[i].Exponent || string(a.Keys[i].Modulus) != string(b.Keys[i].Modulus) {
+			return false
+		}
+	}
+	return true
+}
+
+// Context returns the session context
+func (session *ThresholdSession) Context() *Context {
+	return session.ctx
+}
+
+// GetKeys returns signers for the keys shared by the nodes.
+func (session *ThresholdSession) GetKeys() (*SigKeys, error) {
+	if session.ctx.Config.CreateKeys {
+		return nil, fmt.Errorf("threshold keys cannot be created while signing. Deal them with dns-tools threshold deal")
+	}
+	keys := &SigKeys{}
+	for _, role := range []KeyRole{ZSKRole, KSKRole} {
+		if !session.providedRoles().Has(role) {
+			continue
+		}
+		var public *ThresholdPublicKey
+		for i, key := range session.nodes[0].info.Keys {
+			if key.ID == role.String() {
+				public = &session.nodes[0].info.Keys[i]
+			}
+		}
+		if public == nil {
+			return nil, fmt.Errorf("threshold nodes do not have a %s", role)
+		}
+		signer := &thresholdSigner{
+			session: session,
+			keyID:   public.ID,
+			publicKey: &rsa.PublicKey{
+				N: new(big.Int).SetBytes(public.Modulus),
+				E: public.Exponent,
+			},
+		}
+		if role == ZSKRole {
+			session.zskSigner, keys.zskSigner = signer, signer
+		} else {
+			session.kskSigner, keys.kskSigner = signer, signer
+		}
+	}
+	return keys, nil
+}
+
+// GetPublicKeyBytes returns the public key bytes of the ZSK and KSK.
+func (session *ThresholdSession) GetPublicKeyBytes(keys *SigKeys) (zskBytes, kskBytes []byte, err error) {
+	if session.zskSigner == nil && session.kskSigner == nil {
+		err = fmt.Errorf("keys not retrieved from session")
+		return
+	}
+	if session.zskSigner != nil {
+		if zskBytes, err = publicKeyToBytes(session.zskSigner.publicKey); err != nil {
+			return
+		}
+	}
+	if session.kskSigner != nil {
+		kskBytes, err = publicKeyToBytes(session.kskSigner.publicKey)
+	}
+	return
+}
+
+// DestroyAllKeys is not supported by threshold sessions.
+func (session *ThresholdSession) DestroyAllKeys() error {
+	return fmt.Errorf("threshold keys cannot be destroyed by the session. Delete the share files of the nodes")
+}
+
+// End sends the end request to the nodes and closes the connections.
+func (session *ThresholdSession) End() error {
+	for _, node := range session.nodes {
+		if !node.failed {
+			node.call("end", struct{}{}, nil)
+			node.conn.Close()
+		}
+	}
+	session.nodes = nil
+	return nil
+}
+
+// Info returns the signing mode of the session, its threshold and number of nodes.
+func (session *ThresholdSession) Info() string {
+	return fmt.Sprintf("mode=threshold;threshold=%d;nodes=%d;", session.threshold, session.total)
+}
+
+// restrictRoles makes the session use only the keys of the roles provided.
+func (session *ThresholdSession) restrictRoles(roles KeyRole) {
+	session.roles = roles
+}
+
+// providedRoles returns the roles of the keys provided by the session.
+func (session *ThresholdSession) providedRoles() KeyRole {
+	if session.roles == 0 {
+		return AllRoles
+	}
+	return session.roles
+}
+
+// thresholdSigner signs with a key shared by the nodes of a threshold session.
+type thresholdSigner struct {
+	session   *ThresholdSession
+	keyID     string
+	publicKey *rsa.PublicKey
+}
+
+// Public returns the public key of the signer.
+func (signer *thresholdSigner) Public() crypto.PublicKey {
+	return signer.publicKey
+}
+
+// Sign asks every available node for its partial signature of the digest, and combines them.
+// If a combination of threshold partial signatures does not verify, the other combinations are tried,
+// so nodes with a wrong share are tolerated while threshold nodes answer correctly.
+func (signer *thresholdSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash, err := pluginHashName(opts.HashFunc())
+	if err != nil {
+		return nil, err
+	}
+	session := signer.session
+	partials := make(map[int][]byte)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, node := range session.nodes {
+		if node.failed {
+			continue
+		}
+		wg.Add(1)
+		go func(node *thresholdNodeClient) {
+			defer wg.Done()
+			var share ThresholdSignatureShare
+			err := node.call("sign_share", &PluginSignParams{
+				KeyID:  signer.keyID,
+				Digest: digest,
+				Hash:   hash,
+			}, &share)
+			if err != nil {
+				session.ctx.Log.Printf("threshold node %s did not sign: %s", node.address, err)
+				return
+			}
+			if share.Index != node.info.Index {
+				session.ctx.Log.Printf("threshold node %s answered with index %d instead of %d", node.address, share.Index, node.info.Index)
+				return
+			}
+			mutex.Lock()
+			partials[share.Index] = share.SignatureShare
+			mutex.Unlock()
+		}(node)
+	}
+	wg.Wait()
+	if len(partials) < session.threshold {
+		return nil, fmt.Errorf("%d partial signatures received, but %d are needed", len(partials), session.threshold)
+	}
+	indexes := make([]int, 0, len(partials))
+	for index := range partials {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	var sig []byte
+	err = fmt.Errorf("no combination of partial signatures verifies")
+	forEachCombination(indexes, session.threshold, func(subset []int) bool {
+		selected := make(map[int][]byte)
+		for _, index := range subset {
+			selected[index] = partials[index]
+		}
+		var combineErr error
+		sig, combineErr = CombineThresholdSignature(signer.publicKey, session.threshold, session.total, digest, opts.HashFunc(), selected)
+		if combineErr != nil {
+			session.ctx.Log.Printf("partial signatures of nodes %v cannot be combined: %s", subset, combineErr)
+			return true
+		}
+		err = nil
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
+
+// forEachCombination calls f with every combination of k values of the list, in lexicographic order,
+// until f returns false.
+func forEachCombination(values []int, k int, f func([]int) bool) {
+	positions := make([]int, k)
+	for i := range positions {
+		positions[i] = i
+	}
+	subset := make([]int, k)
+	for {
+		for i, position := range positions {
+			subset[i] = values[position]
+		}
+		if !f(subset) {
+			return
+		}
+		i := k - 1
+		for i >= 0 && positions[i] == len(values)-k+i {
+			i--
+		}
+		if i < 0 {
+			return
+		}
+		positions[i]++
+		for j := i + 1; j < k; j++ {
+			positions[j] = positions[j-1] + 1
+		}
+	}
+}
+
+var thresholdBackend = &SessionBackend{
+	Name:        "threshold",
+	Description: "combines partial signatures of threshold RSA nodes (dns-tools threshold node) to sign the zone",
+	Options: []BackendOption{
+		{Name: "threshold-node", Type: StringSliceOption, Default: []string{}, Usage: "Address (host:port) of a threshold node. It can be repeated."},
+		{Name: "threshold-cert", Type: StringOption, Default: "", Usage: "Full path to the PEM client certificate. If it is not set, nodes are contacted without TLS."},
+		{Name: "threshold-key", Type: StringOption, Default: "", Usage: "Full path to the PEM client private key."},
+		{Name: "threshold-ca", Type: StringOption, Default: "", Usage: "Full path to the PEM CA certificate used to verify the nodes."},
+	},
+	New: func(ctx *Context, conf BackendConfig, roles KeyRole) (SignSession, error) {
+		var tlsConfig *tls.Config
+		if cert := conf.GetString("threshold-cert"); len(cert) > 0 {
+			var err error
+			tlsConfig, err = NewMutualTLSConfig(cert, conf.GetString("threshold-key"), conf.GetString("threshold-ca"), false)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return ctx.NewThresholdSession(conf.GetStringSlice("threshold-node"), tlsConfig)
+	},
+}
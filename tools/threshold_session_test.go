@@ -0,0 +1,227 @@
+package tools_test
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"math/big"
+	"net"
+	"testing"
+
+	"github.com/niclabs/dns-tools/tools"
+)
+
+// Safe primes of 512 bits, so the tests do not need to generate them.
+const (
+	thresholdZSKP = "d7af22704e8bac56a54397c6e409b8d22b465ac6bfc8d486ac7fbac4be5ceebe1480faaf93c56a2315e4c2f69f92fd5f0fb8444a01197e2f6df1fca60bbc77fb"
+	thresholdZSKQ = "c61ee029f336c7ab44922e1b697421717cf3cf7c0a13867ecf790737ee25ba28fb18c4f84b90649139cb2990edca7c9071f3d385faf21c339c161a66ffbb3b1b"
+	thresholdKSKP = "f8205e4a0dd24180149a52ae3695a57442b349dcd119b79ea370da16eba8b25deea01322c77163e5b14b38e5114423b8c15b24153101d4fd7c2462faa8c37e1b"
+	thresholdKSKQ = "fb9ecb293487fe935c5de363e28c7b34da764bd9554514b789957106580e62e4b97fa07f6d4ec82f529c0526ff72d44ba1bf24f4b9ad0d4d622a2a8fc21d537f"
+)
+
+func dealTestThresholdKey(t *testing.T, p, q string, threshold, nodes int) []*tools.ThresholdKeyShare {
+	bigP, _ := new(big.Int).SetString(p, 16)
+	bigQ, _ := new(big.Int).SetString(q, 16)
+	shares, err := tools.DealThresholdKey(bigP, bigQ, threshold, nodes)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	return shares
+}
+
+// dealThresholdNodeKeys deals the test keys to the number of nodes provided.
+func dealThresholdNodeKeys(t *testing.T, threshold, nodes int) []*tools.ThresholdNodeKeys {
+	zsk := dealTestThresholdKey(t, thresholdZSKP, thresholdZSKQ, threshold, nodes)
+	ksk := dealTestThresholdKey(t, thresholdKSKP, thresholdKSKQ, threshold, nodes)
+	keys := make([]*tools.ThresholdNodeKeys, nodes)
+	for i := range keys {
+		keys[i] = &tools.ThresholdNodeKeys{ZSK: zsk[i], KSK: ksk[i]}
+	}
+	return keys
+}
+
+// startThresholdNodes serves the keys of each node on localhost and returns their addresses.
+func startThresholdNodes(t *testing.T, keys []*tools.ThresholdNodeKeys) []string {
+	addresses := make([]string, len(keys))
+	for i := range addresses {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		node := &tools.ThresholdNode{Keys: keys[i], Insecure: true}
+		go node.Serve(listener)
+		addresses[i] = listener.Addr().String()
+	}
+	return addresses
+}
+
+func TestThresholdRSA_AllCombinations(t *testing.T) {
+	shares := dealTestThresholdKey(t, thresholdZSKP, thresholdZSKQ, 3, 5)
+	digest := sha256.Sum256([]byte("threshold"))
+	partials := make(map[int][]byte)
+	for _, share := range shares {
+		partial, err := share.SignPartial(digest[:], crypto.SHA256)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		partials[share.Index] = partial
+	}
+	public := shares[0].PublicKey()
+	for a := 1; a <= 5; a++ {
+		for b := a + 1; b <= 5; b++ {
+			for c := b + 1; c <= 5; c++ {
+				selected := map[int][]byte{a: partials[a], b: partials[b], c: partials[c]}
+				sig, err := tools.CombineThresholdSignature(public, 3, 5, digest[:], crypto.SHA256, selected)
+				if err != nil {
+					t.Errorf("nodes %d, %d and %d: %s", a, b, c, err)
+					continue
+				}
+				if err := rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], sig); err != nil {
+					t.Errorf("nodes %d, %d and %d: %s", a, b, c, err)
+				}
+			}
+		}
+	}
+	delete(partials, 1)
+	delete(partials, 2)
+	delete(partials, 3)
+	if _, err := tools.CombineThresholdSignature(public, 3, 5, digest[:], crypto.SHA256, partials); err == nil {
+		t.Errorf("signature combined with less partial signatures than the threshold")
+	}
+}
+
+func TestThresholdRSA_DealRequiresSafePrimes(t *testing.T) {
+	p, _ := new(big.Int).SetString(thresholdZSKP, 16)
+	q := new(big.Int).Add(p, big.NewInt(2))
+	for !q.ProbablyPrime(20) {
+		q.Add(q, big.NewInt(2))
+	}
+	if _, err := tools.DealThresholdKey(p, q, 2, 3); err == nil {
+		t.Errorf("key dealt with a prime that is not safe")
+	}
+}
+
+func TestSession_ThresholdSign(t *testing.T) {
+	addresses := startThresholdNodes(t, dealThresholdNodeKeys(t, 2, 3))
+	ctx := testContext(tools.RsaSha256, true, false)
+	ctx.Config.Info = true
+	session, err := ctx.NewThresholdSession(addresses, nil)
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	out, err := sign(t, ctx, session)
+	if err != nil {
+		t.Errorf("signing failed: %s", err)
+		return
+	}
+	defer out.Close()
+	if err := ctx.VerifyFile(); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+}
+
+func TestSession_ThresholdSignUnavailableNode(t *testing.T) {
+	addresses := startThresholdNodes(t, dealThresholdNodeKeys(t, 2, 3))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	addresses[1] = listener.Addr().String() // Nothing serves this address after closing it
+	listener.Close()
+	ctx := testContext(tools.RsaSha256, false, false)
+	session, err := ctx.NewSession("threshold", mapConfig{"threshold-node": addresses}, tools.AllRoles)
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	out, err := sign(t, ctx, session)
+	if err != nil {
+		t.Errorf("signing failed: %s", err)
+		return
+	}
+	defer out.Close()
+	if err := ctx.VerifyFile(); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+
+	// With only one node, the threshold cannot be reached.
+	if _, err := ctx.NewThresholdSession(addresses[:2], nil); err == nil {
+		t.Errorf("session created with less nodes than the threshold")
+	}
+}
+
+func TestSession_ThresholdSignWrongShare(t *testing.T) {
+	keys := dealThresholdNodeKeys(t, 2, 3)
+	for _, share := range []*tools.ThresholdKeyShare{keys[0].ZSK, keys[0].KSK} {
+		share.Share = new(big.Int).Add(new(big.Int).SetBytes(share.Share), big.NewInt(1)).Bytes()
+	}
+	addresses := startThresholdNodes(t, keys)
+	ctx := testContext(tools.RsaSha256, false, false)
+	session, err := ctx.NewThresholdSession(addresses, nil)
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	out, err := sign(t, ctx, session)
+	if err != nil {
+		t.Errorf("signing failed: %s", err)
+		return
+	}
+	defer out.Close()
+	if err := ctx.VerifyFile(); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+}
+
+func TestThresholdNode_RequiresMutualTLS(t *testing.T) {
+	keys := dealThresholdNodeKeys(t, 2, 2)
+	ca := newTestCA(t)
+	serverCert := ca.issue(t, "localhost", true)
+	refused := map[string]*tools.ThresholdNode{
+		"plain TCP":              {Keys: keys[0]},
+		"TLS without client CAs": {Keys: keys[0], TLSConfig: &tls.Config{Certificates: []tls.Certificate{serverCert}}},
+	}
+	for name, node := range refused {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		if err := node.Serve(listener); err == nil {
+			t.Errorf("%s: node served connections", name)
+		}
+		listener.Close()
+	}
+
+	addresses := make([]string, len(keys))
+	for i := range keys {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		node := &tools.ThresholdNode{Keys: keys[i], TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientCAs:    ca.pool(),
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		}}
+		go node.Serve(listener)
+		addresses[i] = listener.Addr().String()
+	}
+	ctx := testContext(tools.RsaSha256, false, false)
+	clientConfig := &tls.Config{RootCAs: ca.pool(), Certificates: []tls.Certificate{ca.issue(t, "signer", false)}}
+	session, err := ctx.NewThresholdSession(addresses, clientConfig)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	out, err := sign(t, ctx, session)
+	if err != nil {
+		t.Fatalf("signing with mutual TLS failed: %s", err)
+	}
+	out.Close()
+	if _, err := ctx.NewThresholdSession(addresses, &tls.Config{RootCAs: ca.pool()}); err == nil {
+		t.Errorf("threshold session created without a client certificate")
+	}
+}
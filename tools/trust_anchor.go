@@ -0,0 +1,312 @@
+package tools
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// trustAnchorXML is a trust anchor file in the format of RFC7958.
+type trustAnchorXML struct {
+	XMLName    xml.Name       `xml:"TrustAnchor"`
+	Zone       string         `xml:"Zone"`
+	KeyDigests []keyDigestXML `xml:"KeyDigest"`
+}
+
+// keyDigestXML is a DS RR of a trust anchor file, valid between its validFrom and validUntil dates.
+type keyDigestXML struct {
+	ValidFrom  string `xml:"validFrom,attr"`
+	ValidUntil string `xml:"validUntil,attr"`
+	KeyTag     uint16 `xml:"KeyTag"`
+	Algorithm  uint8  `xml:"Algorithm"`
+	DigestType uint8  `xml:"DigestType"`
+	Digest     string `xml:"Digest"`
+}
+
+// checkChainOfTrust checks that the DNSKEY RRset is signed by a key matching the trust anchors of the zone:
+// the DS RRs of the configuration, the DS and DNSKEY RRs of the trust anchor file, and the DS RRset of the
+// signed parent zone, which must be valid itself. It does nothing if there are no trust anchors.
+func (ctx *Context) checkChainOfTrust() error {
+	anchors, err := ctx.readTrustAnchors()
+	if err != nil {
+		return err
+	}
+	if len(anchors) == 0 {
+		return nil
+	}
+	dnskeys := make(RRArray, 0)
+	sigs := make([]*dns.RRSIG, 0)
+	for _, rr := range ctx.rrs {
+		if rr.Header().Name != ctx.Config.Zone {
+			continue
+		}
+		if rr.Header().Rrtype == dns.TypeDNSKEY {
+			dnskeys = append(dnskeys, rr)
+		} else if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == dns.TypeDNSKEY {
+			sigs = append(sigs, sig)
+		}
+	}
+	if len(dnskeys) == 0 {
+		return fmt.Errorf("the zone has no DNSKEY RRset")
+	}
+	setName := getHash(dnskeys[0], true)
+	for _, sig := range sigs {
+		key, err := ctx.verifyRRSig(setName, sig, dnskeys)
+		if err != nil || key.Flags&dns.REVOKE != 0 {
+			continue
+		}
+		if anchor := matchingAnchor(key, anchors); anchor != nil {
+			ctx.Log.Printf("[ OK  ] DNSKEY RRset signed by key %d, anchored by %s", key.KeyTag(), anchor)
+			return nil
+		}
+	}
+	return fmt.Errorf("the DNSKEY RRset is not signed by a key matching the trust anchors of the zone")
+}
+
+// matchingAnchor returns the DS or DNSKEY trust anchor matching the key, or nil if there is none. The key
+// must have the Zone Key flag (RFC4035 section 5.2), and DNSKEY trust anchors with the REVOKE flag do not
+// match any key (RFC5011 section 2.1).
+func matchingAnchor(key *dns.DNSKEY, anchors RRArray) dns.RR {
+	if key.Flags&dns.ZONE == 0 {
+		return nil
+	}
+	for _, anchor := range anchors {
+		switch anchor := anchor.(type) {
+		case *dns.DS:
+			if anchor.KeyTag != key.KeyTag() || anchor.Algorithm != key.Algorithm {
+				continue
+			}
+			if ds := key.ToDS(anchor.DigestType); ds != nil && strings.EqualFold(ds.Digest, anchor.Digest) {
+				return anchor
+			}
+		case *dns.DNSKEY:
+			if anchor.Flags&dns.REVOKE != 0 {
+				continue
+			}
+			if anchor.Algorithm == key.Algorithm && anchor.Flags == key.Flags && anchor.PublicKey == key.PublicKey {
+				return anchor
+			}
+		}
+	}
+	return nil
+}
+
+// readTrustAnchors returns the trust anchors of the zone from the configuration: DS RRs, a trust anchor file
+// and a signed parent zone.
+func (ctx *Context) readTrustAnchors() (RRArray, error) {
+	anchors, err := parseDS(ctx.Config.TrustAnchorDS, ctx.Config.Zone)
+	if err != nil {
+		return nil, err
+	}
+	if ctx.Config.TrustAnchorFile != "" {
+		fileAnchors, err := ctx.readTrustAnchorFile(ctx.Config.TrustAnchorFile)
+		if err != nil {
+			return nil, err
+		}
+		anchors = append(anchors, fileAnchors...)
+	}
+	if ctx.Config.ParentZoneFile != "" {
+		parentDS, err := ctx.readParentDS(ctx.Config.ParentZoneFile)
+		if err != nil {
+			return nil, err
+		}
+		anchors = append(anchors, parentDS...)
+	}
+	return anchors, nil
+}
+
+// parseDS parses DS RRs in presentation format, which must be DS RRs of the zone provided.
+func parseDS(rrs []string, zone string) (RRArray, error) {
+	dsSet := make(RRArray, 0)
+	for _, s := range rrs {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse DS RR %s: %s", s, err)
+		}
+		ds, ok := rr.(*dns.DS)
+		if !ok || NormalizeFQDN(ds.Hdr.Name) != zone {
+			return nil, fmt.Errorf("%s is not a DS RR of %s", s, zone)
+		}
+		dsSet = append(dsSet, ds)
+	}
+	return dsSet, nil
+}
+
+// readTrustAnchorFile reads the trust anchors of the zone from an XML file in the format of RFC7958, or from
+// a file with DS and DNSKEY RRs in presentation format.
+func (ctx *Context) readTrustAnchorFile(path string) (RRArray, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read trust anchor file: %s", err)
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(content), []byte("<")) {
+		return ctx.parseTrustAnchorXML(path, content)
+	}
+	anchors := make(RRArray, 0)
+	parser := dns.NewZoneParser(bytes.NewReader(content), ctx.Config.Zone, path)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		rr.Header().Name = NormalizeFQDN(rr.Header().Name)
+		switch rr.Header().Rrtype {
+		case dns.TypeDS, dns.TypeDNSKEY:
+		default:
+			return nil, fmt.Errorf("trust anchor file %s has a %s RR, but only DS and DNSKEY RRs are allowed",
+				path, dns.TypeToString[rr.Header().Rrtype])
+		}
+		if rr.Header().Name != ctx.Config.Zone {
+			return nil, fmt.Errorf("trust anchor file %s has RRs of %s, which is not the zone apex", path, rr.Header().Name)
+		}
+		anchors = append(anchors, rr)
+	}
+	if err := parser.Err(); err != nil {
+		return nil, fmt.Errorf("cannot parse trust anchor file %s: %s", path, err)
+	}
+	return anchors, nil
+}
+
+// parseTrustAnchorXML returns the DS RRs of an RFC7958 trust anchor file which are valid now.
+func (ctx *Context) parseTrustAnchorXML(path string, content []byte) (RRArray, error) {
+	var anchor trustAnchorXML
+	if err := xml.Unmarshal(content, &anchor); err != nil {
+		return nil, fmt.Errorf("cannot parse trust anchor file %s: %s", path, err)
+	}
+	if zone := NormalizeFQDN(dns.Fqdn(strings.TrimSpace(anchor.Zone))); zone != ctx.Config.Zone {
+		return nil, fmt.Errorf("trust anchor file %s is for zone %s, not for %s", path, zone, ctx.Config.Zone)
+	}
+	now := time.Now()
+	anchors := make(RRArray, 0)
+	for _, digest := range anchor.KeyDigests {
+		validFrom, err := time.Parse(time.RFC3339, digest.ValidFrom)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse validFrom date of trust anchor %d: %s", digest.KeyTag, err)
+		}
+		if now.Before(validFrom) {
+			continue
+		}
+		if digest.ValidUntil != "" {
+			validUntil, err := time.Parse(time.RFC3339, digest.ValidUntil)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse validUntil date of trust anchor %d: %s", digest.KeyTag, err)
+			}
+			if now.After(validUntil) {
+				continue
+			}
+		}
+		anchors = append(anchors, &dns.DS{
+			Hdr:        dns.RR_Header{Name: ctx.Config.Zone, Rrtype: dns.TypeDS, Class: dns.ClassINET},
+			KeyTag:     digest.KeyTag,
+			Algorithm:  digest.Algorithm,
+			DigestType: digest.DigestType,
+			Digest:     strings.ToUpper(strings.TrimSpace(digest.Digest)),
+		})
+	}
+	if len(anchors) == 0 {
+		return nil, fmt.Errorf("trust anchor file %s has no trust anchors valid now", path)
+	}
+	return anchors, nil
+}
+
+// readParentDS returns the DS RRset of the zone from a signed parent zone file, if it has a valid RRSIG made
+// by a key of the DNSKEY RRset of the parent zone, which must be signed by one of its keys too. The DNSKEY
+// RRset of the parent zone is anchored only if there are DS RRs of the parent zone in the configuration: a key
+// matching one of them must sign it. Otherwise, only the consistency of the parent zone file is checked.
+func (ctx *Context) readParentDS(path string) (RRArray, error) {
+	if ctx.Config.Zone == "." {
+		return nil, fmt.Errorf("the root zone has no parent zone")
+	}
+	next, _ := dns.NextLabel(ctx.Config.Zone, 0)
+	parent := dns.Fqdn(ctx.Config.Zone[next:])
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read parent zone file: %s", err)
+	}
+	dsSet, keySet := make(RRArray, 0), make(RRArray, 0)
+	dsSigs, keySigs := make([]*dns.RRSIG, 0), make([]*dns.RRSIG, 0)
+	parser := dns.NewZoneParser(bytes.NewReader(content), parent, path)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		rr.Header().Name = NormalizeFQDN(rr.Header().Name)
+		name := rr.Header().Name
+		switch {
+		case name == ctx.Config.Zone && rr.Header().Rrtype == dns.TypeDS:
+			dsSet = append(dsSet, rr)
+		case name == parent && rr.Header().Rrtype == dns.TypeDNSKEY:
+			keySet = append(keySet, rr)
+		case rr.Header().Rrtype == dns.TypeRRSIG:
+			sig := rr.(*dns.RRSIG)
+			if name == ctx.Config.Zone && sig.TypeCovered == dns.TypeDS {
+				dsSigs = append(dsSigs, sig)
+			} else if name == parent && sig.TypeCovered == dns.TypeDNSKEY {
+				keySigs = append(keySigs, sig)
+			}
+		}
+	}
+	if err := parser.Err(); err != nil {
+		return nil, fmt.Errorf("cannot parse parent zone file %s: %s", path, err)
+	}
+	if len(dsSet) == 0 {
+		return nil, fmt.Errorf("parent zone %s has no DS RRset of %s", parent, ctx.Config.Zone)
+	}
+	if len(keySet) == 0 {
+		return nil, fmt.Errorf("parent zone file %s has no DNSKEY RRset of %s", path, parent)
+	}
+	if err := ctx.verifyWithKeys(keySigs, keySet, keySet); err != nil {
+		return nil, fmt.Errorf("the DNSKEY RRset of the parent zone %s is not valid: %s", parent, err)
+	}
+	if err := ctx.checkParentAnchors(parent, keySigs, keySet); err != nil {
+		return nil, err
+	}
+	if err := ctx.verifyWithKeys(dsSigs, keySet, dsSet); err != nil {
+		return nil, fmt.Errorf("the DS RRset of %s in the parent zone %s is not valid: %s", ctx.Config.Zone, parent, err)
+	}
+	ctx.Log.Printf("[ OK  ] DS RRset of %s in the parent zone %s", ctx.Config.Zone, parent)
+	return dsSet, nil
+}
+
+// checkParentAnchors checks that a key of the DNSKEY RRset of the parent zone matching one of its configured
+// DS RRs signs the RRset. Without them, the parent zone is not anchored, so it returns an error.
+func (ctx *Context) checkParentAnchors(parent string, keySigs []*dns.RRSIG, keySet RRArray) error {
+	anchors, err := parseDS(ctx.Config.ParentDS, parent)
+	if err != nil {
+		return err
+	}
+	if len(anchors) == 0 {
+		return fmt.Errorf("the DNSKEY RRset of the parent zone %s is not anchored: its DS RRs are required", parent)
+	}
+	for _, rr := range keySet {
+		key := rr.(*dns.DNSKEY)
+		if matchingAnchor(key, anchors) != nil && ctx.verifyWithKeys(keySigs, RRArray{key}, keySet) == nil {
+			ctx.Log.Printf("[ OK  ] DNSKEY RRset of the parent zone %s signed by key %d, anchored by its DS RRs", parent, key.KeyTag())
+			return nil
+		}
+	}
+	return fmt.Errorf("the DNSKEY RRset of the parent zone %s is not signed by a key matching its DS RRs", parent)
+}
+
+// verifyWithKeys returns an error if no RRSIG is a valid signature of the RRset, not expired, made by one
+// of the keys provided.
+func (ctx *Context) verifyWithKeys(sigs []*dns.RRSIG, keys RRArray, set RRArray) error {
+	if len(sigs) == 0 {
+		return fmt.Errorf("the RRset has no RRSIGs")
+	}
+	err := fmt.Errorf("no key of the DNSKEY RRset made the RRSIGs")
+	for _, sig := range sigs {
+		if expDate := time.Unix(int64(sig.Expiration), 0); expDate.Before(ctx.Config.VerifyThreshold) {
+			err = fmt.Errorf("the RRSIG made by key %d has already expired. Expiration date: %s", sig.KeyTag, expDate.Format("2006-01-02 15:04:05"))
+			continue
+		}
+		for _, rr := range keys {
+			key := rr.(*dns.DNSKEY)
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm || key.Flags&dns.REVOKE != 0 {
+				continue
+			}
+			if err = sig.Verify(key, set); err == nil {
+				return nil
+			}
+		}
+	}
+	return err
+}
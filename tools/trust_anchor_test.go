@@ -0,0 +1,168 @@
+package tools_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/niclabs/dns-tools/tools"
+)
+
+// parentZone is the com. zone, delegating example.com. with the DS RR added to it.
+const parentZone = `com.	86400	IN	SOA	ns1.com. hostmaster.com. 2019052103 10800 15 604800 10800
+com.	86400	IN	NS	ns1.com.
+ns1.com.	86400	IN	A	127.0.0.1
+example.com.	86400	IN	NS	ns1.example.com.
+`
+
+// signedKSK returns the KSK of a signed zone.
+func signedKSK(t *testing.T, signed string) *dns.DNSKEY {
+	parser := dns.NewZoneParser(strings.NewReader(signed), zone, "")
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		if key, isKey := rr.(*dns.DNSKEY); isKey && key.Flags == 257 {
+			return key
+		}
+	}
+	t.Fatalf("KSK not found in the signed zone")
+	return nil
+}
+
+// verifyAnchored verifies a signed zone with the trust anchors of the configuration provided.
+func verifyAnchored(signed string, configure func(*tools.ContextConfig)) error {
+	ctx := testContext(tools.RsaSha256, false, false)
+	configure(ctx.Config)
+	ctx.File = strings.NewReader(signed)
+	return ctx.VerifyFile()
+}
+
+// writeFile writes a temporary file with the content provided and returns its path.
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("%s", err)
+	}
+	return path
+}
+
+func TestVerify_TrustAnchors(t *testing.T) {
+	signed, err := signZone(t, testContext(tools.RsaSha256, false, false), fileString)
+	if err != nil {
+		t.Fatalf("signing failed: %s", err)
+	}
+	ksk := signedKSK(t, signed)
+	ds := ksk.ToDS(dns.SHA256)
+	wrongDS := dns.Copy(ds).(*dns.DS)
+	wrongDS.Digest = strings.Repeat("AB", 32)
+	revokedKSK := dns.Copy(ksk).(*dns.DNSKEY)
+	revokedKSK.Flags |= dns.REVOKE
+	xmlAnchor := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<TrustAnchor id="test" source="test">
+<Zone>example.com.</Zone>
+<KeyDigest id="old" validFrom="2010-07-15T00:00:00+00:00" validUntil="2019-01-11T00:00:00+00:00">
+<KeyTag>%d</KeyTag>
+<Algorithm>8</Algorithm>
+<DigestType>2</DigestType>
+<Digest>%s</Digest>
+</KeyDigest>
+<KeyDigest id="current" validFrom="2020-01-01T00:00:00+00:00">
+<KeyTag>%d</KeyTag>
+<Algorithm>8</Algorithm>
+<DigestType>2</DigestType>
+<Digest>%s</Digest>
+</KeyDigest>
+</TrustAnchor>
+`, ds.KeyTag, wrongDS.Digest, ds.KeyTag, ds.Digest)
+
+	anchored := map[string]func(*tools.ContextConfig){
+		"DS":           func(c *tools.ContextConfig) { c.TrustAnchorDS = []string{ds.String()} },
+		"DS file":      func(c *tools.ContextConfig) { c.TrustAnchorFile = writeFile(t, "ds.zone", ds.String()+"\n") },
+		"DNSKEY file":  func(c *tools.ContextConfig) { c.TrustAnchorFile = writeFile(t, "ksk.zone", ksk.String()+"\n") },
+		"RFC 7958 XML": func(c *tools.ContextConfig) { c.TrustAnchorFile = writeFile(t, "anchor.xml", xmlAnchor) },
+	}
+	for name, configure := range anchored {
+		if err := verifyAnchored(signed, configure); err != nil {
+			t.Errorf("%s: zone not verified: %s", name, err)
+		}
+	}
+	notAnchored := map[string]func(*tools.ContextConfig){
+		"wrong DS": func(c *tools.ContextConfig) { c.TrustAnchorDS = []string{wrongDS.String()} },
+		"other zone DS": func(c *tools.ContextConfig) {
+			c.TrustAnchorDS = []string{strings.Replace(ds.String(), zone, "other.com.", 1)}
+		},
+		"expired XML": func(c *tools.ContextConfig) {
+			c.TrustAnchorFile = writeFile(t, "anchor.xml", strings.Replace(xmlAnchor, `validFrom="2020-01-01T00:00:00+00:00"`,
+				`validFrom="2020-01-01T00:00:00+00:00" validUntil="2021-01-01T00:00:00+00:00"`, 1))
+		},
+		"other RRs": func(c *tools.ContextConfig) {
+			c.TrustAnchorFile = writeFile(t, "anchor.zone", ds.String()+"\nwww.example.com. 3600 IN A 127.0.0.1\n")
+		},
+		"revoked DNSKEY file": func(c *tools.ContextConfig) {
+			c.TrustAnchorFile = writeFile(t, "ksk.zone", revokedKSK.String()+"\n")
+		},
+	}
+	for name, configure := range notAnchored {
+		if err := verifyAnchored(signed, configure); err == nil {
+			t.Errorf("%s: zone verified", name)
+		}
+	}
+}
+
+func TestVerify_ParentZone(t *testing.T) {
+	signed, err := signZone(t, testContext(tools.RsaSha256, false, false), fileString)
+	if err != nil {
+		t.Fatalf("signing failed: %s", err)
+	}
+	ds := signedKSK(t, signed).ToDS(dns.SHA256)
+	signParent := func(ds *dns.DS) string {
+		ctx := testContext(tools.EcdsaP256Sha256, false, false)
+		ctx.Config.Zone = "com."
+		return signZoneWithKeys(t, ctx, ECZSK, ECKSK, parentZone+ds.String()+"\n")
+	}
+	parent := signParent(ds)
+	// The DNSKEY RRset of the parent zone is anchored by the DS RRs of the parent zone.
+	withParentDS := func(parent string, ds *dns.DS) func(*tools.ContextConfig) {
+		return func(c *tools.ContextConfig) {
+			c.ParentZoneFile = writeFile(t, "com.zone", parent)
+			if ds != nil {
+				c.ParentDS = []string{ds.String()}
+			}
+		}
+	}
+	withParent := func(parent string) func(*tools.ContextConfig) {
+		return withParentDS(parent, signedKSK(t, parent).ToDS(dns.SHA256))
+	}
+	if err := verifyAnchored(signed, withParent(parent)); err != nil {
+		t.Errorf("zone not verified with its parent zone anchored by its DS RR: %s", err)
+	}
+	if err := verifyAnchored(signed, withParentDS(parent, nil)); err == nil {
+		t.Errorf("zone verified with a parent zone not anchored by its DS RRs")
+	}
+	wrongParentDS := signedKSK(t, parent).ToDS(dns.SHA256)
+	wrongParentDS.Digest = strings.Repeat("AB", 32)
+	if err := verifyAnchored(signed, withParentDS(parent, wrongParentDS)); err == nil {
+		t.Errorf("zone verified with a parent zone whose DNSKEY RRset does not match its DS RR")
+	}
+
+	wrongDS := dns.Copy(ds).(*dns.DS)
+	wrongDS.Digest = strings.Repeat("AB", 32)
+	if err := verifyAnchored(signed, withParent(signParent(wrongDS))); err == nil {
+		t.Errorf("zone verified with a parent zone with other DS RR")
+	}
+	// The DS RRset of the parent zone must be signed by the parent zone.
+	modified := make([]string, 0)
+	for _, line := range strings.Split(parent, "\n") {
+		if fields := strings.Fields(line); len(fields) > 3 && fields[3] == "DS" {
+			line = wrongDS.String()
+		}
+		modified = append(modified, line)
+	}
+	if err := verifyAnchored(signed, withParent(strings.Join(modified, "\n"))); err == nil {
+		t.Errorf("zone verified with a DS RR modified after signing the parent zone")
+	}
+	if err := verifyAnchored(signed, withParent(dropRRs(parent, zone, "RRSIG"))); err == nil {
+		t.Errorf("zone verified with a parent zone without RRSIGs of the DS RRset")
+	}
+}
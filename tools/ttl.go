@@ -0,0 +1,98 @@
+package tools
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// denialTTL returns the TTL of the NSEC and NSEC3 RRs: the minimum of the SOA TTL and the SOA MINIMUM
+// field (RFC9077 section 3.3).
+func (ctx *Context) denialTTL() uint32 {
+	if ctx.soa.Hdr.Ttl < ctx.soa.Minttl {
+		return ctx.soa.Hdr.Ttl
+	}
+	return ctx.soa.Minttl
+}
+
+// dnskeyTTL returns the TTL of the DNSKEY RRset: the configured one, or the SOA MINIMUM field if it is not set.
+func (ctx *Context) dnskeyTTL() uint32 {
+	if ctx.Config.DNSKEYTTL > 0 {
+		return ctx.clampTTL(ctx.Config.DNSKEYTTL)
+	}
+	return ctx.clampTTL(ctx.soa.Minttl)
+}
+
+// nsec3ParamTTL returns the TTL of the NSEC3PARAM RR: the configured one, or the TTL of the denial of
+// existence RRs if it is not set.
+func (ctx *Context) nsec3ParamTTL() uint32 {
+	if ctx.Config.NSEC3PARAMTTL > 0 {
+		return ctx.clampTTL(ctx.Config.NSEC3PARAMTTL)
+	}
+	return ctx.denialTTL()
+}
+
+// clampTTL returns the maximum zone TTL if the TTL provided is larger and TTLs are clamped.
+func (ctx *Context) clampTTL(ttl uint32) uint32 {
+	if maxTTL := ctx.Config.MaxZoneTTL; maxTTL > 0 && ctx.Config.ClampTTLs && ttl > maxTTL {
+		return maxTTL
+	}
+	return ttl
+}
+
+// applyTTLPolicy applies the configured CDS TTL to the CDS and CDNSKEY RRs of the apex, and checks the TTLs
+// of the zone and the configured ones against the maximum zone TTL. Larger TTLs are lowered to it if
+// ClampTTLs is true, and they are an error if not. The denial of existence chain of the input zone is
+// checked too, because it is kept in a denial transition.
+func (ctx *Context) applyTTLPolicy() error {
+	rrs := append(RRArray{}, ctx.rrs...)
+	if ctx.denialChains != nil {
+		rrs = append(rrs, ctx.denialChains.published...)
+	}
+	for _, rr := range rrs {
+		switch rr.Header().Rrtype {
+		case dns.TypeCDS, dns.TypeCDNSKEY:
+			if ctx.Config.CDSTTL > 0 && rr.Header().Name == ctx.Config.Zone {
+				rr.Header().Ttl = ctx.clampTTL(ctx.Config.CDSTTL)
+			}
+		}
+	}
+	maxTTL := ctx.Config.MaxZoneTTL
+	if maxTTL == 0 {
+		return nil
+	}
+	clamped := 0
+	for _, rr := range rrs {
+		if rr.Header().Ttl <= maxTTL {
+			continue
+		}
+		if !ctx.Config.ClampTTLs {
+			return fmt.Errorf("TTL of %s is larger than the maximum zone TTL %d", rr, maxTTL)
+		}
+		rr.Header().Ttl = maxTTL
+		clamped++
+	}
+	if clamped > 0 {
+		ctx.Log.Printf("[Warn ] TTL of %d RRs lowered to the maximum zone TTL %d", clamped, maxTTL)
+	}
+	// The denial TTL depends on the SOA TTL, so it is checked after clamping it
+	for name, ttl := range map[string]uint32{
+		"DNSKEY TTL":     ctx.dnskeyTTL(),
+		"NSEC3PARAM TTL": ctx.nsec3ParamTTL(),
+		"CDS TTL":        ctx.clampTTL(ctx.Config.CDSTTL),
+	} {
+		if ttl > maxTTL {
+			return fmt.Errorf("%s %d is larger than the maximum zone TTL %d", name, ttl, maxTTL)
+		}
+	}
+	return nil
+}
+
+// checkNSEC3Params logs a warning if the NSEC3 parameters are not the ones recommended by RFC9276: no
+// additional iterations and an empty salt.
+func (ctx *Context) checkNSEC3Params(param *dns.NSEC3PARAM) {
+	if param.Iterations > 0 || param.Salt != "" {
+		ctx.Log.Printf("[Warn ] %s: RFC9276 recommends 0 NSEC3 iterations and an empty salt, and validators may treat zones with more iterations as insecure",
+			chainName(param))
+	}
+}
@@ -0,0 +1,90 @@
+package tools_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/niclabs/dns-tools/tools"
+)
+
+// shortSOAZone has a SOA TTL shorter than its MINIMUM field, and a CDS RRset.
+var shortSOAZone = strings.Replace(fileString, "example.com.			86400	IN	SOA", "example.com.			3600	IN	SOA", 1) +
+	"example.com. 7200 IN CDS 12345 13 2 0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20\n"
+
+// ttlsByType returns the TTLs of each RR type of a signed zone.
+func ttlsByType(t *testing.T, signed string) map[uint16]map[uint32]bool {
+	ttls := make(map[uint16]map[uint32]bool)
+	parser := dns.NewZoneParser(strings.NewReader(signed), zone, "")
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		rrtype := rr.Header().Rrtype
+		if ttls[rrtype] == nil {
+			ttls[rrtype] = make(map[uint32]bool)
+		}
+		ttls[rrtype][rr.Header().Ttl] = true
+	}
+	if err := parser.Err(); err != nil {
+		t.Fatalf("%s", err)
+	}
+	return ttls
+}
+
+func TestSession_DenialTTL(t *testing.T) {
+	for _, nsec3 := range []bool{false, true} {
+		ctx := testContext(tools.RsaSha256, nsec3, false)
+		ctx.Config.DNSKEYTTL = 1800
+		ctx.Config.CDSTTL = 600
+		ctx.Config.NSEC3PARAMTTL = 60
+		signed, err := signZone(t, ctx, shortSOAZone)
+		if err != nil {
+			t.Fatalf("signing failed: %s", err)
+		}
+		ttls := ttlsByType(t, signed)
+		denialType := dns.TypeNSEC
+		if nsec3 {
+			denialType = dns.TypeNSEC3
+			if len(ttls[dns.TypeNSEC3PARAM]) != 1 || !ttls[dns.TypeNSEC3PARAM][60] {
+				t.Errorf("NSEC3PARAM TTL should be the configured one: %v", ttls[dns.TypeNSEC3PARAM])
+			}
+		}
+		if len(ttls[denialType]) != 1 || !ttls[denialType][3600] {
+			t.Errorf("%s TTL should be the SOA TTL, lower than the SOA MINIMUM: %v", dns.TypeToString[denialType], ttls[denialType])
+		}
+		if len(ttls[dns.TypeDNSKEY]) != 1 || !ttls[dns.TypeDNSKEY][1800] {
+			t.Errorf("DNSKEY TTL should be the configured one: %v", ttls[dns.TypeDNSKEY])
+		}
+		if len(ttls[dns.TypeCDS]) != 1 || !ttls[dns.TypeCDS][600] {
+			t.Errorf("CDS TTL should be the configured one: %v", ttls[dns.TypeCDS])
+		}
+		if err := verifyZone(signed); err != nil {
+			t.Errorf("Error verifying output: %s", err)
+		}
+	}
+}
+
+func TestSession_MaxZoneTTL(t *testing.T) {
+	ctx := testContext(tools.RsaSha256, true, false)
+	ctx.Config.MaxZoneTTL = 7200
+	if _, err := signZone(t, ctx, fileString); err == nil {
+		t.Errorf("zone signed with TTLs larger than the maximum zone TTL")
+	}
+
+	ctx = testContext(tools.RsaSha256, true, false)
+	ctx.Config.MaxZoneTTL = 7200
+	ctx.Config.ClampTTLs = true
+	ctx.Config.Info = true
+	signed, err := signZone(t, ctx, fileString)
+	if err != nil {
+		t.Fatalf("signing failed: %s", err)
+	}
+	for rrtype, ttls := range ttlsByType(t, signed) {
+		for ttl := range ttls {
+			if ttl > 7200 {
+				t.Errorf("%s RR with TTL %d, larger than the maximum zone TTL", dns.TypeToString[rrtype], ttl)
+			}
+		}
+	}
+	if err := verifyZone(signed); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+}
@@ -1,11 +1,17 @@
 package tools
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
 	"encoding/asn1"
+	"encoding/base64"
 	"encoding/binary"
 	"fmt"
+	"math/big"
 	"sort"
 	"strings"
 	"time"
@@ -105,11 +111,80 @@ func ecdsaPublicKeyToBytes(ecPoint []byte) ([]byte, error) {
 
 }
 
+// publicKeyToBytes returns the DNSKEY public key field for a RSA, ECDSA or Ed25519 public key.
+func publicKeyToBytes(publicKey crypto.PublicKey) ([]byte, error) {
+	switch pk := publicKey.(type) {
+	case *rsa.PublicKey:
+		exponent := big.NewInt(int64(pk.E)).Bytes()
+		return rsaPublicKeyToBytes(exponent, pk.N.Bytes())
+	case *ecdsa.PublicKey:
+		curveBytes := 2 * int((pk.Curve.Params().BitSize+7)/8)
+		xBytes, yBytes := pk.X.Bytes(), pk.Y.Bytes()
+		bytesPoint := make([]byte, curveBytes)
+		copy(bytesPoint[curveBytes/2-len(xBytes):curveBytes/2], xBytes)
+		copy(bytesPoint[curveBytes-len(yBytes):curveBytes], yBytes)
+		return bytesPoint, nil
+	case ed25519.PublicKey:
+		return []byte(pk), nil
+	}
+	return nil, fmt.Errorf("public key type %T not supported", publicKey)
+}
+
+// bytesToPublicKey parses the DNSKEY public key field of the algorithm provided.
+// It is the inverse of publicKeyToBytes.
+func bytesToPublicKey(algorithm SignAlgorithm, keyBytes []byte) (crypto.PublicKey, error) {
+	switch algorithm {
+	case RsaSha256:
+		if len(keyBytes) < 3 {
+			return nil, fmt.Errorf("RSA public key too short")
+		}
+		expLen, offset := int(keyBytes[0]), 1
+		if expLen == 0 {
+			expLen, offset = int(binary.BigEndian.Uint16(keyBytes[1:3])), 3
+		}
+		if expLen == 0 || expLen > 4 || len(keyBytes) <= offset+expLen {
+			return nil, fmt.Errorf("invalid RSA public key exponent")
+		}
+		exponent := new(big.Int).SetBytes(keyBytes[offset : offset+expLen])
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(keyBytes[offset+expLen:]),
+			E: int(exponent.Int64()),
+		}, nil
+	case EcdsaP256Sha256:
+		if len(keyBytes) != 64 {
+			return nil, fmt.Errorf("ECDSA P-256 public key must have 64 bytes")
+		}
+		pk := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(keyBytes[:32]),
+			Y:     new(big.Int).SetBytes(keyBytes[32:]),
+		}
+		if !pk.Curve.IsOnCurve(pk.X, pk.Y) {
+			return nil, fmt.Errorf("ECDSA public key is not on the curve")
+		}
+		return pk, nil
+	case Ed25519:
+		if len(keyBytes) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("ed25519 public key must have %d bytes", ed25519.PublicKeySize)
+		}
+		return ed25519.PublicKey(keyBytes), nil
+	}
+	return nil, fmt.Errorf("undefined sign algorithm")
+}
+
+// keyTag returns the key tag of a zone DNSKEY with the flags, algorithm and public key bytes provided.
+func keyTag(flags uint16, algorithm SignAlgorithm, publicKey []byte) uint16 {
+	dnskey := &dns.DNSKEY{
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: uint8(algorithm),
+		PublicKey: base64.StdEncoding.EncodeToString(publicKey),
+	}
+	return dnskey.KeyTag()
+}
+
 func newTypeArray(typeMap map[uint16]bool) []uint16 {
-	// RRSIG byte is added just in case
-	typeMap[dns.TypeRRSIG] = true
 	typeArray := make([]uint16, 0)
-	// Then we add the types present in typeMap
 	for k := range typeMap {
 		typeArray = append(typeArray, k)
 	}
@@ -135,8 +210,3 @@ func getHash(rr dns.RR, byType bool) string {
 func getRRSIGHash(rr *dns.RRSIG) string {
 	return fmt.Sprintf("%s#%s#%s", rr.Header().Name, dns.Class(rr.Header().Class), dns.Type(rr.TypeCovered))
 }
-
-func (ctx *Context) isSignable(ownerName string) bool {
-	_, isDS := ctx.WithDS[ownerName]
-	return ctx.Config.OptOut || !ctx.isDelegated(ownerName) || isDS
-}
@@ -0,0 +1,421 @@
+package tools
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VaultConfig contains the parameters used to connect to a Vault server and to select the Transit keys.
+type VaultConfig struct {
+	Address     string       // Vault server URL
+	Namespace   string       // Vault namespace (optional, Vault Enterprise only)
+	Token       string       // Token used to authenticate. It is ignored if RoleID is set
+	RoleID      string       // AppRole role ID
+	SecretID    string       // AppRole secret ID
+	AppRolePath string       // Mount path of the AppRole auth method
+	Mount       string       // Mount path of the Transit secrets engine
+	ZSKName     string       // Name of the Transit key used as ZSK
+	KSKName     string       // Name of the Transit key used as KSK
+	Client      *http.Client // HTTP client used to connect to Vault. If it is nil, a client with a timeout is used
+}
+
+// vaultKeyTypes relates the signing algorithms with the Transit key types.
+var vaultKeyTypes = map[SignAlgorithm]string{
+	RsaSha256:       "rsa-2048",
+	EcdsaP256Sha256: "ecdsa-p256",
+	Ed25519:         "ed25519",
+}
+
+// VaultSession signs the zone with keys stored in the Transit secrets engine of a HashiCorp Vault server.
+// Private keys never leave Vault: digests are sent to the Transit sign endpoint.
+type VaultSession struct {
+	ctx       *Context
+	config    *VaultConfig
+	token     string       // Token used in requests
+	ownsToken bool         // True if the token was obtained with AppRole and must be revoked at the end
+	roles     KeyRole      // Roles of the keys provided by the session. Zero means all of them
+	zskSigner *vaultSigner // ZSK signer, after GetKeys
+	kskSigner *vaultSigner // KSK signer, after GetKeys
+}
+
+// NewVaultSession creates a new session using the keys in the Vault server defined by the config.
+// If RoleID is set, it logs in with AppRole. Otherwise, it uses the token provided.
+func (ctx *Context) NewVaultSession(config *VaultConfig) (SignSession, error) {
+	if len(config.Address) == 0 {
+		return nil, fmt.Errorf("vault address not specified")
+	}
+	conf := *config
+	conf.Address = strings.TrimSuffix(conf.Address, "/")
+	if len(conf.Mount) == 0 {
+		conf.Mount = "transit"
+	}
+	if len(conf.AppRolePath) == 0 {
+		conf.AppRolePath = "approle"
+	}
+	if conf.Client == nil {
+		conf.Client = &http.Client{Timeout: 30 * time.Second}
+	}
+	session := &VaultSession{
+		ctx:    ctx,
+		config: &conf,
+		token:  conf.Token,
+	}
+	if len(conf.RoleID) > 0 {
+		var login struct {
+			Auth struct {
+				ClientToken string `json:"client_token"`
+			} `json:"auth"`
+		}
+		err := session.request(http.MethodPost, "auth/"+conf.AppRolePath+"/login", map[string]string{
+			"role_id":   conf.RoleID,
+			"secret_id": conf.SecretID,
+		}, &login)
+		if err != nil {
+			return nil, fmt.Errorf("cannot log in with AppRole: %s", err)
+		}
+		session.token = login.Auth.ClientToken
+		session.ownsToken = true
+	}
+	if len(session.token) == 0 {
+		return nil, fmt.Errorf("vault token or AppRole role ID not specified")
+	}
+	return session, nil
+}
+
+// Context returns the session context
+func (session *VaultSession) Context() *Context {
+	return session.ctx
+}
+
+// GetKeys returns the signers of the Transit keys. If CreateKeys is enabled, the keys are created, or rotated
+// if they already exist, so a new version of them is used.
+func (session *VaultSession) GetKeys() (*SigKeys, error) {
+	keyType, ok := vaultKeyTypes[session.ctx.SignAlgorithm]
+	if !ok {
+		return nil, fmt.Errorf("undefined sign algorithm")
+	}
+	keys := &SigKeys{}
+	for _, role := range []KeyRole{ZSKRole, KSKRole} {
+		if !session.providedRoles().Has(role) {
+			continue
+		}
+		name := session.keyName(role)
+		if len(name) == 0 {
+			return nil, fmt.Errorf("%s key name not specified", strings.ToUpper(role.String()))
+		}
+		if session.ctx.Config.CreateKeys {
+			session.ctx.Log.Printf("create-keys flag activated. Creating or rotating %s %s", strings.ToUpper(role.String()), name)
+			if err := session.createKey(name, keyType); err != nil {
+				return nil, err
+			}
+		}
+		signer, err := session.readKey(name, keyType)
+		if err != nil {
+			return nil, err
+		}
+		if role == ZSKRole {
+			session.zskSigner, keys.zskSigner = signer, signer
+		} else {
+			session.kskSigner, keys.kskSigner = signer, signer
+		}
+	}
+	return keys, nil
+}
+
+// GetPublicKeyBytes returns the public key bytes of the ZSK and KSK, read from Vault in GetKeys.
+func (session *VaultSession) GetPublicKeyBytes(keys *SigKeys) (zskBytes, kskBytes []byte, err error) {
+	if session.zskSigner == nil && session.kskSigner == nil {
+		err = fmt.Errorf("keys not retrieved from session")
+		return
+	}
+	if session.zskSigner != nil {
+		if zskBytes, err = publicKeyToBytes(session.zskSigner.publicKey); err != nil {
+			return
+		}
+	}
+	if session.kskSigner != nil {
+		kskBytes, err = publicKeyToBytes(session.kskSigner.publicKey)
+	}
+	return
+}
+
+// DestroyAllKeys deletes the Transit keys of the session. Keys that do not exist are ignored.
+func (session *VaultSession) DestroyAllKeys() error {
+	for _, role := range []KeyRole{ZSKRole, KSKRole} {
+		if !session.providedRoles().Has(role) {
+			continue
+		}
+		name := session.keyName(role)
+		err := session.request(http.MethodPost, session.config.Mount+"/keys/"+name+"/config", map[string]interface{}{
+			"deletion_allowed": true,
+		}, nil)
+		if err == errVaultNotFound {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("cannot allow deletion of key %s: %s", name, err)
+		}
+		if err := session.request(http.MethodDelete, session.config.Mount+"/keys/"+name, nil, nil); err != nil {
+			return fmt.Errorf("cannot delete key %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// End ends the session, revoking the token if it was obtained with AppRole.
+func (session *VaultSession) End() error {
+	if !session.ownsToken {
+		return nil
+	}
+	session.ownsToken = false
+	return session.request(http.MethodPost, "auth/token/revoke-self", nil, nil)
+}
+
+// Info returns the signing mode of the session.
+func (session *VaultSession) Info() string {
+	return "mode=vault;"
+}
+
+// restrictRoles makes the session use only the keys of the roles provided.
+func (session *VaultSession) restrictRoles(roles KeyRole) {
+	session.roles = roles
+}
+
+// providedRoles returns the roles of the keys provided by the session.
+func (session *VaultSession) providedRoles() KeyRole {
+	if session.roles == 0 {
+		return AllRoles
+	}
+	return session.roles
+}
+
+// keyName returns the name of the Transit key used for the role provided.
+func (session *VaultSession) keyName(role KeyRole) string {
+	if role == KSKRole {
+		return session.config.KSKName
+	}
+	return session.config.ZSKName
+}
+
+// createKey creates a Transit key, or rotates it if it already exists.
+func (session *VaultSession) createKey(name, keyType string) error {
+	path := session.config.Mount + "/keys/" + name
+	err := session.request(http.MethodGet, path, nil, nil)
+	if err == errVaultNotFound {
+		return session.request(http.MethodPost, path, map[string]interface{}{
+			"type":       keyType,
+			"exportable": false,
+		}, nil)
+	} else if err != nil {
+		return fmt.Errorf("cannot read key %s: %s", name, err)
+	}
+	return session.request(http.MethodPost, path+"/rotate", nil, nil)
+}
+
+// readKey reads the latest version of a Transit key and returns a signer using it.
+func (session *VaultSession) readKey(name, keyType string) (*vaultSigner, error) {
+	var key struct {
+		Data struct {
+			Type          string `json:"type"`
+			LatestVersion int    `json:"latest_version"`
+			Keys          map[string]struct {
+				PublicKey string `json:"public_key"`
+			} `json:"keys"`
+		} `json:"data"`
+	}
+	if err := session.request(http.MethodGet, session.config.Mount+"/keys/"+name, nil, &key); err == errVaultNotFound {
+		return nil, fmt.Errorf("key %s not found. If you want to create new keys, use --create-keys flag", name)
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot read key %s: %s", name, err)
+	}
+	if key.Data.Type != keyType {
+		return nil, fmt.Errorf("key %s has type %s, but %s is needed by the sign algorithm", name, key.Data.Type, keyType)
+	}
+	version, ok := key.Data.Keys[strconv.Itoa(key.Data.LatestVersion)]
+	if !ok {
+		return nil, fmt.Errorf("key %s does not have its latest version %d", name, key.Data.LatestVersion)
+	}
+	publicKey, err := parseVaultPublicKey(keyType, version.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse public key of %s: %s", name, err)
+	}
+	return &vaultSigner{
+		session:   session,
+		name:      name,
+		version:   key.Data.LatestVersion,
+		publicKey: publicKey,
+	}, nil
+}
+
+// parseVaultPublicKey parses a public key as returned by Transit: a PEM block for RSA and ECDSA keys,
+// and base64 for Ed25519 keys.
+func parseVaultPublicKey(keyType, encoded string) (crypto.PublicKey, error) {
+	if keyType == "ed25519" {
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		if len(raw) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("wrong Ed25519 public key size")
+		}
+		return ed25519.PublicKey(raw), nil
+	}
+	block, _ := pem.Decode([]byte(encoded))
+	if block == nil {
+		return nil, fmt.Errorf("public key is not a PEM block")
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// errVaultNotFound is returned by request when the Vault path does not exist.
+var errVaultNotFound = fmt.Errorf("not found")
+
+// request sends a request to the Vault API and decodes the JSON response into out, if it is not nil.
+func (session *VaultSession) request(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		encoded, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequest(method, session.config.Address+"/v1/"+path, body)
+	if err != nil {
+		return err
+	}
+	if len(session.token) > 0 {
+		req.Header.Set("X-Vault-Token", session.token)
+	}
+	if len(session.config.Namespace) > 0 {
+		req.Header.Set("X-Vault-Namespace", session.config.Namespace)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := session.config.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return errVaultNotFound
+	}
+	if resp.StatusCode >= 300 {
+		var vaultErr struct {
+			Errors []string `json:"errors"`
+		}
+		if json.Unmarshal(respBody, &vaultErr) == nil && len(vaultErr.Errors) > 0 {
+			return fmt.Errorf("vault returned %s: %s", resp.Status, strings.Join(vaultErr.Errors, "; "))
+		}
+		return fmt.Errorf("vault returned %s", resp.Status)
+	}
+	if out == nil || len(respBody) == 0 {
+		return nil
+	}
+	return json.Unmarshal(respBody, out)
+}
+
+// vaultSigner signs with a version of a Transit key.
+type vaultSigner struct {
+	session   *VaultSession
+	name      string           // Transit key name
+	version   int              // Key version used to sign
+	publicKey crypto.PublicKey // Public key of the version
+}
+
+// Public returns the public key of the signer.
+func (signer *vaultSigner) Public() crypto.PublicKey {
+	return signer.publicKey
+}
+
+// Sign signs the digest with the Transit sign endpoint. RSA and ECDSA digests are sent prehashed,
+// and Ed25519 signatures are created over the data received. ECDSA signatures are returned
+// ASN.1 encoded, as crypto.Signer requires.
+func (signer *vaultSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	req := map[string]interface{}{
+		"input":       base64.StdEncoding.EncodeToString(digest),
+		"key_version": signer.version,
+	}
+	switch signer.publicKey.(type) {
+	case ed25519.PublicKey:
+		if opts.HashFunc() != crypto.Hash(0) {
+			return nil, fmt.Errorf("ed25519 keys sign the data without hashing it")
+		}
+	default:
+		if opts.HashFunc() != crypto.SHA256 {
+			return nil, fmt.Errorf("only SHA256 digests are supported")
+		}
+		req["prehashed"] = true
+		req["hash_algorithm"] = "sha2-256"
+		req["signature_algorithm"] = "pkcs1v15"
+		req["marshaling_algorithm"] = "asn1"
+	}
+	var resp struct {
+		Data struct {
+			Signature string `json:"signature"`
+		} `json:"data"`
+	}
+	if err := signer.session.request(http.MethodPost, signer.session.config.Mount+"/sign/"+signer.name, req, &resp); err != nil {
+		return nil, err
+	}
+	// Transit signatures have the format vault:v<version>:<base64 signature>
+	parts := strings.Split(resp.Data.Signature, ":")
+	if len(parts) != 3 || parts[0] != "vault" {
+		return nil, fmt.Errorf("unexpected signature format")
+	}
+	return base64.StdEncoding.DecodeString(parts[2])
+}
+
+var vaultBackend = &SessionBackend{
+	Name:        "vault",
+	Description: "uses keys in the Transit secrets engine of a HashiCorp Vault server to sign the zone",
+	Options: []BackendOption{
+		{Name: "vault-address", Type: StringOption, Default: "", Usage: "Vault server URL. Default is the value of VAULT_ADDR."},
+		{Name: "vault-token", Type: StringOption, Default: "", Usage: "Vault token. Default is the value of VAULT_TOKEN. It is not used if --vault-role-id is set."},
+		{Name: "vault-role-id", Type: StringOption, Default: "", Usage: "AppRole role ID, used to log in instead of a token."},
+		{Name: "vault-secret-id", Type: StringOption, Default: "", Usage: "AppRole secret ID. Default is the value of VAULT_SECRET_ID."},
+		{Name: "vault-approle-path", Type: StringOption, Default: "approle", Usage: "Mount path of the AppRole auth method."},
+		{Name: "vault-namespace", Type: StringOption, Default: "", Usage: "Vault namespace."},
+		{Name: "vault-mount", Type: StringOption, Default: "transit", Usage: "Mount path of the Transit secrets engine."},
+		{Name: "zsk-vault-key", Type: StringOption, Default: "dns-tools-zsk", Usage: "Name of the Transit key used as ZSK."},
+		{Name: "ksk-vault-key", Type: StringOption, Default: "dns-tools-ksk", Usage: "Name of the Transit key used as KSK."},
+	},
+	New: func(ctx *Context, conf BackendConfig, roles KeyRole) (SignSession, error) {
+		return ctx.NewVaultSession(&VaultConfig{
+			Address:     withEnvDefault(conf.GetString("vault-address"), "VAULT_ADDR"),
+			Namespace:   conf.GetString("vault-namespace"),
+			Token:       withEnvDefault(conf.GetString("vault-token"), "VAULT_TOKEN"),
+			RoleID:      conf.GetString("vault-role-id"),
+			SecretID:    withEnvDefault(conf.GetString("vault-secret-id"), "VAULT_SECRET_ID"),
+			AppRolePath: conf.GetString("vault-approle-path"),
+			Mount:       conf.GetString("vault-mount"),
+			ZSKName:     conf.GetString("zsk-vault-key"),
+			KSKName:     conf.GetString("ksk-vault-key"),
+		})
+	},
+}
+
+// withEnvDefault returns the value if it is not empty, or the value of the environment variable otherwise.
+func withEnvDefault(value, env string) string {
+	if len(value) > 0 {
+		return value
+	}
+	return os.Getenv(env)
+}
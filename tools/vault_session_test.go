@@ -0,0 +1,368 @@
+package tools_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/niclabs/dns-tools/tools"
+)
+
+const (
+	vaultToken    = "s.root-token"
+	vaultRoleID   = "dns-tools-role"
+	vaultSecretID = "dns-tools-secret"
+)
+
+// transitStandIn implements the parts of the Vault Transit and AppRole APIs used by the Vault session.
+type transitStandIn struct {
+	sync.Mutex
+	tokens  map[string]bool
+	keys    map[string]*transitKey
+	revoked int
+}
+
+type transitKey struct {
+	keyType         string
+	versions        []crypto.Signer
+	deletionAllowed bool
+}
+
+func newTransitStandIn() *transitStandIn {
+	return &transitStandIn{
+		tokens: map[string]bool{vaultToken: true},
+		keys:   make(map[string]*transitKey),
+	}
+}
+
+func (v *transitStandIn) addKey(name, keyType string) error {
+	signer, err := newTransitSigner(keyType)
+	if err != nil {
+		return err
+	}
+	v.Lock()
+	defer v.Unlock()
+	v.keys[name] = &transitKey{keyType: keyType, versions: []crypto.Signer{signer}}
+	return nil
+}
+
+func newTransitSigner(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case "rsa-2048":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "ecdsa-p256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("unsupported key type %s", keyType)
+}
+
+func (v *transitStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.Lock()
+	defer v.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	var body map[string]interface{}
+	if r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&body)
+	}
+	if path == "auth/approle/login" {
+		if body["role_id"] != vaultRoleID || body["secret_id"] != vaultSecretID {
+			vaultError(w, http.StatusBadRequest, "invalid role or secret ID")
+			return
+		}
+		token := fmt.Sprintf("s.approle-%d", len(v.tokens))
+		v.tokens[token] = true
+		vaultReply(w, map[string]interface{}{"auth": map[string]interface{}{"client_token": token}})
+		return
+	}
+	token := r.Header.Get("X-Vault-Token")
+	if !v.tokens[token] {
+		vaultError(w, http.StatusForbidden, "permission denied")
+		return
+	}
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "auth/token/revoke-self":
+		delete(v.tokens, token)
+		v.revoked++
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 3 && parts[0] == "transit" && parts[1] == "keys":
+		v.serveKey(w, r, parts[2], body)
+	case len(parts) == 4 && parts[0] == "transit" && parts[1] == "keys" && parts[3] == "rotate":
+		key, ok := v.keys[parts[2]]
+		if !ok {
+			vaultError(w, http.StatusNotFound, "key not found")
+			return
+		}
+		signer, err := newTransitSigner(key.keyType)
+		if err != nil {
+			vaultError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		key.versions = append(key.versions, signer)
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 4 && parts[0] == "transit" && parts[1] == "keys" && parts[3] == "config":
+		key, ok := v.keys[parts[2]]
+		if !ok {
+			vaultError(w, http.StatusNotFound, "key not found")
+			return
+		}
+		key.deletionAllowed = body["deletion_allowed"] == true
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 3 && parts[0] == "transit" && parts[1] == "sign":
+		v.serveSign(w, parts[2], body)
+	default:
+		vaultError(w, http.StatusNotFound, "unsupported path")
+	}
+}
+
+func (v *transitStandIn) serveKey(w http.ResponseWriter, r *http.Request, name string, body map[string]interface{}) {
+	key, ok := v.keys[name]
+	switch r.Method {
+	case http.MethodPost:
+		if !ok {
+			keyType, _ := body["type"].(string)
+			signer, err := newTransitSigner(keyType)
+			if err != nil {
+				vaultError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			v.keys[name] = &transitKey{keyType: keyType, versions: []crypto.Signer{signer}}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if ok && !key.deletionAllowed {
+			vaultError(w, http.StatusBadRequest, "deletion is not allowed for this key")
+			return
+		}
+		delete(v.keys, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		if !ok {
+			vaultError(w, http.StatusNotFound, "key not found")
+			return
+		}
+		versions := make(map[string]interface{})
+		for i, signer := range key.versions {
+			var public string
+			if pk, ok := signer.Public().(ed25519.PublicKey); ok {
+				public = base64.StdEncoding.EncodeToString(pk)
+			} else {
+				der, err := x509.MarshalPKIXPublicKey(signer.Public())
+				if err != nil {
+					vaultError(w, http.StatusInternalServerError, err.Error())
+					return
+				}
+				public = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+			}
+			versions[strconv.Itoa(i+1)] = map[string]interface{}{"public_key": public}
+		}
+		vaultReply(w, map[string]interface{}{"data": map[string]interface{}{
+			"type":           key.keyType,
+			"latest_version": len(key.versions),
+			"keys":           versions,
+		}})
+	}
+}
+
+func (v *transitStandIn) serveSign(w http.ResponseWriter, name string, body map[string]interface{}) {
+	key, ok := v.keys[name]
+	if !ok {
+		vaultError(w, http.StatusNotFound, "key not found")
+		return
+	}
+	version := len(key.versions)
+	if requested, ok := body["key_version"].(float64); ok {
+		version = int(requested)
+	}
+	if version < 1 || version > len(key.versions) {
+		vaultError(w, http.StatusBadRequest, "invalid key version")
+		return
+	}
+	input, _ := body["input"].(string)
+	data, err := base64.StdEncoding.DecodeString(input)
+	if err != nil {
+		vaultError(w, http.StatusBadRequest, "invalid input")
+		return
+	}
+	opts := crypto.Hash(0)
+	if key.keyType != "ed25519" {
+		if body["prehashed"] != true || body["hash_algorithm"] != "sha2-256" {
+			vaultError(w, http.StatusBadRequest, "expected a prehashed SHA-256 input")
+			return
+		}
+		opts = crypto.SHA256
+	}
+	sig, err := key.versions[version-1].Sign(rand.Reader, data, opts)
+	if err != nil {
+		vaultError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	vaultReply(w, map[string]interface{}{"data": map[string]interface{}{
+		"signature": fmt.Sprintf("vault:v%d:%s", version, base64.StdEncoding.EncodeToString(sig)),
+	}})
+}
+
+func vaultReply(w http.ResponseWriter, reply interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reply)
+}
+
+func vaultError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string][]string{"errors": {msg}})
+}
+
+func TestSession_VaultRSASignToken(t *testing.T) {
+	standIn := newTransitStandIn()
+	for _, name := range []string{"zsk", "ksk"} {
+		if err := standIn.addKey(name, "rsa-2048"); err != nil {
+			t.Errorf("%s", err)
+			return
+		}
+	}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+	ctx := testContext(tools.RsaSha256, false, false)
+	session, err := ctx.NewVaultSession(&tools.VaultConfig{
+		Address: server.URL,
+		Token:   vaultToken,
+		ZSKName: "zsk",
+		KSKName: "ksk",
+	})
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	out, err := sign(t, ctx, session)
+	if err != nil {
+		t.Errorf("signing failed: %s", err)
+		return
+	}
+	defer out.Close()
+	if err := ctx.VerifyFile(); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+}
+
+func TestSession_VaultECDSASignAppRole(t *testing.T) {
+	standIn := newTransitStandIn()
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+	ctx := testContext(tools.EcdsaP256Sha256, true, true)
+	session, err := ctx.NewVaultSession(&tools.VaultConfig{
+		Address:  server.URL,
+		RoleID:   vaultRoleID,
+		SecretID: vaultSecretID,
+		ZSKName:  "zsk",
+		KSKName:  "ksk",
+	})
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	out, err := sign(t, ctx, session)
+	if err != nil {
+		t.Errorf("signing failed: %s", err)
+		return
+	}
+	defer out.Close()
+	if err := ctx.VerifyFile(); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+	if len(standIn.keys) != 2 {
+		t.Errorf("expected 2 keys created, got %d", len(standIn.keys))
+	}
+	if standIn.revoked != 1 {
+		t.Errorf("AppRole token was not revoked")
+	}
+}
+
+func TestSession_VaultEd25519Sign(t *testing.T) {
+	standIn := newTransitStandIn()
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+	ctx := testContext(tools.Ed25519, true, true)
+	session, err := ctx.NewVaultSession(&tools.VaultConfig{
+		Address: server.URL,
+		Token:   vaultToken,
+		ZSKName: "zsk",
+		KSKName: "ksk",
+	})
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	out, err := sign(t, ctx, session)
+	if err != nil {
+		t.Errorf("signing failed: %s", err)
+		return
+	}
+	defer out.Close()
+	if err := ctx.VerifyFile(); err != nil {
+		t.Errorf("Error verifying output: %s", err)
+	}
+}
+
+func TestSession_VaultErrors(t *testing.T) {
+	standIn := newTransitStandIn()
+	if err := standIn.addKey("zsk", "ecdsa-p256"); err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+	ctx := testContext(tools.RsaSha256, false, false)
+	if _, err := ctx.NewVaultSession(&tools.VaultConfig{
+		Address:  server.URL,
+		RoleID:   vaultRoleID,
+		SecretID: "wrong",
+	}); err == nil {
+		t.Errorf("AppRole login with a wrong secret ID succeeded")
+	}
+	session, err := ctx.NewVaultSession(&tools.VaultConfig{
+		Address: server.URL,
+		Token:   vaultToken,
+		ZSKName: "zsk",
+		KSKName: "ksk",
+	})
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	defer session.End()
+	// The ZSK has a type that does not match the algorithm
+	if _, err := session.GetKeys(); err == nil {
+		t.Errorf("keys with a wrong type were accepted")
+	}
+	session, err = ctx.NewVaultSession(&tools.VaultConfig{
+		Address: server.URL,
+		Token:   "s.wrong-token",
+		ZSKName: "zsk",
+		KSKName: "ksk",
+	})
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	if _, err := session.GetKeys(); err == nil {
+		t.Errorf("keys read with a wrong token")
+	}
+}
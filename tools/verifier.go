@@ -3,15 +3,16 @@ package tools
 import (
 	"fmt"
 	"os"
+	"sort"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
-// RRSigPair combines an RRSIg and the set related to it.
+// RRSigPair combines an RRset and the RRSIGs covering it.
 type RRSigPair struct {
-	RRSig *dns.RRSIG
-	RRSet RRArray
+	RRSigs []*dns.RRSIG
+	RRSet  RRArray
 }
 
 var ErrNotEnoughDNSkeys = fmt.Errorf("could not find enough dnskeys")
@@ -39,7 +40,7 @@ func (ctx *Context) VerifyFile() (err error) {
 
 	// Pairing each RRArray with its RRSig
 	for _, set := range setList {
-		if len(set) > 0 && ctx.isSignable(set[0].Header().Name) {
+		if len(set) > 0 {
 			firstRR := set[0]
 			var setHash string
 			if firstRR.Header().Rrtype == dns.TypeRRSIG {
@@ -50,7 +51,7 @@ func (ctx *Context) VerifyFile() (err error) {
 						pair = &RRSigPair{}
 						rrSigPairs[setHash] = pair
 					}
-					pair.RRSig = sig.(*dns.RRSIG)
+					pair.RRSigs = append(pair.RRSigs, sig.(*dns.RRSIG))
 				}
 			} else {
 				setHash = getHash(firstRR, true)
@@ -69,57 +70,245 @@ func (ctx *Context) VerifyFile() (err error) {
 		return err
 	}
 
+	if ctx.Config.SkipDenialChecks {
+		ctx.Log.Printf("Skipping NSEC/NSEC3 chain verification")
+	} else {
+		if err = ctx.checkDenialChains(); err != nil {
+			ctx.Log.Printf("[Error] (%s)", err)
+			return
+		}
+		ctx.Log.Printf("[ OK  ] NSEC/NSEC3 chains")
+	}
+	if err = ctx.checkWildcards(); err != nil {
+		ctx.Log.Printf("[Error] (%s)", err)
+		return
+	}
+
+	if err = ctx.checkSignedRRSets(rrSigPairs); err != nil {
+		ctx.Log.Printf("[Error] (%s)", err)
+		return
+	}
+
 	rrSignatures := make(map[string]*RRSigPair)
 
 	for setName, pair := range rrSigPairs {
-		if pair.RRSet == nil || len(pair.RRSet) == 0 || pair.RRSig == nil {
-			// err = fmt.Errorf("the RRSet %s has no elements", setName)
+		if len(pair.RRSet) == 0 || len(pair.RRSigs) == 0 || !ctx.isSignedRRSet(pair.RRSet) {
 			continue
 		}
 		rrSignatures[setName] = pair
 	}
 
-	// Checking each RRset RRSignature.
-	ctx.Log.Printf("number of signatures: %d", len(rrSignatures))
-	for setName, pair := range rrSignatures {
-		sig := pair.RRSig
-		set := pair.RRSet
-		expDate := time.Unix(int64(sig.Expiration), 0)
-		if expDate.Before(ctx.Config.VerifyThreshold) {
-			err = fmt.Errorf(
-				"the Signature for RRSet %s has already expired. Expiration date: %s",
-				setName,
-				expDate.Format("2006-01-02 15:04:05"),
-			)
+	// Checking each RRSIG of each RRset.
+	ctx.Log.Printf("number of signed RRsets: %d", len(rrSignatures))
+	setNames := make([]string, 0, len(rrSignatures))
+	for setName := range rrSignatures {
+		setNames = append(setNames, setName)
+	}
+	sort.Strings(setNames)
+	signedBy := make(map[string]map[uint8]bool)
+	for _, setName := range setNames {
+		algorithms, setErr := ctx.verifyRRSetSigs(setName, rrSignatures[setName])
+		if setErr != nil {
+			ctx.Log.Printf("[Error] (%s) %s", setErr, setName)
+			if err == nil {
+				err = setErr
+			}
+			continue
+		}
+		signedBy[setName] = algorithms
+		ctx.Log.Printf("[ OK  ] %s", setName)
+	}
+	if err != nil {
+		return
+	}
+	if err = ctx.checkAlgorithmCoverage(setNames, rrSignatures, signedBy); err != nil {
+		return
+	}
+	if err = ctx.checkChainOfTrust(); err != nil {
+		ctx.Log.Printf("[Error] (%s)", err)
+		return
+	}
+	for _, q := range ctx.Config.WildcardAnswers {
+		if err = ctx.verifyWildcardAnswer(q); err != nil {
+			ctx.Log.Printf("[Error] (%s)", err)
 			return
 		}
-		var key *dns.DNSKEY
-		var ok bool
-		if set[0].Header().Rrtype == dns.TypeDNSKEY {
-			key, ok = ctx.DNSKEYS.KSK[sig.KeyTag]
-			if !ok {
-				key, ok = ctx.DNSKEYS.ZSK[sig.KeyTag]
+	}
+	ctx.PrintDS()
+	return
+}
+
+// checkSignedRRSets checks that every RRset the zone is authoritative for has RRSIGs, and that every RRSIG
+// covers an RRset. The NS RRsets of delegations and glue must not be signed (RFC4035 section 2.2). Each
+// problem is logged, and the error counts them.
+func (ctx *Context) checkSignedRRSets(rrSigPairs map[string]*RRSigPair) error {
+	setNames := make([]string, 0, len(rrSigPairs))
+	for setName := range rrSigPairs {
+		setNames = append(setNames, setName)
+	}
+	sort.Strings(setNames)
+	unsigned, orphans, delegations := 0, 0, 0
+	for _, setName := range setNames {
+		pair := rrSigPairs[setName]
+		switch {
+		case len(pair.RRSet) == 0:
+			ctx.Log.Printf("[Error] (%d RRSIGs cover no RRset) %s", len(pair.RRSigs), setName)
+			orphans++
+		case !ctx.isSignedRRSet(pair.RRSet):
+			if len(pair.RRSigs) > 0 {
+				ctx.Log.Printf("[Error] (the zone is not authoritative for the RRset, so it must not be signed) %s", setName)
+				delegations++
 			}
-		} else {
-			key, ok = ctx.DNSKEYS.ZSK[sig.KeyTag]
+		case len(pair.RRSigs) == 0:
+			ctx.Log.Printf("[Error] (the RRset is not signed) %s", setName)
+			unsigned++
 		}
-		if !ok {
-			err = fmt.Errorf("key with keytag declared in signature (%d) not found (keys available: ksk=[%v] zsk=[%v])", sig.KeyTag, ctx.DNSKEYS.KSK, ctx.DNSKEYS.ZSK)
-			ctx.Log.Print(err.Error())
-			return
+	}
+	if unsigned > 0 || orphans > 0 || delegations > 0 {
+		return fmt.Errorf("%d RRsets are not signed, %d RRSIG RRsets cover no RRset and %d delegation or glue RRsets are signed", unsigned, orphans, delegations)
+	}
+	return nil
+}
+
+// verifyRRSetSigs verifies each RRSIG of an RRset and logs its result. It returns the algorithms with a valid
+// RRSIG made by a key that is not revoked. RRSIGs made by keys not in the DNSKEY RRset are an error, unless
+// MultiSigner is set: then they are ignored, because other signers sign their own version of the zone, but
+// the RRset needs a valid RRSIG.
+// Revoked KSKs must sign the DNSKEY RRset (RFC 5011), but they do not make it valid.
+func (ctx *Context) verifyRRSetSigs(setName string, pair *RRSigPair) (map[uint8]bool, error) {
+	algorithms := make(map[uint8]bool)
+	selfSigned := make(map[*dns.DNSKEY]bool)
+	var sigErr error
+	for _, sig := range pair.RRSigs {
+		sigName := fmt.Sprintf("%s RRSIG %s %d", setName, dns.AlgorithmToString[sig.Algorithm], sig.KeyTag)
+		if len(ctx.candidateKeys(sig)) == 0 {
+			if ctx.Config.MultiSigner {
+				ctx.Log.Printf("[Warn ] (the key of the RRSIG is not in the DNSKEY RRset, so it is ignored) %s", sigName)
+				continue
+			}
+			err := fmt.Errorf("key with keytag declared in signature (%d) not found in the DNSKEY RRset", sig.KeyTag)
+			ctx.Log.Printf("[Error] (%s) %s", err, sigName)
+			if sigErr == nil {
+				sigErr = fmt.Errorf("%s: %s", sigName, err)
+			}
+			continue
 		}
-		if key.Algorithm != sig.Algorithm {
-			err = fmt.Errorf("key and signature algorithm does not match")
-			return
+		var key *dns.DNSKEY
+		var err error
+		if labels := rrsigLabels(pair.RRSet[0].Header().Name); sig.Labels != labels {
+			err = fmt.Errorf("the RRSIG has %d labels, but its owner name has %d", sig.Labels, labels)
+		} else {
+			key, err = ctx.verifyRRSig(setName, sig, pair.RRSet)
 		}
-		err = sig.Verify(key, set)
 		if err != nil {
-			ctx.Log.Printf("[Error] (%s) %s", err, setName)
-			return
-		} else {
-			ctx.Log.Printf("[ OK  ] %s", setName)
+			ctx.Log.Printf("[Error] (%s) %s", err, sigName)
+			if sigErr == nil {
+				sigErr = fmt.Errorf("%s: %s", sigName, err)
+			}
+			continue
+		}
+		ctx.Log.Printf("[ OK  ] %s", sigName)
+		if key.Flags&dns.REVOKE != 0 {
+			selfSigned[key] = true
+			continue
 		}
+		algorithms[sig.Algorithm] = true
 	}
-	ctx.PrintDS()
-	return
+	if sigErr != nil {
+		return nil, sigErr
+	}
+	if len(algorithms) == 0 {
+		return nil, fmt.Errorf("the RRSet has no valid RRSIG made by a key of the DNSKEY RRset that is not revoked")
+	}
+	if pair.RRSet[0].Header().Rrtype == dns.TypeDNSKEY {
+		for _, rr := range pair.RRSet {
+			if key := rr.(*dns.DNSKEY); key.Flags&dns.REVOKE != 0 && !selfSigned[key] {
+				return nil, fmt.Errorf("revoked key %d does not sign the DNSKEY RRSet", key.KeyTag())
+			}
+		}
+	}
+	return algorithms, nil
+}
+
+// checkAlgorithmCoverage checks that every RRset has a valid RRSIG of each algorithm that signs the DNSKEY
+// RRset (RFC4035 section 2.2 and RFC6840 section 5.11). Keys of other algorithms which do not sign the DNSKEY
+// RRset are an error, unless MultiSigner is set, because then they can be keys of other signers (RFC8901).
+func (ctx *Context) checkAlgorithmCoverage(setNames []string, pairs map[string]*RRSigPair, signedBy map[string]map[uint8]bool) error {
+	var keyAlgorithms map[uint8]bool
+	for _, setName := range setNames {
+		if pairs[setName].RRSet[0].Header().Rrtype == dns.TypeDNSKEY && pairs[setName].RRSet[0].Header().Name == ctx.Config.Zone {
+			keyAlgorithms = signedBy[setName]
+		}
+	}
+	if keyAlgorithms == nil {
+		err := fmt.Errorf("the DNSKEY RRset of the zone is not signed")
+		ctx.Log.Printf("[Error] (%s)", err)
+		return err
+	}
+	for _, rr := range ctx.rrs {
+		key, ok := rr.(*dns.DNSKEY)
+		if !ok || key.Hdr.Name != ctx.Config.Zone || key.Flags&dns.REVOKE != 0 || keyAlgorithms[key.Algorithm] {
+			continue
+		}
+		if !ctx.Config.MultiSigner {
+			err := fmt.Errorf("algorithm %s of key %d does not sign the DNSKEY RRset", dns.AlgorithmToString[key.Algorithm], key.KeyTag())
+			ctx.Log.Printf("[Error] (%s)", err)
+			return err
+		}
+		ctx.Log.Printf("[Warn ] (algorithm %s of key %d does not sign the DNSKEY RRset, so it must be used by other signer)",
+			dns.AlgorithmToString[key.Algorithm], key.KeyTag())
+	}
+	for _, setName := range setNames {
+		for algorithm := range keyAlgorithms {
+			if !signedBy[setName][algorithm] {
+				err := fmt.Errorf("the RRset has no valid RRSIG of algorithm %s, which signs the DNSKEY RRset", dns.AlgorithmToString[algorithm])
+				ctx.Log.Printf("[Error] (%s) %s", err, setName)
+				return err
+			}
+		}
+	}
+	ctx.Log.Printf("[ OK  ] every RRset is signed with every algorithm of the zone")
+	return nil
+}
+
+// candidateKeys returns the keys of the DNSKEY RRset with the key tag and algorithm of the RRSIG. Several
+// keys can have the same key tag.
+func (ctx *Context) candidateKeys(sig *dns.RRSIG) []*dns.DNSKEY {
+	keys := make([]*dns.DNSKEY, 0)
+	for _, rr := range ctx.rrs {
+		key, ok := rr.(*dns.DNSKEY)
+		if ok && key.Hdr.Name == ctx.Config.Zone && key.KeyTag() == sig.KeyTag && key.Algorithm == sig.Algorithm {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// verifyRRSig checks that the RRSIG is not expired and that it is a valid signature of the RRset made by
+// a key of the zone. DNSKEY RRsets can be signed by any key, and other RRsets only by ZSKs. Several keys
+// can have the key tag and algorithm of the RRSIG, so all of them are tried. It returns the key that made the signature.
+func (ctx *Context) verifyRRSig(setName string, sig *dns.RRSIG, set RRArray) (*dns.DNSKEY, error) {
+	expDate := time.Unix(int64(sig.Expiration), 0)
+	if expDate.Before(ctx.Config.VerifyThreshold) {
+		return nil, fmt.Errorf(
+			"the Signature for RRSet %s has already expired. Expiration date: %s",
+			setName,
+			expDate.Format("2006-01-02 15:04:05"),
+		)
+	}
+	keys := ctx.candidateKeys(sig)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("key with keytag declared in signature (%d) not found (keys available: ksk=[%v] zsk=[%v])", sig.KeyTag, ctx.DNSKEYS.KSK, ctx.DNSKEYS.ZSK)
+	}
+	var err error
+	for _, key := range keys {
+		if set[0].Header().Rrtype != dns.TypeDNSKEY && key.Flags != 256 {
+			err = fmt.Errorf("key %d is not a ZSK, so it can only sign the DNSKEY RRset", key.KeyTag())
+			continue
+		}
+		if err = sig.Verify(key, set); err == nil {
+			return key, nil
+		}
+	}
+	return nil, err
 }
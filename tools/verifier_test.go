@@ -0,0 +1,112 @@
+package tools_test
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/niclabs/dns-tools/tools"
+)
+
+func TestVerify_UnsignedAndOrphanRRSets(t *testing.T) {
+	signed, err := signZone(t, testContext(tools.RsaSha256, false, false), delegationsZone)
+	if err != nil {
+		t.Fatalf("signing failed: %s", err)
+	}
+	// Delegation NS RRsets and glue are not signed, and the zone verifies.
+	if err := verifyDenial(signed, true); err != nil {
+		t.Fatalf("Error verifying output: %s", err)
+	}
+	withSignature := func(owner, covered string) string {
+		return signed + strings.Replace(foreignRRSIG, "www.example.com. 86400 IN RRSIG A", owner+" 86400 IN RRSIG "+covered, 1) + "\n"
+	}
+	broken := map[string]string{
+		"unsigned RRset":       dropRRs(signed, "www.example.com.", "RRSIG"),
+		"RRSIG of no RRset":    withSignature("www.example.com.", "TXT"),
+		"RRSIG of no name":     withSignature("nothing.example.com.", "A"),
+		"signed delegation NS": withSignature("insecure.example.com.", "NS"),
+		"signed glue":          withSignature("ns.insecure.example.com.", "A"),
+		"signed secure cut NS": withSignature("secure.example.com.", "NS"),
+	}
+	for name, zoneText := range broken {
+		if zoneText == signed {
+			t.Fatalf("%s: zone not modified", name)
+		}
+		if err := verifyDenial(zoneText, true); err == nil {
+			t.Errorf("%s: zone verified", name)
+		}
+	}
+}
+
+// twoAlgorithmZone signs the test zone with RSA and ECDSA keys, as two signers of a multi-signer zone
+// sharing their DNSKEYs, and merges both versions.
+func twoAlgorithmZone(t *testing.T) string {
+	multiSigner := func(algorithm tools.SignAlgorithm) *tools.Context {
+		ctx := testContext(algorithm, false, false)
+		ctx.Config.MultiSigner = true
+		return ctx
+	}
+	rsaKeys := linesOf(signZoneWithKeys(t, testContext(tools.RsaSha256, false, false), RSAZSK, RSAKSK, fileString), "DNSKEY")
+	ecKeys := linesOf(signZoneWithKeys(t, testContext(tools.EcdsaP256Sha256, false, false), ECZSK, ECKSK, fileString), "DNSKEY")
+	rsaSigned := signZoneWithKeys(t, multiSigner(tools.RsaSha256), RSAZSK, RSAKSK, fileString+ecKeys)
+	ecSigned := signZoneWithKeys(t, multiSigner(tools.EcdsaP256Sha256), ECZSK, ECKSK, fileString+rsaKeys)
+	merged := make(map[string]bool)
+	for _, line := range strings.Split(rsaSigned+ecSigned, "\n") {
+		if line != "" {
+			merged[line] = true
+		}
+	}
+	lines := make([]string, 0, len(merged))
+	for line := range merged {
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func TestVerify_AlgorithmCoverage(t *testing.T) {
+	signed := twoAlgorithmZone(t)
+	if err := verifyZone(signed); err != nil {
+		t.Fatalf("Error verifying zone signed with two algorithms: %s", err)
+	}
+	// The DNSKEY RRset is signed with ECDSA, so every RRset must have an ECDSA RRSIG.
+	lines := strings.Split(signed, "\n")
+	kept := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if fields := strings.Fields(line); len(fields) > 5 && fields[0] == "www.example.com." && fields[3] == "RRSIG" && fields[5] == "13" {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	err := verifyZone(strings.Join(kept, "\n"))
+	if err == nil || !strings.Contains(err.Error(), "ECDSAP256SHA256") {
+		t.Errorf("zone without the ECDSA RRSIG of an RRset verified: %v", err)
+	}
+}
+
+func TestVerify_EveryRRSIG(t *testing.T) {
+	signed := twoAlgorithmZone(t)
+	// An RRSIG made by a key of the zone that does not validate fails, even if other RRSIGs are valid.
+	var sig string
+	for _, line := range strings.Split(signed, "\n") {
+		if fields := strings.Fields(line); len(fields) > 5 && fields[0] == "yo.example.com." && fields[3] == "RRSIG" && fields[5] == "8" {
+			sig = line
+		}
+	}
+	if sig == "" {
+		t.Fatalf("RSA RRSIG of yo.example.com. not found")
+	}
+	fields := strings.Fields(sig)
+	bogus := strings.Replace(sig, fields[len(fields)-1], "AAAA"+fields[len(fields)-1][4:], 1)
+	if err := verifyZone(signed + bogus + "\n"); err == nil {
+		t.Errorf("zone with an invalid RRSIG verified")
+	}
+	// An RRSIG made by a key not in the DNSKEY RRset fails, unless the zone is verified in multi-signer mode,
+	// where it is ignored as an RRSIG of other signer.
+	if err := verifyZone(signed + foreignRRSIG + "\n"); err == nil {
+		t.Errorf("zone with an RRSIG of a key not in the DNSKEY RRset verified")
+	}
+	if err := verifyMultiSignerZone(signed + foreignRRSIG + "\n"); err != nil {
+		t.Errorf("zone with an RRSIG of other signer not verified in multi-signer mode: %s", err)
+	}
+}
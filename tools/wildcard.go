@@ -0,0 +1,240 @@
+package tools
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Query is a name and type asked to the zone.
+type Query struct {
+	Name string
+	Type uint16
+}
+
+// ParseQuery parses a query in "name/TYPE" format.
+func ParseQuery(s string) (Query, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return Query{}, fmt.Errorf("query %s must have the format name/TYPE", s)
+	}
+	rrtype, ok := dns.StringToType[strings.ToUpper(parts[1])]
+	if !ok {
+		return Query{}, fmt.Errorf("unknown type in query %s", s)
+	}
+	return Query{Name: NormalizeFQDN(dns.Fqdn(parts[0])), Type: rrtype}, nil
+}
+
+// String returns the query in "name/TYPE" format.
+func (q Query) String() string {
+	return fmt.Sprintf("%s/%s", q.Name, dns.TypeToString[q.Type])
+}
+
+// rrsigLabels returns the value of the Labels field of the RRSIGs of an owner name: its number of labels,
+// not counting the root nor the leftmost wildcard label (RFC4034 section 3.1.3).
+func rrsigLabels(ownerName string) uint8 {
+	labels := dns.CountLabel(ownerName)
+	if strings.HasPrefix(ownerName, "*.") {
+		labels--
+	}
+	return uint8(labels)
+}
+
+// canonicalLess returns true if the name a is before the name b in the canonical order (RFC4034 section 6.1).
+func canonicalLess(a, b string) bool {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if la[i] != lb[j] {
+			return la[i] < lb[j]
+		}
+	}
+	return len(la) < len(lb)
+}
+
+// covers returns true if the name is strictly between the owner and the next name of a denial of existence
+// RR. The last RR of the chain covers the names after its owner and before the first one.
+func covers(owner, next, name string, less func(a, b string) bool) bool {
+	if less(owner, next) {
+		return less(owner, name) && less(name, next)
+	}
+	return less(owner, name) || less(name, next)
+}
+
+// existingNames returns the names of the zone which exist: the owners of RRsets other than RRSIG, NSEC and
+// NSEC3, and the empty non-terminals above them.
+func (ctx *Context) existingNames() map[string]bool {
+	names := map[string]bool{ctx.Config.Zone: true}
+	for _, rr := range ctx.rrs {
+		switch rr.Header().Rrtype {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			continue
+		}
+		name := rr.Header().Name
+		if names[name] {
+			continue
+		}
+		names[name] = true
+		for _, ancestor := range ctx.ancestors(name) {
+			names[ancestor] = true
+		}
+	}
+	return names
+}
+
+// checkWildcards checks the wildcards of the zone: they must not be at or below a zone cut, and in NSEC3
+// zones their closest enclosers, the names the wildcards are expanded from, must have a NSEC3 RR.
+func (ctx *Context) checkWildcards() error {
+	param, nsec3s := ctx.nsec3Chain()
+	checked := make(map[string]bool)
+	for _, rr := range ctx.rrs {
+		name := rr.Header().Name
+		if !strings.HasPrefix(name, "*.") || checked[name] || rr.Header().Rrtype == dns.TypeRRSIG {
+			continue
+		}
+		checked[name] = true
+		encloser := strings.TrimPrefix(name, "*.")
+		if ctx.isDelegated(name) || ctx.isBelowZoneCut(name) {
+			return fmt.Errorf("wildcard %s is at or below a zone cut", name)
+		}
+		if param == nil || ctx.isDelegated(encloser) {
+			continue
+		}
+		if _, ok := nsec3s[ctx.hashedOwner(encloser, param)]; !ok {
+			return fmt.Errorf("closest encloser %s of wildcard %s has no NSEC3 RR", encloser, name)
+		}
+	}
+	return nil
+}
+
+// nsec3Chain returns the NSEC3PARAM RR of the zone and the NSEC3 RRs of its chain, indexed by lowercase
+// owner name. The NSEC3PARAM RR is nil if the zone has no published NSEC3 chain.
+func (ctx *Context) nsec3Chain() (*dns.NSEC3PARAM, map[string]*dns.NSEC3) {
+	var param *dns.NSEC3PARAM
+	for _, rr := range ctx.rrs {
+		if p, ok := rr.(*dns.NSEC3PARAM); ok && p.Hdr.Name == ctx.Config.Zone {
+			param = p
+		}
+	}
+	nsec3s := make(map[string]*dns.NSEC3)
+	if param == nil {
+		return nil, nsec3s
+	}
+	for _, rr := range ctx.rrs {
+		if nsec3, ok := rr.(*dns.NSEC3); ok && sameNSEC3Params(nsec3Params(nsec3), param) {
+			nsec3s[strings.ToLower(nsec3.Hdr.Name)] = nsec3
+		}
+	}
+	return param, nsec3s
+}
+
+// hashedOwner returns the lowercase owner name of the NSEC3 RR of a name.
+func (ctx *Context) hashedOwner(name string, param *dns.NSEC3PARAM) string {
+	owner := strings.ToLower(dns.HashName(name, param.Hash, param.Iterations, param.Salt)) + "."
+	if ctx.Config.Zone != "." {
+		owner += ctx.Config.Zone
+	}
+	return owner
+}
+
+// verifyWildcardAnswer checks that the answer to the query is provably synthesized from a wildcard: the query
+// name does not exist, the wildcard at its closest encloser has an RRset of the query type (or a CNAME) with
+// a valid RRSIG for the expanded RRset, and a NSEC or NSEC3 RR proves that the next closer name does not
+// exist (RFC4035 section 5.3.4 and RFC5155 section 8.8).
+func (ctx *Context) verifyWildcardAnswer(q Query) error {
+	if !dns.IsSubDomain(ctx.Config.Zone, q.Name) || q.Name == ctx.Config.Zone {
+		return fmt.Errorf("%s is not below the zone apex", q.Name)
+	}
+	if ctx.isBelowZoneCut(q.Name) || ctx.isDelegated(q.Name) {
+		return fmt.Errorf("%s is at or below a zone cut", q.Name)
+	}
+	names := ctx.existingNames()
+	if names[q.Name] {
+		return fmt.Errorf("%s exists in the zone, so it is not answered by a wildcard", q.Name)
+	}
+	// The closest encloser is the nearest existing ancestor, and the next closer name is its child
+	// in the way to the query name.
+	nextCloser := q.Name
+	encloser := ctx.Config.Zone
+	for _, ancestor := range ctx.ancestors(q.Name) {
+		if names[ancestor] {
+			encloser = ancestor
+			break
+		}
+		nextCloser = ancestor
+	}
+	for _, rr := range ctx.rrs {
+		if rr.Header().Name == encloser && rr.Header().Rrtype == dns.TypeDNAME {
+			return fmt.Errorf("%s is redirected by the DNAME of %s", q.Name, encloser)
+		}
+	}
+	wildcard := "*." + encloser
+	var answer RRArray
+	sigs := make([]*dns.RRSIG, 0)
+	for _, rrtype := range []uint16{q.Type, dns.TypeCNAME} {
+		for _, rr := range ctx.rrs {
+			if rr.Header().Name != wildcard {
+				continue
+			}
+			if rr.Header().Rrtype == rrtype {
+				expanded := dns.Copy(rr)
+				expanded.Header().Name = q.Name
+				answer = append(answer, expanded)
+			} else if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == rrtype {
+				sigs = append(sigs, sig)
+			}
+		}
+		if len(answer) > 0 {
+			break
+		}
+	}
+	if len(answer) == 0 {
+		return fmt.Errorf("the closest encloser of %s is %s, and %s has no %s nor CNAME RRset", q.Name, encloser, wildcard, dns.TypeToString[q.Type])
+	}
+	var err error
+	valid := false
+	for _, sig := range sigs {
+		if sig.Labels != rrsigLabels(wildcard) {
+			err = fmt.Errorf("the RRSIG of %s has %d labels instead of %d", wildcard, sig.Labels, rrsigLabels(wildcard))
+			continue
+		}
+		if _, err = ctx.verifyRRSig(q.String(), sig, answer); err == nil {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		if err == nil {
+			err = fmt.Errorf("%s has no RRSIGs", wildcard)
+		}
+		return fmt.Errorf("the expanded answer of %s cannot be validated: %s", q, err)
+	}
+	if err := ctx.proveNonExistence(nextCloser); err != nil {
+		return fmt.Errorf("the answer of %s is not provably synthesized from %s: %s", q, wildcard, err)
+	}
+	ctx.Log.Printf("[ OK  ] %s answered by wildcard %s", q, wildcard)
+	return nil
+}
+
+// proveNonExistence returns an error if the zone has no NSEC or NSEC3 RR covering the name. Following RFC5155
+// section 8.8, an NSEC3 span with the Opt-Out flag covering the next closer name of a wildcard answer proves it.
+func (ctx *Context) proveNonExistence(name string) error {
+	param, nsec3s := ctx.nsec3Chain()
+	if param == nil {
+		for _, rr := range ctx.rrs {
+			if nsec, ok := rr.(*dns.NSEC); ok && covers(nsec.Hdr.Name, nsec.NextDomain, name, canonicalLess) {
+				return nil
+			}
+		}
+		return fmt.Errorf("no NSEC RR covers %s", name)
+	}
+	hashed := strings.ToUpper(dns.HashName(name, param.Hash, param.Iterations, param.Salt))
+	for _, nsec3 := range nsec3s {
+		owner := strings.ToUpper(strings.SplitN(nsec3.Hdr.Name, ".", 2)[0])
+		if covers(owner, strings.ToUpper(nsec3.NextDomain), hashed, func(a, b string) bool { return a < b }) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no NSEC3 RR covers the hash of %s", name)
+}
@@ -0,0 +1,203 @@
+package tools_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/niclabs/dns-tools/tools"
+)
+
+// wildcardCase is a zone of the wildcard corpus, with the queries answered by a wildcard and the ones
+// which are not.
+type wildcardCase struct {
+	zone        string
+	answered    []string
+	notAnswered []string
+}
+
+// wildcardCorpus has tricky zones: wildcards at the apex, below empty non-terminals and next to existing
+// names, wildcard CNAMEs, nested delegations and DNAMEs occluding wildcards.
+var wildcardCorpus = map[string]wildcardCase{
+	"wildcards": {
+		zone: fileString + `
+*.example.com.	86400	IN	A	127.0.0.10
+*.w.example.com.	86400	IN	TXT	"wildcard"
+host.w.example.com.	86400	IN	TXT	"host"
+*.a.b.c.example.com.	86400	IN	MX	10 mail.example.com.
+*.cname.example.com.	86400	IN	CNAME	www.example.com.
+`,
+		answered: []string{
+			"q.example.com/A",
+			"a.w.example.com/TXT",
+			"deep.a.w.example.com/TXT",
+			"z.a.b.c.example.com/MX",
+			"x.cname.example.com/AAAA",
+		},
+		notAnswered: []string{
+			"host.w.example.com/TXT", // It exists
+			"b.c.example.com/A",      // Empty non-terminal
+			"foo.c.example.com/A",    // Its closest encloser is c.example.com., which has no wildcard
+			"q.example.com/TXT",      // The wildcard has no TXT RRset
+			"www.example.com/A",      // It exists
+		},
+	},
+	"delegations": {
+		zone: fileString + `
+*.example.com.	86400	IN	TXT	"wildcard"
+sub.example.com.	86400	IN	NS	ns.sub.example.com.
+sub.example.com.	86400	IN	DS	12345 8 2 0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20
+ns.sub.example.com.	86400	IN	A	127.0.0.20
+deeper.sub.example.com.	86400	IN	NS	ns.other.com.
+*.sub.example.com.	86400	IN	TXT	"occluded"
+insecure.example.com.	86400	IN	NS	ns.other.com.
+`,
+		answered: []string{"new.example.com/TXT"},
+		notAnswered: []string{
+			"foo.sub.example.com/TXT",      // Below a zone cut
+			"insecure.example.com/TXT",     // Delegation
+			"foo.insecure.example.com/TXT", // Below a zone cut
+		},
+	},
+	"dname": {
+		zone: fileString + `
+*.example.com.	86400	IN	A	127.0.0.10
+d.example.com.	86400	IN	DNAME	other.org.
+*.d.example.com.	86400	IN	A	127.0.0.11
+x.d.example.com.	86400	IN	A	127.0.0.12
+*.e.f.example.com.	86400	IN	A	127.0.0.13
+`,
+		answered: []string{"x.e.f.example.com/A", "g.example.com/A"},
+		notAnswered: []string{
+			"x.d.example.com/A", // Redirected by the DNAME
+			"y.f.example.com/A", // Its closest encloser is the empty non-terminal f.example.com.
+		},
+	},
+}
+
+// verifyWildcards verifies a signed zone checking the wildcard answers provided.
+func verifyWildcards(t *testing.T, signed string, queries ...string) error {
+	ctx := testContext(tools.RsaSha256, false, false)
+	for _, s := range queries {
+		q, err := tools.ParseQuery(s)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		ctx.Config.WildcardAnswers = append(ctx.Config.WildcardAnswers, q)
+	}
+	ctx.File = strings.NewReader(signed)
+	return ctx.VerifyFile()
+}
+
+func TestSession_WildcardCorpus(t *testing.T) {
+	modes := map[string]func() *tools.Context{
+		"NSEC":  func() *tools.Context { return testContext(tools.RsaSha256, false, false) },
+		"NSEC3": func() *tools.Context { return testContext(tools.RsaSha256, true, false) },
+		"NSEC3 opt-out": func() *tools.Context {
+			ctx := testContext(tools.RsaSha256, true, false)
+			ctx.Config.OptOut = true
+			return ctx
+		},
+	}
+	for name, c := range wildcardCorpus {
+		for mode, newContext := range modes {
+			signed, err := signZone(t, newContext(), c.zone)
+			if err != nil {
+				t.Errorf("%s (%s): signing failed: %s", name, mode, err)
+				continue
+			}
+			if err := verifyZone(signed); err != nil {
+				t.Errorf("%s (%s): Error verifying output: %s", name, mode, err)
+			}
+			checkWildcardLabels(t, signed)
+			for _, q := range c.answered {
+				if err := verifyWildcards(t, signed, q); err != nil {
+					t.Errorf("%s (%s): %s should be answered by a wildcard: %s", name, mode, q, err)
+				}
+			}
+			for _, q := range c.notAnswered {
+				if err := verifyWildcards(t, signed, q); err == nil {
+					t.Errorf("%s (%s): %s should not be answered by a wildcard", name, mode, q)
+				}
+			}
+		}
+	}
+}
+
+// checkWildcardLabels checks that the RRSIGs of wildcards do not count the wildcard label.
+func checkWildcardLabels(t *testing.T, signed string) {
+	parser := dns.NewZoneParser(strings.NewReader(signed), zone, "")
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		sig, isSig := rr.(*dns.RRSIG)
+		if !isSig || !strings.HasPrefix(sig.Hdr.Name, "*.") {
+			continue
+		}
+		if int(sig.Labels) != dns.CountLabel(sig.Hdr.Name)-1 {
+			t.Errorf("RRSIG of wildcard %s has %d labels", sig.Hdr.Name, sig.Labels)
+		}
+	}
+}
+
+func TestSession_WildcardWithoutDenial(t *testing.T) {
+	signed, err := signZone(t, testContext(tools.RsaSha256, false, false), wildcardCorpus["wildcards"].zone)
+	if err != nil {
+		t.Fatalf("signing failed: %s", err)
+	}
+	// Without the NSEC RR covering the query name, the answer could be a replay of the wildcard.
+	lines := strings.Split(signed, "\n")
+	kept := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "ns1.example.com.") || !strings.Contains(line, "\tNSEC\t") {
+			kept = append(kept, line)
+		}
+	}
+	if err := verifyWildcards(t, strings.Join(kept, "\n"), "q.example.com/A"); err == nil {
+		t.Errorf("wildcard answer verified without the NSEC RR covering the query name")
+	}
+}
+
+func TestSession_WildcardOptOutSpan(t *testing.T) {
+	ctx := testContext(tools.RsaSha256, true, false)
+	ctx.Config.OptOut = true
+	signed, err := signZone(t, ctx, fileString+`
+*.example.com.	86400	IN	A	127.0.0.10
+insecure1.example.com.	86400	IN	NS	ns1.other.org.
+insecure2.example.com.	86400	IN	NS	ns2.other.org.
+`)
+	if err != nil {
+		t.Fatalf("signing failed: %s", err)
+	}
+	// The NSEC3 RRs with the Opt-Out flag cover the next closer name of the wildcard answer (RFC5155 section 8.8).
+	var param *dns.NSEC3PARAM
+	spans := make([]*dns.NSEC3, 0)
+	parser := dns.NewZoneParser(strings.NewReader(signed), zone, "")
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		switch rr := rr.(type) {
+		case *dns.NSEC3PARAM:
+			param = rr
+		case *dns.NSEC3:
+			if rr.Flags&1 != 0 {
+				spans = append(spans, rr)
+			}
+		}
+	}
+	if param == nil || len(spans) == 0 {
+		t.Fatalf("the signed zone has no opt-out spans")
+	}
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("q%d.example.com.", i)
+		hashed := strings.ToUpper(dns.HashName(name, param.Hash, param.Iterations, param.Salt))
+		for _, span := range spans {
+			owner := strings.ToUpper(strings.SplitN(span.Hdr.Name, ".", 2)[0])
+			next := strings.ToUpper(span.NextDomain)
+			if owner < hashed && (hashed < next || next <= owner) || next <= owner && hashed < next {
+				if err := verifyWildcards(t, signed, name+"/A"); err != nil {
+					t.Errorf("%s covered by an opt-out span should be answered by a wildcard: %s", name, err)
+				}
+				return
+			}
+		}
+	}
+	t.Fatalf("no name covered by an opt-out span found")
+}